@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcEndpoint labels the results of gRPC requests in metrics and the report
+const grpcEndpoint = "ShouldRateLimit"
+
+// DescriptorEntry is one key/value pair of a rate limit descriptor
+type DescriptorEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GRPCSpec is the template of the rate limit requests sent in gRPC mode.
+// Entry values may reference {{seq}}, the number of the request being made,
+// to spread the load over many counters.
+type GRPCSpec struct {
+	Domain      string              `json:"domain"`
+	Descriptors [][]DescriptorEntry `json:"descriptors"`           // Each descriptor is a list of entries
+	HitsAddend  uint32              `json:"hits_addend,omitempty"` // Hits each request counts for, 1 if unset
+}
+
+// loadGRPCSpec reads a GRPCSpec from a JSON file, or builds one from the
+// -domain, -descriptors and -hits-addend flags when no file is given
+func loadGRPCSpec(config *Config) (*GRPCSpec, error) {
+	if config.grpcSpecFile != "" {
+		data, err := os.ReadFile(config.grpcSpecFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gRPC spec: %v", err)
+		}
+		var spec GRPCSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("failed to parse gRPC spec %s: %v", config.grpcSpecFile, err)
+		}
+		if len(spec.Descriptors) == 0 {
+			return nil, fmt.Errorf("gRPC spec %s has no descriptors", config.grpcSpecFile)
+		}
+		return &spec, nil
+	}
+
+	descriptors, err := parseDescriptors(config.descriptors)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCSpec{
+		Domain:      config.domain,
+		Descriptors: descriptors,
+		HitsAddend:  uint32(config.hitsAddend),
+	}, nil
+}
+
+// parseDescriptors parses descriptors written as key=value entries separated
+// by commas, with descriptors separated by semicolons, for example
+// "company_id=acme,path=/users;remote_address=10.0.0.1"
+func parseDescriptors(s string) ([][]DescriptorEntry, error) {
+	var descriptors [][]DescriptorEntry
+	for _, descriptor := range strings.Split(s, ";") {
+		var entries []DescriptorEntry
+		for _, entry := range strings.Split(descriptor, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid descriptor entry %q: want key=value", entry)
+			}
+			entries = append(entries, DescriptorEntry{Key: key, Value: value})
+		}
+		descriptors = append(descriptors, entries)
+	}
+	return descriptors, nil
+}
+
+// request builds the rate limit request for the seq-th request of the test
+func (s *GRPCSpec) request(vars *variables, seq int) *envoy.RateLimitRequest {
+	req := &envoy.RateLimitRequest{
+		Domain:     s.Domain,
+		HitsAddend: s.HitsAddend,
+	}
+	for _, descriptor := range s.Descriptors {
+		d := &ratelimit.RateLimitDescriptor{}
+		for _, entry := range descriptor {
+			d.Entries = append(d.Entries, &ratelimit.RateLimitDescriptor_Entry{
+				Key:   entry.Key,
+				Value: vars.expand(entry.Value, seq),
+			})
+		}
+		req.Descriptors = append(req.Descriptors, d)
+	}
+	return req
+}
+
+// dialRateLimitService connects to the rate limit service at addr, without
+// TLS
+func dialRateLimitService(addr string) (*grpc.ClientConn, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// makeGRPCRequest sends the seq-th rate limit request and returns the
+// overall code of the response, such as "OK" or "OVER_LIMIT", or "error" if
+// the call failed
+func makeGRPCRequest(client envoy.RateLimitServiceClient, spec *GRPCSpec, vars *variables, seq int) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.ShouldRateLimit(ctx, spec.request(vars, seq))
+	if err != nil {
+		log.Printf("Error making request: %v", err)
+		return "error"
+	}
+	return resp.OverallCode.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+)
+
+// fakeRateLimitService allows the first limit hits it receives and rejects
+// the rest, recording the requests
+type fakeRateLimitService struct {
+	envoy.UnimplementedRateLimitServiceServer
+	limit uint32
+
+	mu       sync.Mutex
+	hits     uint32
+	requests []*envoy.RateLimitRequest
+}
+
+func (f *fakeRateLimitService) ShouldRateLimit(ctx context.Context, req *envoy.RateLimitRequest) (*envoy.RateLimitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	f.hits += max(req.HitsAddend, 1)
+	if f.hits > f.limit {
+		return &envoy.RateLimitResponse{OverallCode: envoy.RateLimitResponse_OVER_LIMIT}, nil
+	}
+	return &envoy.RateLimitResponse{OverallCode: envoy.RateLimitResponse_OK}, nil
+}
+
+// startRateLimitService serves service on a local port and returns its
+// address
+func startRateLimitService(t *testing.T, service envoy.RateLimitServiceServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	envoy.RegisterRateLimitServiceServer(server, service)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return ln.Addr().String()
+}
+
+func TestGRPCTalliesCodes(t *testing.T) {
+	service := &fakeRateLimitService{limit: 10}
+	config := &Config{
+		rps:         100,
+		duration:    500 * time.Millisecond,
+		concurrency: 4,
+		profile:     profileConstant,
+		grpcAddr:    startRateLimitService(t, service),
+		domain:      "istio-system",
+		descriptors: "company_id=acme,user_id=user-{{seq}};remote_address=10.0.0.1",
+		hitsAddend:  2,
+	}
+	profile, err := newLoadProfile(config)
+	if err != nil {
+		t.Fatalf("newLoadProfile: %v", err)
+	}
+	newSender, closeConn := setupGRPC(config)
+	defer closeConn()
+
+	summaries := runLoadTest(context.Background(), config, profile, newSender)
+	if len(summaries) != 1 || summaries[0].Endpoint != grpcEndpoint {
+		t.Fatalf("summaries = %+v, want one for %s", summaries, grpcEndpoint)
+	}
+	// Each request counts two hits against a limit of 10
+	statuses := summaries[0].Statuses
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if statuses["OK"] != 5 || statuses["OVER_LIMIT"] != len(service.requests)-5 || statuses["error"] != 0 {
+		t.Errorf("statuses = %v for %d requests, want 5 OK and the rest OVER_LIMIT", statuses, len(service.requests))
+	}
+	if got := summaries[0].SuccessRate; got != 5/float64(len(service.requests)) {
+		t.Errorf("success rate = %v, want the OK share", got)
+	}
+
+	// The requests follow the descriptor template
+	req := service.requests[0]
+	if req.Domain != "istio-system" || req.HitsAddend != 2 || len(req.Descriptors) != 2 {
+		t.Fatalf("request = %v", req)
+	}
+	company := req.Descriptors[0].Entries
+	if len(company) != 2 || company[0].Key != "company_id" || company[0].Value != "acme" ||
+		company[1].Key != "user_id" || company[1].Value == "user-{{seq}}" {
+		t.Errorf("first descriptor = %v, want company_id=acme and an expanded user_id", company)
+	}
+}
+
+func TestGRPCUnavailable(t *testing.T) {
+	// Nothing listens on a closed listener's address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	conn, err := dialRateLimitService(addr)
+	if err != nil {
+		t.Fatalf("dialRateLimitService: %v", err)
+	}
+	defer conn.Close()
+	spec := &GRPCSpec{Descriptors: [][]DescriptorEntry{{{Key: "remote_address", Value: "10.0.0.1"}}}}
+	if got := makeGRPCRequest(envoy.NewRateLimitServiceClient(conn), spec, newVariables(), 1); got != "error" {
+		t.Errorf("status = %s, want error", got)
+	}
+}
+
+func TestParseDescriptors(t *testing.T) {
+	descriptors, err := parseDescriptors("company_id=acme, path=/users;remote_address=10.0.0.1")
+	if err != nil {
+		t.Fatalf("parseDescriptors: %v", err)
+	}
+	if len(descriptors) != 2 || len(descriptors[0]) != 2 || descriptors[0][1] != (DescriptorEntry{Key: "path", Value: "/users"}) ||
+		descriptors[1][0] != (DescriptorEntry{Key: "remote_address", Value: "10.0.0.1"}) {
+		t.Errorf("descriptors = %v", descriptors)
+	}
+	for _, s := range []string{"company_id", "=acme", "company_id=acme;"} {
+		if _, err := parseDescriptors(s); err == nil {
+			t.Errorf("parseDescriptors accepted %q", s)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -35,6 +40,12 @@ var (
 		},
 		[]string{"endpoint"},
 	)
+	targetRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "loadtest_target_rps",
+			Help: "Request rate the load profile currently aims for",
+		},
+	)
 )
 
 type Config struct {
@@ -44,17 +55,74 @@ type Config struct {
 	concurrency   int
 	enableMetrics bool
 	metricsPort   int
+	specFile      string
+	reportFormat  string
+	weights       string
+	profile       string
+	startRPS      int
+	stepRPS       int
+	stepInterval  time.Duration
+	protocol      string
+	grpcAddr      string
+	grpcSpecFile  string
+	domain        string
+	descriptors   string
+	hitsAddend    int
 }
 
+// sender makes the seq-th request of the test and returns the endpoint to
+// record it under and its status. Each worker has its own.
+type sender func(seq int) (endpoint, status string)
+
 var baseURL string
 
 func main() {
 	config := parseFlags()
+	profile, err := newLoadProfile(config)
+	if err != nil {
+		log.Fatalf("Invalid load profile: %v", err)
+	}
+
+	// Stop early on Ctrl-C or SIGTERM, still reporting the requests made
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// A second signal kills the process as usual
+		<-ctx.Done()
+		stop()
+	}()
 
+	var metricsServer *http.Server
 	if config.enableMetrics {
-		go serveMetrics(config.metricsPort)
+		metricsServer = serveMetrics(config.metricsPort)
 	}
 
+	var newSender func() sender
+	if config.protocol == "grpc" {
+		var closeConn func()
+		newSender, closeConn = setupGRPC(config)
+		defer closeConn()
+	} else {
+		newSender = setupHTTP(config)
+	}
+
+	summaries := runLoadTest(ctx, config, profile, newSender)
+	if err := writeReport(os.Stdout, config.reportFormat, summaries); err != nil {
+		log.Printf("Error writing report: %v", err)
+	}
+
+	if metricsServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping metrics server: %v", err)
+		}
+	}
+}
+
+// setupHTTP checks the user service is reachable, loads the request spec
+// and runs its setup requests, returning the HTTP senders' constructor
+func setupHTTP(config *Config) func() sender {
 	// Get service URL from environment or use default
 	baseURL = os.Getenv("SERVICE_URL")
 	if baseURL == "" {
@@ -75,21 +143,97 @@ func main() {
 		os.Exit(1)
 	}
 
-	runLoadTest(config)
+	spec, err := loadSpec(config.specFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if config.weights != "" {
+		if err := spec.applyWeights(config.weights); err != nil {
+			log.Fatalf("Invalid -weights: %v", err)
+		}
+	}
+
+	// Run the setup requests, such as logging in, before the load starts
+	vars := newVariables()
+	if err := runSetup(&http.Client{Timeout: 5 * time.Second}, spec, vars); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	return func() sender {
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+		}
+		requests := newPicker(spec.Requests)
+		return func(seq int) (string, string) {
+			request := requests.next()
+			// Label by the path template, so {{seq}} does not add a series per request
+			return request.Path, makeRequest(client, request, vars, seq)
+		}
+	}
+}
+
+// setupGRPC connects to the rate limit service and loads the request
+// template, returning the gRPC senders' constructor and a function closing
+// the connection
+func setupGRPC(config *Config) (func() sender, func()) {
+	spec, err := loadGRPCSpec(config)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	conn, err := dialRateLimitService(config.grpcAddr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	fmt.Printf("Starting load test for %v with %d concurrent workers\n", config.duration, config.concurrency)
+	fmt.Printf("Target rate limit service: %s\n", config.grpcAddr)
+
+	// The connection is shared; gRPC multiplexes the workers' calls over it
+	client := envoy.NewRateLimitServiceClient(conn)
+	vars := newVariables()
+	newSender := func() sender {
+		return func(seq int) (string, string) {
+			return grpcEndpoint, makeGRPCRequest(client, spec, vars, seq)
+		}
+	}
+	return newSender, func() { conn.Close() }
 }
 
 func parseFlags() *Config {
 	config := &Config{}
 
 	flag.StringVar(&config.targetURL, "url", "", "Target URL (overrides SERVICE_URL env var)")
-	flag.IntVar(&config.rps, "rps", 100, "Requests per second")
+	flag.IntVar(&config.rps, "rps", 100, "Requests per second, or the rate ramp and step profiles end at")
+	flag.StringVar(&config.profile, "profile", profileConstant, "Load profile: constant, ramp or step")
+	flag.IntVar(&config.startRPS, "start-rps", 1, "Requests per second at the start of a ramp or step profile")
+	flag.IntVar(&config.stepRPS, "step-rps", 10, "Requests per second added at each step of a step profile")
+	flag.DurationVar(&config.stepInterval, "step-interval", 30*time.Second, "Time between steps of a step profile")
 	flag.DurationVar(&config.duration, "duration", 5*time.Minute, "Test duration")
 	flag.IntVar(&config.concurrency, "concurrency", 10, "Number of concurrent workers")
 	flag.BoolVar(&config.enableMetrics, "metrics", true, "Enable Prometheus metrics")
 	flag.IntVar(&config.metricsPort, "metrics-port", 9090, "Metrics port")
+	flag.StringVar(&config.specFile, "spec", "", "JSON file of requests to make (default: the dummy endpoints)")
+	flag.StringVar(&config.reportFormat, "report", "text", "Format of the final latency report: text or json")
+	flag.StringVar(&config.protocol, "protocol", "http", "Protocol to load test with: http (the user service) or grpc (the rate limit service)")
+	flag.StringVar(&config.grpcAddr, "grpc-addr", "localhost:8081", "Address of the rate limit service in grpc mode")
+	flag.StringVar(&config.grpcSpecFile, "grpc-spec", "", "JSON file with the domain, descriptors and hits_addend of grpc requests (overrides -domain, -descriptors and -hits-addend)")
+	flag.StringVar(&config.domain, "domain", "istio-system", "Rate limit domain of grpc requests")
+	flag.StringVar(&config.descriptors, "descriptors", "remote_address=10.0.0.1", "Descriptors of grpc requests: key=value entries separated by commas, descriptors by semicolons")
+	flag.IntVar(&config.hitsAddend, "hits-addend", 0, "Hits each grpc request counts for (default: 1)")
+	flag.StringVar(&config.weights, "weights", "", "Comma-separated relative weights of the requests, in order, e.g. 70,20,9,1 (default: uniform)")
 
 	flag.Parse()
 
+	if config.reportFormat != "text" && config.reportFormat != "json" {
+		log.Fatalf("Invalid -report %q: must be text or json", config.reportFormat)
+	}
+	if config.protocol != "http" && config.protocol != "grpc" {
+		log.Fatalf("Invalid -protocol %q: must be http or grpc", config.protocol)
+	}
+	if config.hitsAddend < 0 {
+		log.Fatalf("Invalid -hits-addend %d: must not be negative", config.hitsAddend)
+	}
+
 	// If URL is provided via flag, use it instead of env var
 	if config.targetURL != "" {
 		baseURL = config.targetURL
@@ -98,12 +242,20 @@ func parseFlags() *Config {
 	return config
 }
 
-func serveMetrics(port int) {
-	http.Handle("/metrics", promhttp.Handler())
+// serveMetrics starts the metrics server in the background and returns it,
+// so it can be shut down when the test ends
+func serveMetrics(port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+
 	log.Printf("Starting metrics server on :%d", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		log.Fatalf("Failed to start metrics server: %v", err)
-	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start metrics server: %v", err)
+		}
+	}()
+	return srv
 }
 
 func testConnection() error {
@@ -124,60 +276,69 @@ func testConnection() error {
 	return nil
 }
 
-func runLoadTest(config *Config) {
-	ticker := time.NewTicker(time.Second / time.Duration(config.rps))
-	defer ticker.Stop()
-
-	done := make(chan bool)
-	go func() {
-		time.Sleep(config.duration)
-		done <- true
-	}()
+// runLoadTest sends requests for the configured duration, or until ctx is
+// cancelled, then waits for the requests in flight and returns their
+// per-endpoint summaries
+func runLoadTest(ctx context.Context, config *Config, profile loadProfile, newSender func() sender) []EndpointSummary {
+	ctx, cancel := context.WithTimeout(ctx, config.duration)
+	defer cancel()
 
 	// Create worker pool
 	jobs := make(chan int, config.rps)
 	var wg sync.WaitGroup
+	results := newRecorder()
 
 	// Start workers
 	for i := 0; i < config.concurrency; i++ {
 		wg.Add(1)
-		go worker(config, jobs, &wg)
+		go worker(config, newSender(), results, jobs, &wg)
 	}
 
-	log.Printf("Starting load test: %d RPS for %v", config.rps, config.duration)
+	log.Printf("Starting load test: %v for %v", profile, config.duration)
 	requestCount := 0
 
+	// Schedule each request 1/rate after the previous one was due, rather
+	// than after it was sent, so the rate holds when the loop falls behind
+	start := time.Now()
+	next := start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
 	for {
 		select {
-		case <-done:
+		case <-ctx.Done():
 			close(jobs)
 			wg.Wait()
-			log.Printf("Load test completed. Total requests: %d", requestCount)
-			return
-		case <-ticker.C:
-			requestCount++
-			jobs <- requestCount
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				log.Printf("Load test completed. Total requests: %d", requestCount)
+			} else {
+				log.Printf("Load test interrupted. Total requests: %d", requestCount)
+			}
+			return results.summary()
+		case <-timer.C:
+			// Do not block on busy workers once the test is stopping
+			select {
+			case jobs <- requestCount + 1:
+				requestCount++
+			case <-ctx.Done():
+			}
+
+			rate := profile.rateAt(time.Since(start))
+			targetRate.Set(rate)
+			next = next.Add(time.Duration(float64(time.Second) / rate))
+			timer.Reset(time.Until(next))
 		}
 	}
 }
 
-func worker(config *Config, jobs <-chan int, wg *sync.WaitGroup) {
+func worker(config *Config, send sender, results *recorder, jobs <-chan int, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	// Define endpoints to test
-	endpoints := []string{"/fast", "/medium", "/slow", "/very-slow"}
-
-	for range jobs {
-		// Select a random endpoint
-		endpoint := endpoints[time.Now().UnixNano()%int64(len(endpoints))]
-
+	for seq := range jobs {
 		start := time.Now()
-		status := makeRequest(client, baseURL+endpoint)
+		endpoint, status := send(seq)
 		duration := time.Since(start)
+		results.record(endpoint, status, duration)
 
 		if config.enableMetrics {
 			requestsTotal.WithLabelValues(status, endpoint).Inc()
@@ -185,20 +346,3 @@ func worker(config *Config, jobs <-chan int, wg *sync.WaitGroup) {
 		}
 	}
 }
-
-func makeRequest(client *http.Client, url string) string {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return "error"
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error making request: %v", err)
-		return "error"
-	}
-	defer resp.Body.Close()
-
-	return fmt.Sprintf("%d", resp.StatusCode)
-}
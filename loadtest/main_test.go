@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSender returns a sender constructor whose senders succeed after
+// latency and count the requests they complete
+func countingSender(sent *atomic.Int64, latency time.Duration) func() sender {
+	return func() sender {
+		return func(seq int) (string, string) {
+			time.Sleep(latency)
+			sent.Add(1)
+			return "/fast", "200"
+		}
+	}
+}
+
+// testConfig returns a config sending rps requests a second for duration,
+// without metrics
+func testConfig(rps int, duration time.Duration) (*Config, loadProfile) {
+	config := &Config{rps: rps, duration: duration, concurrency: 4, profile: profileConstant}
+	profile, _ := newLoadProfile(config)
+	return config, profile
+}
+
+func TestCancelledRunStillSummarized(t *testing.T) {
+	config, profile := testConfig(100, time.Minute)
+	var sent atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	start := time.Now()
+	summaries := runLoadTest(ctx, config, profile, countingSender(&sent, 20*time.Millisecond))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("runLoadTest took %v after being cancelled", elapsed)
+	}
+
+	// The summary covers every request completed, including those in flight
+	// when the test was cancelled
+	if len(summaries) != 1 {
+		t.Fatalf("got %d summaries, want 1", len(summaries))
+	}
+	if got := summaries[0].Requests; got == 0 || int64(got) != sent.Load() {
+		t.Errorf("summary counts %d requests, %d were completed", got, sent.Load())
+	}
+	if summaries[0].P50 < 20 {
+		t.Errorf("p50 = %vms, want at least the 20ms each request took", summaries[0].P50)
+	}
+}
+
+func TestRunEndsAfterDuration(t *testing.T) {
+	config, profile := testConfig(50, 500*time.Millisecond)
+	var sent atomic.Int64
+
+	summaries := runLoadTest(context.Background(), config, profile, countingSender(&sent, 0))
+	// 50 rps for half a second, give or take the first and last request
+	if len(summaries) != 1 || summaries[0].Requests < 20 || summaries[0].Requests > 30 {
+		t.Errorf("summaries = %+v, want about 25 requests", summaries)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Load profiles: how the request rate changes over the test
+const (
+	profileConstant = "constant" // -rps for the whole test
+	profileRamp     = "ramp"     // Linear from -start-rps to -rps over the test
+	profileStep     = "step"     // From -start-rps, up -step-rps every -step-interval, capped at -rps
+)
+
+// loadProfile gives the target request rate at each point of the test
+type loadProfile struct {
+	kind         string
+	startRPS     int           // Rate at the start, for ramp and step
+	targetRPS    int           // Constant rate, or the rate ramp and step end at
+	stepRPS      int           // Increase per step
+	stepInterval time.Duration // Time between steps
+	duration     time.Duration // Length of the test
+}
+
+// newLoadProfile builds the profile selected by config
+func newLoadProfile(config *Config) (loadProfile, error) {
+	p := loadProfile{
+		kind:         config.profile,
+		startRPS:     config.startRPS,
+		targetRPS:    config.rps,
+		stepRPS:      config.stepRPS,
+		stepInterval: config.stepInterval,
+		duration:     config.duration,
+	}
+	if p.targetRPS <= 0 {
+		return p, fmt.Errorf("-rps must be positive")
+	}
+	switch p.kind {
+	case profileConstant:
+	case profileRamp, profileStep:
+		if p.startRPS <= 0 || p.startRPS > p.targetRPS {
+			return p, fmt.Errorf("-start-rps must be between 1 and -rps")
+		}
+		if p.kind == profileStep && (p.stepRPS <= 0 || p.stepInterval <= 0) {
+			return p, fmt.Errorf("-step-rps and -step-interval must be positive")
+		}
+	default:
+		return p, fmt.Errorf("unknown profile %q: must be constant, ramp or step", p.kind)
+	}
+	return p, nil
+}
+
+// rateAt returns the target requests per second once elapsed has passed
+// since the test started
+func (p loadProfile) rateAt(elapsed time.Duration) float64 {
+	switch p.kind {
+	case profileRamp:
+		progress := min(float64(elapsed)/float64(p.duration), 1)
+		return float64(p.startRPS) + float64(p.targetRPS-p.startRPS)*progress
+	case profileStep:
+		steps := math.Floor(float64(elapsed) / float64(p.stepInterval))
+		return min(float64(p.startRPS)+steps*float64(p.stepRPS), float64(p.targetRPS))
+	default:
+		return float64(p.targetRPS)
+	}
+}
+
+// String describes the profile for the startup log
+func (p loadProfile) String() string {
+	switch p.kind {
+	case profileRamp:
+		return fmt.Sprintf("ramp from %d to %d RPS", p.startRPS, p.targetRPS)
+	case profileStep:
+		return fmt.Sprintf("step from %d RPS by %d every %v, up to %d RPS", p.startRPS, p.stepRPS, p.stepInterval, p.targetRPS)
+	default:
+		return fmt.Sprintf("%d RPS", p.targetRPS)
+	}
+}
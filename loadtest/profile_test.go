@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateAt(t *testing.T) {
+	ramp := loadProfile{kind: profileRamp, startRPS: 10, targetRPS: 110, duration: 100 * time.Second}
+	step := loadProfile{kind: profileStep, startRPS: 10, targetRPS: 35, stepRPS: 10, stepInterval: 30 * time.Second}
+	constant := loadProfile{kind: profileConstant, targetRPS: 50}
+	tests := []struct {
+		name    string
+		profile loadProfile
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "ramp start", profile: ramp, elapsed: 0, want: 10},
+		{name: "ramp quarter", profile: ramp, elapsed: 25 * time.Second, want: 35},
+		{name: "ramp end", profile: ramp, elapsed: 100 * time.Second, want: 110},
+		{name: "ramp past the end", profile: ramp, elapsed: 120 * time.Second, want: 110},
+		{name: "first step", profile: step, elapsed: 29 * time.Second, want: 10},
+		{name: "second step", profile: step, elapsed: 30 * time.Second, want: 20},
+		{name: "third step", profile: step, elapsed: 75 * time.Second, want: 30},
+		{name: "step capped", profile: step, elapsed: 90 * time.Second, want: 35},
+		{name: "constant", profile: constant, elapsed: time.Hour, want: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.rateAt(tt.elapsed); got != tt.want {
+				t.Errorf("rateAt(%v) = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssuedRateTracksRamp(t *testing.T) {
+	config := &Config{rps: 200, startRPS: 20, duration: time.Second, concurrency: 4, profile: profileRamp}
+	profile, err := newLoadProfile(config)
+	if err != nil {
+		t.Fatalf("newLoadProfile: %v", err)
+	}
+
+	var mu sync.Mutex
+	var sentAt []time.Duration
+	start := time.Now()
+	runLoadTest(context.Background(), config, profile, func() sender {
+		return func(seq int) (string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			sentAt = append(sentAt, time.Since(start))
+			return "/fast", "200"
+		}
+	})
+
+	// Ramping from 20 to 200 rps over a second sends about 32 requests in
+	// the first half and 77 in the second
+	var firstHalf, secondHalf int
+	for _, at := range sentAt {
+		if at < 500*time.Millisecond {
+			firstHalf++
+		} else {
+			secondHalf++
+		}
+	}
+	if firstHalf < 22 || firstHalf > 42 {
+		t.Errorf("sent %d requests in the first half, want about 32", firstHalf)
+	}
+	if secondHalf < 62 || secondHalf > 92 {
+		t.Errorf("sent %d requests in the second half, want about 77", secondHalf)
+	}
+	// The gauge follows the profile to its target
+	if got := testutil.ToFloat64(targetRate); got < 180 || got > 200 {
+		t.Errorf("target rps gauge = %v, want about 200", got)
+	}
+}
+
+func TestNewLoadProfileInvalid(t *testing.T) {
+	for name, config := range map[string]*Config{
+		"no rate":            {rps: 0, profile: profileConstant},
+		"unknown profile":    {rps: 100, profile: "sine"},
+		"start above target": {rps: 100, startRPS: 200, profile: profileRamp},
+		"no start":           {rps: 100, startRPS: 0, profile: profileRamp},
+		"no step":            {rps: 100, startRPS: 10, stepRPS: 0, stepInterval: time.Second, profile: profileStep},
+		"no step interval":   {rps: 100, startRPS: 10, stepRPS: 10, profile: profileStep},
+	} {
+		if _, err := newLoadProfile(config); err == nil {
+			t.Errorf("newLoadProfile accepted a config with %s", name)
+		}
+	}
+}
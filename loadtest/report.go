@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// recorder collects the status and latency of every request, per endpoint,
+// for the summary printed at the end of the test
+type recorder struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointSamples
+}
+
+// endpointSamples holds the results recorded for one endpoint
+type endpointSamples struct {
+	successes int             // Requests that succeeded, see isSuccess
+	statuses  map[string]int  // Requests by status
+	latencies []time.Duration // Latency of every request, in arrival order
+}
+
+func newRecorder() *recorder {
+	return &recorder{endpoints: map[string]*endpointSamples{}}
+}
+
+// record adds the result of a request to endpoint
+func (r *recorder) record(endpoint, status string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	samples, ok := r.endpoints[endpoint]
+	if !ok {
+		samples = &endpointSamples{statuses: map[string]int{}}
+		r.endpoints[endpoint] = samples
+	}
+	samples.latencies = append(samples.latencies, latency)
+	samples.statuses[status]++
+	if isSuccess(status) {
+		samples.successes++
+	}
+}
+
+// isSuccess reports whether a status counts as a success: a 2xx or 3xx
+// HTTP status, or an OK rate limit decision
+func isSuccess(status string) bool {
+	if status == "OK" {
+		return true
+	}
+	code, err := strconv.Atoi(status)
+	return err == nil && code < 400
+}
+
+// EndpointSummary reports the requests made to one endpoint. Latencies are
+// in milliseconds.
+type EndpointSummary struct {
+	Endpoint    string         `json:"endpoint"`
+	Requests    int            `json:"requests"`
+	SuccessRate float64        `json:"success_rate"` // Fraction of requests that succeeded, see isSuccess
+	Statuses    map[string]int `json:"statuses"`     // Requests by HTTP status or rate limit code
+	P50         float64        `json:"p50_ms"`
+	P90         float64        `json:"p90_ms"`
+	P99         float64        `json:"p99_ms"`
+	Max         float64        `json:"max_ms"`
+}
+
+// summary computes the per-endpoint summaries, sorted by endpoint
+func (r *recorder) summary() []EndpointSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	summaries := make([]EndpointSummary, 0, len(r.endpoints))
+	for endpoint, samples := range r.endpoints {
+		sorted := slices.Clone(samples.latencies)
+		slices.Sort(sorted)
+		summaries = append(summaries, EndpointSummary{
+			Endpoint:    endpoint,
+			Requests:    len(sorted),
+			SuccessRate: float64(samples.successes) / float64(len(sorted)),
+			Statuses:    maps.Clone(samples.statuses),
+			P50:         milliseconds(percentile(sorted, 50)),
+			P90:         milliseconds(percentile(sorted, 90)),
+			P99:         milliseconds(percentile(sorted, 99)),
+			Max:         milliseconds(sorted[len(sorted)-1]),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Endpoint < summaries[j].Endpoint
+	})
+	return summaries
+}
+
+// percentile returns the p-th percentile of sorted latencies, using the
+// nearest-rank method
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeReport writes the summaries to w as a table, or as JSON when format
+// is "json"
+func writeReport(w io.Writer, format string, summaries []EndpointSummary) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summaries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "endpoint\trequests\tsuccess\tp50 (ms)\tp90 (ms)\tp99 (ms)\tmax (ms)\t statuses")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f%%\t%.1f\t%.1f\t%.1f\t%.1f\t %s\n",
+			s.Endpoint, s.Requests, s.SuccessRate*100, s.P50, s.P90, s.P99, s.Max, formatStatuses(s.Statuses))
+	}
+	return tw.Flush()
+}
+
+// formatStatuses lists request counts by status, such as "200:95 429:5"
+func formatStatuses(statuses map[string]int) string {
+	parts := make([]string, 0, len(statuses))
+	for _, status := range slices.Sorted(maps.Keys(statuses)) {
+		parts = append(parts, fmt.Sprintf("%s:%d", status, statuses[status]))
+	}
+	return strings.Join(parts, " ")
+}
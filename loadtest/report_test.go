@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	r := newRecorder()
+	// 1ms to 100ms, recorded out of order
+	for i := 100; i >= 1; i-- {
+		status := "200"
+		if i%10 == 0 {
+			status = "429"
+		}
+		r.record("/fast", status, time.Duration(i)*time.Millisecond)
+	}
+	r.record("/slow", "error", 2*time.Second)
+
+	summaries := r.summary()
+	if len(summaries) != 2 {
+		t.Fatalf("got %d summaries, want 2", len(summaries))
+	}
+	fast := summaries[0]
+	want := EndpointSummary{
+		Endpoint:    "/fast",
+		Requests:    100,
+		SuccessRate: 0.9,
+		P50:         50,
+		P90:         90,
+		P99:         99,
+		Max:         100,
+	}
+	if fast.Endpoint != want.Endpoint || fast.Requests != want.Requests || fast.SuccessRate != want.SuccessRate ||
+		fast.P50 != want.P50 || fast.P90 != want.P90 || fast.P99 != want.P99 || fast.Max != want.Max {
+		t.Errorf("summary = %+v, want %+v", fast, want)
+	}
+	if fast.Statuses["200"] != 90 || fast.Statuses["429"] != 10 {
+		t.Errorf("statuses = %v, want 90 200s and 10 429s", fast.Statuses)
+	}
+
+	// A single sample is every percentile
+	slow := summaries[1]
+	if slow.P50 != 2000 || slow.P99 != 2000 || slow.Max != 2000 || slow.SuccessRate != 0 {
+		t.Errorf("single sample summary = %+v", slow)
+	}
+}
+
+func TestPercentileNearestRank(t *testing.T) {
+	sorted := []time.Duration{10, 20, 30, 40}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 0, want: 10},
+		{p: 25, want: 10},
+		{p: 26, want: 20},
+		{p: 50, want: 20},
+		{p: 75, want: 30},
+		{p: 99, want: 40},
+		{p: 100, want: 40},
+	}
+	for _, tt := range tests {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("p%v = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of no samples = %v, want 0", got)
+	}
+}
+
+func TestIsSuccess(t *testing.T) {
+	for status, want := range map[string]bool{
+		"200": true, "201": true, "302": true, "OK": true,
+		"404": false, "429": false, "500": false, "OVER_LIMIT": false, "error": false,
+	} {
+		if got := isSuccess(status); got != want {
+			t.Errorf("isSuccess(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	summaries := []EndpointSummary{{
+		Endpoint:    "/fast",
+		Requests:    10,
+		SuccessRate: 0.9,
+		Statuses:    map[string]int{"200": 9, "429": 1},
+		P50:         5,
+		P90:         9,
+		P99:         10,
+		Max:         10,
+	}}
+
+	var out bytes.Buffer
+	if err := writeReport(&out, "json", summaries); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, out.String())
+	}
+	if len(decoded) != 1 || decoded[0]["endpoint"] != "/fast" || decoded[0]["p90_ms"] != 9.0 || decoded[0]["success_rate"] != 0.9 {
+		t.Errorf("JSON report = %v", decoded)
+	}
+
+	out.Reset()
+	if err := writeReport(&out, "text", summaries); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+	for _, want := range []string{"p99 (ms)", "/fast", "90.0%", "200:9 429:1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("text report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
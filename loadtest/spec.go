@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RequestSpec describes one request the load tester can make. Path, Body
+// and header values may reference variables as {{name}}: values captured
+// from earlier responses, or {{seq}}, the number of the request being made.
+type RequestSpec struct {
+	Method  string            `json:"method"`            // HTTP method, GET if empty
+	Path    string            `json:"path"`              // Path appended to the target URL
+	Body    json.RawMessage   `json:"body,omitempty"`    // JSON body template
+	Headers map[string]string `json:"headers,omitempty"` // Header templates
+	Capture map[string]string `json:"capture,omitempty"` // Variable name -> top-level field of the JSON response
+	Weight  int               `json:"weight,omitempty"`  // Relative share of the load, 1 if unset
+}
+
+// Spec is the set of requests to load test with. Setup requests run once,
+// in order, before the test starts, for example to log in and capture a
+// token; the test then picks from Requests at random, in proportion to
+// their weights.
+type Spec struct {
+	Setup    []RequestSpec `json:"setup"`
+	Requests []RequestSpec `json:"requests"`
+}
+
+// defaultSpec exercises the dummy endpoints of the user service
+var defaultSpec = &Spec{
+	Requests: []RequestSpec{
+		{Method: http.MethodGet, Path: "/fast"},
+		{Method: http.MethodGet, Path: "/medium"},
+		{Method: http.MethodGet, Path: "/slow"},
+		{Method: http.MethodGet, Path: "/very-slow"},
+	},
+}
+
+// loadSpec reads a Spec from a JSON file, or returns defaultSpec when no
+// file is given
+func loadSpec(path string) (*Spec, error) {
+	if path == "" {
+		return defaultSpec, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec: %v", err)
+	}
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse spec %s: %v", path, err)
+	}
+	if len(spec.Requests) == 0 {
+		return nil, fmt.Errorf("spec %s has no requests", path)
+	}
+	for _, request := range spec.Requests {
+		if request.Weight < 0 {
+			return nil, fmt.Errorf("spec %s: negative weight for %s", path, request.Path)
+		}
+	}
+	return &spec, nil
+}
+
+// applyWeights sets the weights of the spec's requests, in order, from a
+// comma-separated list such as "70,20,9,1"
+func (s *Spec) applyWeights(list string) error {
+	fields := strings.Split(list, ",")
+	if len(fields) != len(s.Requests) {
+		return fmt.Errorf("got %d weights for %d requests", len(fields), len(s.Requests))
+	}
+	weights := make([]int, len(fields))
+	for i, field := range fields {
+		weight, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("invalid weight %q", field)
+		}
+		weights[i] = weight
+	}
+
+	requests := slices.Clone(s.Requests)
+	for i := range requests {
+		requests[i].Weight = weights[i]
+	}
+	s.Requests = requests
+	return nil
+}
+
+// picker selects requests at random in proportion to their weights. It is
+// not safe for concurrent use; each worker has its own.
+type picker struct {
+	requests   []RequestSpec
+	cumulative []int // Running total of the weights, ending with their sum
+	rng        *rand.Rand
+}
+
+// newPicker builds a picker over requests with a randomly seeded source.
+// Requests without a weight count as weight 1.
+func newPicker(requests []RequestSpec) *picker {
+	cumulative := make([]int, len(requests))
+	total := 0
+	for i, request := range requests {
+		weight := request.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		total += weight
+		cumulative[i] = total
+	}
+	return &picker{
+		requests:   requests,
+		cumulative: cumulative,
+		rng:        rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+}
+
+// next returns the next request to make
+func (p *picker) next() RequestSpec {
+	n := p.rng.IntN(p.cumulative[len(p.cumulative)-1])
+	i, _ := slices.BinarySearch(p.cumulative, n+1)
+	return p.requests[i]
+}
+
+// variables holds the values captured from responses, shared by all workers
+type variables struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func newVariables() *variables {
+	return &variables{values: map[string]string{}}
+}
+
+// set records a captured value
+func (v *variables) set(name, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[name] = value
+}
+
+// expand replaces the {{name}} references in s with their values, and
+// {{seq}} with seq. Unknown references are left as they are.
+func (v *variables) expand(s string, seq int) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	pairs := []string{"{{seq}}", strconv.Itoa(seq)}
+	for name, value := range v.values {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// makeRequest sends the request described by spec, the seq-th of the test,
+// and captures the fields it asks for from the response. It returns the
+// response status code, or "error" if no response was received or a field
+// could not be captured.
+func makeRequest(client *http.Client, spec RequestSpec, vars *variables, seq int) string {
+	method := spec.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(spec.Body) > 0 {
+		body = strings.NewReader(vars.expand(string(spec.Body), seq))
+	}
+
+	req, err := http.NewRequest(method, baseURL+vars.expand(spec.Path, seq), body)
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		return "error"
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range spec.Headers {
+		req.Header.Set(name, vars.expand(value, seq))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error making request: %v", err)
+		return "error"
+	}
+	defer resp.Body.Close()
+
+	if len(spec.Capture) > 0 && resp.StatusCode < 300 {
+		if err := capture(resp.Body, spec.Capture, vars); err != nil {
+			log.Printf("Error capturing from %s: %v", spec.Path, err)
+			return "error"
+		}
+	}
+
+	return fmt.Sprintf("%d", resp.StatusCode)
+}
+
+// capture stores the response fields named in fields as variables
+func capture(r io.Reader, fields map[string]string, vars *variables) error {
+	var response map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&response); err != nil {
+		return fmt.Errorf("response is not a JSON object: %v", err)
+	}
+	for name, field := range fields {
+		value, ok := response[field]
+		if !ok {
+			return fmt.Errorf("response has no field %q", field)
+		}
+		vars.set(name, fmt.Sprint(value))
+	}
+	return nil
+}
+
+// runSetup makes the spec's setup requests in order, failing on the first
+// that does not succeed
+func runSetup(client *http.Client, spec *Spec, vars *variables) error {
+	for i, step := range spec.Setup {
+		status := makeRequest(client, step, vars, i)
+		if code, err := strconv.Atoi(status); err != nil || code >= 300 {
+			return fmt.Errorf("setup request %s %s returned %s", step.Method, step.Path, status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// useTarget points the load tester at url for the duration of the test
+func useTarget(t *testing.T, url string) {
+	t.Helper()
+	previous := baseURL
+	baseURL = url
+	t.Cleanup(func() { baseURL = previous })
+}
+
+func TestCapturedTokenSentOnLaterRequests(t *testing.T) {
+	var mu sync.Mutex
+	var created []string
+	var authorizations []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		var credentials map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil || credentials["password"] != "change-me" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-for-" + credentials["email"]})
+	})
+	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Method == http.MethodPost {
+			var user map[string]string
+			json.NewDecoder(r.Body).Decode(&user)
+			created = append(created, user["email"])
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	useTarget(t, server.URL)
+
+	spec, err := loadSpec(filepath.Join("specs", "users.json"))
+	if err != nil {
+		t.Fatalf("loadSpec: %v", err)
+	}
+	client := server.Client()
+	vars := newVariables()
+	if err := runSetup(client, spec, vars); err != nil {
+		t.Fatalf("runSetup: %v", err)
+	}
+
+	// Both the GET and the POST carry the token captured at login
+	for i, request := range spec.Requests[:2] {
+		if status := makeRequest(client, request, vars, i+1); status != "200" && status != "201" {
+			t.Errorf("%s %s returned %s", request.Method, request.Path, status)
+		}
+	}
+	for _, got := range authorizations {
+		if got != "Bearer token-for-admin@example.com" {
+			t.Errorf("Authorization = %q, want the captured token", got)
+		}
+	}
+	if len(authorizations) != 2 {
+		t.Errorf("server saw %d /users requests, want 2", len(authorizations))
+	}
+	// The body template is expanded too
+	if len(created) != 1 || created[0] != "loadtest-2@example.com" {
+		t.Errorf("created %v, want loadtest-2@example.com", created)
+	}
+}
+
+func TestSetupFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	useTarget(t, server.URL)
+
+	spec := &Spec{Setup: []RequestSpec{{Method: http.MethodPost, Path: "/login", Capture: map[string]string{"token": "token"}}}}
+	if err := runSetup(server.Client(), spec, newVariables()); err == nil {
+		t.Error("runSetup succeeded although login was refused")
+	}
+}
+
+func TestCaptureMissingField(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user_id": "1"}`))
+	}))
+	defer server.Close()
+	useTarget(t, server.URL)
+
+	request := RequestSpec{Path: "/login", Capture: map[string]string{"token": "token"}}
+	if status := makeRequest(server.Client(), request, newVariables(), 1); status != "error" {
+		t.Errorf("status = %s, want error", status)
+	}
+}
+
+func TestLoadSpecInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"malformed":       `{"requests": [`,
+		"no requests":     `{"setup": [{"path": "/login"}]}`,
+		"negative weight": `{"requests": [{"path": "/fast", "weight": -1}]}`,
+	} {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSpec(path); err == nil {
+			t.Errorf("loadSpec accepted a spec with %s", name)
+		}
+	}
+}
+
+// pickCounts draws n requests from a picker over requests and counts them
+// by path
+func pickCounts(requests []RequestSpec, n int) map[string]int {
+	p := newPicker(requests)
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[p.next().Path]++
+	}
+	return counts
+}
+
+func TestPickerUniformByDefault(t *testing.T) {
+	const n = 100000
+	counts := pickCounts(defaultSpec.Requests, n)
+	for _, request := range defaultSpec.Requests {
+		share := float64(counts[request.Path]) / n
+		if share < 0.24 || share > 0.26 {
+			t.Errorf("%s got %.3f of the requests, want 0.25", request.Path, share)
+		}
+	}
+}
+
+func TestPickerFollowsWeights(t *testing.T) {
+	spec := *defaultSpec
+	if err := spec.applyWeights("70,20,9,1"); err != nil {
+		t.Fatalf("applyWeights: %v", err)
+	}
+	// The default spec is left unweighted
+	if defaultSpec.Requests[0].Weight != 0 {
+		t.Error("applyWeights modified the default spec")
+	}
+
+	const n = 200000
+	counts := pickCounts(spec.Requests, n)
+	want := map[string]float64{"/fast": 0.70, "/medium": 0.20, "/slow": 0.09, "/very-slow": 0.01}
+	for path, share := range want {
+		got := float64(counts[path]) / n
+		if got < share*0.9 || got > share*1.1 {
+			t.Errorf("%s got %.4f of the requests, want %.2f", path, got, share)
+		}
+	}
+}
+
+func TestApplyWeightsInvalid(t *testing.T) {
+	for _, weights := range []string{"70,20,10", "70,20,9,1,1", "70,20,9,x", "70,20,10,0", "70,20,11,-1"} {
+		spec := *defaultSpec
+		if err := spec.applyWeights(weights); err == nil {
+			t.Errorf("applyWeights accepted %q", weights)
+		}
+	}
+}
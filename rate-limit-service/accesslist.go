@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// accessListHits counts descriptors bypassed by the allowlist, blocked by
+// the denylist or exempted from limits by the unlimited list, labeled by the
+// list
+var accessListHits = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_access_list_total",
+		Help: "Total number of descriptors matched by the allowlist, denylist or unlimited list",
+	},
+	[]string{"list"},
+)
+
+// errDenylisted is returned for descriptors carrying a denylisted value
+var errDenylisted = errors.New("descriptor value is denylisted")
+
+// AccessList matches descriptor values, such as IPs or company IDs, under
+// the descriptor key they were listed for, exactly or, for remote_address
+// entries, by CIDR range
+type AccessList struct {
+	Values   map[string]map[string]bool // Exact descriptor values by descriptor key
+	Networks []*net.IPNet               // IP ranges matched against remote_address
+}
+
+// parseAccessList builds an access list from entries listed by descriptor
+// key, each either a plain descriptor value or, under remote_address, a CIDR
+// range
+func parseAccessList(entries map[string][]string) (AccessList, error) {
+	list := AccessList{Values: make(map[string]map[string]bool, len(entries))}
+	for key, values := range entries {
+		if key == "" {
+			return AccessList{}, fmt.Errorf("empty descriptor key")
+		}
+		for _, value := range values {
+			if value == "" {
+				return AccessList{}, fmt.Errorf("%s: empty entry", key)
+			}
+			if key == "remote_address" && strings.Contains(value, "/") {
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					return AccessList{}, fmt.Errorf("%s: invalid CIDR %q: %v", key, value, err)
+				}
+				list.Networks = append(list.Networks, network)
+				continue
+			}
+			if list.Values[key] == nil {
+				list.Values[key] = make(map[string]bool)
+			}
+			list.Values[key][value] = true
+		}
+	}
+	return list, nil
+}
+
+// matches reports whether any entry of the descriptor is on the list under
+// its own key
+func (l AccessList) matches(descriptor *ratelimit.RateLimitDescriptor) bool {
+	for _, entry := range descriptor.Entries {
+		if l.Values[entry.Key][entry.Value] {
+			return true
+		}
+		if entry.Key != "remote_address" || len(l.Networks) == 0 {
+			continue
+		}
+		ip := net.ParseIP(entry.Value)
+		if ip == nil {
+			continue
+		}
+		for _, network := range l.Networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
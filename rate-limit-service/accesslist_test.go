@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// accessListConfig allows an office network, denies one company and leaves
+// another unlimited, with limits small enough to trip otherwise
+const accessListConfig = `
+rules:
+  - key: remote_address
+    limit: 1
+    unit: minute
+  - key: company_id
+    limit: 1
+    unit: minute
+allowlist:
+  remote_address: ["10.1.0.0/16"]
+denylist:
+  company_id: ["abuser"]
+unlimited:
+  company_id: ["platform"]
+`
+
+func TestAllowlistedCIDR(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, accessListConfig), rdb)
+
+	allowed0 := testutil.ToFloat64(accessListHits.WithLabelValues("allow"))
+	commands := mr.CommandCount()
+	if got := allowed(t, s, 5, "", descriptor("remote_address", "10.1.2.3")); got != 5 {
+		t.Errorf("allowlisted IP allowed %d of 5, want 5", got)
+	}
+	if got := mr.CommandCount() - commands; got != 0 {
+		t.Errorf("allowlisted IP sent %d commands to Redis, want 0", got)
+	}
+	if got := testutil.ToFloat64(accessListHits.WithLabelValues("allow")) - allowed0; got != 5 {
+		t.Errorf("allowlist hits increased by %v, want 5", got)
+	}
+
+	// Addresses outside the block are limited as usual
+	if got := allowed(t, s, 3, "", descriptor("remote_address", "10.2.0.1")); got != 1 {
+		t.Errorf("IP outside the block allowed %d of 3, want 1", got)
+	}
+}
+
+func TestDenylistedCompany(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, accessListConfig), rdb)
+
+	denied := testutil.ToFloat64(accessListHits.WithLabelValues("deny"))
+	if got := check(t, s, "", descriptor("company_id", "abuser")); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("denylisted company got %v, want OVER_LIMIT", got)
+	}
+	if got := testutil.ToFloat64(accessListHits.WithLabelValues("deny")) - denied; got != 1 {
+		t.Errorf("denylist hits increased by %v, want 1", got)
+	}
+	if got := check(t, s, "", descriptor("company_id", "acme")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("other company got %v, want OK", got)
+	}
+}
+
+func TestUnlimitedCompany(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, accessListConfig), rdb)
+
+	unlimited := testutil.ToFloat64(accessListHits.WithLabelValues("unlimited"))
+	for i := 1; i <= 5; i++ {
+		response := shouldRateLimit(t, s, "", descriptor("company_id", "platform"))
+		if got := response.Statuses[0]; got.Code != envoy.RateLimitResponse_OK || got.LimitRemaining != maxEnvoyLimit {
+			t.Fatalf("request %d got %v with %d remaining, want OK with %d", i, got.Code, got.LimitRemaining, uint32(maxEnvoyLimit))
+		}
+	}
+	// The hits are still counted, past the limit of 1
+	key := windowedKey(s.buildKey("company", "platform"), time.Minute)
+	if got, _ := mr.Get(key); got != "5" {
+		t.Errorf("%s = %q, want 5", key, got)
+	}
+	if got := testutil.ToFloat64(accessListHits.WithLabelValues("unlimited")) - unlimited; got != 5 {
+		t.Errorf("unlimited hits increased by %v, want 5", got)
+	}
+	if got := allowed(t, s, 3, "", descriptor("company_id", "acme")); got != 1 {
+		t.Errorf("other company allowed %d of 3, want 1", got)
+	}
+
+	// A hit that cannot be counted does not reject an unlimited company,
+	// even failing closed
+	s = newTestServer(t, loadTestConfig(t, accessListConfig), newDeadRedis(t))
+	if got := check(t, s, "", descriptor("company_id", "platform")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("unlimited company got %v without Redis, want OK", got)
+	}
+}
+
+func TestAccessListScopedByKey(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, accessListConfig), rdb)
+
+	// A value listed under one key does not match another key's entries
+	if got := check(t, s, "", descriptor("user_id", "abuser")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("user named like a denylisted company got %v, want OK", got)
+	}
+}
+
+func TestParseAccessListCIDR(t *testing.T) {
+	// Only remote_address entries are IP ranges; elsewhere a slash is part
+	// of the value
+	list, err := parseAccessList(map[string][]string{"company_id": {"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("parseAccessList: %v", err)
+	}
+	if len(list.Networks) != 0 || !list.Values["company_id"]["10.0.0.0/8"] {
+		t.Errorf("company_id entry parsed as %+v, want a plain value", list)
+	}
+	if _, err := parseAccessList(map[string][]string{"remote_address": {"10.0.0.0/33"}}); err == nil {
+		t.Error("parseAccessList accepted an invalid CIDR")
+	}
+}
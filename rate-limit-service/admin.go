@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// adminAddr is the address of the admin HTTP server, started only when
+// ADMIN_TOKEN is set
+const adminAddr = ":9091"
+
+// limitStatus is the JSON view of a single rate limit counter
+type limitStatus struct {
+	Key   string `json:"key"`             // Redis key
+	Count int64  `json:"count"`           // Hits recorded in the current window
+	Limit int64  `json:"limit,omitempty"` // Configured limit, if known for the key
+	TTLMs int64  `json:"ttl_ms"`          // Time until the key expires
+}
+
+// limitOverride is the JSON view of a limit override
+type limitOverride struct {
+	Key   string `json:"key"`   // Counter key the override applies to
+	Limit int64  `json:"limit"` // Limit replacing the configured default
+}
+
+// adminHandler returns the admin API, guarded by a bearer token:
+//   - GET /admin/limits/{key}: current count, limit and TTL of a Redis key
+//   - DELETE /admin/limits/{key}: reset a counter in Redis and the local cache
+//   - GET /admin/overrides/{key}: the limit override for a counter key
+//   - PUT /admin/overrides/{key}: set the limit override for a counter key
+//   - DELETE /admin/overrides/{key}: remove it, restoring the default
+//   - GET /admin/selftest: count, read back and delete a test counter in
+//     Redis, reporting each step
+//
+// Keys are given without the key prefix, which is added to them.
+func (s *RateLimitServer) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/limits/{key...}", s.handleGetLimit)
+	mux.HandleFunc("DELETE /admin/limits/{key...}", s.handleResetLimit)
+	mux.HandleFunc("GET /admin/overrides/{key...}", s.handleGetOverride)
+	mux.HandleFunc("PUT /admin/overrides/{key...}", s.handleSetOverride)
+	mux.HandleFunc("DELETE /admin/overrides/{key...}", s.handleDeleteOverride)
+	mux.HandleFunc("GET /admin/selftest", s.handleSelfTest)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleGetLimit reports the current state of a counter
+func (s *RateLimitServer) handleGetLimit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := r.PathValue("key")
+	redisKey := s.keyPrefix + key
+
+	count, err := s.counterValue(ctx, key)
+	if errors.Is(err, redis.Nil) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to read counter", zap.Error(err), zap.String("key", redisKey))
+		http.Error(w, "Failed to read counter", http.StatusInternalServerError)
+		return
+	}
+
+	ttl, err := s.redis.PTTL(ctx, redisKey).Result()
+	if err != nil {
+		s.logger.Error("failed to read counter TTL", zap.Error(err), zap.String("key", redisKey))
+		http.Error(w, "Failed to read counter", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitStatus{
+		Key:   redisKey,
+		Count: count,
+		Limit: s.config.Load().limitForKey(key),
+		TTLMs: ttl.Milliseconds(),
+	})
+}
+
+// handleResetLimit deletes a counter from Redis and from this replica's
+// local cache. Other replicas may keep rejecting the key until their cached
+// entry expires with the window.
+func (s *RateLimitServer) handleResetLimit(w http.ResponseWriter, r *http.Request) {
+	key := s.keyPrefix + r.PathValue("key")
+
+	if err := s.redis.Del(r.Context(), key).Err(); err != nil {
+		s.logger.Error("failed to reset counter", zap.Error(err), zap.String("key", key))
+		http.Error(w, "Failed to reset counter", http.StatusInternalServerError)
+		return
+	}
+	s.cacheDel(key)
+
+	s.logger.Info("reset rate limit counter", zap.String("key", key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// overrideKeyFor returns the Redis key holding the limit override for a
+// counter key given without the key prefix, or false if limits of that kind
+// cannot be overridden: only company, company region and API key path limits
+// read overrides
+func (s *RateLimitServer) overrideKeyFor(key string) (string, bool) {
+	base := strings.NewReplacer("{", "", "}", "").Replace(key)
+	keyType, rest, _ := strings.Cut(base, ":")
+	switch {
+	case rest == "":
+		return "", false
+	case keyType == "company" && (!strings.Contains(rest, ":") || strings.Contains(rest, ":region:")):
+	case keyType == "apikey" && strings.Contains(rest, ":path:"):
+	default:
+		return "", false
+	}
+	return s.overrideKey(s.keyPrefix + key), true
+}
+
+// handleGetOverride reports the limit override for a counter key
+func (s *RateLimitServer) handleGetOverride(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	overrideKey, ok := s.overrideKeyFor(key)
+	if !ok {
+		http.Error(w, "Limits of this key cannot be overridden", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := s.redis.Get(r.Context(), overrideKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		http.Error(w, "No override set", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to read limit override", zap.Error(err), zap.String("key", overrideKey))
+		http.Error(w, "Failed to read override", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitOverride{Key: key, Limit: limit})
+}
+
+// handleSetOverride stores a limit override for a counter key and drops it
+// from this replica's local cache. Other replicas pick it up once their
+// cached entry expires, within overrideCacheTTL.
+func (s *RateLimitServer) handleSetOverride(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	overrideKey, ok := s.overrideKeyFor(key)
+	if !ok {
+		http.Error(w, "Limits of this key cannot be overridden", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Limit int64 `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Limit <= 0 {
+		http.Error(w, "Body must be {\"limit\": <positive integer>}", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.redis.Set(r.Context(), overrideKey, body.Limit, 0).Err(); err != nil {
+		s.logger.Error("failed to set limit override", zap.Error(err), zap.String("key", overrideKey))
+		http.Error(w, "Failed to set override", http.StatusInternalServerError)
+		return
+	}
+	s.cacheDel(overrideKey)
+
+	s.logger.Info("set limit override", zap.String("key", key), zap.Int64("limit", body.Limit))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitOverride{Key: key, Limit: body.Limit})
+}
+
+// handleDeleteOverride removes the limit override for a counter key, so the
+// configured default applies again, and drops it from this replica's local
+// cache
+func (s *RateLimitServer) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	overrideKey, ok := s.overrideKeyFor(key)
+	if !ok {
+		http.Error(w, "Limits of this key cannot be overridden", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.redis.Del(r.Context(), overrideKey).Err(); err != nil {
+		s.logger.Error("failed to delete limit override", zap.Error(err), zap.String("key", overrideKey))
+		http.Error(w, "Failed to delete override", http.StatusInternalServerError)
+		return
+	}
+	s.cacheDel(overrideKey)
+
+	s.logger.Info("deleted limit override", zap.String("key", key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// counterValue reads a counter, given without the key prefix, in whichever
+// representation its window mode stores it: a string for fixed windows, a
+// sorted set for sliding windows, whose count is the running total kept
+// beside it, a hash for token buckets, whose count is the tokens used, and a
+// theoretical arrival time for GCRA, whose count is the capacity used
+func (s *RateLimitServer) counterValue(ctx context.Context, key string) (int64, error) {
+	redisKey := s.keyPrefix + key
+	kind, err := s.redis.Type(ctx, redisKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	config := s.config.Load()
+	switch kind {
+	case "string":
+		if config.WindowMode != GCRA {
+			return s.redis.Get(ctx, redisKey).Int64()
+		}
+		// The TAT expires when the capacity is fully restored, so the time
+		// left is the capacity still in use
+		ttl, err := s.redis.PTTL(ctx, redisKey).Result()
+		if err != nil {
+			return 0, err
+		}
+		limit, window := config.ruleForKey(key)
+		if ttl <= 0 || window <= 0 {
+			return 0, nil
+		}
+		return int64(math.Ceil(float64(ttl) / float64(window) * float64(limit))), nil
+	case "zset":
+		// The running total the script keeps beside the set. A set recorded
+		// before totals were kept has none until its next request.
+		count, err := s.redis.Get(ctx, slidingWindowSumKey(redisKey)).Int64()
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return count, err
+	case "hash":
+		tokens, err := s.redis.HGet(ctx, redisKey, "tokens").Float64()
+		if err != nil {
+			return 0, err
+		}
+		return config.limitForKey(key) - int64(tokens), nil
+	default:
+		return 0, redis.Nil
+	}
+}
+
+// windowSuffix matches the suffixes of a counter key: the domain added by
+// scopeKey for domains with their own rules, captured, the window added by
+// windowedKey and the period of calendar-aligned counters
+var windowSuffix = regexp.MustCompile(`(:domain:([\w.-]+))?:w\d+(:p\d+)?$`)
+
+// limitForKey returns the configured limit for a Redis counter key, or 0
+// when the key does not belong to a known rule. Redis overrides are not
+// consulted.
+func (c *RateLimitConfig) limitForKey(key string) int64 {
+	limit, _ := c.ruleForKey(key)
+	return limit
+}
+
+// ruleForKey returns the limit and window of the rule a Redis counter key
+// belongs to, adjusted like the counter's own by bucketParams, or zero values
+// when the key does not belong to a known rule
+func (c *RateLimitConfig) ruleForKey(key string) (int64, time.Duration) {
+	if m := windowSuffix.FindStringSubmatch(key); m != nil && m[2] != "" {
+		scoped, ok := c.Domains[m[2]]
+		if !ok {
+			return 0, 0
+		}
+		c = scoped
+	}
+	base := strings.NewReplacer("{", "", "}", "").Replace(windowSuffix.ReplaceAllString(key, ""))
+	keyType, _, _ := strings.Cut(base, ":")
+
+	var rule KeyRule
+	switch {
+	case keyType == "ip" && strings.Contains(base, ":path:"):
+		rule = KeyRule{Limit: c.IPPathLimit, Window: c.IPPathWindow}
+	case keyType == "user" && strings.HasSuffix(base, ":writes"):
+		rule = KeyRule{Limit: c.UserWriteLimit, Window: c.UserWriteWindow}
+	case keyType == "company" && strings.Contains(base, ":region:"):
+		rule = KeyRule{Limit: c.CompanyRegionLimit, Window: c.CompanyRegionWindow}
+	case keyType == "apikey" && strings.Contains(base, ":path:"):
+		rule = KeyRule{Limit: c.APIKeyPathLimit, Window: c.APIKeyPathWindow}
+	case keyType == "tenant":
+		rule = KeyRule{Limit: c.TenantLimit, Window: c.TenantWindow}
+	default:
+		for descriptorKey, r := range c.Keys {
+			if keyTypeFor(descriptorKey) == keyType {
+				rule = r
+			}
+		}
+	}
+	if rule.Limit == 0 {
+		return 0, 0
+	}
+
+	// Token buckets and GCRA report their capacity as the limit
+	return c.bucketParams(rule.Limit, rule.Window)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+// adminToken is the bearer token guarding the admin API in tests
+const adminToken = "admin-secret"
+
+// adminRequest sends a request with the admin token to the admin API of s
+func adminRequest(t *testing.T, s *RateLimitServer, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	s.adminHandler(adminToken).ServeHTTP(rec, req)
+	return rec
+}
+
+// limitPath returns the admin path of a counter key
+func limitPath(key string) string {
+	return "/admin/limits/" + url.PathEscape(key)
+}
+
+func TestAdminGetLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1"))
+	key := windowedKey("{ip:10.0.0.1}", time.Minute)
+	mr.FastForward(15 * time.Second)
+
+	rec := adminRequest(t, s, http.MethodGet, limitPath(key), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var got limitStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := limitStatus{Key: key, Count: 3, Limit: 5, TTLMs: (45 * time.Second).Milliseconds()}
+	if got != want {
+		t.Errorf("limit = %+v, want %+v", got, want)
+	}
+
+	if rec := adminRequest(t, s, http.MethodGet, limitPath("{ip:10.9.9.9}:w60000"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("missing key status = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminResetLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := loadTestConfig(t, ipRuleConfig)
+	s := newCachedTestServer(t, config, rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+	for i := 0; i < 2; i++ {
+		checkCached(t, s)
+	}
+	if got := check(t, s, "", ip); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("request over the limit got %v, want OVER_LIMIT", got)
+	}
+	s.localCache.Wait()
+	key := windowedKey("{ip:10.0.0.1}", time.Second)
+
+	if rec := adminRequest(t, s, http.MethodDelete, limitPath(key), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+	s.localCache.Wait()
+
+	// Both the counter and the cached over-limit count are gone
+	if mr.Exists(key) {
+		t.Error("counter still in Redis after reset")
+	}
+	if got := check(t, s, "", ip); got != envoy.RateLimitResponse_OK {
+		t.Errorf("request after reset got %v, want OK", got)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+	handler := s.adminHandler(adminToken)
+
+	for _, auth := range []string{"", "Bearer wrong", adminToken} {
+		req := httptest.NewRequest(http.MethodDelete, limitPath("{ip:10.0.0.1}:w60000"), nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", auth, rec.Code)
+		}
+	}
+}
+
+func TestAdminOverrides(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+	s.keyPrefix = "staging:"
+	path := "/admin/overrides/" + url.PathEscape("{company:acme}")
+	request := func() envoy.RateLimitResponse_Code {
+		code := check(t, s, "", descriptor("company_id", "acme"))
+		s.localCache.Wait()
+		return code
+	}
+	// Caches the absence of an override
+	request()
+
+	rec := adminRequest(t, s, http.MethodPut, path, `{"limit": 2}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got, _ := mr.Get("staging:limit:{company:acme}"); got != "2" {
+		t.Errorf("stored override = %q, want 2", got)
+	}
+	rec = adminRequest(t, s, http.MethodGet, path, "")
+	var got limitOverride
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got != (limitOverride{Key: "{company:acme}", Limit: 2}) {
+		t.Errorf("get = %+v (%v), want a limit of 2", got, err)
+	}
+
+	// The next check uses the override rather than the cached default
+	if got := request(); got != envoy.RateLimitResponse_OK {
+		t.Errorf("second request got %v, want OK", got)
+	}
+	if got := request(); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("third request got %v, want OVER_LIMIT under the override", got)
+	}
+
+	// Deleting it restores the default
+	if rec := adminRequest(t, s, http.MethodDelete, path, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, s, http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get after delete status = %d, want 404", rec.Code)
+	}
+	if got := request(); got != envoy.RateLimitResponse_OK {
+		t.Errorf("fourth request got %v, want OK under the default", got)
+	}
+}
+
+func TestAdminOverrideInvalid(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+	company := "/admin/overrides/" + url.PathEscape("{company:acme}")
+
+	for _, body := range []string{`{"limit": 0}`, `{"limit": -1}`, `{"limit": "ten"}`, ``} {
+		if rec := adminRequest(t, s, http.MethodPut, company, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("body %q: status = %d, want 400", body, rec.Code)
+		}
+	}
+	// Only company, company region and API key path limits are overridable
+	for _, key := range []string{"{ip:10.0.0.1}", "{user:1}:writes", "{apikey:k1}"} {
+		path := "/admin/overrides/" + url.PathEscape(key)
+		if rec := adminRequest(t, s, http.MethodPut, path, `{"limit": 10}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", key, rec.Code)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("redis keys = %v, want no override stored", keys)
+	}
+}
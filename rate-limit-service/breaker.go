@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// breakerState is the state of the circuit breaker around Redis
+type breakerState int
+
+const (
+	// breakerClosed lets every call through to Redis
+	breakerClosed breakerState = iota
+
+	// breakerHalfOpen lets a single probe through to test whether Redis has
+	// recovered
+	breakerHalfOpen
+
+	// breakerOpen keeps calls away from Redis until the cooldown has passed
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "open"
+	}
+}
+
+// errBreakerOpen is returned for a check that could not be decided without
+// Redis while the circuit breaker was open
+var errBreakerOpen = errors.New("redis circuit breaker is open")
+
+// breakerStateGauge reports the state of the Redis circuit breaker:
+// 0 closed, 1 half-open, 2 open
+var breakerStateGauge = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rate_limit_redis_breaker_state",
+		Help: "State of the Redis circuit breaker: 0 closed, 1 half-open, 2 open",
+	},
+)
+
+// breakerRejections tracks Redis calls skipped because the breaker was open,
+// labeled by the operation skipped
+var breakerRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_redis_breaker_rejections_total",
+		Help: "Total number of Redis calls skipped because the circuit breaker was open",
+	},
+	[]string{"operation"},
+)
+
+// BreakerOptions configures the circuit breaker around Redis
+type BreakerOptions struct {
+	FailureThreshold int           // Consecutive failures that open the breaker (0 disables it)
+	Cooldown         time.Duration // How long the breaker stays open before probing Redis
+}
+
+// breakerOptionsFromEnv reads BREAKER_FAILURE_THRESHOLD and BREAKER_COOLDOWN,
+// defaulting to opening after 5 consecutive failures for 5 seconds
+func breakerOptionsFromEnv() (BreakerOptions, error) {
+	opts := BreakerOptions{
+		FailureThreshold: 5,
+		Cooldown:         5 * time.Second,
+	}
+
+	var err error
+	if opts.FailureThreshold, err = intEnv("BREAKER_FAILURE_THRESHOLD", opts.FailureThreshold); err != nil {
+		return opts, err
+	}
+	if opts.Cooldown, err = durationEnv("BREAKER_COOLDOWN", opts.Cooldown); err != nil {
+		return opts, fmt.Errorf("breaker: %v", err)
+	}
+	return opts, nil
+}
+
+// circuitBreaker stops calls to Redis after repeated failures, so checks do
+// not each wait for a timeout while Redis is down. Once the cooldown has
+// passed it lets one probe through: a success closes it again, a failure
+// reopens it. A nil breaker lets every call through.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int       // Consecutive failures while closed
+	changedAt time.Time // When the breaker last opened or let a probe through
+	opts      BreakerOptions
+	logger    *zap.Logger
+}
+
+// newCircuitBreaker returns a closed breaker, or nil when opts disable it
+func newCircuitBreaker(opts BreakerOptions, logger *zap.Logger) *circuitBreaker {
+	if opts.FailureThreshold == 0 {
+		return nil
+	}
+	breakerStateGauge.Set(float64(breakerClosed))
+	return &circuitBreaker{opts: opts, logger: logger}
+}
+
+// allow reports whether a call may be made to Redis. Half-open, a probe
+// whose outcome is never recorded is replaced by another after a further
+// cooldown, so the breaker cannot stay half-open forever.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerClosed {
+		return true
+	}
+	if time.Since(b.changedAt) < b.opts.Cooldown {
+		return false
+	}
+	b.changedAt = time.Now()
+	b.setState(breakerHalfOpen)
+	return true
+}
+
+// refusing reports whether allow would keep calls away from Redis, without
+// letting a probe through when the cooldown has passed
+func (b *circuitBreaker) refusing() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != breakerClosed && time.Since(b.changedAt) < b.opts.Cooldown
+}
+
+// record reports the outcome of a call allowed through to Redis
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.opts.FailureThreshold {
+		b.failures = 0
+		b.changedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState moves the breaker to state, logging and publishing changes.
+// The caller must hold b.mu.
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	b.logger.Warn("redis circuit breaker changed state",
+		zap.Stringer("from", b.state),
+		zap.Stringer("to", state),
+	)
+	b.state = state
+	breakerStateGauge.Set(float64(state))
+}
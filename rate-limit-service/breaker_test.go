@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// callCounter is a Redis hook counting the commands and pipelines sent
+type callCounter struct{ calls atomic.Int64 }
+
+func (c *callCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (c *callCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.calls.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (c *callCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.calls.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func TestBreakerStates(t *testing.T) {
+	b := newCircuitBreaker(BreakerOptions{FailureThreshold: 3, Cooldown: 50 * time.Millisecond}, zap.NewNop())
+	failure := errors.New("connection refused")
+	assertState := func(want breakerState) {
+		t.Helper()
+		if b.state != want {
+			t.Errorf("state = %v, want %v", b.state, want)
+		}
+		if got := testutil.ToFloat64(breakerStateGauge); got != float64(want) {
+			t.Errorf("state gauge = %v, want %v", got, float64(want))
+		}
+	}
+
+	// Failures must be consecutive to open the breaker
+	b.record(failure)
+	b.record(failure)
+	b.record(nil)
+	b.record(failure)
+	b.record(failure)
+	assertState(breakerClosed)
+	b.record(failure)
+	assertState(breakerOpen)
+	if b.allow() {
+		t.Error("open breaker allowed a call")
+	}
+
+	// After the cooldown one probe goes through; its failure reopens it
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker allowed no probe after the cooldown")
+	}
+	assertState(breakerHalfOpen)
+	if b.allow() {
+		t.Error("half-open breaker allowed a second probe")
+	}
+	b.record(failure)
+	assertState(breakerOpen)
+
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(nil)
+	assertState(breakerClosed)
+	if !b.allow() || b.refusing() {
+		t.Error("closed breaker refused a call")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(BreakerOptions{FailureThreshold: 0}, zap.NewNop())
+	b.record(errors.New("connection refused"))
+	if b != nil || !b.allow() || b.refusing() {
+		t.Error("disabled breaker refused a call")
+	}
+}
+
+func TestBreakerKeepsChecksFromRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	counter := &callCounter{}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	rdb.AddHook(counter)
+	t.Cleanup(func() { rdb.Close() })
+
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Minute}
+	config.FailureMode = FailOpen
+	s := newTestServer(t, config, rdb)
+	s.breaker = newCircuitBreaker(BreakerOptions{FailureThreshold: 2, Cooldown: 100 * time.Millisecond}, zap.NewNop())
+	request := func() envoy.RateLimitResponse_Code {
+		return check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+	}
+
+	// Failing calls open the breaker, the failure mode deciding meanwhile
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	for i := 0; i < 2; i++ {
+		if got := request(); got != envoy.RateLimitResponse_OK {
+			t.Errorf("failing request %d got %v, want OK when failing open", i+1, got)
+		}
+	}
+	if !s.breaker.refusing() {
+		t.Fatal("breaker not open after 2 failures")
+	}
+
+	// While open, checks are decided without calling Redis
+	calls := counter.calls.Load()
+	rejections := testutil.ToFloat64(breakerRejections.WithLabelValues("check"))
+	for i := 0; i < 5; i++ {
+		if got := request(); got != envoy.RateLimitResponse_OK {
+			t.Errorf("request while open got %v, want OK when failing open", got)
+		}
+	}
+	if got := counter.calls.Load() - calls; got != 0 {
+		t.Errorf("made %d Redis calls while the breaker was open, want none", got)
+	}
+	if got := testutil.ToFloat64(breakerRejections.WithLabelValues("check")) - rejections; got != 5 {
+		t.Errorf("breaker rejections increased by %v, want 5", got)
+	}
+
+	// Once Redis recovers, the first check after the cooldown closes it and
+	// is counted again
+	mr.SetError("")
+	time.Sleep(110 * time.Millisecond)
+	request()
+	if s.breaker.refusing() || s.breaker.state != breakerClosed {
+		t.Errorf("breaker %v after a successful probe, want closed", s.breaker.state)
+	}
+	request()
+	if got := request(); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("third request after recovery got %v, want OVER_LIMIT", got)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	// cacheHits counts local cache lookups that found a counter
+	cacheHits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_cache_hits_total",
+			Help: "Total number of local cache lookups that found a counter",
+		},
+	)
+
+	// cacheMisses counts local cache lookups that found no counter
+	cacheMisses = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_cache_misses_total",
+			Help: "Total number of local cache lookups that found no counter",
+		},
+	)
+
+	// cacheRejections counts descriptors rejected from their locally cached
+	// count without contacting Redis, labeled by key type
+	cacheRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_cache_rejections_total",
+			Help: "Total number of descriptors rejected from the local cache without contacting Redis",
+		},
+		[]string{"type"},
+	)
+
+	// shortCircuitedRequests counts requests rejected without contacting
+	// Redis because a descriptor was denylisted or known from the local
+	// cache to be over its limit
+	shortCircuitedRequests = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_short_circuited_requests_total",
+			Help: "Total number of requests rejected without contacting Redis",
+		},
+	)
+
+	// cacheHitRatio publishes ristretto's own hit ratio
+	cacheHitRatio = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "rate_limit_cache_hit_ratio",
+			Help: "Hit ratio reported by the local cache",
+		},
+	)
+
+	// cacheCost publishes ristretto's cumulative cost added and evicted,
+	// labeled by event
+	cacheCost = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rate_limit_cache_cost",
+			Help: "Cumulative cost added to and evicted from the local cache",
+		},
+		[]string{"event"},
+	)
+)
+
+// cacheMetricsInterval is how often the local cache's metrics are published
+const cacheMetricsInterval = 10 * time.Second
+
+// overrideCacheTTL is how long a limit override read from Redis is cached,
+// and so how long a changed override can take to apply on each replica
+const overrideCacheTTL = 10 * time.Second
+
+// cachedOverride is a limit override read from Redis. A zero limit records
+// that no override is set, so absent overrides are not looked up on every
+// request either.
+type cachedOverride struct {
+	limit int64
+}
+
+// CacheOptions configures the local counter cache
+type CacheOptions struct {
+	Disabled    bool          // Count every request against Redis without caching
+	NumCounters int64         // Keys tracked for admission, ideally 10x the expected entries
+	MaxCost     int64         // Maximum size of the cached entries in bytes
+	MaxTTL      time.Duration // Upper bound on how long a count is cached (0 bounds it by the remaining window only)
+}
+
+// cacheOptionsFromEnv reads CACHE_DISABLED, CACHE_NUM_COUNTERS,
+// CACHE_MAX_COST and CACHE_MAX_TTL, defaulting to an enabled cache tracking
+// 10M keys in up to 1GB, each kept for the rest of its window
+func cacheOptionsFromEnv() (CacheOptions, error) {
+	opts := CacheOptions{
+		NumCounters: 1e7,
+		MaxCost:     1 << 30,
+	}
+
+	var err error
+	if opts.Disabled, err = boolEnv("CACHE_DISABLED", opts.Disabled); err != nil {
+		return opts, err
+	}
+	numCounters, err := intEnv("CACHE_NUM_COUNTERS", int(opts.NumCounters))
+	if err != nil {
+		return opts, err
+	}
+	maxCost, err := intEnv("CACHE_MAX_COST", int(opts.MaxCost))
+	if err != nil {
+		return opts, err
+	}
+	if opts.MaxTTL, err = durationEnv("CACHE_MAX_TTL", opts.MaxTTL); err != nil {
+		return opts, err
+	}
+	if numCounters == 0 {
+		return opts, fmt.Errorf("CACHE_NUM_COUNTERS must be positive")
+	}
+	if maxCost == 0 {
+		return opts, fmt.Errorf("CACHE_MAX_COST must be positive")
+	}
+	opts.NumCounters, opts.MaxCost = int64(numCounters), int64(maxCost)
+	return opts, nil
+}
+
+// newLocalCache creates the local counter cache, or returns nil when it is
+// disabled
+func newLocalCache(opts CacheOptions, logger *zap.Logger) (*ristretto.Cache, error) {
+	if opts.Disabled {
+		return nil, nil
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: opts.NumCounters, // Keys tracked for admission
+		MaxCost:     opts.MaxCost,     // Maximum cache size in bytes
+		BufferItems: 64,               // Keys per Get buffer
+		Metrics:     true,             // Track hit ratio and cost for Prometheus
+		OnEvict: func(item *ristretto.Item) {
+			logger.Debug("cache item evicted",
+				zap.String("key", fmt.Sprintf("%v", item.Key)),
+				zap.Int64("cost", item.Cost),
+			)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	return cache, nil
+}
+
+// cachedCountCost is the cost of caching a count under key: its approximate
+// size in bytes, the key plus the cached value. Composite keys such as
+// IP-and-path ones cost more than plain IP or user keys.
+func cachedCountCost(key string) int64 {
+	return int64(len(key)) + int64(unsafe.Sizeof(cachedCount{}))
+}
+
+// cacheGet returns the cached count for key, counting the lookup. A value
+// of another type stored under key is dropped and reported as a miss, so the
+// count is read from Redis instead.
+func (s *RateLimitServer) cacheGet(key string) (cachedCount, bool) {
+	if s.localCache == nil {
+		return cachedCount{}, false
+	}
+	val, found := s.localCache.Get(key)
+	cached, ok := val.(cachedCount)
+	if found && !ok {
+		s.dropUnexpected(key, val)
+		found = false
+	}
+	recordCacheLookup(found)
+	return cached, found
+}
+
+// cacheSet caches the count for key for ttl, capped at the configured
+// maximum. Callers pass at most the time left in the key's window, so a
+// cached count, and any over-limit decision taken from it, expires no later
+// than the window it was counted in.
+func (s *RateLimitServer) cacheSet(key string, cached cachedCount, ttl time.Duration) {
+	if s.localCache == nil || ttl <= 0 {
+		return
+	}
+	if s.cacheMaxTTL > 0 {
+		ttl = min(ttl, s.cacheMaxTTL)
+	}
+	s.localCache.SetWithTTL(key, cached, cachedCountCost(key), ttl)
+}
+
+// cacheDel removes the cached count for key
+func (s *RateLimitServer) cacheDel(key string) {
+	if s.localCache == nil {
+		return
+	}
+	s.localCache.Del(key)
+}
+
+// cacheGetOverride returns the cached limit override stored at overrideKey
+func (s *RateLimitServer) cacheGetOverride(overrideKey string) (cachedOverride, bool) {
+	if s.localCache == nil {
+		return cachedOverride{}, false
+	}
+	val, found := s.localCache.Get(overrideKey)
+	cached, ok := val.(cachedOverride)
+	if found && !ok {
+		s.dropUnexpected(overrideKey, val)
+	}
+	return cached, found && ok
+}
+
+// cacheSetOverride caches the limit override stored at overrideKey for
+// overrideCacheTTL
+func (s *RateLimitServer) cacheSetOverride(overrideKey string, cached cachedOverride) {
+	if s.localCache == nil {
+		return
+	}
+	cost := int64(len(overrideKey)) + int64(unsafe.Sizeof(cachedOverride{}))
+	s.localCache.SetWithTTL(overrideKey, cached, cost, overrideCacheTTL)
+}
+
+// dropUnexpected removes val, a value of a type not expected under key,
+// from the local cache. Every key holds one type, so this only happens if a
+// change stores another type under keys of an existing kind.
+func (s *RateLimitServer) dropUnexpected(key string, val interface{}) {
+	s.logger.Warn("dropping cached value of unexpected type",
+		zap.String("key", key),
+		zap.String("type", fmt.Sprintf("%T", val)),
+	)
+	s.localCache.Del(key)
+}
+
+// recordCacheLookup counts a local cache lookup as a hit or a miss
+func recordCacheLookup(found bool) {
+	if found {
+		cacheHits.Inc()
+	} else {
+		cacheMisses.Inc()
+	}
+}
+
+// publishCacheMetrics copies the cache's internal metrics into Prometheus
+// gauges every interval, until ctx is cancelled
+func publishCacheMetrics(ctx context.Context, cache *ristretto.Cache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		metrics := cache.Metrics
+		cacheHitRatio.Set(metrics.Ratio())
+		cacheCost.WithLabelValues("added").Set(float64(metrics.CostAdded()))
+		cacheCost.WithLabelValues("evicted").Set(float64(metrics.CostEvicted()))
+	}
+}
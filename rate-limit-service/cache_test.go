@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// ipRuleConfig limits remote addresses to 2 requests per second
+const ipRuleConfig = `
+rules:
+  - key: remote_address
+    limit: 2
+    unit: second
+`
+
+// newCachedTestServer returns a test server with a small local cache
+func newCachedTestServer(t testing.TB, config *RateLimitConfig, rdb redisClient) *RateLimitServer {
+	t.Helper()
+	cache, err := newLocalCache(CacheOptions{NumCounters: 1000, MaxCost: 1 << 20}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newLocalCache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+	s := newTestServer(t, config, rdb)
+	s.localCache = cache
+	return s
+}
+
+// checkCached sends a request and waits for the cache writes it made
+func checkCached(t *testing.T, s *RateLimitServer) envoy.RateLimitResponse_Code {
+	t.Helper()
+	code := check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+	s.localCache.Wait()
+	return code
+}
+
+func TestCacheSkipsRedisAtLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newCachedTestServer(t, loadTestConfig(t, ipRuleConfig), rdb)
+
+	// Under the limit every request is counted in Redis
+	for i := 0; i < 2; i++ {
+		checkCached(t, s)
+	}
+	if got, _ := mr.Get("{ip:10.0.0.1}:w1000"); got != "2" {
+		t.Fatalf("redis counter = %q, want 2", got)
+	}
+
+	// At the limit, the cached count decides without contacting Redis
+	commands := mr.CommandCount()
+	checkCached(t, s)
+	if got := mr.CommandCount() - commands; got != 0 {
+		t.Errorf("request at the limit sent %d commands to Redis, want 0", got)
+	}
+}
+
+func TestCacheExpiresWithWindow(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newCachedTestServer(t, loadTestConfig(t, ipRuleConfig), rdb)
+
+	for i := 0; i < 3; i++ {
+		checkCached(t, s)
+	}
+
+	// Once the window resets, the cached count is gone and the request is
+	// counted in a fresh window
+	time.Sleep(1100 * time.Millisecond)
+	mr.FastForward(1100 * time.Millisecond)
+	checkCached(t, s)
+	if got, _ := mr.Get("{ip:10.0.0.1}:w1000"); got != "1" {
+		t.Errorf("redis counter after the window = %q, want 1", got)
+	}
+}
+
+func TestCacheValueOfWrongType(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 100, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+
+	// A count cached as a bare integer, as before counts carried their reset
+	key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Minute)
+	mr.Set(key, "7")
+	s.localCache.Set(key, int64(7), 1)
+	s.localCache.Wait()
+
+	// The value is treated as a miss and the count read from Redis
+	misses := testutil.ToFloat64(cacheMisses)
+	response := shouldRateLimit(t, s, "", descriptor("remote_address", "10.0.0.1"))
+	if got := response.Statuses[0].LimitRemaining; got != 92 {
+		t.Errorf("remaining = %d, want 92 after 7 stored hits and this one", got)
+	}
+	if got := testutil.ToFloat64(cacheMisses) - misses; got != 1 {
+		t.Errorf("cache misses increased by %v, want 1", got)
+	}
+	s.localCache.Wait()
+	if val, _ := s.localCache.Get(key); val == nil {
+		t.Error("count not cached after the request")
+	} else if _, ok := val.(cachedCount); !ok {
+		t.Errorf("cached %T after the request, want cachedCount", val)
+	}
+
+	// Overrides are checked the same way
+	s.localCache.Set("limit:override", "3", 1)
+	s.localCache.Wait()
+	if _, ok := s.cacheGetOverride("limit:override"); ok {
+		t.Error("string cached as an override was returned")
+	}
+	if _, found := s.localCache.Get("limit:override"); found {
+		t.Error("mistyped override left in the cache")
+	}
+}
+
+func TestCachedCountExpiresWithWindow(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+
+	// A counter at its limit with 300ms of its minute left
+	key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Minute)
+	mr.Set(key, "2")
+	mr.SetTTL(key, 300*time.Millisecond)
+	if got := checkCached(t, s); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("request at the limit got %v, want OVER_LIMIT", got)
+	}
+
+	// The count is cached for what is left of the window, not a whole one
+	cached, found := s.cacheGet(key)
+	if !found {
+		t.Fatal("count not cached")
+	}
+	if left := time.Until(cached.resetAt); left > 300*time.Millisecond {
+		t.Errorf("cached count resets in %v, want at most the 300ms left", left)
+	}
+
+	// Once the window has passed, the cached decision is no longer served
+	time.Sleep(350 * time.Millisecond)
+	mr.FastForward(350 * time.Millisecond)
+	if _, found := s.localCache.Get(key); found {
+		t.Error("count still cached after its window")
+	}
+	if got := checkCached(t, s); got != envoy.RateLimitResponse_OK {
+		t.Errorf("request after the window got %v, want OK", got)
+	}
+}
+
+func TestCacheMaxTTL(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newCachedTestServer(t, DefaultRateLimitConfig(), rdb)
+	s.cacheMaxTTL = 50 * time.Millisecond
+
+	s.cacheSet("counter", cachedCount{count: 1, resetAt: time.Now().Add(time.Minute)}, time.Minute)
+	s.localCache.Wait()
+	if _, found := s.localCache.Get("counter"); !found {
+		t.Fatal("count not cached")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if _, found := s.localCache.Get("counter"); found {
+		t.Error("count cached beyond CACHE_MAX_TTL")
+	}
+
+	t.Setenv("CACHE_MAX_TTL", "2s")
+	if opts, err := cacheOptionsFromEnv(); err != nil || opts.MaxTTL != 2*time.Second {
+		t.Errorf("CACHE_MAX_TTL=2s gave %v, %v", opts.MaxTTL, err)
+	}
+}
+
+func TestCacheLookupMetrics(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.WindowMode = SlidingWindow
+	s := newCachedTestServer(t, config, rdb)
+
+	hits, misses := testutil.ToFloat64(cacheHits), testutil.ToFloat64(cacheMisses)
+	// Two keys, each missed once and then found
+	for i := 0; i < 5; i++ {
+		checkCached(t, s)
+		check(t, s, "", descriptor("user_id", "alice"))
+		s.localCache.Wait()
+	}
+	if got := testutil.ToFloat64(cacheMisses) - misses; got != 2 {
+		t.Errorf("cache misses increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(cacheHits) - hits; got != 8 {
+		t.Errorf("cache hits increased by %v, want 8", got)
+	}
+}
+
+func TestPublishCacheMetrics(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newCachedTestServer(t, DefaultRateLimitConfig(), rdb)
+	for i := 0; i < 3; i++ {
+		checkCached(t, s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		publishCacheMetrics(ctx, s.localCache, 5*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	// The gauges mirror ristretto's own metrics
+	if got, want := testutil.ToFloat64(cacheHitRatio), s.localCache.Metrics.Ratio(); got != want || got == 0 {
+		t.Errorf("hit ratio gauge = %v, want %v and above 0", got, want)
+	}
+	if got := testutil.ToFloat64(cacheCost.WithLabelValues("added")); got <= 0 {
+		t.Errorf("cost added gauge = %v, want it above 0", got)
+	}
+}
+
+// withWorkerPool gives s a worker pool flushing every interval, shut down
+// with the test
+func withWorkerPool(t testing.TB, s *RateLimitServer, interval time.Duration) *UpdateWorkerPool {
+	t.Helper()
+	pool := NewUpdateWorkerPool(WorkerPoolOptions{Size: 2, FlushInterval: interval, BatchSize: 100}, s.redis, s.scripts, nil, zap.NewNop())
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	s.workerPool = pool
+	s.updateQueue = pool.queue
+	return pool
+}
+
+func TestQueuedIncrementsPersisted(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 100, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+	withWorkerPool(t, s, 20*time.Millisecond)
+
+	// Decisions follow the optimistic local count while increments queue
+	for i := 1; i <= 30; i++ {
+		response := shouldRateLimit(t, s, "", descriptor("remote_address", "10.0.0.1"))
+		s.localCache.Wait()
+		if got := response.Statuses[0].LimitRemaining; got != uint32(100-i) {
+			t.Fatalf("request %d: limit_remaining = %d, want %d", i, got, 100-i)
+		}
+	}
+
+	// and every increment eventually reaches Redis
+	key := windowedKey("{ip:10.0.0.1}", time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := mr.Get(key)
+		if got == "30" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("counter = %q, want 30", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ttl := mr.TTL(key); ttl <= 0 {
+		t.Error("flushed counter has no TTL")
+	}
+}
+
+// benchmarkRedisCommands checks one key b.N times and reports the Redis
+// commands sent per request
+func benchmarkRedisCommands(b *testing.B, queued bool) {
+	rdb, mr := newTestRedis(b)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: math.MaxInt32, Window: time.Minute}
+	s := newCachedTestServer(b, config, rdb)
+	if queued {
+		withWorkerPool(b, s, 100*time.Millisecond)
+	}
+	req := &envoy.RateLimitRequest{Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")}}
+
+	commands := mr.CommandCount()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ShouldRateLimit(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if queued {
+		s.workerPool.Shutdown(context.Background())
+	}
+	b.ReportMetric(float64(mr.CommandCount()-commands)/float64(b.N), "redis-cmds/op")
+}
+
+func BenchmarkSyncIncrements(b *testing.B)   { benchmarkRedisCommands(b, false) }
+func BenchmarkQueuedIncrements(b *testing.B) { benchmarkRedisCommands(b, true) }
+
+func TestWorkerWritesCanonicalKeys(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newCachedTestServer(t, DefaultRateLimitConfig(), rdb)
+	pool := withWorkerPool(t, s, time.Hour)
+
+	check(t, s, "",
+		descriptor("remote_address", "10.0.0.1"),
+		descriptor("company_id", "acme"),
+		descriptor("path", "/api/orders"),
+		descriptor("user_id", "alice"),
+	)
+	// Only the reads reach Redis until the queued increments are flushed
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("keys before flushing = %v, want none", keys)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// The worker writes the same keys the checks read
+	want := []string{
+		"{company:acme}:w60000",
+		"{ip:10.0.0.1}:w60000",
+		"{path:/api/orders}:w60000",
+		"{user:alice}:w60000",
+	}
+	if got := mr.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	for _, key := range want {
+		if got, _ := mr.Get(key); got != "1" {
+			t.Errorf("%s = %q, want 1", key, got)
+		}
+	}
+}
+
+func TestLimitRemainingOverLimit(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newCachedTestServer(t, loadTestConfig(t, ipRuleConfig), rdb)
+
+	// Later requests are rejected from the cached count, well past the limit,
+	// without the remaining quota wrapping around
+	want := []uint32{1, 0, 0, 0, 0}
+	for i, remaining := range want {
+		response := shouldRateLimit(t, s, "", descriptor("remote_address", "10.0.0.1"))
+		s.localCache.Wait()
+		status := response.Statuses[0]
+		if status.LimitRemaining != remaining {
+			t.Errorf("request %d: LimitRemaining = %d, want %d", i+1, status.LimitRemaining, remaining)
+		}
+		if got := status.CurrentLimit.GetRequestsPerUnit(); got != 2 {
+			t.Errorf("request %d: RequestsPerUnit = %d, want 2", i+1, got)
+		}
+		if i >= 2 && status.Code != envoy.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("request %d over the limit got %v, want OVER_LIMIT", i+1, status.Code)
+		}
+	}
+}
+
+func TestLimitRemainingUnderLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 1, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+	user := descriptor("user_id", "u1")
+	key := windowedKey(s.buildKey("user", "u1"), time.Minute)
+	mr.Set(key, "40")
+
+	// quota sends a request from the user and an IP and returns the user's
+	// status
+	quota := func(ip string) *envoy.RateLimitResponse_DescriptorStatus {
+		t.Helper()
+		response := shouldRateLimit(t, s, "", user, descriptor("remote_address", ip))
+		s.localCache.Wait()
+		return response.Statuses[0]
+	}
+
+	// An OK descriptor reports the remaining quota of its Redis counter
+	status := quota("10.0.0.1")
+	if status.Code != envoy.RateLimitResponse_OK || status.LimitRemaining != 59 || status.CurrentLimit.GetRequestsPerUnit() != 100 {
+		t.Errorf("user got %v with %d of %d remaining, want OK with 59 of 100", status.Code, status.LimitRemaining, status.CurrentLimit.GetRequestsPerUnit())
+	}
+
+	// With the IP at its limit, the next request is rejected from the cache
+	// without counting the user, who still gets their cached quota
+	status = quota("10.0.0.1")
+	if status.Code != envoy.RateLimitResponse_OK || status.LimitRemaining != 59 || status.CurrentLimit.GetRequestsPerUnit() != 100 {
+		t.Errorf("short-circuited user got %v with %d of %d remaining, want OK with 59 of 100", status.Code, status.LimitRemaining, status.CurrentLimit.GetRequestsPerUnit())
+	}
+	if got, _ := mr.Get(key); got != "41" {
+		t.Errorf("%s = %s, want 41", key, got)
+	}
+}
+
+func TestNewRateLimitResult(t *testing.T) {
+	tests := []struct {
+		count, limit, remaining int64
+		decision                Decision
+	}{
+		{count: 1, limit: 2, remaining: 1, decision: DecisionOK},
+		{count: 2, limit: 2, remaining: 0, decision: DecisionOK},
+		{count: 3, limit: 2, remaining: 0, decision: DecisionOverLimit},
+		{count: math.MaxInt64, limit: 2, remaining: 0, decision: DecisionOverLimit},
+	}
+	for _, tt := range tests {
+		result := newRateLimitResult(tt.count, tt.limit, time.Second, time.Second)
+		if result.Remaining != tt.remaining || result.Decision != tt.decision {
+			t.Errorf("newRateLimitResult(%d, %d) = remaining %d, %v; want %d, %v", tt.count, tt.limit, result.Remaining, result.Decision, tt.remaining, tt.decision)
+		}
+	}
+}
+
+func TestTinyCacheEvicts(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 10, Window: time.Minute}
+
+	// Room for only a few counts
+	entry := cachedCountCost(windowedKey("{ip:10.0.0.10}", time.Minute))
+	maxCost := 4 * entry
+	cache, err := newLocalCache(CacheOptions{NumCounters: 1000, MaxCost: maxCost}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newLocalCache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+	s := newTestServer(t, config, rdb)
+	s.localCache = cache
+
+	for i := 10; i < 60; i++ {
+		check(t, s, "", descriptor("remote_address", fmt.Sprintf("10.0.0.%d", i)))
+		cache.Wait()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		publishCacheMetrics(ctx, cache, 5*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	// Older counts make way for new ones, keeping the cache within its cost
+	added := testutil.ToFloat64(cacheCost.WithLabelValues("added"))
+	evicted := testutil.ToFloat64(cacheCost.WithLabelValues("evicted"))
+	if evicted <= 0 {
+		t.Errorf("cost evicted gauge = %v, want it above 0", evicted)
+	}
+	if held := added - evicted; held > float64(maxCost) {
+		t.Errorf("cache holds cost %v, want at most %d", held, maxCost)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	cache, err := newLocalCache(CacheOptions{Disabled: true}, zap.NewNop())
+	if err != nil || cache != nil {
+		t.Fatalf("newLocalCache = %v, %v; want no cache", cache, err)
+	}
+
+	// Without a cache every request is counted against Redis
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, ipRuleConfig), rdb)
+	if got := allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1")); got != 2 {
+		t.Errorf("allowed %d of 3, want 2", got)
+	}
+	if got, _ := mr.Get(windowedKey(s.buildKey("ip", "10.0.0.1"), time.Second)); got != "3" {
+		t.Errorf("counter = %q, want 3", got)
+	}
+}
+
+func TestCacheOptionsFromEnv(t *testing.T) {
+	t.Setenv("CACHE_DISABLED", "true")
+	t.Setenv("CACHE_NUM_COUNTERS", "5000")
+	t.Setenv("CACHE_MAX_COST", "65536")
+	opts, err := cacheOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("cacheOptionsFromEnv: %v", err)
+	}
+	if want := (CacheOptions{Disabled: true, NumCounters: 5000, MaxCost: 65536}); opts != want {
+		t.Errorf("options = %+v, want %+v", opts, want)
+	}
+
+	for _, name := range []string{"CACHE_NUM_COUNTERS", "CACHE_MAX_COST"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, "0")
+			if _, err := cacheOptionsFromEnv(); err == nil {
+				t.Errorf("cacheOptionsFromEnv accepted %s=0", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// DescriptorRule defines the limit applied to one descriptor key in a
+// configuration file
+type DescriptorRule struct {
+	Key     string `yaml:"key" json:"key"`         // Descriptor entry key, e.g. remote_address
+	Limit   int64  `yaml:"limit" json:"limit"`     // Maximum number of requests per unit
+	Unit    string `yaml:"unit" json:"unit"`       // Window unit: second, minute, hour or day
+	Default bool   `yaml:"default" json:"default"` // Apply to descriptors without a matching rule
+}
+
+// KeyRule is the limit applied to descriptors matching a descriptor key, or
+// a tuple of keys such as a company and a user together
+type KeyRule struct {
+	Limit  int64         // Maximum number of requests per window
+	Window time.Duration // Window length
+}
+
+// FailureMode selects the decision made when Redis is unavailable
+type FailureMode string
+
+const (
+	// FailOpen allows requests when their counter cannot be checked
+	FailOpen FailureMode = "open"
+
+	// FailClosed rejects requests when their counter cannot be checked
+	FailClosed FailureMode = "closed"
+)
+
+// configFile is the on-disk representation of the rate limit configuration
+type configFile struct {
+	WindowMode         WindowMode            `yaml:"window_mode" json:"window_mode"`
+	WindowAlignment    WindowAlignment       `yaml:"window_alignment" json:"window_alignment"`
+	RefillRate         float64               `yaml:"refill_rate" json:"refill_rate"`
+	BurstCapacity      int64                 `yaml:"burst_capacity" json:"burst_capacity"`
+	FailureMode        FailureMode           `yaml:"failure_mode" json:"failure_mode"`
+	SelfProtection     *bool                 `yaml:"self_protection" json:"self_protection"`
+	CountRejected      *bool                 `yaml:"count_rejected" json:"count_rejected"`
+	QueueSaturation    float64               `yaml:"queue_saturation" json:"queue_saturation"`
+	AccountSharing     *sharingFile          `yaml:"account_sharing" json:"account_sharing"`
+	DryRun             bool                  `yaml:"dry_run" json:"dry_run"`
+	Allowlist          map[string][]string   `yaml:"allowlist" json:"allowlist"`
+	Denylist           map[string][]string   `yaml:"denylist" json:"denylist"`
+	Unlimited          map[string][]string   `yaml:"unlimited" json:"unlimited"`
+	Normalize          *normalizeFile        `yaml:"normalize" json:"normalize"`
+	ObservedCompanies  []string              `yaml:"observed_companies" json:"observed_companies"`
+	Rules              []DescriptorRule      `yaml:"rules" json:"rules"`
+	Domains            map[string]domainFile `yaml:"domains" json:"domains"`
+	UnknownDomains     DomainAction          `yaml:"unknown_domains" json:"unknown_domains"`
+	UnknownDescriptors DescriptorPolicy      `yaml:"unknown_descriptors" json:"unknown_descriptors"`
+	MaxDescriptors     int                   `yaml:"max_descriptors" json:"max_descriptors"`
+	TooManyDescriptors DescriptorPolicy      `yaml:"too_many_descriptors" json:"too_many_descriptors"`
+}
+
+// sharingFile configures detection of accounts used from many distinct IPs
+type sharingFile struct {
+	MaxIPs int64         `yaml:"max_ips" json:"max_ips"` // Distinct IPs allowed per user per unit
+	Unit   string        `yaml:"unit" json:"unit"`       // Window unit, default hour
+	Action SharingAction `yaml:"action" json:"action"`   // flag (default) or reject
+}
+
+// unitWindows maps the supported rule units to their window durations
+var unitWindows = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// validateAlignment checks the window alignment, which only applies to fixed
+// windows: the other modes free capacity gradually rather than resetting
+func (c *RateLimitConfig) validateAlignment() error {
+	switch c.WindowAlignment {
+	case RollingAlignment:
+		return nil
+	case CalendarAlignment:
+		if c.WindowMode != FixedWindow {
+			return fmt.Errorf("window_alignment %q requires window_mode %q, got %q", c.WindowAlignment, FixedWindow, c.WindowMode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid window_alignment %q", c.WindowAlignment)
+	}
+}
+
+// LoadConfig reads a YAML or JSON rate limit configuration file. Rules in
+// the file override the matching built-in defaults; keys without a rule keep
+// their default limit. A missing file yields the default configuration.
+func LoadConfig(path string) (*RateLimitConfig, error) {
+	config := DefaultRateLimitConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	var file configFile
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	if file.WindowMode != "" {
+		config.WindowMode = file.WindowMode
+	}
+	switch config.WindowMode {
+	case FixedWindow, SlidingWindow, TokenBucket, GCRA:
+	default:
+		return nil, fmt.Errorf("invalid window_mode %q", config.WindowMode)
+	}
+	if file.WindowAlignment != "" {
+		config.WindowAlignment = file.WindowAlignment
+	}
+	if err := config.validateAlignment(); err != nil {
+		return nil, err
+	}
+	if file.RefillRate < 0 {
+		return nil, fmt.Errorf("refill_rate must not be negative, got %v", file.RefillRate)
+	}
+	if file.BurstCapacity < 0 {
+		return nil, fmt.Errorf("burst_capacity must not be negative, got %d", file.BurstCapacity)
+	}
+	config.RefillRate = file.RefillRate
+	config.BurstCapacity = file.BurstCapacity
+
+	if file.FailureMode != "" {
+		config.FailureMode = file.FailureMode
+	}
+	if config.FailureMode != FailOpen && config.FailureMode != FailClosed {
+		return nil, fmt.Errorf("invalid failure_mode %q", config.FailureMode)
+	}
+
+	if file.SelfProtection != nil {
+		config.SelfProtection = *file.SelfProtection
+	}
+	if file.CountRejected != nil {
+		config.CountRejected = *file.CountRejected
+	}
+	if file.QueueSaturation != 0 {
+		if file.QueueSaturation < 0 || file.QueueSaturation > 1 {
+			return nil, fmt.Errorf("queue_saturation must be within (0, 1], got %v", file.QueueSaturation)
+		}
+		config.QueueSaturation = file.QueueSaturation
+	}
+
+	config.DryRun = file.DryRun
+
+	if file.UnknownDescriptors != "" {
+		config.UnknownDescriptors = file.UnknownDescriptors
+	}
+	if !validDescriptorPolicy(config.UnknownDescriptors) {
+		return nil, fmt.Errorf("invalid unknown_descriptors %q", config.UnknownDescriptors)
+	}
+
+	if file.MaxDescriptors < 0 {
+		return nil, fmt.Errorf("max_descriptors must not be negative, got %d", file.MaxDescriptors)
+	}
+	config.MaxDescriptors = file.MaxDescriptors
+	if file.TooManyDescriptors != "" {
+		config.TooManyDescriptors = file.TooManyDescriptors
+	}
+	if !validTooManyDescriptorsPolicy(config.TooManyDescriptors) {
+		return nil, fmt.Errorf("invalid too_many_descriptors %q", config.TooManyDescriptors)
+	}
+
+	if config.Allowlist, err = parseAccessList(file.Allowlist); err != nil {
+		return nil, fmt.Errorf("allowlist: %v", err)
+	}
+	if config.Denylist, err = parseAccessList(file.Denylist); err != nil {
+		return nil, fmt.Errorf("denylist: %v", err)
+	}
+	if config.Unlimited, err = parseAccessList(file.Unlimited); err != nil {
+		return nil, fmt.Errorf("unlimited: %v", err)
+	}
+
+	config.ObservedCompanies = make(map[string]bool, len(file.ObservedCompanies))
+	for _, company := range file.ObservedCompanies {
+		config.ObservedCompanies[company] = true
+	}
+
+	if err := config.loadNormalization(file.Normalize); err != nil {
+		return nil, err
+	}
+
+	if sharing := file.AccountSharing; sharing != nil {
+		if sharing.MaxIPs <= 0 {
+			return nil, fmt.Errorf("account_sharing: max_ips must be positive, got %d", sharing.MaxIPs)
+		}
+		config.SharedIPLimit = sharing.MaxIPs
+		if sharing.Unit != "" {
+			window, ok := unitWindows[sharing.Unit]
+			if !ok {
+				return nil, fmt.Errorf("account_sharing: unknown unit %q", sharing.Unit)
+			}
+			config.SharedIPWindow = window
+		}
+		if sharing.Action != "" {
+			config.SharedIPAction = sharing.Action
+		}
+		if config.SharedIPAction != SharingFlag && config.SharedIPAction != SharingReject {
+			return nil, fmt.Errorf("account_sharing: invalid action %q", config.SharedIPAction)
+		}
+	}
+
+	if err := config.applyRules(file.Rules); err != nil {
+		return nil, err
+	}
+	if err := config.loadDomains(file); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 10 * time.Second
+
+// watchConfig polls the config file and reloads it whenever its
+// modification time changes, until ctx is cancelled
+func (s *RateLimitServer) watchConfig(ctx context.Context, interval time.Duration) {
+	var lastMod time.Time
+	if info, err := os.Stat(s.configPath); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(s.configPath)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		if err := s.reloadConfig(); err != nil {
+			s.logger.Error("failed to reload rate limit configuration",
+				zap.Error(err),
+				zap.String("path", s.configPath),
+			)
+		}
+	}
+}
+
+// applyRules applies the rules of a configuration file, or of one domain in
+// it, on top of the limits already in c
+func (c *RateLimitConfig) applyRules(rules []DescriptorRule) error {
+	seenDefault := false
+	for i, rule := range rules {
+		if rule.Limit <= 0 {
+			return fmt.Errorf("rule %d (%s): limit must be positive, got %d", i, rule.Key, rule.Limit)
+		}
+		unit := rule.Unit
+		if unit == "" {
+			unit = "minute"
+		}
+		window, ok := unitWindows[unit]
+		if !ok {
+			return fmt.Errorf("rule %d (%s): unknown unit %q", i, rule.Key, rule.Unit)
+		}
+
+		if rule.Default {
+			if seenDefault {
+				return fmt.Errorf("rule %d: only one default rule is allowed", i)
+			}
+			seenDefault = true
+			c.DefaultLimit = rule.Limit
+			c.DefaultWindow = window
+			continue
+		}
+
+		switch rule.Key {
+		case "tenant_id":
+			c.TenantLimit = rule.Limit
+			c.TenantWindow = window
+		case "remote_address+path":
+			c.IPPathLimit = rule.Limit
+			c.IPPathWindow = window
+		case "user_id+method":
+			c.UserWriteLimit = rule.Limit
+			c.UserWriteWindow = window
+		case "company_id+region":
+			c.CompanyRegionLimit = rule.Limit
+			c.CompanyRegionWindow = window
+		case "api_key+path":
+			c.APIKeyPathLimit = rule.Limit
+			c.APIKeyPathWindow = window
+		case "":
+			return fmt.Errorf("rule %d: key is required", i)
+		default:
+			// Other keys joined with "+" define a tuple rule, matched
+			// against descriptors carrying exactly those keys in order
+			if parts := strings.Split(rule.Key, "+"); len(parts) > 1 {
+				for _, part := range parts {
+					if part == "" {
+						return fmt.Errorf("rule %d: invalid tuple key %q", i, rule.Key)
+					}
+				}
+				c.Tuples[rule.Key] = KeyRule{Limit: rule.Limit, Window: window}
+				continue
+			}
+
+			// Any other key, built-in or custom, is limited on its own
+			c.Keys[rule.Key] = KeyRule{Limit: rule.Limit, Window: window}
+		}
+	}
+	return nil
+}
+
+// reloadConfig loads the config file and atomically swaps it in, so every
+// check sees either the old or the new configuration in full. The current
+// configuration is kept if the file fails to load.
+func (s *RateLimitServer) reloadConfig() error {
+	config, err := LoadConfig(s.configPath)
+	if err != nil {
+		configReloads.WithLabelValues("error").Inc()
+		return err
+	}
+
+	// The counting algorithm is chosen at startup and cannot be swapped live
+	current := s.config.Load()
+	if config.WindowMode != current.WindowMode {
+		s.logger.Warn("window mode change requires a restart, keeping current mode",
+			zap.String("current", string(current.WindowMode)),
+			zap.String("requested", string(config.WindowMode)),
+		)
+		config.setWindowMode(current.WindowMode)
+		if err := config.validateAlignment(); err != nil {
+			configReloads.WithLabelValues("error").Inc()
+			return err
+		}
+	}
+	if config.CountRejected != current.CountRejected {
+		s.logger.Warn("count_rejected change requires a restart, keeping current setting",
+			zap.Bool("current", current.CountRejected),
+			zap.Bool("requested", config.CountRejected),
+		)
+		config.setCountRejected(current.CountRejected)
+	}
+
+	old := s.config.Swap(config)
+	configReloads.WithLabelValues("success").Inc()
+	s.logger.Info("reloaded rate limit configuration",
+		zap.Any("old", old),
+		zap.Any("new", config),
+	)
+	config.checkEnvoyLimits(s.logger)
+
+	return nil
+}
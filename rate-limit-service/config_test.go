@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config := loadTestConfig(t, `
+window_mode: sliding
+failure_mode: open
+self_protection: true
+queue_saturation: 0.75
+rules:
+  - key: remote_address
+    limit: 50
+    unit: second
+  - key: company_id
+    limit: 1000000
+    unit: day
+  - key: remote_address+path
+    limit: 20
+    unit: second
+  - key: user_id+method
+    limit: 3
+    unit: hour
+  - key: company_id+region
+    limit: 400
+  - key: api_key
+    limit: 70
+  - key: api_key+path
+    limit: 7
+    unit: hour
+  - default: true
+    limit: 10
+`)
+	if config.WindowMode != SlidingWindow {
+		t.Errorf("window mode = %q, want sliding", config.WindowMode)
+	}
+	if config.FailureMode != FailOpen {
+		t.Errorf("failure mode = %q, want open", config.FailureMode)
+	}
+	if !config.SelfProtection || config.QueueSaturation != 0.75 {
+		t.Errorf("self-protection = %v at %v, want true at 0.75", config.SelfProtection, config.QueueSaturation)
+	}
+	want := map[string]KeyRule{
+		"remote_address": {Limit: 50, Window: time.Second},
+		"company_id":     {Limit: 1000000, Window: 24 * time.Hour},
+		"api_key":        {Limit: 70, Window: time.Minute},
+	}
+	for key, rule := range want {
+		if got := config.Keys[key]; got != rule {
+			t.Errorf("%s rule = %+v, want %+v", key, got, rule)
+		}
+	}
+	if config.IPPathLimit != 20 || config.IPPathWindow != time.Second {
+		t.Errorf("remote_address+path rule = %d per %v, want 20 per second", config.IPPathLimit, config.IPPathWindow)
+	}
+	if config.UserWriteLimit != 3 || config.UserWriteWindow != time.Hour {
+		t.Errorf("user_id+method rule = %d per %v, want 3 per hour", config.UserWriteLimit, config.UserWriteWindow)
+	}
+	if config.CompanyRegionLimit != 400 || config.CompanyRegionWindow != time.Minute {
+		t.Errorf("company_id+region rule = %d per %v, want 400 per minute", config.CompanyRegionLimit, config.CompanyRegionWindow)
+	}
+	if config.APIKeyPathLimit != 7 || config.APIKeyPathWindow != time.Hour {
+		t.Errorf("api_key+path rule = %d per %v, want 7 per hour", config.APIKeyPathLimit, config.APIKeyPathWindow)
+	}
+	if config.RefillRate != 0 || config.BurstCapacity != 0 {
+		t.Errorf("token bucket = %v per second up to %d, want both derived from the limits", config.RefillRate, config.BurstCapacity)
+	}
+	// Keys without a rule keep their default limit
+	if got := config.Keys["user_id"]; got != DefaultRateLimitConfig().Keys["user_id"] {
+		t.Errorf("user_id rule = %+v, want the default", got)
+	}
+	// The unit defaults to a minute
+	if config.DefaultLimit != 10 || config.DefaultWindow != time.Minute {
+		t.Errorf("default rule = %d per %v, want 10 per minute", config.DefaultLimit, config.DefaultWindow)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"rules": [{"key": "user_id", "limit": 7, "unit": "hour"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if got, want := config.Keys["user_id"], (KeyRule{Limit: 7, Window: time.Hour}); got != want {
+		t.Errorf("user_id rule = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(config, DefaultRateLimitConfig()) {
+		t.Errorf("missing file did not yield the default configuration")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string // Part of the error
+	}{
+		{name: "malformed", data: "rules: [", want: "failed to parse"},
+		{name: "zero limit", data: "rules:\n  - key: user_id\n    limit: 0\n", want: "limit must be positive"},
+		{name: "negative limit", data: "rules:\n  - key: user_id\n    limit: -5\n", want: "limit must be positive"},
+		{name: "unknown unit", data: "rules:\n  - key: user_id\n    limit: 5\n    unit: fortnight\n", want: `unknown unit "fortnight"`},
+		{name: "missing key", data: "rules:\n  - limit: 5\n", want: "key is required"},
+		{name: "two defaults", data: "rules:\n  - default: true\n    limit: 5\n  - default: true\n    limit: 6\n", want: "only one default rule"},
+		{name: "window mode", data: "window_mode: leaky\n", want: `invalid window_mode "leaky"`},
+		{name: "queue saturation", data: "queue_saturation: 1.5\n", want: "queue_saturation must be within (0, 1]"},
+		{name: "refill rate", data: "refill_rate: -1\n", want: "refill_rate must not be negative"},
+		{name: "burst capacity", data: "burst_capacity: -1\n", want: "burst_capacity must not be negative"},
+		{name: "failure mode", data: "failure_mode: ajar\n", want: `invalid failure_mode "ajar"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeTestConfig(t, tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfig error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfiguredWindowAndDefaultRule(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := loadTestConfig(t, `
+rules:
+  - key: remote_address
+    limit: 50
+    unit: second
+  - default: true
+    limit: 10
+    unit: hour
+`)
+	s := newTestServer(t, config, rdb)
+	check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+	check(t, s, "", descriptor("device_id", "d1"))
+
+	// Each descriptor is counted over the window of its rule
+	if ttl := mr.TTL("{ip:10.0.0.1}:w1000"); ttl != time.Second {
+		t.Errorf("remote_address TTL = %v, want 1s", ttl)
+	}
+	if ttl := mr.TTL("{device_id:d1}:w3600000"); ttl != time.Hour {
+		t.Errorf("default rule TTL = %v, want 1h", ttl)
+	}
+}
+
+// rewriteConfig replaces the server's configuration file and reloads it
+func rewriteConfig(t *testing.T, s *RateLimitServer, data string) {
+	t.Helper()
+	if err := os.WriteFile(s.configPath, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+}
+
+func TestReloadWindowChange(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	path := writeTestConfig(t, `
+rules:
+  - key: remote_address
+    limit: 2
+    unit: minute
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s := newTestServer(t, config, rdb)
+	s.configPath = path
+	ip := descriptor("remote_address", "10.0.0.1")
+	check(t, s, "", ip)
+
+	// The new window applies at once, in a fresh counter that carries its
+	// TTL, rather than in the counter of the old window
+	rewriteConfig(t, s, `
+rules:
+  - key: remote_address
+    limit: 2
+    unit: second
+`)
+	if got := check(t, s, "", ip); got != envoy.RateLimitResponse_OK {
+		t.Errorf("after window change got %v, want OK", got)
+	}
+	if got, _ := mr.Get("{ip:10.0.0.1}:w1000"); got != "1" {
+		t.Errorf("new counter = %q, want 1", got)
+	}
+	if ttl := mr.TTL("{ip:10.0.0.1}:w1000"); ttl <= 0 || ttl > time.Second {
+		t.Errorf("new counter TTL = %v, want (0, 1s]", ttl)
+	}
+	if ttl := mr.TTL("{ip:10.0.0.1}:w60000"); ttl <= time.Second {
+		t.Errorf("old counter TTL = %v, want it left to expire with its own window", ttl)
+	}
+}
+
+func TestReloadAppliesNewLimits(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	path := writeTestConfig(t, "rules:\n  - key: user_id\n    limit: 1\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s := newTestServer(t, config, rdb)
+	s.configPath = path
+
+	// The watcher picks up the rewritten file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchConfig(ctx, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // Let the watcher record the file's current time
+	if err := os.WriteFile(path, []byte("rules:\n  - key: user_id\n    limit: 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.config.Load().Keys["user_id"].Limit != 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration was not reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	path := writeTestConfig(t, "rules:\n  - key: user_id\n    limit: 1\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s := newTestServer(t, config, rdb)
+	s.configPath = path
+
+	if err := os.WriteFile(path, []byte("rules:\n  - key: user_id\n    limit: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadConfig(); err == nil {
+		t.Fatal("reloadConfig accepted an invalid file")
+	}
+	if s.config.Load() != config {
+		t.Error("an invalid file replaced the current configuration")
+	}
+}
+
+func TestReloadKeepsWindowMode(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	path := writeTestConfig(t, "window_mode: fixed\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	s := newTestServer(t, config, rdb)
+	s.configPath = path
+
+	// The counting algorithm only changes with a restart
+	rewriteConfig(t, s, "window_mode: sliding\nrules:\n  - key: user_id\n    limit: 5\n")
+	if got := s.config.Load(); got.WindowMode != FixedWindow || got.Keys["user_id"].Limit != 5 {
+		t.Errorf("reloaded config has mode %q and user limit %d, want fixed and 5", got.WindowMode, got.Keys["user_id"].Limit)
+	}
+}
+
+func TestReloadNoTornReads(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	// Every limit in a file is the same, so a snapshot mixing two files
+	// would carry different limits
+	configs := make([]string, 2)
+	for i, limit := range []int{10, 20} {
+		configs[i] = writeTestConfig(t, fmt.Sprintf(`
+failure_mode: %s
+rules:
+  - key: remote_address
+    limit: %[2]d
+    unit: minute
+  - key: user_id
+    limit: %[2]d
+    unit: minute
+  - key: company_id
+    limit: %[2]d
+    unit: minute
+`, []string{"open", "closed"}[i], limit))
+	}
+	s := newTestServer(t, loadTestConfig(t, "rules: []"), rdb)
+	s.configPath = configs[0]
+	if err := s.reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				config := s.config.Load()
+				ip, user, company := config.Keys["remote_address"].Limit, config.Keys["user_id"].Limit, config.Keys["company_id"].Limit
+				want := map[int64]FailureMode{10: FailOpen, 20: FailClosed}[ip]
+				if user != ip || company != ip || config.FailureMode != want {
+					t.Errorf("torn read: ip %d, user %d, company %d, failure mode %s", ip, user, company, config.FailureMode)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		s.configPath = configs[i%2]
+		if err := s.reloadConfig(); err != nil {
+			t.Errorf("reloadConfig: %v", err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestLoadConfigTokenBucket(t *testing.T) {
+	config := loadTestConfig(t, "window_mode: token_bucket\nrefill_rate: 2.5\nburst_capacity: 40\n")
+	if config.WindowMode != TokenBucket || config.RefillRate != 2.5 || config.BurstCapacity != 40 {
+		t.Errorf("config = %s refilling %v per second up to %d, want token_bucket refilling 2.5 up to 40",
+			config.WindowMode, config.RefillRate, config.BurstCapacity)
+	}
+}
+
+func TestTupleRule(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, `
+rules:
+  - key: company_id
+    limit: 10
+    unit: minute
+  - key: user_id
+    limit: 10
+    unit: minute
+  - key: company_id+user_id
+    limit: 2
+    unit: minute
+`), rdb)
+	tuple := descriptor("company_id", "acme", "user_id", "123")
+
+	// The pair has its own limit, tripping well before either key's
+	if got := admitted(t, s, 4, "", tuple); got != 2 {
+		t.Errorf("tuple allowed %d of 4, want 2", got)
+	}
+	if got := admitted(t, s, 4, "", descriptor("company_id", "acme")); got != 4 {
+		t.Errorf("company allowed %d of 4, want 4", got)
+	}
+	if got := admitted(t, s, 4, "", descriptor("user_id", "123")); got != 4 {
+		t.Errorf("user allowed %d of 4, want 4", got)
+	}
+	// Another user of the same company gets a tuple counter of their own
+	if got := admitted(t, s, 2, "", descriptor("company_id", "acme", "user_id", "456")); got != 2 {
+		t.Errorf("second user allowed %d of 2, want 2", got)
+	}
+
+	// Every part of the tuple is inside one cluster hash tag
+	if !mr.Exists(windowedKey("{company_id:acme|user_id:123}", time.Minute)) {
+		t.Errorf("tuple counter missing from %v", mr.Keys())
+	}
+}
+
+func TestCustomKeyRule(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, `
+rules:
+  - key: header.x-region
+    limit: 2
+    unit: minute
+`), rdb)
+
+	// A key the service has no built-in handling for is limited by its rule
+	if got := allowed(t, s, 4, "", descriptor("header.x-region", "eu")); got != 2 {
+		t.Errorf("custom key allowed %d of 4, want 2", got)
+	}
+	if !mr.Exists(windowedKey("{header.x-region:eu}", time.Minute)) {
+		t.Errorf("custom key counter missing from %v", mr.Keys())
+	}
+}
+
+func TestUnknownKeyWithoutDefault(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, `
+rules:
+  - key: company_id
+    limit: 2
+    unit: minute
+`), rdb)
+
+	// Descriptors without a rule are skipped, never counted
+	if got := allowed(t, s, 4, "", descriptor("header.x-region", "eu")); got != 4 {
+		t.Errorf("unknown key allowed %d of 4, want 4", got)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("unknown key wrote %v, want no keys", keys)
+	}
+}
+
+func TestUnknownKeyWithDefault(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, `
+rules:
+  - key: company_id
+    limit: 5
+    unit: minute
+  - default: true
+    limit: 3
+    unit: hour
+`), rdb)
+
+	// The default rule limits descriptors without a rule of their own, but
+	// not those with one
+	if got := allowed(t, s, 5, "", descriptor("header.x-region", "eu")); got != 3 {
+		t.Errorf("unknown key allowed %d of 5, want 3", got)
+	}
+	if !mr.Exists(windowedKey("{header.x-region:eu}", time.Hour)) {
+		t.Errorf("default rule counter missing from %v", mr.Keys())
+	}
+	if got := allowed(t, s, 5, "", descriptor("company_id", "acme")); got != 5 {
+		t.Errorf("configured key allowed %d of 5, want 5", got)
+	}
+}
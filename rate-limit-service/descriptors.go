@@ -0,0 +1,42 @@
+package main
+
+import (
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tooManyDescriptorRequests tracks requests carrying more descriptors than
+// MaxDescriptors, labeled by the policy applied to them
+var tooManyDescriptorRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_too_many_descriptors_total",
+		Help: "Total number of requests carrying more descriptors than allowed",
+	},
+	[]string{"policy"},
+)
+
+// validTooManyDescriptorsPolicy reports whether p can be applied to requests
+// carrying too many descriptors. Skipping the extra descriptors would let a
+// client choose which ones are counted, so DescriptorAllow is not accepted.
+func validTooManyDescriptorsPolicy(p DescriptorPolicy) bool {
+	return p == DescriptorDeny || p == DescriptorError
+}
+
+// checkDescriptorCount bounds the number of descriptors, and so of counters,
+// a request can have checked. For a request carrying more than MaxDescriptors
+// it returns an InvalidArgument error under DescriptorError, or a response
+// rejecting every descriptor under DescriptorDeny; other requests get
+// neither.
+func (c *RateLimitConfig) checkDescriptorCount(n int) (*envoy.RateLimitResponse, error) {
+	if c.MaxDescriptors <= 0 || n <= c.MaxDescriptors {
+		return nil, nil
+	}
+	tooManyDescriptorRequests.WithLabelValues(string(c.TooManyDescriptors)).Inc()
+	if c.TooManyDescriptors == DescriptorDeny {
+		return overLimitResponse(n), nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "request carries %d descriptors, more than the %d allowed", n, c.MaxDescriptors)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxDescriptorsConfig allows 3 descriptors a request under the given
+// policy
+const maxDescriptorsConfig = `
+max_descriptors: 3
+too_many_descriptors: %s
+rules:
+  - key: remote_address
+    limit: 100
+    unit: minute
+`
+
+// ipDescriptors returns n descriptors of distinct addresses
+func ipDescriptors(n int) []*ratelimit.RateLimitDescriptor {
+	descriptors := make([]*ratelimit.RateLimitDescriptor, n)
+	for i := range descriptors {
+		descriptors[i] = descriptor("remote_address", fmt.Sprintf("10.0.0.%d", i+1))
+	}
+	return descriptors
+}
+
+func TestMaxDescriptors(t *testing.T) {
+	tests := []struct {
+		policy DescriptorPolicy
+		code   codes.Code                   // gRPC status of a request above the limit
+		result envoy.RateLimitResponse_Code // Decision for a request above the limit
+	}{
+		{policy: DescriptorError, code: codes.InvalidArgument},
+		{policy: DescriptorDeny, code: codes.OK, result: envoy.RateLimitResponse_OVER_LIMIT},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rdb, mr := newTestRedis(t)
+			s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(maxDescriptorsConfig, tt.policy)), rdb)
+			rejected := testutil.ToFloat64(tooManyDescriptorRequests.WithLabelValues(string(tt.policy)))
+
+			// A request at the limit is checked as usual
+			if response := shouldRateLimit(t, s, "", ipDescriptors(3)...); response.OverallCode != envoy.RateLimitResponse_OK {
+				t.Errorf("request with 3 descriptors got %v, want OK", response.OverallCode)
+			}
+			if got := testutil.ToFloat64(tooManyDescriptorRequests.WithLabelValues(string(tt.policy))) - rejected; got != 0 {
+				t.Errorf("request at the limit counted %v times, want 0", got)
+			}
+
+			// One above it is rejected without touching Redis
+			commands := mr.CommandCount()
+			response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{Descriptors: ipDescriptors(4)})
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("request with 4 descriptors failed with %v, want %v", got, tt.code)
+			}
+			if err == nil && response.OverallCode != tt.result {
+				t.Errorf("request with 4 descriptors got %v, want %v", response.OverallCode, tt.result)
+			}
+			if got := mr.CommandCount() - commands; got != 0 {
+				t.Errorf("rejected request sent %d commands to Redis, want 0", got)
+			}
+			if got := testutil.ToFloat64(tooManyDescriptorRequests.WithLabelValues(string(tt.policy))) - rejected; got != 1 {
+				t.Errorf("request above the limit counted %v times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMaxDescriptorsDryRun(t *testing.T) {
+	for _, policy := range []DescriptorPolicy{DescriptorError, DescriptorDeny} {
+		t.Run(string(policy), func(t *testing.T) {
+			rdb, _ := newTestRedis(t)
+			s := newTestServer(t, loadTestConfig(t, "dry_run: true\n"+fmt.Sprintf(maxDescriptorsConfig, policy)), rdb)
+
+			// The request is allowed, but the rejection of each of its
+			// descriptors is counted
+			shadow := shadowRejections.WithLabelValues("remote_address")
+			before := testutil.ToFloat64(shadow)
+			response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{Descriptors: ipDescriptors(4)})
+			if err != nil {
+				t.Fatalf("request with 4 descriptors failed in dry run: %v", err)
+			}
+			if response.OverallCode != envoy.RateLimitResponse_OK {
+				t.Errorf("request with 4 descriptors got %v in dry run, want OK", response.OverallCode)
+			}
+			if got := testutil.ToFloat64(shadow) - before; got != 4 {
+				t.Errorf("shadow rejections increased by %v, want 4", got)
+			}
+		})
+	}
+}
+
+func TestMaxDescriptorsInvalid(t *testing.T) {
+	for _, config := range []string{
+		fmt.Sprintf(maxDescriptorsConfig, DescriptorAllow),
+		"max_descriptors: -1\nrules: []\n",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, config)); err == nil {
+			t.Errorf("LoadConfig accepted:\n%s", config)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DomainAction selects how requests for a domain without its own rules are
+// handled once some domains have rules
+type DomainAction string
+
+const (
+	// DomainDefault applies the shared rules to requests for unlisted
+	// domains
+	DomainDefault DomainAction = "default"
+
+	// DomainReject rejects requests for unlisted domains
+	DomainReject DomainAction = "reject"
+)
+
+// unknownDomainRequests tracks requests whose domain has no rules of its
+// own, labeled by the action taken
+var unknownDomainRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_unknown_domain_total",
+		Help: "Total number of requests for a domain without its own rules",
+	},
+	[]string{"action"},
+)
+
+// domainFile holds the rules of one request domain in a configuration file
+type domainFile struct {
+	Rules []DescriptorRule `yaml:"rules" json:"rules"` // Rules overriding the shared ones for this domain
+}
+
+// validDomain matches the domain names accepted in a configuration file.
+// Domains become part of counter keys, so separators are not allowed.
+var validDomain = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// withDomain returns a copy of the configuration scoped to domain, on which
+// the domain's own rules are then applied
+func (c *RateLimitConfig) withDomain(domain string) *RateLimitConfig {
+	scoped := *c
+	scoped.Keys = maps.Clone(c.Keys)
+	scoped.Tuples = maps.Clone(c.Tuples)
+	scoped.Domain = domain
+	scoped.Domains = nil
+	return &scoped
+}
+
+// loadDomains builds the configuration of each domain in the file from the
+// shared rules and the domain's own
+func (c *RateLimitConfig) loadDomains(file configFile) error {
+	if file.UnknownDomains != "" {
+		c.UnknownDomains = file.UnknownDomains
+	}
+	switch c.UnknownDomains {
+	case DomainDefault:
+	case DomainReject:
+		if len(file.Domains) == 0 {
+			return fmt.Errorf("unknown_domains %q requires at least one domain", DomainReject)
+		}
+	default:
+		return fmt.Errorf("invalid unknown_domains %q", c.UnknownDomains)
+	}
+
+	c.Domains = make(map[string]*RateLimitConfig, len(file.Domains))
+	for name, domain := range file.Domains {
+		if !validDomain.MatchString(name) {
+			return fmt.Errorf("invalid domain name %q", name)
+		}
+		scoped := c.withDomain(name)
+		if err := scoped.applyRules(domain.Rules); err != nil {
+			return fmt.Errorf("domain %s: %v", name, err)
+		}
+		c.Domains[name] = scoped
+	}
+	return nil
+}
+
+// forDomain returns the configuration for requests in domain: the domain's
+// own if it has rules, otherwise the shared one. It returns false when the
+// domain has no rules and unknown domains are rejected.
+func (c *RateLimitConfig) forDomain(domain string) (*RateLimitConfig, bool) {
+	if scoped, ok := c.Domains[domain]; ok {
+		return scoped, true
+	}
+	if len(c.Domains) == 0 {
+		return c, true
+	}
+	if c.UnknownDomains == DomainReject {
+		unknownDomainRequests.WithLabelValues("reject").Inc()
+		return c, false
+	}
+	unknownDomainRequests.WithLabelValues("default").Inc()
+	return c, true
+}
+
+// scopeKey scopes a counter key to the configuration's domain, so a domain
+// with its own rules never shares counters with the shared rules or with
+// another domain. Keys counted under the shared rules are left unchanged.
+func (c *RateLimitConfig) scopeKey(key string) string {
+	if c.Domain == "" {
+		return key
+	}
+	return key + ":domain:" + c.Domain
+}
+
+// setWindowMode sets the counting algorithm of the configuration and of
+// every domain derived from it
+func (c *RateLimitConfig) setWindowMode(mode WindowMode) {
+	c.WindowMode = mode
+	for _, scoped := range c.Domains {
+		scoped.WindowMode = mode
+	}
+}
+
+// setCountRejected sets whether rejected hits are counted, for the
+// configuration and every domain derived from it
+func (c *RateLimitConfig) setCountRejected(countRejected bool) {
+	c.CountRejected = countRejected
+	for _, scoped := range c.Domains {
+		scoped.CountRejected = countRejected
+	}
+}
+
+// overLimitResponse rejects every one of n descriptors
+func overLimitResponse(n int) *envoy.RateLimitResponse {
+	response := &envoy.RateLimitResponse{OverallCode: envoy.RateLimitResponse_OVER_LIMIT}
+	for range n {
+		response.Statuses = append(response.Statuses, &envoy.RateLimitResponse_DescriptorStatus{
+			Code: envoy.RateLimitResponse_OVER_LIMIT,
+		})
+	}
+	return response
+}
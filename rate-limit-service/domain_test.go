@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatewayConfig gives the ingress and egress gateways their own limit
+// tables for the same descriptor key
+const gatewayConfig = `
+unknown_domains: %s
+rules:
+  - key: remote_address
+    limit: 10
+    unit: minute
+domains:
+  ingress:
+    rules:
+      - key: remote_address
+        limit: 2
+        unit: minute
+  egress:
+    rules:
+      - key: remote_address
+        limit: 5
+        unit: minute
+`
+
+func TestDomainTables(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(gatewayConfig, "default")), rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+
+	// Identical descriptors get the decisions of their gateway's table
+	if got := allowed(t, s, 4, "ingress", ip); got != 2 {
+		t.Errorf("ingress allowed %d of 4, want 2", got)
+	}
+	if got := allowed(t, s, 7, "egress", ip); got != 5 {
+		t.Errorf("egress allowed %d of 7, want 5", got)
+	}
+	// Unlisted domains fall back to the shared table
+	if got := allowed(t, s, 12, "mesh", ip); got != 10 {
+		t.Errorf("unlisted domain allowed %d of 12, want 10", got)
+	}
+}
+
+func TestDomainTablesRejectUnknown(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(gatewayConfig, "reject")), rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+
+	if got := check(t, s, "mesh", ip); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("unlisted domain got %v, want OVER_LIMIT", got)
+	}
+	if got := check(t, s, "ingress", ip); got != envoy.RateLimitResponse_OK {
+		t.Errorf("ingress got %v, want OK", got)
+	}
+}
+
+func TestDomainTablesRejectUnknownDryRun(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, "dry_run: true\n"+fmt.Sprintf(gatewayConfig, "reject")), rdb)
+
+	// The unlisted domain is allowed, but the rejection it would have had
+	// is counted
+	shadow := shadowRejections.WithLabelValues("remote_address")
+	before := testutil.ToFloat64(shadow)
+	if got := check(t, s, "mesh", descriptor("remote_address", "10.0.0.1")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("unlisted domain got %v in dry run, want OK", got)
+	}
+	if got := testutil.ToFloat64(shadow) - before; got != 1 {
+		t.Errorf("shadow rejections increased by %v, want 1", got)
+	}
+}
+
+func TestDomainCountersScoped(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(gatewayConfig, "default")), rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+	check(t, s, "ingress", ip)
+	check(t, s, "egress", ip)
+	check(t, s, "mesh", ip)
+
+	// Domains with their own rules count under their own keys; others share
+	// the unscoped counter
+	base := s.buildKey("ip", "10.0.0.1")
+	for _, key := range []string{base + ":domain:ingress:w60000", base + ":domain:egress:w60000", base + ":w60000"} {
+		if got, _ := mr.Get(key); got != "1" {
+			t.Errorf("%s = %q, want 1", key, got)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 3 {
+		t.Errorf("redis keys = %v, want 3 counters", keys)
+	}
+}
+
+func TestAdminGetLimitInDomain(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(gatewayConfig, "default")), rdb)
+	check(t, s, "ingress", descriptor("remote_address", "10.0.0.1"))
+
+	// The limit reported is the one of the domain the key was counted in
+	rec := adminRequest(t, s, http.MethodGet, limitPath("{ip:10.0.0.1}:domain:ingress:w60000"), "")
+	var got limitStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if got.Count != 1 || got.Limit != 2 {
+		t.Errorf("limit = %+v, want a count of 1 against ingress's limit of 2", got)
+	}
+	if limit := s.config.Load().limitForKey("{ip:10.0.0.1}:domain:mesh:w60000"); limit != 0 {
+		t.Errorf("limit of a key in an unlisted domain = %d, want 0", limit)
+	}
+}
+
+func TestLoadDomainsInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"an invalid domain name": `
+domains:
+  "in:gress":
+    rules:
+      - key: remote_address
+        limit: 2
+        unit: minute
+`,
+		"reject but no domains": `
+unknown_domains: reject
+`,
+		"an unknown action": fmt.Sprintf(gatewayConfig, "ignore"),
+		"an invalid domain rule": `
+domains:
+  ingress:
+    rules:
+      - key: remote_address
+        limit: 2
+        unit: fortnight
+`,
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, data)); err == nil {
+			t.Errorf("LoadConfig accepted a config with %s", name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// selfDegraded tracks requests handed back to Envoy because the service
+// itself was degraded, labeled by the reason
+var selfDegraded = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_self_degraded_total",
+		Help: "Total number of requests rejected with Unavailable because the service was degraded",
+	},
+	[]string{"reason"},
+)
+
+// servingStatus reports the status served by the gRPC health service:
+// 1 while SERVING, 0 otherwise
+var servingStatus = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "rate_limit_serving_status",
+		Help: "Whether the gRPC health service reports SERVING (1) or NOT_SERVING (0)",
+	},
+)
+
+// healthCheckInterval is how often Redis is pinged to update the health status
+const healthCheckInterval = 5 * time.Second
+
+// setServingStatus updates the health service for all services and the
+// serving status gauge
+func setServingStatus(hs *health.Server, serving bool) {
+	if serving {
+		hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		servingStatus.Set(1)
+		return
+	}
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	servingStatus.Set(0)
+}
+
+// watchRedisHealth pings Redis every interval and reports the service as
+// NOT_SERVING while the ping fails, until ctx is cancelled
+func (s *RateLimitServer) watchRedisHealth(ctx context.Context, hs *health.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	serving := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := s.redis.Ping(pingCtx).Err()
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if (err == nil) == serving {
+			continue
+		}
+		serving = err == nil
+		setServingStatus(hs, serving)
+		if serving {
+			s.logger.Info("redis reachable again, reporting SERVING")
+		} else {
+			redisErrors.WithLabelValues("health_ping").Inc()
+			s.logger.Warn("redis unreachable, reporting NOT_SERVING",
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// checkSelfHealth returns an Unavailable error when self-protection is
+// enabled and the server is internally degraded. Envoy treats the error as
+// a rate limit service failure and applies its own fallback (local rate
+// limiting or failure_mode_deny) instead of trusting a degraded decision.
+func (s *RateLimitServer) checkSelfHealth(config *RateLimitConfig) error {
+	if !config.SelfProtection {
+		return nil
+	}
+
+	reason := s.degradedReason(config.QueueSaturation)
+	if reason == "" {
+		return nil
+	}
+
+	selfDegraded.WithLabelValues(reason).Inc()
+	s.logger.Warn("rate limit service degraded, deferring to Envoy fallback",
+		zap.String("reason", reason),
+	)
+	return status.Errorf(codes.Unavailable, "rate limit service degraded: %s", reason)
+}
+
+// degradedReason reports why the server is internally degraded, or an
+// empty string when it is healthy
+func (s *RateLimitServer) degradedReason(saturation float64) string {
+	if queueSaturated(len(s.updateQueue), cap(s.updateQueue), saturation) {
+		return "update_queue_saturated"
+	}
+	// Checked without taking the half-open probe, which is left to a
+	// request that contacts Redis
+	if s.breaker.refusing() {
+		return "redis_breaker_open"
+	}
+	return ""
+}
+
+// queueSaturated reports whether a queue is filled to at least the given ratio
+func queueSaturated(length, capacity int, saturation float64) bool {
+	return capacity > 0 && float64(length) >= saturation*float64(capacity)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// shouldRateLimitCode returns the gRPC code of the error from checking an IP
+func shouldRateLimitCode(s *RateLimitServer) codes.Code {
+	_, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	})
+	return status.Code(err)
+}
+
+func TestSelfProtectionQueueSaturated(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.SelfProtection = true
+	config.QueueSaturation = 0.5
+	s := newTestServer(t, config, rdb)
+	s.updateQueue = make(chan *counterUpdate, 4)
+
+	s.updateQueue <- &counterUpdate{}
+	if got := shouldRateLimitCode(s); got != codes.OK {
+		t.Fatalf("below saturation got %v, want OK", got)
+	}
+
+	before := testutil.ToFloat64(selfDegraded.WithLabelValues("update_queue_saturated"))
+	s.updateQueue <- &counterUpdate{}
+	if got := shouldRateLimitCode(s); got != codes.Unavailable {
+		t.Errorf("saturated queue got %v, want Unavailable", got)
+	}
+	if got := testutil.ToFloat64(selfDegraded.WithLabelValues("update_queue_saturated")) - before; got != 1 {
+		t.Errorf("update_queue_saturated increased by %v, want 1", got)
+	}
+
+	// Disabled, the server decides regardless of its queue
+	config.SelfProtection = false
+	if got := shouldRateLimitCode(s); got != codes.OK {
+		t.Errorf("self-protection disabled got %v, want OK", got)
+	}
+}
+
+func TestSelfProtectionBreakerOpen(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.SelfProtection = true
+	s := newTestServer(t, config, rdb)
+	s.breaker = newCircuitBreaker(BreakerOptions{FailureThreshold: 1, Cooldown: 50 * time.Millisecond}, zap.NewNop())
+
+	s.breaker.record(errors.New("connection refused"))
+	if got := shouldRateLimitCode(s); got != codes.Unavailable {
+		t.Errorf("breaker open got %v, want Unavailable", got)
+	}
+
+	// Once the cooldown has passed, the check itself probes Redis and
+	// closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	if got := shouldRateLimitCode(s); got != codes.OK {
+		t.Errorf("after cooldown got %v, want OK", got)
+	}
+	if s.breaker.refusing() {
+		t.Error("breaker still refusing after a successful probe")
+	}
+}
+
+// waitForStatus polls the health service until it reports want
+func waitForStatus(t *testing.T, client healthpb.HealthClient, want healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		response, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if response.Status == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health status = %v, want %v", response.Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthTracksRedis(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, hs)
+	go grpcServer.Serve(ln)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := healthpb.NewHealthClient(conn)
+
+	setServingStatus(hs, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watchRedisHealth(ctx, hs, 20*time.Millisecond)
+	waitForStatus(t, client, healthpb.HealthCheckResponse_SERVING)
+
+	// Unreachable Redis takes the service out of rotation
+	mr.SetError("connection refused")
+	waitForStatus(t, client, healthpb.HealthCheckResponse_NOT_SERVING)
+	if got := testutil.ToFloat64(servingStatus); got != 0 {
+		t.Errorf("serving status gauge = %v, want 0", got)
+	}
+
+	// and puts it back once Redis recovers
+	mr.SetError("")
+	waitForStatus(t, client, healthpb.HealthCheckResponse_SERVING)
+	if got := testutil.ToFloat64(servingStatus); got != 1 {
+		t.Errorf("serving status gauge = %v, want 1", got)
+	}
+}
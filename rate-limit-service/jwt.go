@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// tokenChecks counts requests whose bearer token was checked, labeled by
+// the result: valid, missing or invalid
+var tokenChecks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_token_checks_total",
+		Help: "Total number of requests whose bearer token was checked, by result",
+	},
+	[]string{"result"},
+)
+
+// trustedClaims are the JWT claims that replace the descriptor entries of
+// the same key once the token is verified
+var trustedClaims = []string{"company_id", "user_id"}
+
+// errNoToken is returned when a request carries no bearer token
+var errNoToken = errors.New("no bearer token")
+
+const (
+	// defaultJWKSTTL is how often the JWKS is fetched again to pick up
+	// rotated keys, unless JWT_JWKS_TTL says otherwise
+	defaultJWKSTTL = 5 * time.Minute
+
+	// jwksMinRefreshInterval is the minimum time between two fetches of the
+	// JWKS triggered by tokens with an unknown key ID, so tokens with made-up
+	// key IDs cannot flood the identity provider
+	jwksMinRefreshInterval = 30 * time.Second
+
+	// jwksFetchTimeout bounds a single JWKS fetch
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// tokenVerifier validates the bearer token of a rate limit request and
+// derives descriptor values from its claims, so clients cannot choose the
+// company or user their requests are counted against
+type tokenVerifier struct {
+	keyfunc jwt.Keyfunc               // Returns the key verifying a token
+	parser  *jwt.Parser               // Parser restricted to the accepted algorithms and claims
+	logger  *zap.Logger               // Structured logger
+	keysMu  sync.RWMutex              // Guards keys
+	keys    map[string]*rsa.PublicKey // JWKS keys by key ID
+
+	jwksURL     string     // JWKS endpoint
+	refreshMu   sync.Mutex // Serializes fetches for unknown key IDs and guards lastRefresh
+	lastRefresh time.Time  // When the JWKS was last fetched for an unknown key ID
+}
+
+// newTokenVerifier builds a verifier from the environment, or returns nil
+// when token verification is disabled:
+//   - JWT_HMAC_SECRET: verify HS256 tokens with a shared secret
+//   - JWT_JWKS_URL: verify RS256 tokens with the keys published at a JWKS
+//     endpoint, refreshed every JWT_JWKS_TTL (default 5m) until ctx is
+//     cancelled, and at most every jwksMinRefreshInterval when a token
+//     names a key ID the verifier does not know
+//   - JWT_ISSUER, JWT_AUDIENCE: optionally required iss and aud claims
+//
+// A JWKS that cannot be fetched at startup does not fail it: tokens are
+// rejected as invalid, and so handled per the failure mode, until a fetch
+// succeeds.
+func newTokenVerifier(ctx context.Context, logger *zap.Logger) (*tokenVerifier, error) {
+	secret := os.Getenv("JWT_HMAC_SECRET")
+	jwksURL := os.Getenv("JWT_JWKS_URL")
+	if secret == "" && jwksURL == "" {
+		return nil, nil
+	}
+	if secret != "" && jwksURL != "" {
+		return nil, fmt.Errorf("JWT_HMAC_SECRET and JWT_JWKS_URL are mutually exclusive")
+	}
+
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	v := &tokenVerifier{logger: logger}
+	if secret != "" {
+		v.parser = jwt.NewParser(append(opts, jwt.WithValidMethods([]string{"HS256"}))...)
+		v.keyfunc = func(*jwt.Token) (interface{}, error) {
+			return []byte(secret), nil
+		}
+		return v, nil
+	}
+
+	ttl, err := durationEnv("JWT_JWKS_TTL", defaultJWKSTTL)
+	if err != nil {
+		return nil, err
+	}
+	v.parser = jwt.NewParser(append(opts, jwt.WithValidMethods([]string{"RS256"}))...)
+	v.keyfunc = v.jwksKey
+	v.jwksURL = jwksURL
+	if err := v.refreshKeys(ctx); err != nil {
+		logger.Error("failed to fetch JWKS, rejecting tokens until it is fetched",
+			zap.Error(err),
+			zap.String("url", jwksURL),
+		)
+	}
+	go v.watchKeys(ctx, ttl)
+	return v, nil
+}
+
+// verify parses and validates the bearer token in the request's incoming
+// metadata and returns its claims
+func (v *tokenVerifier) verify(ctx context.Context) (jwt.MapClaims, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, errNoToken
+	}
+	raw, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || raw == "" {
+		return nil, errNoToken
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.keyfunc); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// applyClaims replaces the company_id and user_id entries of every
+// descriptor with the token's claims. A trusted claim that no descriptor
+// carries is added as a descriptor of its own, and entries whose claim is
+// missing from the token are removed, so only verified values are counted.
+// With nil claims, as for a request without a valid token, every such
+// entry is removed.
+func applyClaims(descriptors []*ratelimit.RateLimitDescriptor, claims jwt.MapClaims) []*ratelimit.RateLimitDescriptor {
+	trusted := make(map[string]string, len(trustedClaims))
+	for _, key := range trustedClaims {
+		if value, ok := claims[key]; ok && fmt.Sprint(value) != "" {
+			trusted[key] = fmt.Sprint(value)
+		}
+	}
+
+	seen := make(map[string]bool, len(trustedClaims))
+	for _, descriptor := range descriptors {
+		entries := descriptor.Entries[:0]
+		for _, entry := range descriptor.Entries {
+			if !isTrustedClaim(entry.Key) {
+				entries = append(entries, entry)
+				continue
+			}
+			if value, ok := trusted[entry.Key]; ok {
+				entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: entry.Key, Value: value})
+				seen[entry.Key] = true
+			}
+		}
+		descriptor.Entries = entries
+	}
+
+	for _, key := range trustedClaims {
+		if value, ok := trusted[key]; ok && !seen[key] {
+			descriptors = append(descriptors, &ratelimit.RateLimitDescriptor{
+				Entries: []*ratelimit.RateLimitDescriptor_Entry{{Key: key, Value: value}},
+			})
+		}
+	}
+	return descriptors
+}
+
+// isTrustedClaim reports whether a descriptor key is derived from the token
+func isTrustedClaim(key string) bool {
+	for _, claim := range trustedClaims {
+		if key == claim {
+			return true
+		}
+	}
+	return false
+}
+
+// jwksKey returns the JWKS key matching the token's kid, fetching the JWKS
+// again if the key is unknown, as the identity provider may have rotated
+// its keys since the last fetch
+func (v *tokenVerifier) jwksKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.key(kid); ok {
+		return key, nil
+	}
+
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+
+	// Another request may have fetched the key while this one waited
+	if key, ok := v.key(kid); ok {
+		return key, nil
+	}
+	if time.Since(v.lastRefresh) < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	v.lastRefresh = time.Now()
+	if err := v.refreshKeys(context.Background()); err != nil {
+		v.logger.Error("failed to refresh JWKS for unknown key id",
+			zap.Error(err),
+			zap.String("kid", kid),
+		)
+	}
+	if key, ok := v.key(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// key returns the JWKS key with the given ID
+func (v *tokenVerifier) key(kid string) (*rsa.PublicKey, bool) {
+	v.keysMu.RLock()
+	defer v.keysMu.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// watchKeys refetches the JWKS every interval until ctx is cancelled,
+// keeping the previous keys when a fetch fails
+func (v *tokenVerifier) watchKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := v.refreshKeys(ctx); err != nil {
+			v.logger.Error("failed to refresh JWKS, keeping previous keys",
+				zap.Error(err),
+				zap.String("url", v.jwksURL),
+			)
+		}
+	}
+}
+
+// jwks is a JSON Web Key Set; only RSA keys are used
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"` // Key type
+		Kid string `json:"kid"` // Key ID matched against the token header
+		N   string `json:"n"`   // RSA modulus, base64url encoded
+		E   string `json:"e"`   // RSA exponent, base64url encoded
+	} `json:"keys"`
+}
+
+// refreshKeys fetches the JWKS and replaces the verifier's keys
+func (v *tokenVerifier) refreshKeys(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS URL: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus for key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent for key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS contains no RSA keys")
+	}
+
+	v.keysMu.Lock()
+	v.keys = keys
+	v.keysMu.Unlock()
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// testJWTSecret is the HS256 secret shared by the tests' issuer and verifier
+const testJWTSecret = "jwt-test-secret"
+
+// newHMACVerifier returns a verifier of HS256 tokens signed with testJWTSecret
+func newHMACVerifier(t *testing.T) *tokenVerifier {
+	t.Helper()
+	t.Setenv("JWT_HMAC_SECRET", testJWTSecret)
+	t.Setenv("JWT_JWKS_URL", "")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	v, err := newTokenVerifier(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("newTokenVerifier: %v", err)
+	}
+	return v
+}
+
+// signHS256 signs claims with testJWTSecret
+func signHS256(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// checkWithToken sends a request carrying token as its bearer token
+func checkWithToken(t *testing.T, s *RateLimitServer, token string, descriptors ...*ratelimit.RateLimitDescriptor) envoy.RateLimitResponse_Code {
+	t.Helper()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	response, err := s.ShouldRateLimit(ctx, &envoy.RateLimitRequest{Descriptors: descriptors})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	return response.OverallCode
+}
+
+// allowedWithToken sends n requests carrying token and returns how many
+// were allowed
+func allowedWithToken(t *testing.T, s *RateLimitServer, n int, token string, descriptors ...*ratelimit.RateLimitDescriptor) int {
+	t.Helper()
+	var ok int
+	for i := 0; i < n; i++ {
+		if checkWithToken(t, s, token, descriptors...) == envoy.RateLimitResponse_OK {
+			ok++
+		}
+	}
+	return ok
+}
+
+// newJWTTestServer returns a server verifying HS256 tokens and limiting
+// companies to 2 requests a minute
+func newJWTTestServer(t *testing.T, mode FailureMode) *RateLimitServer {
+	t.Helper()
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 2, Window: time.Minute}
+	config.FailureMode = mode
+	s := newTestServer(t, config, rdb)
+	s.tokens = newHMACVerifier(t)
+	return s
+}
+
+func TestValidTokenOverridesDescriptors(t *testing.T) {
+	s := newJWTTestServer(t, FailClosed)
+	token := signHS256(t, jwt.MapClaims{"company_id": "acme", "exp": time.Now().Add(time.Hour).Unix()})
+
+	// Whatever company the client claims, requests count against the
+	// token's company
+	var ok int
+	for _, spoofed := range []string{"acme", "other", "another"} {
+		if checkWithToken(t, s, token, descriptor("company_id", spoofed)) == envoy.RateLimitResponse_OK {
+			ok++
+		}
+	}
+	if ok != 2 {
+		t.Errorf("allowed %d of 3 requests claiming different companies, want 2", ok)
+	}
+
+	// A claim no descriptor carries is limited as a descriptor of its own
+	if got := checkWithToken(t, s, token, descriptor("remote_address", "10.0.0.1")); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("request without a company descriptor got %v, want OVER_LIMIT", got)
+	}
+}
+
+func TestInvalidTokens(t *testing.T) {
+	valid := signHS256(t, jwt.MapClaims{"company_id": "acme", "exp": time.Now().Add(time.Hour).Unix()})
+	parts := strings.Split(valid, ".")
+	forged := signHS256(t, jwt.MapClaims{"company_id": "other", "exp": time.Now().Add(time.Hour).Unix()})
+	tokens := map[string]string{
+		"expired": signHS256(t, jwt.MapClaims{"company_id": "acme", "exp": time.Now().Add(-time.Minute).Unix()}),
+		// The payload of another token under the valid token's signature
+		"tampered":  parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2],
+		"no expiry": signHS256(t, jwt.MapClaims{"company_id": "acme"}),
+	}
+
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			// Fail closed rejects the request outright
+			s := newJWTTestServer(t, FailClosed)
+			if got := checkWithToken(t, s, token, descriptor("company_id", "acme")); got != envoy.RateLimitResponse_OVER_LIMIT {
+				t.Errorf("fail closed got %v, want OVER_LIMIT", got)
+			}
+
+			// Fail open lets it through, but without the client's unverified
+			// company, so it is never counted against one
+			s = newJWTTestServer(t, FailOpen)
+			if got := allowedWithToken(t, s, 3, token, descriptor("company_id", "acme")); got != 3 {
+				t.Errorf("fail open allowed %d of 3, want 3", got)
+			}
+		})
+	}
+}
+
+func TestInvalidTokenDryRun(t *testing.T) {
+	s := newJWTTestServer(t, FailClosed)
+	s.config.Load().DryRun = true
+	expired := signHS256(t, jwt.MapClaims{"company_id": "acme", "exp": time.Now().Add(-time.Minute).Unix()})
+
+	// Fail closed would reject the request; dry run allows it and counts
+	// the rejection instead
+	shadow := shadowRejections.WithLabelValues("company_id")
+	before := testutil.ToFloat64(shadow)
+	if got := checkWithToken(t, s, expired, descriptor("company_id", "acme")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("dry run got %v, want OK", got)
+	}
+	if got := testutil.ToFloat64(shadow) - before; got != 1 {
+		t.Errorf("shadow rejections increased by %v, want 1", got)
+	}
+}
+
+// jwksServer publishes a JWKS that tests can rotate or make unavailable,
+// counting the fetches
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey // Published keys by key ID
+	failing bool                       // Whether fetches fail with a 500
+	fetches int                        // Number of fetches served
+	url     string
+}
+
+func newJWKSServer(t *testing.T, keys map[string]*rsa.PrivateKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		if s.failing {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		set := map[string][]map[string]string{"keys": {}}
+		for kid, key := range s.keys {
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+// publish replaces the published keys and sets whether fetches fail
+func (s *jwksServer) publish(keys map[string]*rsa.PrivateKey, failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys, s.failing = keys, failing
+}
+
+// fetchCount returns the number of fetches served so far
+func (s *jwksServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// newJWKSVerifier returns a verifier of RS256 tokens signed with the keys
+// published at url
+func newJWKSVerifier(t *testing.T, url string) *tokenVerifier {
+	t.Helper()
+	t.Setenv("JWT_HMAC_SECRET", "")
+	t.Setenv("JWT_JWKS_URL", url)
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := newTokenVerifier(ctx, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newTokenVerifier: %v", err)
+	}
+	return v
+}
+
+// newRSAKey generates a signing key
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signRS256 signs a valid token for acme with key under kid
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"company_id": "acme", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// verifyRS256 returns the error of verifying a token signed with key
+// under kid
+func verifyRS256(t *testing.T, v *tokenVerifier, key *rsa.PrivateKey, kid string) error {
+	t.Helper()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+signRS256(t, key, kid)))
+	_, err := v.verify(ctx)
+	return err
+}
+
+func TestJWKSRotation(t *testing.T) {
+	oldKey, newKey := newRSAKey(t), newRSAKey(t)
+	jwks := newJWKSServer(t, map[string]*rsa.PrivateKey{"old": oldKey})
+	v := newJWKSVerifier(t, jwks.url)
+	if err := verifyRS256(t, v, oldKey, "old"); err != nil {
+		t.Fatalf("token signed with the published key rejected: %v", err)
+	}
+
+	// The provider rotates in a new key and retires the old one; the first
+	// token naming the new key fetches the JWKS again
+	jwks.publish(map[string]*rsa.PrivateKey{"new": newKey}, false)
+	if err := verifyRS256(t, v, newKey, "new"); err != nil {
+		t.Fatalf("token signed with the rotated key rejected: %v", err)
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+
+	// Tokens naming a known key are verified without fetching the JWKS
+	if err := verifyRS256(t, v, newKey, "new"); err != nil {
+		t.Errorf("token signed with the rotated key rejected: %v", err)
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestJWKSUnknownKeyRefreshThrottled(t *testing.T) {
+	key := newRSAKey(t)
+	jwks := newJWKSServer(t, map[string]*rsa.PrivateKey{"current": key})
+	v := newJWKSVerifier(t, jwks.url)
+
+	// A made-up key ID fetches the JWKS once, then is rejected without
+	// fetching it again for jwksMinRefreshInterval
+	for i := 0; i < 3; i++ {
+		if err := verifyRS256(t, v, key, "made-up"); err == nil {
+			t.Fatal("token naming an unknown key accepted")
+		}
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+
+	// Once the interval has passed, an unknown key ID fetches it again
+	v.refreshMu.Lock()
+	v.lastRefresh = time.Now().Add(-jwksMinRefreshInterval)
+	v.refreshMu.Unlock()
+	jwks.publish(map[string]*rsa.PrivateKey{"current": key, "next": key}, false)
+	if err := verifyRS256(t, v, key, "next"); err != nil {
+		t.Errorf("token naming a newly published key rejected: %v", err)
+	}
+	if got := jwks.fetchCount(); got != 3 {
+		t.Errorf("JWKS fetched %d times, want 3", got)
+	}
+}
+
+func TestJWKSFetchFailure(t *testing.T) {
+	key := newRSAKey(t)
+	jwks := newJWKSServer(t, nil)
+	jwks.publish(map[string]*rsa.PrivateKey{"current": key}, true)
+
+	// A JWKS unavailable at startup does not fail it, but tokens are
+	// rejected, and handled per the failure mode, until it is fetched
+	v := newJWKSVerifier(t, jwks.url)
+	if err := verifyRS256(t, v, key, "current"); err == nil {
+		t.Fatal("token accepted without a JWKS")
+	}
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+	s.tokens = v
+	if got := checkWithToken(t, s, signRS256(t, key, "current"), descriptor("company_id", "acme")); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("fail closed got %v without a JWKS, want OVER_LIMIT", got)
+	}
+
+	// Once the JWKS is back, a token fetches it again
+	jwks.publish(map[string]*rsa.PrivateKey{"current": key}, false)
+	v.refreshMu.Lock()
+	v.lastRefresh = time.Time{}
+	v.refreshMu.Unlock()
+	if err := verifyRS256(t, v, key, "current"); err != nil {
+		t.Fatalf("token rejected once the JWKS is back: %v", err)
+	}
+
+	// A failing refresh keeps the keys fetched before
+	jwks.publish(nil, true)
+	if err := v.refreshKeys(context.Background()); err == nil {
+		t.Error("refreshKeys succeeded against a failing JWKS")
+	}
+	if err := verifyRS256(t, v, key, "current"); err != nil {
+		t.Errorf("token rejected after a failed refresh: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// serverKeepalive builds the keepalive options of the gRPC server from the
+// environment:
+//   - GRPC_MAX_CONNECTION_AGE (default 30m): connections are closed with a
+//     GOAWAY after this long, so clients reconnect and spread across replicas
+//   - GRPC_MAX_CONNECTION_AGE_GRACE (default 30s): time in-flight calls get
+//     to finish once a connection has reached its maximum age
+//   - GRPC_MAX_CONNECTION_IDLE (default 15m): connections without calls for
+//     this long are closed
+//   - GRPC_KEEPALIVE_TIME (default 30s): idle connections are pinged after
+//     this long, and closed if the ping is not answered within
+//     GRPC_KEEPALIVE_TIMEOUT (default 10s), clearing half-open connections
+//   - GRPC_MIN_PING_INTERVAL (default 10s): clients pinging more often,
+//     with or without calls in flight, are disconnected
+func serverKeepalive() ([]grpc.ServerOption, error) {
+	params := keepalive.ServerParameters{
+		MaxConnectionAge:      30 * time.Minute,
+		MaxConnectionAgeGrace: 30 * time.Second,
+		MaxConnectionIdle:     15 * time.Minute,
+		Time:                  30 * time.Second,
+		Timeout:               10 * time.Second,
+	}
+	policy := keepalive.EnforcementPolicy{
+		MinTime:             10 * time.Second,
+		PermitWithoutStream: true, // Envoy pings connections it keeps idle
+	}
+
+	var err error
+	if params.MaxConnectionAge, err = durationEnv("GRPC_MAX_CONNECTION_AGE", params.MaxConnectionAge); err != nil {
+		return nil, err
+	}
+	if params.MaxConnectionAgeGrace, err = durationEnv("GRPC_MAX_CONNECTION_AGE_GRACE", params.MaxConnectionAgeGrace); err != nil {
+		return nil, err
+	}
+	if params.MaxConnectionIdle, err = durationEnv("GRPC_MAX_CONNECTION_IDLE", params.MaxConnectionIdle); err != nil {
+		return nil, err
+	}
+	if params.Time, err = durationEnv("GRPC_KEEPALIVE_TIME", params.Time); err != nil {
+		return nil, err
+	}
+	if params.Timeout, err = durationEnv("GRPC_KEEPALIVE_TIMEOUT", params.Timeout); err != nil {
+		return nil, err
+	}
+	if policy.MinTime, err = durationEnv("GRPC_MIN_PING_INTERVAL", policy.MinTime); err != nil {
+		return nil, err
+	}
+
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(params),
+		grpc.KeepaliveEnforcementPolicy(policy),
+	}, nil
+}
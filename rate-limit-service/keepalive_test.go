@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestMaxConnectionAge(t *testing.T) {
+	t.Setenv("GRPC_MAX_CONNECTION_AGE", "300ms")
+	t.Setenv("GRPC_MAX_CONNECTION_AGE_GRACE", "100ms")
+	opts, err := serverKeepalive()
+	if err != nil {
+		t.Fatalf("serverKeepalive: %v", err)
+	}
+	addr := serveHealth(t, opts...)
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("health check: %v", err)
+	}
+
+	// The server sends a GOAWAY once the connection reaches its maximum
+	// age, taking the client's connection out of READY
+	connected := time.Now()
+	for state := conn.GetState(); state == connectivity.Ready; state = conn.GetState() {
+		if !conn.WaitForStateChange(ctx, state) {
+			t.Fatal("connection still READY 3s after its maximum age of 300ms")
+		}
+	}
+	if age := time.Since(connected); age < 200*time.Millisecond {
+		t.Errorf("connection closed after %v, before its maximum age", age)
+	}
+}
+
+func TestServerKeepaliveInvalid(t *testing.T) {
+	for _, name := range []string{"GRPC_MAX_CONNECTION_AGE", "GRPC_KEEPALIVE_TIME", "GRPC_MIN_PING_INTERVAL"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, "soon")
+			if _, err := serverKeepalive(); err == nil {
+				t.Errorf("serverKeepalive accepted %s=soon", name)
+			}
+		})
+	}
+}
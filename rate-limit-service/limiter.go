@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WindowMode selects the algorithm used to count requests within a window
+type WindowMode string
+
+const (
+	// FixedWindow counts requests in a counter that resets when its TTL
+	// expires. It is cheap, but allows up to twice the limit across a
+	// window boundary.
+	FixedWindow WindowMode = "fixed"
+
+	// SlidingWindow counts the requests whose timestamps fall within the
+	// trailing window, so the limit holds across any window-sized interval.
+	SlidingWindow WindowMode = "sliding"
+
+	// TokenBucket admits requests while a per-key bucket holds enough
+	// tokens. Buckets refill continuously up to their capacity, so short
+	// bursts above the steady-state rate are tolerated.
+	TokenBucket WindowMode = "token_bucket"
+
+	// GCRA (the generic cell rate algorithm) spaces requests at the rate's
+	// emission interval, tolerating bursts up to a capacity. It stores a
+	// single timestamp per key and reports exactly when a rejected request
+	// could be retried.
+	GCRA WindowMode = "gcra"
+)
+
+// WindowAlignment selects when fixed-window counters reset
+type WindowAlignment string
+
+const (
+	// RollingAlignment starts a key's window at its first hit, so the
+	// counter resets one full window later
+	RollingAlignment WindowAlignment = "rolling"
+
+	// CalendarAlignment resets every key at the same wall-clock boundaries,
+	// such as the top of the hour or midnight. Boundaries are multiples of
+	// the window counted in UTC, so daylight saving changes never move them;
+	// a daily window resets at midnight UTC rather than local midnight.
+	CalendarAlignment WindowAlignment = "calendar"
+)
+
+// calendarPeriod returns the start of the UTC-aligned period of length
+// window containing now, and the time left until the next one begins. The
+// time left is at least a millisecond, as counter expiries are set in
+// milliseconds and a zero expiry would delete the key.
+func calendarPeriod(now time.Time, window time.Duration) (time.Time, time.Duration) {
+	start := now.UTC().Truncate(window)
+	return start, max(start.Add(window).Sub(now), time.Millisecond)
+}
+
+// incrScript atomically increments a counter by ARGV[2] hits and sets its
+// expiry (ARGV[1], in milliseconds) whenever the key has none, so a counter
+// can never be left without a TTL between the increment and the expire, and
+// a counter left without one, e.g. by a manual SET, gets one on its next hit.
+// With a limit in ARGV[3], hits that would take the counter over it are not
+// recorded, and the count they would have reached is returned.
+const incrScript = `
+local limit = tonumber(ARGV[3])
+if limit then
+	local count = (tonumber(redis.call("GET", KEYS[1])) or 0) + tonumber(ARGV[2])
+	if count > limit then
+		return count
+	end
+end
+local count = redis.call("INCRBY", KEYS[1], ARGV[2])
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`
+
+// slidingWindowScript records each request as one member of a sorted set
+// (KEYS[1]) scored by timestamp, weighted by the hits it counts for, and
+// keeps the running total of those hits at KEYS[2], so counting a request
+// only reads the members leaving the window instead of every member in it.
+// ARGV[1] is the current time and ARGV[2] the window, both in milliseconds;
+// ARGV[3] is a member prefix unique to this request and ARGV[4] the number
+// of hits it counts for, stored after a "#" in the member. Members without
+// a weight count as one hit. The total is ignored once the set is gone, e.g.
+// after an admin reset, and rebuilt from the members when it is missing. It
+// returns the hits within the window; with a limit in ARGV[5], hits that
+// would take the window over it are not recorded, and the count they would
+// have reached is returned.
+const slidingWindowScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local hits = tonumber(ARGV[4])
+local function weight(member)
+	local w = string.match(member, "#(%d+)$")
+	return w and tonumber(w) or 1
+end
+local sum = 0
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	sum = tonumber(redis.call("GET", KEYS[2]))
+	if not sum then
+		sum = 0
+		for _, member in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+			sum = sum + weight(member)
+		end
+	end
+	local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", now - window)
+	if #expired > 0 then
+		for _, member in ipairs(expired) do
+			sum = sum - weight(member)
+		end
+		redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+	end
+end
+local count = sum + hits
+local limit = tonumber(ARGV[5])
+if not limit or count <= limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[3] .. "#" .. hits)
+	sum = count
+end
+redis.call("SET", KEYS[2], sum, "PX", window)
+redis.call("PEXPIRE", KEYS[1], window)
+return count
+`
+
+// tokenBucketScript takes ARGV[4] tokens from the bucket at KEYS[1], which
+// holds up to ARGV[1] tokens and refills completely over ARGV[2]
+// milliseconds. ARGV[3] is the current time in milliseconds. It returns the
+// number of tokens used out of the capacity after the request; a value above
+// the capacity means the bucket could not cover the request, which then
+// consumes nothing.
+const tokenBucketScript = `
+local capacity = tonumber(ARGV[1])
+local refill = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local hits = tonumber(ARGV[4])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * capacity / refill)
+	ts = now
+end
+local used
+if tokens >= hits then
+	tokens = tokens - hits
+	used = capacity - tokens
+else
+	used = capacity - tokens + hits
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], refill)
+return math.ceil(used)
+`
+
+// gcraScript applies the generic cell rate algorithm to ARGV[4] hits
+// against the theoretical arrival time (TAT) stored at KEYS[1]. Up to ARGV[1]
+// hits are admitted at once, and capacity returns at one hit per ARGV[2] /
+// ARGV[1] milliseconds (the emission interval); ARGV[3] is the current time
+// in milliseconds. Conforming hits advance the TAT, which expires once it
+// has passed. It returns the hits the key has used out of its capacity,
+// above the capacity when the request does not conform and is not recorded,
+// and the milliseconds until the request could be retried or, when it
+// conforms, until the key's capacity is fully restored. The small epsilon
+// keeps floating-point error from counting an extra hit.
+const gcraScript = `
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local hits = tonumber(ARGV[4])
+local emission = period / capacity
+local tat = math.max(tonumber(redis.call("GET", KEYS[1])) or now, now)
+local new_tat = tat + hits * emission
+local used = math.ceil((new_tat - now) / emission - 1e-6)
+local allow_at = new_tat - period
+if allow_at > now then
+	return {used, math.ceil(allow_at - now)}
+end
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil(new_tat - now))
+return {used, math.ceil(new_tat - now)}
+`
+
+// windowStrategy counts hits against a key and returns the number of hits
+// recorded for that key within the current window, to be compared with limit,
+// and the time until the window resets, or 0 if the strategy leaves it to
+// the key's TTL
+type windowStrategy interface {
+	increment(ctx context.Context, key string, limit int64, window time.Duration, hits int64) (int64, time.Duration, error)
+
+	// incrementAll counts hits against several keys in a single Redis
+	// pipeline. Results are in the order of reqs, and the time until reset
+	// is filled in from the key's TTL when the strategy does not report it.
+	incrementAll(ctx context.Context, reqs []counterRequest) []counterResult
+}
+
+// counterRequest is one counter to increment in a batch
+type counterRequest struct {
+	key    string        // Windowed Redis key
+	limit  int64         // Limit compared against the count
+	window time.Duration // Window length, the TTL of a new counter
+	hits   int64         // Hits to add
+}
+
+// counterResult is the outcome of one counterRequest
+type counterResult struct {
+	count int64         // Hits recorded within the window
+	reset time.Duration // Time until the window resets, 0 if unknown
+	err   error
+}
+
+// newWindowStrategy returns the strategy for the given mode, running its
+// script through scripts. Unless countRejected is set, fixed and sliding
+// windows only record hits that stay within the limit; token buckets and
+// GCRA never record the hits of rejected requests.
+func newWindowStrategy(mode WindowMode, countRejected bool, scripts *scriptManager) (windowStrategy, error) {
+	switch mode {
+	case FixedWindow, "":
+		args := fixedWindowArgs
+		if !countRejected {
+			args = underLimit(fixedWindowArgs)
+		}
+		return &scriptStrategy{scripts: scripts, src: incrScript, args: args, parse: parseCount}, nil
+	case SlidingWindow:
+		args := slidingWindowArgs
+		if !countRejected {
+			args = underLimit(slidingWindowArgs)
+		}
+		return &scriptStrategy{scripts: scripts, src: slidingWindowScript, keys: slidingWindowKeys, args: args, parse: parseCount}, nil
+	case TokenBucket:
+		return &scriptStrategy{scripts: scripts, src: tokenBucketScript, args: tokenBucketArgs, parse: parseCount}, nil
+	case GCRA:
+		return &scriptStrategy{scripts: scripts, src: gcraScript, args: gcraArgs, parse: parseGCRA}, nil
+	default:
+		return nil, fmt.Errorf("unknown window mode %q", mode)
+	}
+}
+
+// scriptStrategy implements windowStrategy with a preloaded Lua script
+// taking the counter key, and any keys derived from it
+type scriptStrategy struct {
+	scripts *scriptManager // Runs the script by SHA
+	src     string         // Script source
+
+	// keys returns the keys the script takes for a counter key, the counter
+	// key alone when nil
+	keys func(key string) []string
+
+	// args builds the script arguments for counting hits against a key
+	args func(limit int64, window time.Duration, hits int64) []interface{}
+
+	// parse reads the count, and the time until reset if the script
+	// reports it, from the script's reply
+	parse func(cmd *redis.Cmd) (int64, time.Duration, error)
+}
+
+// scriptKeys returns the keys the script is run against for a counter key
+func (s *scriptStrategy) scriptKeys(key string) []string {
+	if s.keys == nil {
+		return []string{key}
+	}
+	return s.keys(key)
+}
+
+// increment runs the script once against key
+func (s *scriptStrategy) increment(ctx context.Context, key string, limit int64, window time.Duration, hits int64) (int64, time.Duration, error) {
+	count, reset, err := s.parse(s.scripts.run(ctx, s.src, s.scriptKeys(key), s.args(limit, window, hits)...))
+	if err != nil {
+		redisErrors.WithLabelValues("eval").Inc()
+		return 0, 0, fmt.Errorf("redis error: %w", err)
+	}
+	return count, reset, nil
+}
+
+// incrementAll runs the script against every key, each followed by a PTTL
+// of its key, in one pipeline. Scripts Redis no longer has cached are run
+// again by source in a second pipeline.
+func (s *scriptStrategy) incrementAll(ctx context.Context, reqs []counterRequest) []counterResult {
+	args := make([][]interface{}, len(reqs))
+	for i, req := range reqs {
+		args[i] = s.args(req.limit, req.window, req.hits)
+	}
+
+	cmds := make([]*redis.Cmd, len(reqs))
+	ttls := make([]*redis.DurationCmd, len(reqs))
+	pipe := newPipeline(s.scripts.redis)
+	for i, req := range reqs {
+		cmds[i] = pipe.EvalSha(ctx, s.scripts.sha(s.src), s.scriptKeys(req.key), args[i]...)
+		ttls[i] = pipe.PTTL(ctx, req.key)
+	}
+	start := time.Now()
+	_, execErr := pipe.Exec(ctx) // Errors are read per command below
+
+	var missing []int
+	for i, cmd := range cmds {
+		if s.scripts.missing(cmd.Err()) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 {
+		pipe := newPipeline(s.scripts.redis)
+		for _, i := range missing {
+			cmds[i] = pipe.Eval(ctx, s.src, s.scriptKeys(reqs[i].key), args[i]...)
+			ttls[i] = pipe.PTTL(ctx, reqs[i].key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			execErr = err
+		}
+	}
+	observeRedis("eval_pipeline", start)
+
+	results := make([]counterResult, len(reqs))
+	for i, cmd := range cmds {
+		// go-redis leaves the commands of a pipeline it could not send, e.g.
+		// for want of a connection, without a reply or an error of their own
+		if cmd.Err() == nil && cmd.Val() == nil {
+			cmd.SetErr(execErr)
+		}
+		count, reset, err := s.parse(cmd)
+		if err != nil {
+			redisErrors.WithLabelValues("eval").Inc()
+			results[i].err = fmt.Errorf("redis error: %w", err)
+			continue
+		}
+		if reset <= 0 {
+			if ttl, err := ttls[i].Result(); err != nil {
+				redisErrors.WithLabelValues("pttl").Inc()
+			} else if ttl > 0 {
+				reset = ttl
+			}
+		}
+		results[i] = counterResult{count: count, reset: reset}
+	}
+	return results
+}
+
+// fixedWindowArgs increments a counter per key that expires one window
+// after its first hit
+func fixedWindowArgs(limit int64, window time.Duration, hits int64) []interface{} {
+	return []interface{}{window.Milliseconds(), hits}
+}
+
+// slidingWindowArgs records the request at the current time, weighted by its
+// hits, in a sorted set per key, counting the hits within the trailing window
+func slidingWindowArgs(limit int64, window time.Duration, hits int64) []interface{} {
+	now := time.Now().UnixMilli()
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+	return []interface{}{now, window.Milliseconds(), member, hits}
+}
+
+// slidingWindowKeys returns the keys slidingWindowScript takes for a
+// counter key: the sorted set of requests and the running total of their hits
+func slidingWindowKeys(key string) []string {
+	return []string{key, slidingWindowSumKey(key)}
+}
+
+// slidingWindowSumKey returns the key holding the running total of a sliding
+// window's hits. It extends the counter key, and with it the counter's hash
+// tag, so both land on the same cluster slot.
+func slidingWindowSumKey(key string) string {
+	return key + ":sum"
+}
+
+// cappedHits caps the hits counted against limit at one more than the
+// limit. Any addend above the limit is rejected alike, so capping it keeps
+// a huge hits_addend from inflating counters, and the work and memory the
+// window modes spend on it, without changing the decision.
+func cappedHits(hits, limit int64) int64 {
+	return min(hits, max(limit, 0)+1)
+}
+
+// underLimit appends the limit to the arguments built by args, so the fixed
+// and sliding window scripts only record hits that stay within it
+func underLimit(args func(limit int64, window time.Duration, hits int64) []interface{}) func(limit int64, window time.Duration, hits int64) []interface{} {
+	return func(limit int64, window time.Duration, hits int64) []interface{} {
+		return append(args(limit, window, hits), limit)
+	}
+}
+
+// tokenBucketArgs takes hits tokens from a bucket holding up to limit tokens
+// that refills completely over window, stored as a hash of the token count
+// and the last refill time. The script returns the tokens used, so that
+// limit minus the result is the number of tokens remaining.
+func tokenBucketArgs(limit int64, window time.Duration, hits int64) []interface{} {
+	return []interface{}{limit, window.Milliseconds(), time.Now().UnixMilli(), hits}
+}
+
+// gcraArgs admits hits if they conform to a rate of limit per window with a
+// burst of limit, using the generic cell rate algorithm over each key's
+// theoretical arrival time
+func gcraArgs(limit int64, window time.Duration, hits int64) []interface{} {
+	return []interface{}{limit, window.Milliseconds(), time.Now().UnixMilli(), hits}
+}
+
+// parseCount reads a script reply holding just the count
+func parseCount(cmd *redis.Cmd) (int64, time.Duration, error) {
+	count, err := cmd.Int64()
+	return count, 0, err
+}
+
+// parseGCRA reads the GCRA script's reply: the capacity used and the retry
+// delay of a rejected request, or the time until a conforming key is fully
+// restored
+func parseGCRA(cmd *redis.Cmd) (int64, time.Duration, error) {
+	result, err := cmd.Int64Slice()
+	if err == nil && len(result) != 2 {
+		err = fmt.Errorf("unexpected GCRA script result %v", result)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return result[0], time.Duration(result[1]) * time.Millisecond, nil
+}
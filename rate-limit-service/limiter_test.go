@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// newTestStrategy returns the strategy for mode, recording rejected hits,
+// running its scripts against rdb
+func newTestStrategy(t testing.TB, mode WindowMode, rdb redisClient) windowStrategy {
+	t.Helper()
+	strategy, err := newWindowStrategy(mode, true, newScriptManager(rdb, zap.NewNop()))
+	if err != nil {
+		t.Fatalf("newWindowStrategy: %v", err)
+	}
+	return strategy
+}
+
+func TestFixedWindowSetsTTLUnderConcurrency(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, FixedWindow, rdb)
+
+	const callers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := strategy.increment(context.Background(), "counter", 1000, time.Minute, 1); err != nil {
+				t.Errorf("increment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := mr.Get("counter"); got != "50" {
+		t.Errorf("counter = %s, want 50", got)
+	}
+	if ttl := mr.TTL("counter"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL = %v, want (0, 1m]", ttl)
+	}
+}
+
+func TestFixedWindowTTLSetOnFirstIncrement(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, FixedWindow, rdb)
+
+	if _, _, err := strategy.increment(context.Background(), "counter", 1000, time.Minute, 1); err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	if ttl := mr.TTL("counter"); ttl != time.Minute {
+		t.Errorf("TTL after first increment = %v, want 1m", ttl)
+	}
+
+	// Later increments leave the window where it is
+	mr.FastForward(20 * time.Second)
+	if _, _, err := strategy.increment(context.Background(), "counter", 1000, time.Minute, 1); err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	if ttl := mr.TTL("counter"); ttl != 40*time.Second {
+		t.Errorf("TTL after second increment = %v, want 40s", ttl)
+	}
+}
+
+func TestFixedWindowReloadsFlushedScript(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, FixedWindow, rdb)
+
+	// A restarted Redis no longer has the preloaded script
+	mr.FlushAll()
+	if err := rdb.(redis.UniversalClient).ScriptFlush(context.Background()).Err(); err != nil {
+		t.Fatalf("ScriptFlush: %v", err)
+	}
+	count, _, err := strategy.increment(context.Background(), "counter", 1000, time.Minute, 1)
+	if err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	if count != 1 || mr.TTL("counter") != time.Minute {
+		t.Errorf("count = %d with TTL %v, want 1 with 1m", count, mr.TTL("counter"))
+	}
+}
+
+func TestFixedWindowRepairsMissingTTL(t *testing.T) {
+	redisStore, _ := newTestRedis(t)
+	backends := map[string]redisClient{"redis": redisStore, "memory": newMemoryStore(memoryShards)}
+	for name, rdb := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// A counter left behind without a TTL, e.g. by a manual SET
+			if err := rdb.Set(ctx, "counter", 5, 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+			strategy := newTestStrategy(t, FixedWindow, rdb)
+			if _, _, err := strategy.increment(ctx, "counter", 10, time.Minute, 1); err != nil {
+				t.Fatalf("increment: %v", err)
+			}
+			if got, err := rdb.Get(ctx, "counter").Int64(); err != nil || got != 6 {
+				t.Errorf("counter = %d (%v), want 6", got, err)
+			}
+			if ttl := rdb.PTTL(ctx, "counter").Val(); ttl <= 0 || ttl > time.Minute {
+				t.Errorf("TTL after increment = %v, want (0, 1m]", ttl)
+			}
+		})
+	}
+}
+
+func TestSlidingWindowTrailingCount(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, SlidingWindow, rdb)
+
+	const window = 200 * time.Millisecond
+	increment := func() int64 {
+		t.Helper()
+		count, _, err := strategy.increment(context.Background(), "sliding", 1000, window, 1)
+		if err != nil {
+			t.Fatalf("increment: %v", err)
+		}
+		return count
+	}
+
+	for i := 0; i < 3; i++ {
+		increment()
+	}
+	time.Sleep(window / 2)
+	if got := increment(); got != 4 {
+		t.Errorf("count half a window later = %d, want 4", got)
+	}
+
+	// Once a full window has passed since the first three hits they no
+	// longer count, although the key never expired in between, unlike a
+	// fixed window that only resets with its TTL
+	time.Sleep(window/2 + 20*time.Millisecond)
+	if got := increment(); got != 2 {
+		t.Errorf("count a window later = %d, want 2", got)
+	}
+	if ttl := mr.TTL("sliding"); ttl <= 0 || ttl > window {
+		t.Errorf("TTL = %v, want (0, %v]", ttl, window)
+	}
+}
+
+// benchmarkStrategy counts hits against a rotating set of keys
+func benchmarkStrategy(b *testing.B, mode WindowMode) {
+	rdb, _ := newTestRedis(b)
+	strategy := newTestStrategy(b, mode, rdb)
+	keys := []string{"a", "b", "c", "d"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := strategy.increment(context.Background(), keys[i%len(keys)], 1000, time.Minute, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFixedWindow(b *testing.B)   { benchmarkStrategy(b, FixedWindow) }
+func BenchmarkSlidingWindow(b *testing.B) { benchmarkStrategy(b, SlidingWindow) }
+
+func TestSlidingWindowWeightedHits(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, SlidingWindow, rdb)
+
+	count, _, err := strategy.increment(context.Background(), "sliding", 10, time.Minute, 5)
+	if err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("count after 5 hits = %d, want 5", count)
+	}
+	// A weighted request is stored as one member carrying its weight
+	members, err := mr.ZMembers("sliding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || !strings.HasSuffix(members[0], "#5") {
+		t.Errorf("members = %v, want one of weight 5", members)
+	}
+
+	if count, _, _ = strategy.increment(context.Background(), "sliding", 10, time.Minute, 1); count != 6 {
+		t.Errorf("count after another hit = %d, want 6", count)
+	}
+	if got, _ := mr.Get("sliding:sum"); got != "6" {
+		t.Errorf("running total = %q, want 6", got)
+	}
+}
+
+func TestSlidingWindowRunningTotal(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy := newTestStrategy(t, SlidingWindow, rdb)
+	ctx := context.Background()
+	now := time.Now().UnixMilli()
+
+	// Members leaving the window are subtracted from the total, whatever
+	// their weight; older members recorded without one count as one hit
+	mr.ZAdd("sliding", float64(now-2*time.Minute.Milliseconds()), "old-1#3")
+	mr.ZAdd("sliding", float64(now-2*time.Minute.Milliseconds()), "old-2")
+	mr.ZAdd("sliding", float64(now-time.Second.Milliseconds()), "recent#2")
+	mr.Set("sliding:sum", "6")
+	if count, _, err := strategy.increment(ctx, "sliding", 100, time.Minute, 1); err != nil || count != 3 {
+		t.Errorf("count = %d (%v), want 3", count, err)
+	}
+	if got, _ := mr.Get("sliding:sum"); got != "3" {
+		t.Errorf("running total = %q, want 3", got)
+	}
+	if ttl := mr.TTL("sliding:sum"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("running total TTL = %v, want (0, 1m]", ttl)
+	}
+
+	// A missing total, as for a set recorded before totals were kept, is
+	// rebuilt from the members
+	mr.Del("sliding:sum")
+	if count, _, _ := strategy.increment(ctx, "sliding", 100, time.Minute, 1); count != 4 {
+		t.Errorf("count with the total missing = %d, want 4", count)
+	}
+
+	// A total left behind by a deleted set, as after an admin reset, is
+	// ignored
+	mr.Del("sliding")
+	if count, _, _ := strategy.increment(ctx, "sliding", 100, time.Minute, 1); count != 1 {
+		t.Errorf("count after the set was deleted = %d, want 1", count)
+	}
+}
+
+func TestSlidingWindowRejectedHitsLeaveTotal(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	strategy, err := newWindowStrategy(SlidingWindow, false, newScriptManager(rdb, zap.NewNop()))
+	if err != nil {
+		t.Fatalf("newWindowStrategy: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		strategy.increment(context.Background(), "sliding", 2, time.Minute, 1)
+	}
+	if got, _ := mr.Get("sliding:sum"); got != "2" {
+		t.Errorf("running total = %q, want the 2 hits within the limit", got)
+	}
+}
+
+func TestCappedHits(t *testing.T) {
+	tests := []struct {
+		hits, limit, want int64
+	}{
+		{hits: 5, limit: 10, want: 5},
+		{hits: 11, limit: 10, want: 11},
+		{hits: 1 << 32, limit: 10, want: 11},
+		{hits: 3, limit: 0, want: 1},
+	}
+	for _, tt := range tests {
+		if got := cappedHits(tt.hits, tt.limit); got != tt.want {
+			t.Errorf("cappedHits(%d, %d) = %d, want %d", tt.hits, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	// take runs the script at a simulated time against a bucket of 10
+	// tokens refilling completely over 10s, one token a second, and
+	// returns the tokens used after the request
+	take := func(at time.Duration, hits int64) int64 {
+		t.Helper()
+		used, err := rdb.Eval(ctx, tokenBucketScript, []string{"bucket"}, 10, 10000, at.Milliseconds(), hits).Int64()
+		if err != nil {
+			t.Fatalf("token bucket script: %v", err)
+		}
+		return used
+	}
+
+	// A full bucket accepts a burst of its whole capacity, then is drained
+	if used := take(0, 10); used != 10 {
+		t.Errorf("burst of 10 used %d, want 10", used)
+	}
+	if used := take(0, 1); used <= 10 {
+		t.Errorf("drained bucket used %d, want it over the capacity of 10", used)
+	}
+
+	// Tokens come back gradually: 2.5s later two and a half are available
+	if used := take(2500*time.Millisecond, 2); used != 10 {
+		t.Errorf("2 hits after 2.5s used %d, want 10", used)
+	}
+	if used := take(2500*time.Millisecond, 1); used <= 10 {
+		t.Errorf("third hit after 2.5s used %d, want it rejected", used)
+	}
+	// The half token left over counts towards the next one
+	if used := take(3000*time.Millisecond, 1); used != 10 {
+		t.Errorf("hit after 3s used %d, want 10", used)
+	}
+
+	// Refilling stops at the capacity
+	if used := take(time.Hour, 1); used != 1 {
+		t.Errorf("hit after an hour used %d, want 1", used)
+	}
+}
+
+func TestGCRAConformance(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	for name, client := range map[string]redisClient{"redis": rdb, "memory": newMemoryStore(1)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			base := time.Now()
+
+			// take runs the script at a simulated time for a capacity of 5
+			// restored over 5s, one hit a second, and returns the capacity
+			// used and the delay it reports
+			take := func(at time.Duration) (int64, time.Duration) {
+				t.Helper()
+				result, err := client.Eval(ctx, gcraScript, []string{"gcra"}, 5, 5000, base.Add(at).UnixMilli(), 1).Int64Slice()
+				if err != nil || len(result) != 2 {
+					t.Fatalf("GCRA script = %v (%v), want capacity used and delay", result, err)
+				}
+				return result[0], time.Duration(result[1]) * time.Millisecond
+			}
+
+			// Requests at the emission interval always conform
+			for i := 0; i < 20; i++ {
+				if used, _ := take(time.Duration(i) * time.Second); used != 1 {
+					t.Fatalf("steady request %d used %d, want 1", i, used)
+				}
+			}
+
+			// A burst is admitted up to the tolerance left, then rejected
+			// with the time until the next hit conforms
+			now := 20 * time.Second
+			for i := 1; i <= 5; i++ {
+				if used, _ := take(now); used > 5 {
+					t.Fatalf("burst request %d rejected, used %d", i, used)
+				}
+			}
+			used, delay := take(now)
+			if used <= 5 {
+				t.Fatalf("request beyond the burst used %d, want it rejected", used)
+			}
+			if delay != time.Second {
+				t.Errorf("retry delay = %v, want 1s", delay)
+			}
+
+			// Rejected requests are not recorded, so the next hit conforms
+			// once the delay has passed
+			if used, _ := take(now + time.Second); used != 5 {
+				t.Errorf("request after the delay used %d, want 5", used)
+			}
+		})
+	}
+}
+
+func TestGCRARetryDelay(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 100, Window: time.Minute}
+	config.WindowMode = GCRA
+	config.BurstCapacity = 2
+	config.RefillRate = 1
+	s := newTestServer(t, config, rdb)
+
+	ip := descriptor("remote_address", "10.0.0.1")
+	if got := allowed(t, s, 2, "", ip); got != 2 {
+		t.Fatalf("burst allowed %d of 2, want 2", got)
+	}
+	response := shouldRateLimit(t, s, "", ip)
+	if response.OverallCode != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("request beyond the burst got %v, want OVER_LIMIT", response.OverallCode)
+	}
+	// The reset is the time until the next request conforms, a fraction of
+	// the one second emission interval
+	reset := response.Statuses[0].DurationUntilReset.AsDuration()
+	if reset <= 0 || reset > time.Second {
+		t.Errorf("DurationUntilReset = %v, want within the 1s emission interval", reset)
+	}
+}
+
+func TestCalendarPeriod(t *testing.T) {
+	at := func(hour, min, sec int, zone *time.Location) time.Time {
+		return time.Date(2026, time.March, 8, hour, min, sec, 0, zone)
+	}
+	// New York leaves standard time at 07:00 UTC that day
+	eastern := time.FixedZone("EDT", -4*60*60)
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	tests := []struct {
+		name      string
+		now       time.Time
+		window    time.Duration
+		wantStart time.Time
+		wantLeft  time.Duration
+	}{
+		{name: "key created at 10:59", now: at(10, 59, 0, time.UTC), window: time.Hour, wantStart: at(10, 0, 0, time.UTC), wantLeft: time.Minute},
+		{name: "new period at 11:00", now: at(11, 0, 0, time.UTC), window: time.Hour, wantStart: at(11, 0, 0, time.UTC), wantLeft: time.Hour},
+		{name: "minute", now: at(10, 59, 45, time.UTC), window: time.Minute, wantStart: at(10, 59, 0, time.UTC), wantLeft: 15 * time.Second},
+		{name: "day resets at midnight UTC", now: at(23, 30, 0, time.UTC), window: 24 * time.Hour, wantStart: at(0, 0, 0, time.UTC), wantLeft: 30 * time.Minute},
+		// Local times are aligned in UTC, whatever their zone or its
+		// daylight saving rules
+		{name: "daylight saving zone", now: at(3, 59, 0, eastern), window: time.Hour, wantStart: at(7, 0, 0, time.UTC), wantLeft: time.Minute},
+		{name: "half-hour zone", now: at(10, 59, 0, india), window: time.Hour, wantStart: at(5, 0, 0, time.UTC), wantLeft: 31 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, left := calendarPeriod(tt.now, tt.window)
+			if !start.Equal(tt.wantStart) || left != tt.wantLeft {
+				t.Errorf("calendarPeriod = %v, %v; want %v, %v", start, left, tt.wantStart, tt.wantLeft)
+			}
+		})
+	}
+
+	// A counter always gets an expiry, even right at the boundary
+	if _, left := calendarPeriod(at(10, 59, 59, time.UTC).Add(time.Second-time.Nanosecond), time.Hour); left != time.Millisecond {
+		t.Errorf("time left just before the boundary = %v, want 1ms", left)
+	}
+}
+
+func TestCalendarAlignedCounter(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Hour}
+	config.WindowAlignment = CalendarAlignment
+	s := newTestServer(t, config, rdb)
+
+	before, _ := calendarPeriod(time.Now(), time.Hour)
+	if got := allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1")); got != 2 {
+		t.Errorf("allowed %d of 3, want 2", got)
+	}
+	after, left := calendarPeriod(time.Now(), time.Hour)
+
+	// The counter belongs to the current hour and expires at its end, not
+	// an hour after the first request
+	keys := mr.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("redis keys = %v, want one counter", keys)
+	}
+	base := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Hour)
+	if keys[0] != fmt.Sprintf("%s:p%d", base, before.Unix()) && keys[0] != fmt.Sprintf("%s:p%d", base, after.Unix()) {
+		t.Errorf("counter key = %s, want it scoped to the hour starting %v", keys[0], after)
+	}
+	if ttl := mr.TTL(keys[0]); ttl <= 0 || ttl > left+time.Second {
+		t.Errorf("counter TTL = %v, want the %v left in the hour", ttl, left)
+	}
+}
+
+func TestCalendarAlignmentRequiresFixedWindow(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.WindowAlignment = CalendarAlignment
+	if err := config.validateAlignment(); err != nil {
+		t.Errorf("calendar fixed windows rejected: %v", err)
+	}
+	config.WindowMode = SlidingWindow
+	if err := config.validateAlignment(); err == nil {
+		t.Error("calendar alignment accepted with sliding windows")
+	}
+	config.WindowAlignment = "hourly"
+	if err := config.validateAlignment(); err == nil {
+		t.Error("unknown alignment accepted")
+	}
+}
+
+func TestRejectedHitsNotCounted(t *testing.T) {
+	for _, backend := range []string{"redis", "memory"} {
+		for _, mode := range []WindowMode{FixedWindow, SlidingWindow} {
+			for _, cached := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/%s/cached=%v", backend, mode, cached), func(t *testing.T) {
+					var rdb redisClient = newMemoryStore(memoryShards)
+					if backend == "redis" {
+						rdb, _ = newTestRedis(t)
+					}
+					config := DefaultRateLimitConfig()
+					config.Keys["remote_address"] = KeyRule{Limit: 3, Window: time.Minute}
+					config.setWindowMode(mode)
+					config.CountRejected = false
+					var s *RateLimitServer
+					if cached {
+						s = newCachedTestServer(t, config, rdb)
+					} else {
+						s = newTestServer(t, config, rdb)
+					}
+					ip := descriptor("remote_address", "10.0.0.1")
+					key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Minute)
+
+					// Rejected requests leave the counter at the limit
+					if got := allowed(t, s, 6, "", ip); got != 3 {
+						t.Errorf("allowed %d of 6, want 3", got)
+					}
+					if got, err := s.counterValue(context.Background(), key); err != nil || got != 3 {
+						t.Errorf("counter = %d (%v), want 3", got, err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestRejectedWeightedHitsNotCounted(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 3, Window: time.Minute}
+	config.CountRejected = false
+	s := newTestServer(t, config, rdb)
+
+	// A request that does not fit is rejected without using up the quota
+	// a smaller one can still take
+	want := []envoy.RateLimitResponse_Code{
+		envoy.RateLimitResponse_OK,
+		envoy.RateLimitResponse_OVER_LIMIT,
+		envoy.RateLimitResponse_OK,
+		envoy.RateLimitResponse_OVER_LIMIT,
+	}
+	for i, hits := range []uint32{2, 2, 1, 1} {
+		request := &envoy.RateLimitRequest{
+			HitsAddend:  hits,
+			Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		}
+		response, err := s.ShouldRateLimit(context.Background(), request)
+		if err != nil {
+			t.Fatalf("ShouldRateLimit: %v", err)
+		}
+		if response.OverallCode != want[i] {
+			t.Errorf("request %d of %d hits got %v, want %v", i+1, hits, response.OverallCode, want[i])
+		}
+	}
+}
@@ -4,18 +4,24 @@
 package main
 
 import (
-	"context"  // For context management
-	"fmt"      // For formatted I/O
-	"log"      // For logging
-	"net"      // For network operations
-	"net/http" // For HTTP server
-
-	// For string operations
-	// For environment variables
-	// For string conversions
-	"time" // For time operations
-
-	"github.com/dgraph-io/ristretto" // For local caching
+	"context"     // For context management
+	"errors"      // For sentinel errors
+	"fmt"         // For formatted I/O
+	"log"         // For logging
+	"math"        // For numeric limits
+	"net"         // For network operations
+	"net/http"    // For HTTP server
+	"os"          // For environment variables
+	"os/signal"   // For shutdown signals
+	"strconv"     // For header values
+	"strings"     // For string operations
+	"sync"        // For one-time shutdown
+	"sync/atomic" // For atomic config swaps
+	"syscall"     // For SIGTERM
+	"time"        // For time operations
+
+	"github.com/dgraph-io/ristretto"                                   // For local caching
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3" // Envoy header values
 	// Envoy rate limit service
 	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
 	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
@@ -23,10 +29,17 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto" // Prometheus auto-registration
 	"github.com/prometheus/client_golang/prometheus/promhttp" // Prometheus HTTP handler
 	"github.com/redis/go-redis/v9"                            // Redis client
+	"go.opentelemetry.io/otel"                                // OpenTelemetry propagation
+	"go.opentelemetry.io/otel/attribute"                      // Span attributes
+	"go.opentelemetry.io/otel/trace"                          // Spans
 	"go.uber.org/zap"                                         // Structured logging
 	"google.golang.org/grpc"                                  // gRPC server
+	"google.golang.org/grpc/health"                           // gRPC health service
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"   // gRPC health protocol
 	"google.golang.org/grpc/metadata"                         // gRPC metadata
 	"google.golang.org/grpc/reflection"                       // gRPC reflection
+	"google.golang.org/grpc/status"                           // gRPC status errors
+	"google.golang.org/protobuf/types/known/durationpb"       // Protobuf durations
 )
 
 // Context keys for tracing
@@ -51,14 +64,26 @@ var (
 	)
 
 	// rateLimitLatency measures the latency of rate limit checks in seconds,
-	// using standard Prometheus buckets for histogram analysis
+	// using standard Prometheus buckets for histogram analysis, labeled by
+	// type (request or descriptor) and, for descriptors, the matched key type
 	rateLimitLatency = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "rate_limit_latency_seconds",
 			Help:    "Rate limit request latency in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"type"},
+		[]string{"type", "key_type"},
+	)
+
+	// rateLimitDecisions counts per-descriptor decisions, labeled by the
+	// matched key type (ip, path, company, ...) and the decision. Raw key
+	// values are never used as labels to keep cardinality bounded.
+	rateLimitDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_decisions_total",
+			Help: "Total number of rate limit decisions by key type",
+		},
+		[]string{"key_type", "decision"},
 	)
 
 	// redisErrors tracks Redis operation failures,
@@ -70,37 +95,183 @@ var (
 		},
 		[]string{"operation"},
 	)
+
+	// redisOperationDuration measures the latency of Redis calls in seconds,
+	// labeled by operation, separating Redis slowness from the service's own
+	// overhead in rate_limit_latency_seconds. Buckets start at 100µs, as most
+	// calls finish well under the default buckets' 5ms.
+	redisOperationDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "redis_operation_duration_seconds",
+			Help:    "Redis operation latency in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 15),
+		},
+		[]string{"operation"},
+	)
+
+	// limitClamped tracks limit values that did not fit into Envoy's uint32
+	// fields and were clamped, labeled by the response field affected
+	limitClamped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_limit_clamped_total",
+			Help: "Total number of limit values clamped to fit Envoy's uint32 fields",
+		},
+		[]string{"field"},
+	)
+
+	// configReloads tracks rate limit configuration reloads,
+	// labeled by status (success/error)
+	configReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_config_reloads_total",
+			Help: "Total number of rate limit configuration reloads",
+		},
+		[]string{"status"},
+	)
+
+	// failOpenDecisions counts requests allowed because Redis was unavailable
+	failOpenDecisions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_fail_open_total",
+			Help: "Total number of requests allowed due to fail-open on Redis errors",
+		},
+	)
+
+	// shadowRejections counts descriptors that would have been rejected in
+	// dry-run mode, labeled by the descriptor's entry keys
+	shadowRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_shadow_rejections_total",
+			Help: "Total number of descriptors that would have been rejected in dry-run mode",
+		},
+		[]string{"key"},
+	)
+
+	// queueOverflows counts increments written synchronously because the
+	// update queue was full
+	queueOverflows = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_update_queue_overflows_total",
+			Help: "Total number of increments written synchronously because the update queue was full",
+		},
+	)
+
+	// failClosedDecisions counts requests rejected because Redis was unavailable
+	failClosedDecisions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "rate_limit_fail_closed_total",
+			Help: "Total number of requests rejected due to fail-closed on Redis errors",
+		},
+	)
 )
 
-// CompanyLimits defines rate limits for a specific company
-type CompanyLimits struct {
-	RequestsPerMinute int // Maximum number of requests allowed per minute
-}
+// errNoRateLimitKey is returned for descriptors that match no rate limit rule
+var errNoRateLimitKey = errors.New("no valid rate limit key found in descriptor")
 
-// RateLimitConfig defines rate limits for different types of requests
+// maxEnvoyLimit is the largest limit that can be reported to Envoy, whose
+// RateLimit.RequestsPerUnit and LimitRemaining fields are uint32. Configured
+// limits above this ceiling are still enforced, but reported as the ceiling.
+const maxEnvoyLimit = math.MaxUint32
+
+// RateLimitConfig defines rate limits for different types of requests.
+// A config is immutable once stored on the server: reloads build a complete
+// new config and swap it in, so readers never observe a partial update.
 type RateLimitConfig struct {
-	IPLimit      int64
-	PathLimit    int64
-	CompanyLimit int64
-	UserLimit    int64
-	Window       time.Duration
+	Keys                map[string]KeyRule // Limits per descriptor key, e.g. remote_address or a custom key
+	TenantLimit         int64              // Aggregate limit across all keys carrying the same tenant ID
+	TenantWindow        time.Duration
+	IPPathLimit         int64 // Limit for a single IP on a single path (anti-scraping)
+	IPPathWindow        time.Duration
+	UserWriteLimit      int64 // Limit for a single user's write operations
+	UserWriteWindow     time.Duration
+	CompanyRegionLimit  int64 // Default regional quota per company, overridable in Redis
+	CompanyRegionWindow time.Duration
+	APIKeyPathLimit     int64 // Default per-endpoint quota per API key, overridable in Redis
+	APIKeyPathWindow    time.Duration
+	Window              time.Duration
+	WindowMode          WindowMode      // Counting algorithm (fixed/sliding window, token bucket)
+	WindowAlignment     WindowAlignment // Whether fixed windows roll from the first hit or follow the clock
+	RefillRate          float64         // Token bucket or GCRA rate in requests per second (0 derives it from the limit)
+	BurstCapacity       int64           // Token bucket or GCRA burst capacity (0 uses each key's limit)
+	CountRejected       bool            // Count the hits of rejected requests in fixed and sliding windows
+	FailureMode         FailureMode     // Decision when Redis is unavailable
+	SelfProtection      bool            // Signal Envoy to fall back when internally degraded
+	QueueSaturation     float64         // Queue fill ratio at which the server is degraded
+	DefaultLimit        int64           // Limit for descriptors without a known key (0 disables)
+	DefaultWindow       time.Duration
+	Tuples              map[string]KeyRule // Limits for descriptors matching a tuple of entry keys
+	SharedIPLimit       int64              // Distinct IPs allowed per user within SharedIPWindow (0 disables)
+	SharedIPWindow      time.Duration
+	SharedIPAction      SharingAction               // Whether shared accounts are flagged or rejected
+	DryRun              bool                        // Log and count rejections but always allow requests
+	Allowlist           AccessList                  // Values exempt from rate limiting
+	Denylist            AccessList                  // Values always rejected, taking precedence over the allowlist
+	Unlimited           AccessList                  // Values counted for observability but never limited
+	ObservedCompanies   map[string]bool             // Companies given their own series in rate_limit_company_decisions_total
+	NormalizePaths      bool                        // Collapse ID segments of path values before counting
+	IPv4Prefix          int                         // Count IPv4 addresses per network of this length (0 keeps them whole)
+	IPv6Prefix          int                         // Count IPv6 addresses per network of this length (0 keeps them whole)
+	Domain              string                      // Request domain these rules apply to; empty for the shared rules
+	Domains             map[string]*RateLimitConfig // Rules of domains that have their own, keyed by domain
+	UnknownDomains      DomainAction                // Handling of domains without their own rules
+	UnknownDescriptors  DescriptorPolicy            // Handling of descriptors matching no rule
+	MaxDescriptors      int                         // Descriptors allowed per request (0 disables)
+	TooManyDescriptors  DescriptorPolicy            // Handling of requests with more than MaxDescriptors
+}
+
+// DefaultRateLimitConfig returns the built-in rate limit configuration
+func DefaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		Keys: map[string]KeyRule{
+			"remote_address": {Limit: 1000, Window: time.Minute},  // 1000 requests per minute per IP
+			"path":           {Limit: 500, Window: time.Minute},   // 500 requests per minute per path
+			"company_id":     {Limit: 10000, Window: time.Minute}, // 10000 requests per minute per company
+			"user_id":        {Limit: 100, Window: time.Minute},   // 100 requests per minute per user
+			"api_key":        {Limit: 1000, Window: time.Minute},  // 1000 requests per minute per API key
+		},
+		TenantLimit:         50000,       // 50000 requests per window per tenant (all keys)
+		TenantWindow:        time.Minute, // 1-minute window for tenant ceilings
+		IPPathLimit:         100,         // 100 requests per window per IP on one path
+		IPPathWindow:        time.Minute, // 1-minute window for IP-per-path
+		UserWriteLimit:      20,          // 20 write requests per window per user
+		UserWriteWindow:     time.Minute, // 1-minute window for user writes
+		CompanyRegionLimit:  5000,        // 5000 requests per window per company and region
+		CompanyRegionWindow: time.Minute, // 1-minute window for regional quotas
+		APIKeyPathLimit:     100,         // 100 requests per window per API key and path
+		APIKeyPathWindow:    time.Minute, // 1-minute window for per-endpoint API key quotas
+		Window:              time.Minute, // 1-minute window
+		WindowMode:          FixedWindow,
+		WindowAlignment:     RollingAlignment,
+		CountRejected:       true,
+		FailureMode:         FailClosed,
+		QueueSaturation:     0.9,
+		Tuples:              make(map[string]KeyRule),
+		SharedIPWindow:      time.Hour, // 1-hour window for distinct IPs per user
+		SharedIPAction:      SharingFlag,
+		UnknownDomains:      DomainDefault,
+		UnknownDescriptors:  DescriptorAllow,
+		TooManyDescriptors:  DescriptorError,
+	}
 }
 
 // RateLimitServer implements the Envoy rate limit service interface
 // and manages the rate limiting state and operations
 type RateLimitServer struct {
 	envoy.UnimplementedRateLimitServiceServer
-	localCache   *ristretto.Cache             // Local cache for rate limit decisions
-	redis        *redis.ClusterClient         // Redis cluster client for distributed state
-	updateQueue  chan *envoy.RateLimitRequest // Channel for async updates
-	workerPool   *UpdateWorkerPool            // Pool of workers for processing updates
-	ipLimit      int64                        // Rate limit for IP-based limiting
-	pathLimit    int64                        // Rate limit for path-based limiting
-	companyLimit int64                        // Rate limit for company-based limiting
-	userLimit    int64                        // Rate limit for user-based limiting
-	window       time.Duration                // Time window for rate limiting
-	metrics      *prometheus.CounterVec       // Prometheus metrics
-	logger       *zap.Logger                  // Structured logger
+	localCache  *ristretto.Cache                // Local cache for rate limit decisions; nil when disabled
+	cacheMaxTTL time.Duration                   // Upper bound on how long a count is cached; 0 for the rest of its window
+	redis       redisClient                     // Redis client for distributed state
+	updateQueue chan *counterUpdate             // Channel for async updates, shared with the worker pool
+	workerPool  *UpdateWorkerPool               // Pool of workers for processing updates
+	config      atomic.Pointer[RateLimitConfig] // Current configuration, swapped atomically on reload
+	configPath  string                          // Path of the watched config file, if any
+	strategy    windowStrategy                  // Counting algorithm selected by WindowMode
+	scripts     *scriptManager                  // Loads and runs the Lua scripts
+	tokens      *tokenVerifier                  // Verifies bearer tokens; nil when disabled
+	keyPrefix   string                          // Prepended to every Redis key, e.g. "staging:"; empty by default
+	breaker     *circuitBreaker                 // Keeps checks away from a failing Redis; nil when disabled
+	metrics     *prometheus.CounterVec          // Prometheus metrics
+	logger      *zap.Logger                     // Structured logger
 }
 
 // RateLimitRequest represents a rate limit check request
@@ -111,21 +282,36 @@ type RateLimitRequest struct {
 	Method    string // HTTP method
 }
 
+// counterUpdate is a pending increment of a fixed-window counter
+type counterUpdate struct {
+	key    string        // Windowed Redis key
+	window time.Duration // Window length, set as the TTL of a new key
+	hits   int64         // Hits to add
+}
+
 // UpdateWorkerPool manages a pool of workers for processing rate limit updates
 // and ensures efficient batch processing of Redis operations
 type UpdateWorkerPool struct {
-	workers []*UpdateWorker              // List of worker goroutines
-	queue   chan *envoy.RateLimitRequest // Shared queue for updates
-	logger  *zap.Logger                  // Structured logger
+	workers  []*UpdateWorker     // List of worker goroutines
+	queue    chan *counterUpdate // Shared queue for updates
+	stop     chan struct{}       // Closed to make workers flush and exit
+	stopOnce sync.Once           // Guards closing stop
+	logger   *zap.Logger         // Structured logger
 }
 
 // UpdateWorker processes rate limit updates in batches
 // and handles the actual Redis operations
 type UpdateWorker struct {
-	queue  chan *envoy.RateLimitRequest // Queue for receiving updates
-	redis  *redis.ClusterClient         // Redis client for state updates
-	buffer []*envoy.RateLimitRequest    // Buffer for batching updates
-	logger *zap.Logger                  // Structured logger
+	queue         chan *counterUpdate // Queue for receiving updates
+	redis         redisClient         // Redis client for state updates
+	scripts       *scriptManager      // Runs the increment script by SHA
+	buffer        []*counterUpdate    // Buffer for batching updates
+	flushInterval time.Duration       // Maximum time updates wait in the buffer
+	batchSize     int                 // Buffer length that triggers a flush
+	breaker       *circuitBreaker     // Skips flushes while Redis is failing; may be nil
+	stop          <-chan struct{}     // Closed when the pool shuts down
+	done          chan struct{}       // Closed once the worker has flushed and exited
+	logger        *zap.Logger         // Structured logger
 }
 
 // NewRateLimitServer creates and initializes a new rate limit server
@@ -137,87 +323,211 @@ func NewRateLimitServer() (*RateLimitServer, error) {
 		return nil, fmt.Errorf("failed to create logger: %v", err)
 	}
 
-	// Initialize local cache with optimized settings for high throughput
-	cache, err := ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,     // Track frequency of 10M keys
-		MaxCost:     1 << 30, // Maximum cache size (1GB)
-		BufferItems: 64,      // Keys per Get buffer
-		OnEvict: func(item *ristretto.Item) {
-			logger.Debug("cache item evicted",
-				zap.String("key", fmt.Sprintf("%v", item.Key)),
-				zap.Int64("cost", item.Cost),
-			)
-		},
-	})
+	// Initialize local cache with optimized settings for high throughput,
+	// unless it is disabled
+	cacheOpts, err := cacheOptionsFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cache: %v", err)
+		return nil, err
+	}
+	cache, err := newLocalCache(cacheOpts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize the Redis client for the configured deployment, or an
+	// in-memory store when BACKEND=memory
+	var rdb redisClient
+	switch backend := Backend(os.Getenv("BACKEND")); backend {
+	case "", BackendRedis:
+		rdb, err = newRedisClient(logger)
+		if err != nil {
+			return nil, err
+		}
+	case BackendMemory:
+		store := newMemoryStore(memoryShards)
+		go store.sweep(context.Background(), memorySweepInterval)
+		rdb = store
+		logger.Warn("using in-memory backend, limits are enforced per replica")
+	default:
+		return nil, fmt.Errorf("invalid BACKEND %q", backend)
 	}
 
-	// Define Redis cluster addresses for high availability
-	redisAddrs := []string{
-		"redis-cluster-0.redis:6379",
-		"redis-cluster-1.redis:6379",
-		"redis-cluster-2.redis:6379",
+	// Namespace every Redis key when several environments share a Redis
+	keyPrefix, err := keyPrefixFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
-	// Initialize Redis cluster client with connection settings
-	rdb := redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:        redisAddrs,
-		ReadTimeout:  time.Second, // Timeout for read operations
-		WriteTimeout: time.Second, // Timeout for write operations
-		MaxRedirects: 3,           // Maximum number of redirects
-		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
-			logger.Info("connected to Redis node",
-				zap.String("addr", fmt.Sprintf("%v", cn)),
-			)
-			return nil
+	// Load rate limit configuration from file if configured, allowing the
+	// window mode to be overridden
+	config := DefaultRateLimitConfig()
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		config, err = LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("loaded rate limit configuration",
+			zap.String("path", path),
+		)
+	}
+	if mode := os.Getenv("WINDOW_MODE"); mode != "" {
+		config.setWindowMode(WindowMode(mode))
+	}
+	if err := config.validateAlignment(); err != nil {
+		return nil, err
+	}
+
+	// Select the counting algorithm
+	scripts := newScriptManager(rdb, logger)
+	strategy, err := newWindowStrategy(config.WindowMode, config.CountRejected, scripts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify Redis, preload scripts and warm connections concurrently
+	err = runStartup(context.Background(), logger, startupTimeout, []startupTask{
+		{
+			name:     "redis_ping",
+			critical: true,
+			run: func(ctx context.Context) error {
+				if err := rdb.Ping(ctx).Err(); err != nil {
+					return fmt.Errorf("failed to connect to Redis: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			// Preload every script on all nodes
+			name:     "script_load",
+			critical: true,
+			run:      scripts.load,
+		},
+		{
+			// Open a connection to every master before traffic arrives
+			name: "connection_warmup",
+			run: func(ctx context.Context) error {
+				return warmRedisConnections(ctx, rdb)
+			},
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	// Test Redis connection with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	// Verify bearer tokens when a JWT key is configured
+	tokens, err := newTokenVerifier(context.Background(), logger)
+	if err != nil {
+		return nil, err
 	}
 
 	// Initialize worker pool for processing updates
-	pool := NewUpdateWorkerPool(10, rdb, logger)
+	poolOpts, err := workerPoolOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	// Stop calling Redis for a while after repeated failures, shared by
+	// checks and the update workers
+	breakerOpts, err := breakerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	breaker := newCircuitBreaker(breakerOpts, logger)
+
+	pool := NewUpdateWorkerPool(poolOpts, rdb, scripts, breaker, logger)
 
 	// Create and configure rate limit server with updated limits
 	server := &RateLimitServer{
-		localCache:   cache,
-		redis:        rdb,
-		updateQueue:  make(chan *envoy.RateLimitRequest, 10000),
-		workerPool:   pool,
-		ipLimit:      1000,        // 1000 requests per window per IP
-		pathLimit:    500,         // 500 requests per window per path
-		companyLimit: 10000,       // 10000 requests per window per company
-		userLimit:    100,         // 100 requests per window per user
-		window:       time.Minute, // 1-minute window
-		metrics:      rateLimitRequests,
-		logger:       logger,
+		localCache:  cache,
+		cacheMaxTTL: cacheOpts.MaxTTL,
+		redis:       rdb,
+		updateQueue: pool.queue,
+		workerPool:  pool,
+		configPath:  os.Getenv("CONFIG_PATH"),
+		strategy:    strategy,
+		scripts:     scripts,
+		tokens:      tokens,
+		keyPrefix:   keyPrefix,
+		breaker:     breaker,
+		metrics:     rateLimitRequests,
+		logger:      logger,
+	}
+	server.config.Store(config)
+	config.checkEnvoyLimits(logger)
+
+	// Publish the local cache's internal metrics
+	if cache != nil {
+		go publishCacheMetrics(context.Background(), cache, cacheMetricsInterval)
+	} else {
+		logger.Info("local cache disabled, counting every request against Redis")
+	}
+
+	// Watch the config file so limits can change without a restart
+	if server.configPath != "" {
+		go server.watchConfig(context.Background(), configPollInterval)
 	}
 
 	return server, nil
 }
 
+// WorkerPoolOptions configures the update worker pool
+type WorkerPoolOptions struct {
+	Size          int           // Number of workers
+	FlushInterval time.Duration // Maximum time updates wait in a worker's buffer
+	BatchSize     int           // Buffered updates that trigger an early flush
+}
+
+// workerPoolOptionsFromEnv reads WORKER_POOL_SIZE, WORKER_FLUSH_INTERVAL and
+// WORKER_BATCH_SIZE, defaulting to 10 workers flushing every 100ms or every
+// 100 updates
+func workerPoolOptionsFromEnv() (WorkerPoolOptions, error) {
+	opts := WorkerPoolOptions{
+		Size:          10,
+		FlushInterval: 100 * time.Millisecond,
+		BatchSize:     100,
+	}
+
+	var err error
+	if opts.Size, err = intEnv("WORKER_POOL_SIZE", opts.Size); err != nil {
+		return opts, err
+	}
+	if opts.FlushInterval, err = durationEnv("WORKER_FLUSH_INTERVAL", opts.FlushInterval); err != nil {
+		return opts, err
+	}
+	if opts.BatchSize, err = intEnv("WORKER_BATCH_SIZE", opts.BatchSize); err != nil {
+		return opts, err
+	}
+	if opts.Size == 0 {
+		return opts, fmt.Errorf("WORKER_POOL_SIZE must be positive")
+	}
+	if opts.BatchSize == 0 {
+		return opts, fmt.Errorf("WORKER_BATCH_SIZE must be positive")
+	}
+	return opts, nil
+}
+
 // NewUpdateWorkerPool creates a new pool of update workers
-// with the specified size and Redis client
-func NewUpdateWorkerPool(size int, redis *redis.ClusterClient, logger *zap.Logger) *UpdateWorkerPool {
+// with the specified options and Redis client
+func NewUpdateWorkerPool(opts WorkerPoolOptions, redis redisClient, scripts *scriptManager, breaker *circuitBreaker, logger *zap.Logger) *UpdateWorkerPool {
 	pool := &UpdateWorkerPool{
-		workers: make([]*UpdateWorker, size),
-		queue:   make(chan *envoy.RateLimitRequest, 10000), // Buffer for 10k requests
+		workers: make([]*UpdateWorker, opts.Size),
+		queue:   make(chan *counterUpdate, 10000), // Buffer for 10k updates
+		stop:    make(chan struct{}),
 		logger:  logger,
 	}
 
 	// Initialize and start workers
-	for i := 0; i < size; i++ {
+	for i := 0; i < opts.Size; i++ {
 		pool.workers[i] = &UpdateWorker{
-			queue:  pool.queue,
-			redis:  redis,
-			buffer: make([]*envoy.RateLimitRequest, 0, 100), // Buffer for batching
-			logger: logger,
+			queue:         pool.queue,
+			redis:         redis,
+			scripts:       scripts,
+			breaker:       breaker,
+			buffer:        make([]*counterUpdate, 0, opts.BatchSize), // Buffer for batching
+			flushInterval: opts.FlushInterval,
+			batchSize:     opts.BatchSize,
+			stop:          pool.stop,
+			done:          make(chan struct{}),
+			logger:        logger,
 		}
 		go pool.workers[i].Start()
 	}
@@ -225,17 +535,42 @@ func NewUpdateWorkerPool(size int, redis *redis.ClusterClient, logger *zap.Logge
 	return pool
 }
 
+// Shutdown stops the workers once they have drained the shared queue and
+// flushed their buffers to Redis. It returns ctx's error if the workers do
+// not finish before ctx is done, in which case pending updates may be lost.
+func (p *UpdateWorkerPool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+
+	for _, worker := range p.workers {
+		select {
+		case <-worker.done:
+		case <-ctx.Done():
+			p.logger.Warn("update workers did not finish before shutdown deadline",
+				zap.Int("pending", len(p.queue)),
+			)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // Start begins processing updates in the worker
-// and manages the update buffer and Redis operations
+// and manages the update buffer and Redis operations.
+// It returns, closing done, once the pool is stopped and the worker has
+// flushed everything left in the queue.
 func (w *UpdateWorker) Start() {
-	ticker := time.NewTicker(100 * time.Millisecond) // Flush every 100ms
+	ticker := time.NewTicker(w.flushInterval) // Flush at least every interval
 	defer ticker.Stop()
+	defer close(w.done)
 
 	for {
 		select {
+		case <-w.stop:
+			w.drain()
+			return
 		case req := <-w.queue:
 			w.buffer = append(w.buffer, req)
-			if len(w.buffer) >= 100 { // Flush when buffer is full
+			if len(w.buffer) >= w.batchSize { // Flush when buffer is full
 				w.flush()
 			}
 		case <-ticker.C:
@@ -246,6 +581,23 @@ func (w *UpdateWorker) Start() {
 	}
 }
 
+// drain moves everything left in the queue into the buffer, flushing as it
+// fills, and flushes the remainder
+func (w *UpdateWorker) drain() {
+	for {
+		select {
+		case req := <-w.queue:
+			w.buffer = append(w.buffer, req)
+			if len(w.buffer) >= w.batchSize {
+				w.flush()
+			}
+		default:
+			w.flush()
+			return
+		}
+	}
+}
+
 // flush writes buffered updates to Redis
 // and handles any errors that occur during the operation
 func (w *UpdateWorker) flush() {
@@ -253,36 +605,63 @@ func (w *UpdateWorker) flush() {
 		return
 	}
 
-	pipe := w.redis.Pipeline()
-	// Batch increment counters for each request
-	for _, req := range w.buffer {
-		// Extract IP and company ID from descriptors
-		ip := ""
-		companyID := ""
-		for _, entry := range req.Descriptors {
-			for _, kv := range entry.Entries {
-				if kv.Key == "ip" {
-					ip = kv.Value
-				} else if kv.Key == "company_id" {
-					companyID = kv.Value
-				}
-			}
-		}
+	// Bound the batch so a stalled Redis cannot block the worker forever
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
 
-		// Increment counters for each type of limit
-		if ip != "" {
-			pipe.Incr(context.Background(), fmt.Sprintf("ip:%s", ip))
+	// Sum the hits per key so each counter is written once per batch
+	pending := make(map[string]*counterUpdate, len(w.buffer))
+	for _, update := range w.buffer {
+		if p, ok := pending[update.key]; ok {
+			p.hits += update.hits
+			continue
 		}
-		if companyID != "" {
-			pipe.Incr(context.Background(), fmt.Sprintf("company:%s", companyID))
+		merged := *update
+		pending[update.key] = &merged
+	}
+
+	// Drop the batch rather than wait on Redis while the breaker is open;
+	// the hits were already counted in the local cache
+	if !w.breaker.allow() {
+		breakerRejections.WithLabelValues("flush").Inc()
+		w.logger.Warn("dropping counter updates while Redis circuit breaker is open",
+			zap.Int("batch_size", len(w.buffer)),
+		)
+		w.buffer = w.buffer[:0]
+		return
+	}
+
+	updates := make([]*counterUpdate, 0, len(pending))
+	cmds := make([]*redis.Cmd, 0, len(pending))
+	pipe := newPipeline(w.redis)
+	for _, update := range pending {
+		updates = append(updates, update)
+		cmds = append(cmds, pipe.EvalSha(ctx, w.scripts.sha(incrScript), []string{update.key}, update.window.Milliseconds(), update.hits))
+	}
+	start := time.Now()
+	_, err := pipe.Exec(ctx)
+
+	// Resend the updates Redis had no script for with the script itself
+	if err != nil {
+		var missing []*counterUpdate
+		for i, cmd := range cmds {
+			if w.scripts.missing(cmd.Err()) {
+				missing = append(missing, updates[i])
+			}
 		}
-		if ip != "" && companyID != "" {
-			pipe.Incr(context.Background(), fmt.Sprintf("combined:%s:%s", ip, companyID))
+		if len(missing) > 0 {
+			retry := newPipeline(w.redis)
+			for _, update := range missing {
+				retry.Eval(ctx, incrScript, []string{update.key}, update.window.Milliseconds(), update.hits)
+			}
+			_, err = retry.Exec(ctx)
 		}
 	}
+	observeRedis("pipeline_exec", start)
 
-	// Execute pipeline and handle errors
-	if _, err := pipe.Exec(context.Background()); err != nil {
+	// Handle errors
+	w.breaker.record(err)
+	if err != nil {
 		redisErrors.WithLabelValues("pipeline_exec").Inc()
 		w.logger.Error("failed to execute Redis pipeline",
 			zap.Error(err),
@@ -293,14 +672,76 @@ func (w *UpdateWorker) flush() {
 	w.buffer = w.buffer[:0] // Clear buffer
 }
 
+// flushTimeout bounds each batch of updates written to Redis
+const flushTimeout = 2 * time.Second
+
+// shutdownTimeout bounds how long shutdown waits for in-flight requests and
+// for the update workers to flush
+const shutdownTimeout = 15 * time.Second
+
 // ShouldRateLimit implements the Envoy rate limit service interface
 // and processes rate limit requests
 func (s *RateLimitServer) ShouldRateLimit(ctx context.Context, req *envoy.RateLimitRequest) (*envoy.RateLimitResponse, error) {
 	start := time.Now()
 	defer func() {
-		rateLimitLatency.WithLabelValues("request").Observe(time.Since(start).Seconds())
+		rateLimitLatency.WithLabelValues("request", "").Observe(time.Since(start).Seconds())
 	}()
 
+	ctx, span := tracer.Start(ctx, "ShouldRateLimit")
+	defer span.End()
+
+	// Evaluate the whole request against one configuration snapshot, so a
+	// concurrent reload is never observed half-applied
+	config := s.config.Load()
+
+	// Apply the rules of the request's domain, rejecting the request if the
+	// domain has none and unknown domains are rejected
+	config, ok := config.forDomain(req.Domain)
+	if !ok {
+		s.logger.Warn("rejected request for unknown domain",
+			zap.String("domain", req.Domain),
+			zap.Bool("dry_run", config.DryRun),
+		)
+		return s.rejectRequest(config, req), nil
+	}
+
+	// Bound the counters a single request can have checked
+	if response, err := config.checkDescriptorCount(len(req.Descriptors)); response != nil || err != nil {
+		s.logger.Warn("rejected request with too many descriptors",
+			zap.Int("descriptors", len(req.Descriptors)),
+			zap.Int("max", config.MaxDescriptors),
+			zap.Bool("dry_run", config.DryRun),
+		)
+		if config.DryRun {
+			return s.rejectRequest(config, req), nil
+		}
+		return response, err
+	}
+
+	// Hand the decision back to Envoy's local fallback while degraded
+	if err := s.checkSelfHealth(config); err != nil {
+		return nil, err
+	}
+
+	// Count requests against the company and user in the verified token
+	// rather than the values the client sent
+	if s.tokens != nil {
+		claims, err := s.tokens.verify(ctx)
+		switch {
+		case err == nil:
+			tokenChecks.WithLabelValues("valid").Inc()
+		case errors.Is(err, errNoToken):
+			tokenChecks.WithLabelValues("missing").Inc()
+		default:
+			tokenChecks.WithLabelValues("invalid").Inc()
+			s.logger.Warn("rejected invalid bearer token", zap.Error(err))
+			if config.FailureMode == FailClosed {
+				return s.rejectRequest(config, req), nil
+			}
+		}
+		req.Descriptors = applyClaims(req.Descriptors, claims)
+	}
+
 	// Extract request metadata for tracing
 	requestID := ctx.Value(requestIDKey)
 	traceID := ctx.Value(traceIDKey)
@@ -319,6 +760,22 @@ func (s *RateLimitServer) ShouldRateLimit(ctx context.Context, req *envoy.RateLi
 		Statuses:    make([]*envoy.RateLimitResponse_DescriptorStatus, len(req.Descriptors)),
 	}
 
+	// Check rate limits, counting the request's hits against every
+	// descriptor at once
+	hits := make([]int64, len(req.Descriptors))
+	for i, descriptor := range req.Descriptors {
+		hits[i] = hitsAddend(req, descriptor)
+	}
+	results, errs, rejected := s.checkRateLimits(ctx, config, req.Descriptors, hits)
+	if err := contextDone(ctx); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	denied, err := config.checkUnknownDescriptors(req.Descriptors, errs)
+	if err != nil {
+		s.logger.Warn("rejected request with a descriptor matching no rule", zap.Error(err))
+		return nil, err
+	}
+
 	// Process each descriptor
 	for i, descriptor := range req.Descriptors {
 		status := &envoy.RateLimitResponse_DescriptorStatus{
@@ -327,88 +784,1011 @@ func (s *RateLimitServer) ShouldRateLimit(ctx context.Context, req *envoy.RateLi
 			LimitRemaining: 0,
 		}
 
-		// Check rate limits
-		limit, remaining, err := s.checkRateLimit(descriptor)
+		result, err := results[i], errs[i]
+		if errors.Is(err, errDenylisted) {
+			status.Code = envoy.RateLimitResponse_OVER_LIMIT
+			response.Statuses[i] = status
+			response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
+			continue
+		}
+		if errors.Is(err, errNoRateLimitKey) {
+			// Descriptors no rule applies to, such as tenant-only ones
+			// handled below, are not limited on their own unless the
+			// unknown descriptor policy rejects them
+			if denied[i] {
+				status.Code = envoy.RateLimitResponse_OVER_LIMIT
+				response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
+			}
+			response.Statuses[i] = status
+			continue
+		}
 		if err != nil {
 			s.logger.Error("error checking rate limit",
 				zap.Error(err),
 				zap.Any("descriptor", descriptor),
 			)
-			rateLimitRequests.WithLabelValues("error", "request", err.Error()).Inc()
+			rateLimitRequests.WithLabelValues("error", "request", classifyError(err)).Inc()
 			status.Code = envoy.RateLimitResponse_OVER_LIMIT
+			response.Statuses[i] = status
+			response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
 			continue
 		}
 
-		// Set limit information if applicable
-		if limit > 0 {
+		// Set the decision and limit information if applicable
+		if result.Decision == DecisionOverLimit {
+			status.Code = envoy.RateLimitResponse_OVER_LIMIT
+		}
+		if result.Limit > 0 {
 			status.CurrentLimit = &envoy.RateLimitResponse_RateLimit{
-				RequestsPerUnit: uint32(limit),
-				Unit:            envoy.RateLimitResponse_RateLimit_MINUTE,
+				RequestsPerUnit: toEnvoyLimit("requests_per_unit", result.Limit),
+				Unit:            unitForWindow(result.Window),
 			}
-			status.LimitRemaining = uint32(remaining)
+			status.LimitRemaining = toEnvoyLimit("limit_remaining", result.Remaining)
+			status.DurationUntilReset = durationpb.New(result.Reset)
 		}
 
+		// Envoy only enforces the overall code, so any rejected descriptor
+		// rejects the whole request
+		if status.Code == envoy.RateLimitResponse_OVER_LIMIT {
+			response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
+		}
 		response.Statuses[i] = status
 	}
 
+	// Enforce the tenant-wide ceiling on top of the per-key limits, unless
+	// the request was already rejected without contacting Redis
+	if tenantID := requestValue(req.Descriptors, "tenant_id"); tenantID != "" && !rejected {
+		overLimit, err := s.checkTenantLimit(ctx, config, tenantID, hitsAddend(req, nil))
+		if err != nil {
+			s.logger.Error("error checking tenant limit",
+				zap.Error(err),
+				zap.String("tenant_id", tenantID),
+			)
+			rateLimitRequests.WithLabelValues("error", "tenant", classifyError(err)).Inc()
+		}
+		if overLimit {
+			response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
+			for i, descriptor := range req.Descriptors {
+				if descriptorValue(descriptor, "tenant_id") == "" {
+					continue
+				}
+				if response.Statuses[i] == nil {
+					response.Statuses[i] = &envoy.RateLimitResponse_DescriptorStatus{}
+				}
+				response.Statuses[i].Code = envoy.RateLimitResponse_OVER_LIMIT
+			}
+		}
+	}
+
+	// Detect accounts shared across many IPs, independently of the user's
+	// request count. Errors only skip detection; they never reject requests.
+	userID, ip := requestValue(req.Descriptors, "user_id"), requestValue(req.Descriptors, "remote_address")
+	if config.SharedIPLimit > 0 && userID != "" && ip != "" && !rejected {
+		shared, err := s.checkSharedAccount(ctx, config, userID, ip)
+		if err != nil {
+			s.logger.Error("error checking distinct IPs per user",
+				zap.Error(err),
+				zap.String("user_id", userID),
+			)
+			rateLimitRequests.WithLabelValues("error", "shared_account", classifyError(err)).Inc()
+		}
+		if shared {
+			sharedAccounts.WithLabelValues(string(config.SharedIPAction)).Inc()
+			s.logger.Warn("user seen from too many distinct IPs",
+				zap.String("user_id", userID),
+				zap.String("ip", ip),
+				zap.Int64("limit", config.SharedIPLimit),
+				zap.String("action", string(config.SharedIPAction)),
+			)
+		}
+		if shared && config.SharedIPAction == SharingReject {
+			response.OverallCode = envoy.RateLimitResponse_OVER_LIMIT
+			for i, descriptor := range req.Descriptors {
+				if descriptorValue(descriptor, "user_id") == "" {
+					continue
+				}
+				if response.Statuses[i] == nil {
+					response.Statuses[i] = &envoy.RateLimitResponse_DescriptorStatus{}
+				}
+				response.Statuses[i].Code = envoy.RateLimitResponse_OVER_LIMIT
+			}
+		}
+	}
+
+	// Report the most constrained descriptor to the client as headers
+	response.ResponseHeadersToAdd = rateLimitHeaders(response.Statuses)
+
+	// In dry-run mode the decision is only observed, never enforced
+	if config.DryRun {
+		s.allowShadowRejections(req, response)
+	}
+
 	// Record success metric
 	rateLimitRequests.WithLabelValues("success", "request", "").Inc()
 	return response, nil
 }
 
-// checkRateLimit checks if a request should be rate limited based on its descriptors
-func (s *RateLimitServer) checkRateLimit(descriptor *ratelimit.RateLimitDescriptor) (int, int, error) {
+// rateLimitHeaders returns the X-RateLimit-Limit, X-RateLimit-Remaining
+// and X-RateLimit-Reset headers for the limited descriptor with the fewest
+// requests remaining, or nil if no descriptor reported a limit. The reset is
+// in whole seconds, rounded up.
+func rateLimitHeaders(statuses []*envoy.RateLimitResponse_DescriptorStatus) []*core.HeaderValue {
+	var lowest *envoy.RateLimitResponse_DescriptorStatus
+	for _, status := range statuses {
+		if status == nil || status.CurrentLimit == nil {
+			continue
+		}
+		if lowest == nil || status.LimitRemaining < lowest.LimitRemaining {
+			lowest = status
+		}
+	}
+	if lowest == nil {
+		return nil
+	}
+
+	reset := time.Duration(0)
+	if lowest.DurationUntilReset != nil {
+		reset = lowest.DurationUntilReset.AsDuration()
+	}
+	return []*core.HeaderValue{
+		{Key: "X-RateLimit-Limit", Value: strconv.FormatUint(uint64(lowest.CurrentLimit.RequestsPerUnit), 10)},
+		{Key: "X-RateLimit-Remaining", Value: strconv.FormatUint(uint64(lowest.LimitRemaining), 10)},
+		{Key: "X-RateLimit-Reset", Value: strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10)},
+	}
+}
+
+// allowShadowRejections records and logs every descriptor the response
+// rejects, then rewrites the response to allow the request
+func (s *RateLimitServer) allowShadowRejections(req *envoy.RateLimitRequest, response *envoy.RateLimitResponse) {
+	for i, status := range response.Statuses {
+		if status == nil || status.Code != envoy.RateLimitResponse_OVER_LIMIT {
+			continue
+		}
+		descriptor := req.Descriptors[i]
+		shadowRejections.WithLabelValues(tupleRuleKey(descriptor)).Inc()
+		s.logger.Info("would reject descriptor (dry run)",
+			zap.Any("descriptor", descriptor),
+			zap.Uint32("limit_remaining", status.LimitRemaining),
+		)
+		status.Code = envoy.RateLimitResponse_OK
+	}
+	response.OverallCode = envoy.RateLimitResponse_OK
+}
+
+// rejectRequest rejects every descriptor of a request turned away before
+// its descriptors are checked. In dry-run mode the rejections are recorded
+// as shadow rejections and the request is allowed.
+func (s *RateLimitServer) rejectRequest(config *RateLimitConfig, req *envoy.RateLimitRequest) *envoy.RateLimitResponse {
+	response := overLimitResponse(len(req.Descriptors))
+	if config.DryRun {
+		s.allowShadowRejections(req, response)
+	}
+	return response
+}
+
+// Decision is the outcome of checking a descriptor against its limit
+type Decision int
+
+const (
+	// DecisionOK allows the descriptor
+	DecisionOK Decision = iota
+
+	// DecisionOverLimit rejects the descriptor
+	DecisionOverLimit
+)
+
+// RateLimitResult is the outcome of checking one descriptor
+type RateLimitResult struct {
+	Decision  Decision      // Whether the descriptor is allowed
+	Limit     int64         // Applied limit; 0 when no limit is reported, e.g. allowlisted or fail-open
+	Remaining int64         // Requests left in the window, never negative
+	Window    time.Duration // Window length, reported as the limit's unit
+	Reset     time.Duration // Time until the window resets
+}
+
+// newRateLimitResult builds the result for a key that has counted count
+// hits against limit. Reaching the limit leaves nothing remaining; only
+// exceeding it rejects the descriptor.
+func newRateLimitResult(count, limit int64, window, reset time.Duration) RateLimitResult {
+	result := RateLimitResult{
+		Decision:  DecisionOK,
+		Limit:     limit,
+		Remaining: max(limit-count, 0),
+		Window:    window,
+		Reset:     reset,
+	}
+	if count > limit {
+		result.Decision = DecisionOverLimit
+	}
+	return result
+}
+
+// rateLimitCheck is a descriptor check whose key and limit are resolved,
+// waiting for its hits to be counted
+type rateLimitCheck struct {
+	ctx       context.Context // Carries the check's span
+	span      trace.Span      // Span ended by finishCheck
+	start     time.Time       // When the check started
+	key       string          // Windowed Redis key
+	keyType   string          // Matched key type, for metrics
+	limit     int64
+	window    time.Duration // Window length reported to clients
+	expiry    time.Duration // TTL of a new counter: the window, or what is left of a calendar period
+	hits      int64
+	company   string      // Company ID of the descriptor, if any
+	cached    cachedCount // Local cache entry for key, if found
+	found     bool
+	unlimited bool // Counted but never limited, see RateLimitConfig.Unlimited
+}
+
+// checkRateLimits checks a request's descriptors, counting hits[i] against
+// the i-th. The increments written synchronously are sent together in a
+// single Redis pipeline, so a request costs one round trip however many
+// descriptors it carries, and each descriptor still gets its own decision.
+//
+// When a descriptor is rejected without contacting Redis, because it is
+// denylisted or the local cache knows it to be over its limit, the request
+// is rejected whatever the other descriptors count, so their hits are not
+// counted and it reports true; Redis is then not contacted at all. In dry-run
+// mode every descriptor is still counted, as the request will be allowed.
+func (s *RateLimitServer) checkRateLimits(ctx context.Context, config *RateLimitConfig, descriptors []*ratelimit.RateLimitDescriptor, hits []int64) ([]RateLimitResult, []error, bool) {
+	results := make([]RateLimitResult, len(descriptors))
+	errs := make([]error, len(descriptors))
+
+	checks := make([]*rateLimitCheck, len(descriptors))
+	rejected := false
+	for i, descriptor := range descriptors {
+		// Stop doing Redis work for a caller that has gone away
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		check, result, err := s.prepareCheck(ctx, config, descriptor, hits[i])
+		if check == nil {
+			results[i], errs[i] = result, err
+			if result.Decision == DecisionOverLimit || errors.Is(err, errDenylisted) {
+				rejected = true
+			}
+			continue
+		}
+		checks[i] = check
+	}
+
+	if rejected && !config.DryRun {
+		for i, check := range checks {
+			if check == nil {
+				continue
+			}
+			// Report the quota of uncounted descriptors the local cache
+			// knows about
+			if reset := time.Until(check.cached.resetAt); check.found && reset > 0 {
+				results[i] = newRateLimitResult(check.cached.count, check.limit, check.window, reset)
+			}
+			check.span.End()
+		}
+		shortCircuitedRequests.Inc()
+		return results, errs, true
+	}
+
+	var batch []*rateLimitCheck
+	var batchIndexes []int
+	for i, check := range checks {
+		if check == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			check.span.End()
+			errs[i] = err
+			continue
+		}
+
+		// While the circuit breaker is open Redis is not contacted: a cached
+		// fixed-window count still decides, otherwise the failure mode
+		// applies. Fixed-window increments are queued for the worker pool to
+		// batch, while the other modes need their atomic scripts. Queued hits
+		// are only visible through the local cache, so without it every
+		// increment is written synchronously.
+		switch {
+		case !s.breaker.allow():
+			count, reset, err := s.countCached(config, check)
+			results[i], errs[i] = s.finishCheck(config, check, count, reset, err)
+		case config.WindowMode == FixedWindow && s.localCache != nil:
+			count, reset, err := s.countAsync(check.ctx, check.key, check.limit, check.expiry, check.hits, check.cached, check.found, config.CountRejected)
+			results[i], errs[i] = s.finishCheck(config, check, count, reset, err)
+		default:
+			batch = append(batch, check)
+			batchIndexes = append(batchIndexes, i)
+		}
+	}
+	if len(batch) == 0 {
+		return results, errs, false
+	}
+
+	reqs := make([]counterRequest, len(batch))
+	for j, check := range batch {
+		reqs[j] = counterRequest{key: check.key, limit: check.limit, window: check.expiry, hits: check.hits}
+	}
+	counts := s.countSyncAll(ctx, reqs, config.CountRejected)
+
+	// The pipeline is one call as far as the circuit breaker is concerned
+	var batchErr error
+	for j, check := range batch {
+		count := counts[j]
+		if batchErr == nil {
+			batchErr = count.err
+		}
+		results[batchIndexes[j]], errs[batchIndexes[j]] = s.finishCheck(config, check, count.count, count.reset, count.err)
+	}
+	s.recordRedisResult(ctx, batchErr)
+
+	return results, errs, false
+}
+
+// prepareCheck resolves the key and limit that apply to a descriptor. It
+// returns a nil check, with the decision, when the descriptor is decided
+// without counting its hits: access-listed values, descriptors no rule
+// applies to, and keys the local cache already knows to be over the limit.
+func (s *RateLimitServer) prepareCheck(ctx context.Context, config *RateLimitConfig, descriptor *ratelimit.RateLimitDescriptor, hits int64) (*rateLimitCheck, RateLimitResult, error) {
+	// Denylisted values are rejected and allowlisted ones exempted without
+	// contacting Redis
+	if config.Denylist.matches(descriptor) {
+		accessListHits.WithLabelValues("deny").Inc()
+		return nil, RateLimitResult{}, errDenylisted
+	}
+	if config.Allowlist.matches(descriptor) {
+		accessListHits.WithLabelValues("allow").Inc()
+		return nil, RateLimitResult{}, nil
+	}
+
+	// Unlimited values are still counted, but never rejected
+	unlimited := config.Unlimited.matches(descriptor)
+	if unlimited {
+		accessListHits.WithLabelValues("unlimited").Inc()
+	}
+
+	// Count unbounded values such as resource IDs or addresses under a
+	// bounded set of keys
+	descriptor = config.normalizeDescriptor(descriptor)
+
+	// The span ends here for decided descriptors, or in finishCheck
+	ctx, span := tracer.Start(ctx, "checkRateLimit")
+	var check *rateLimitCheck
+	defer func() {
+		if check == nil {
+			span.End()
+		}
+	}()
+
+	start := time.Now()
 	var limit int64
-	var key string
+	var key, keyType string
+	window := config.Window
 
-	// Extract rate limit key and limit based on descriptor
+	// Extract rate limit key and limit based on descriptor; when several
+	// entries have a rule, the last one wins
 	for _, entry := range descriptor.Entries {
-		switch entry.Key {
-		case "remote_address":
-			limit = s.ipLimit
-			key = fmt.Sprintf("ip:%s", entry.Value)
-		case "path":
-			limit = s.pathLimit
-			key = fmt.Sprintf("path:%s", entry.Value)
-		case "company_id":
-			limit = s.companyLimit
-			key = fmt.Sprintf("company:%s", entry.Value)
-		case "user_id":
-			limit = s.userLimit
-			key = fmt.Sprintf("user:%s", entry.Value)
+		rule, ok := config.Keys[entry.Key]
+		if !ok {
+			continue
 		}
+		limit = rule.Limit
+		window = rule.Window
+		keyType = keyTypeFor(entry.Key)
+		key = s.buildKey(keyType, entry.Value)
+	}
+
+	// A company's limit may be overridden per company in Redis
+	if keyType == "company" {
+		limit = s.overrideLimit(ctx, s.overrideKey(key), limit)
+	}
+
+	// Fall back to the default rule for descriptors without a known key
+	if key == "" && config.DefaultLimit > 0 && len(descriptor.Entries) > 0 {
+		entry := descriptor.Entries[0]
+		limit = config.DefaultLimit
+		window = config.DefaultWindow
+		key = s.buildKey(entry.Key, entry.Value)
+		keyType = "default"
+	}
+
+	// A descriptor carrying both an IP and a path limits that IP on that
+	// path only, independently of the standalone IP and path descriptors
+	ip, path := descriptorValue(descriptor, "remote_address"), descriptorValue(descriptor, "path")
+	if ip != "" && path != "" {
+		limit = config.IPPathLimit
+		window = config.IPPathWindow
+		key = s.buildKey("ip", ip) + ":path:" + path
+		keyType = "ip_path"
+	}
+
+	// A descriptor carrying both a user and an HTTP method caps that user's
+	// write operations; reads fall through to the descriptor's other rules
+	userID, method := descriptorValue(descriptor, "user_id"), descriptorValue(descriptor, "method")
+	if userID != "" && method != "" && isWriteMethod(method) {
+		limit = config.UserWriteLimit
+		window = config.UserWriteWindow
+		key = s.buildKey("user", userID) + ":writes"
+		keyType = "user_write"
+	}
+
+	// A descriptor carrying both a company and a region enforces that
+	// company's regional quota, which may be overridden per company in Redis
+	companyID, region := descriptorValue(descriptor, "company_id"), descriptorValue(descriptor, "region")
+	if companyID != "" && region != "" {
+		key = s.buildKey("company", companyID) + ":region:" + region
+		keyType = "company_region"
+		limit = s.overrideLimit(ctx, s.overrideKey(key), config.CompanyRegionLimit)
+		window = config.CompanyRegionWindow
+	}
+
+	// A descriptor carrying both an API key and a path enforces that key's
+	// quota for the endpoint, which may be overridden per key in Redis
+	apiKey := descriptorValue(descriptor, "api_key")
+	if apiKey != "" && path != "" {
+		key = s.buildKey("apikey", apiKey) + ":path:" + path
+		keyType = "apikey_path"
+		limit = s.overrideLimit(ctx, s.overrideKey(key), config.APIKeyPathLimit)
+		window = config.APIKeyPathWindow
+	}
+
+	// A descriptor whose entry keys match a configured tuple rule is limited
+	// on the combination of all its values, independently of single keys
+	if rule, ok := config.Tuples[tupleRuleKey(descriptor)]; ok {
+		limit = rule.Limit
+		window = rule.Window
+		key = s.tupleKey(descriptor)
+		keyType = "tuple"
 	}
 
 	if key == "" {
-		return 0, 0, fmt.Errorf("no valid rate limit key found in descriptor")
+		return nil, RateLimitResult{}, errNoRateLimitKey
+	}
+	limit, window = config.bucketParams(limit, window)
+	key = windowedKey(config.scopeKey(key), window)
+	hits = cappedHits(hits, limit)
+
+	// Calendar-aligned counters are scoped to their period and expire at its
+	// end, however far into the period the first hit came
+	expiry := window
+	if config.WindowAlignment == CalendarAlignment {
+		var periodStart time.Time
+		periodStart, expiry = calendarPeriod(start, window)
+		key = fmt.Sprintf("%s:p%d", key, periodStart.Unix())
+	}
+
+	// The local cache only short-circuits over-limit decisions: a key
+	// already at its limit within the current window is rejected without
+	// contacting Redis. Under-limit requests always count against Redis, so
+	// the only inconsistency is that a replica may keep rejecting a key for up
+	// to one window after other replicas' counters (or an admin reset) would
+	// have allowed it again; it never admits requests over the limit. Only
+	// fixed windows are short-circuited, as the other modes free capacity
+	// gradually rather than at the end of the window. Entries expire when
+	// their window resets; the reset time is checked as well, so a decision
+	// is never served from a window that has ended.
+	cached, found := s.cacheGet(key)
+	if found && !unlimited && config.WindowMode == FixedWindow && time.Now().Before(cached.resetAt) {
+		count := cached.count + hits
+		if count > limit {
+			cacheRejections.WithLabelValues(keyType).Inc()
+			recordDecision(ctx, keyType, start, count, limit)
+			config.recordCompanyDecision(descriptorValue(descriptor, "company_id"), true)
+			return nil, newRateLimitResult(count, limit, window, time.Until(cached.resetAt)), nil
+		}
+	}
+
+	check = &rateLimitCheck{
+		ctx:       ctx,
+		span:      span,
+		start:     start,
+		key:       key,
+		keyType:   keyType,
+		limit:     limit,
+		window:    window,
+		expiry:    expiry,
+		hits:      hits,
+		company:   descriptorValue(descriptor, "company_id"),
+		cached:    cached,
+		found:     found,
+		unlimited: unlimited,
+	}
+	return check, RateLimitResult{}, nil
+}
+
+// countCached counts a check's hits against its locally cached count while
+// the circuit breaker keeps Redis from being contacted. Only fixed windows
+// can be decided this way; other checks get errBreakerOpen.
+func (s *RateLimitServer) countCached(config *RateLimitConfig, check *rateLimitCheck) (int64, time.Duration, error) {
+	breakerRejections.WithLabelValues("check").Inc()
+	reset := time.Until(check.cached.resetAt)
+	if !check.found || config.WindowMode != FixedWindow || reset <= 0 {
+		return 0, 0, errBreakerOpen
+	}
+	count := check.cached.count + check.hits
+	if !config.CountRejected && count > check.limit {
+		return count, reset, nil
+	}
+	s.cacheSet(check.key, cachedCount{count: count, resetAt: check.cached.resetAt}, reset)
+	return count, reset, nil
+}
+
+// finishCheck completes a check with the outcome of counting its hits,
+// applying the failure mode if they could not be counted
+func (s *RateLimitServer) finishCheck(config *RateLimitConfig, check *rateLimitCheck, count int64, reset time.Duration, err error) (RateLimitResult, error) {
+	defer check.span.End()
+
+	if err != nil {
+		// A caller that gave up is not a Redis failure; the decision is
+		// discarded, so the failure mode does not apply
+		if err := contextDone(check.ctx); err != nil {
+			return RateLimitResult{}, err
+		}
+		// Unlimited values are only counted for observability, so an
+		// uncounted hit never rejects them
+		if check.unlimited {
+			return RateLimitResult{}, nil
+		}
+		if config.FailureMode == FailOpen {
+			failOpenDecisions.Inc()
+			s.logger.Warn("allowing request on Redis error (fail-open)",
+				zap.Error(err),
+				zap.String("key", check.key),
+			)
+			return RateLimitResult{}, nil
+		}
+		failClosedDecisions.Inc()
+		return RateLimitResult{}, err
+	}
+
+	if check.unlimited {
+		recordDecision(check.ctx, check.keyType, check.start, count, math.MaxInt64)
+		config.recordCompanyDecision(check.company, false)
+		result := newRateLimitResult(count, check.limit, check.window, reset)
+		result.Decision = DecisionOK
+		result.Remaining = maxEnvoyLimit
+		return result, nil
+	}
+
+	recordDecision(check.ctx, check.keyType, check.start, count, check.limit)
+	config.recordCompanyDecision(check.company, count > check.limit)
+
+	return newRateLimitResult(count, check.limit, check.window, reset), nil
+}
+
+// recordRedisResult reports the outcome of a Redis call to the circuit
+// breaker, unless the call failed because the caller gave up
+func (s *RateLimitServer) recordRedisResult(ctx context.Context, err error) {
+	if err != nil && contextDone(ctx) != nil {
+		return
+	}
+	s.breaker.record(err)
+}
+
+// contextDone returns the error of a context that is done, or whose
+// deadline has passed. Redis connections take their deadlines from the
+// context, so a call can time out just before the context reports it.
+func contextDone(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// asyncRefreshInterval bounds how long a fixed-window count is estimated
+// locally before it is re-read from Redis, picking up other replicas' hits
+const asyncRefreshInterval = time.Second
+
+// cachedCount is a counter value held in the local cache
+type cachedCount struct {
+	count   int64     // Hits counted in the window, including queued ones
+	resetAt time.Time // When the window resets
+}
+
+// countSync increments a counter in Redis and returns its new value and the
+// time until its window resets
+func (s *RateLimitServer) countSync(ctx context.Context, key string, limit int64, window time.Duration, hits int64, countRejected bool) (int64, time.Duration, error) {
+	result := s.countSyncAll(ctx, []counterRequest{{key: key, limit: limit, window: window, hits: hits}}, countRejected)[0]
+	return result.count, result.reset, result.err
+}
+
+// countSyncAll increments several counters in one Redis pipeline and returns
+// their new values and the time until their windows reset, falling back to
+// the full window for a key without a TTL. Unless countRejected is set, the
+// hits of rejected requests are left out of the cached counts, as the
+// counters did not record them.
+func (s *RateLimitServer) countSyncAll(ctx context.Context, reqs []counterRequest, countRejected bool) []counterResult {
+	results := s.strategy.incrementAll(ctx, reqs)
+	for i, req := range reqs {
+		if results[i].err != nil {
+			continue
+		}
+		if results[i].reset <= 0 {
+			results[i].reset = req.window
+		}
+
+		// Refresh the cached count from Redis; the entry expires when the
+		// window resets, so a cached over-limit decision cannot outlive it.
+		// Rejected hits the counter did not record are left out.
+		count := results[i].count
+		if !countRejected && count > req.limit {
+			count -= req.hits
+		}
+		s.cacheSet(req.key, cachedCount{count: count, resetAt: time.Now().Add(results[i].reset)}, results[i].reset)
+	}
+	return results
+}
+
+// countAsync counts hits against a fixed-window counter without writing it
+// synchronously. The current value comes from the local cache, or from a
+// Redis read on a miss; the increment is queued for the worker pool and
+// applied to the cached value straight away, so this replica's decisions
+// include its own queued hits. Cached values are re-read at least every
+// asyncRefreshInterval. If the queue is full the hits are counted
+// synchronously instead of being dropped. Unless countRejected is set, hits
+// that would take the counter over the limit are neither queued nor cached.
+// Only the calls that reach Redis are reported to the circuit breaker; a
+// count answered from the cache is neither a success nor a failure.
+func (s *RateLimitServer) countAsync(ctx context.Context, key string, limit int64, window time.Duration, hits int64, cached cachedCount, found bool, countRejected bool) (int64, time.Duration, error) {
+	base, reset := cached.count, time.Until(cached.resetAt)
+	if !found {
+		pipe := newPipeline(s.redis)
+		get := pipe.Get(ctx, key)
+		pttl := pipe.PTTL(ctx, key)
+		start := time.Now()
+		_, err := pipe.Exec(ctx)
+		observeRedis("read", start)
+		if errors.Is(err, redis.Nil) {
+			err = nil
+		}
+		s.recordRedisResult(ctx, err)
+		if err != nil {
+			redisErrors.WithLabelValues("read").Inc()
+			return 0, 0, err
+		}
+		base, _ = get.Int64() // A missing key has no hits yet
+		reset = pttl.Val()
+	}
+	if reset <= 0 {
+		reset = window
+	}
+
+	if !countRejected && base+hits > limit {
+		if !found {
+			s.cacheSet(key, cachedCount{count: base, resetAt: time.Now().Add(reset)}, min(reset, asyncRefreshInterval))
+		}
+		return base + hits, reset, nil
+	}
+
+	select {
+	case s.updateQueue <- &counterUpdate{key: key, window: window, hits: hits}:
+	default:
+		queueOverflows.Inc()
+		count, reset, err := s.countSync(ctx, key, limit, window, hits, countRejected)
+		s.recordRedisResult(ctx, err)
+		return count, reset, err
+	}
+
+	count := base + hits
+	s.cacheSet(key, cachedCount{count: count, resetAt: time.Now().Add(reset)}, min(reset, asyncRefreshInterval))
+	return count, reset, nil
+}
+
+// recordDecision records the decision and latency of a descriptor check
+// that started at start, labeled by the matched key type, and annotates the
+// check's span in ctx
+func recordDecision(ctx context.Context, keyType string, start time.Time, count, limit int64) {
+	decision := "ok"
+	if count > limit {
+		decision = "over_limit"
 	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("ratelimit.key_type", keyType),
+		attribute.String("ratelimit.decision", decision),
+		attribute.Int64("ratelimit.count", count),
+		attribute.Int64("ratelimit.limit", limit),
+	)
+	rateLimitDecisions.WithLabelValues(keyType, decision).Inc()
+	rateLimitLatency.WithLabelValues("descriptor", keyType).Observe(time.Since(start).Seconds())
+}
+
+// observeRedis records the latency of a Redis operation that started at
+// start
+func observeRedis(operation string, start time.Time) {
+	redisOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// overrideLimit returns the limit stored at overrideKey in Redis, falling
+// back to the configured default when no valid override is set. Overrides,
+// and their absence, are cached locally for overrideCacheTTL so they are not
+// read from Redis on every request.
+func (s *RateLimitServer) overrideLimit(ctx context.Context, overrideKey string, fallback int64) int64 {
+	if cached, ok := s.cacheGetOverride(overrideKey); ok {
+		if cached.limit > 0 {
+			return cached.limit
+		}
+		return fallback
+	}
+
+	// Limits are not looked up while the circuit breaker is open; the
+	// configured limit applies, and is not cached, until Redis recovers
+	if !s.breaker.allow() {
+		breakerRejections.WithLabelValues("override").Inc()
+		return fallback
+	}
+	start := time.Now()
+	limit, err := s.redis.Get(ctx, overrideKey).Int64()
+	observeRedis("get", start)
+	if err == redis.Nil {
+		s.recordRedisResult(ctx, nil)
+	} else {
+		s.recordRedisResult(ctx, err)
+	}
+	switch {
+	case err == redis.Nil:
+		s.cacheSetOverride(overrideKey, cachedOverride{})
+		return fallback
+	case err != nil:
+		redisErrors.WithLabelValues("get").Inc()
+		s.logger.Warn("failed to read limit override, using default",
+			zap.Error(err),
+			zap.String("key", overrideKey),
+		)
+		return fallback
+	case limit <= 0:
+		s.logger.Warn("ignoring non-positive limit override",
+			zap.String("key", overrideKey),
+			zap.Int64("limit", limit),
+		)
+		s.cacheSetOverride(overrideKey, cachedOverride{})
+		return fallback
+	}
+	s.cacheSetOverride(overrideKey, cachedOverride{limit: limit})
+	return limit
+}
 
-	// Check local cache first
-	if val, found := s.localCache.Get(key); found {
-		count := val.(int64)
-		if count >= limit {
-			return int(count), int(limit), nil
+// checkEnvoyLimits warns about configured limits that exceed the uint32
+// ceiling of Envoy's response fields and will therefore be clamped
+func (c *RateLimitConfig) checkEnvoyLimits(logger *zap.Logger) {
+	limits := map[string]int64{
+		"tenant":         c.TenantLimit,
+		"ip_path":        c.IPPathLimit,
+		"user_write":     c.UserWriteLimit,
+		"company_region": c.CompanyRegionLimit,
+		"api_key_path":   c.APIKeyPathLimit,
+	}
+	for descriptorKey, rule := range c.Keys {
+		limits[keyTypeFor(descriptorKey)] = rule.Limit
+	}
+	for tuple, rule := range c.Tuples {
+		limits[tuple] = rule.Limit
+	}
+	for name, limit := range limits {
+		if limit > maxEnvoyLimit {
+			logger.Warn("configured limit exceeds Envoy uint32 ceiling and will be clamped",
+				zap.String("domain", c.Domain),
+				zap.String("limit_type", name),
+				zap.Int64("limit", limit),
+				zap.Int64("ceiling", maxEnvoyLimit),
+			)
 		}
 	}
+	for _, scoped := range c.Domains {
+		scoped.checkEnvoyLimits(logger)
+	}
+}
+
+// toEnvoyLimit converts a limit value to Envoy's uint32 representation,
+// clamping values outside [0, maxEnvoyLimit] instead of letting them wrap
+func toEnvoyLimit(field string, v int64) uint32 {
+	switch {
+	case v < 0:
+		limitClamped.WithLabelValues(field).Inc()
+		return 0
+	case v > maxEnvoyLimit:
+		limitClamped.WithLabelValues(field).Inc()
+		return maxEnvoyLimit
+	}
+	return uint32(v)
+}
 
-	// Check Redis for distributed rate limiting
-	ctx := context.Background()
-	count, err := s.redis.Incr(ctx, key).Result()
+// checkTenantLimit increments the aggregate counter for a tenant and reports
+// whether the tenant has exceeded its global cap. The counter is incremented
+// once per request regardless of how many descriptors carry the tenant ID.
+// While the circuit breaker is open the failure mode decides.
+func (s *RateLimitServer) checkTenantLimit(ctx context.Context, config *RateLimitConfig, tenantID string, hits int64) (bool, error) {
+	limit, window := config.bucketParams(config.TenantLimit, config.TenantWindow)
+	key := windowedKey(config.scopeKey(s.buildKey(keyTypeFor("tenant_id"), tenantID)), window)
+
+	var count int64
+	var err error
+	if s.breaker.allow() {
+		count, _, err = s.strategy.increment(ctx, key, limit, window, cappedHits(hits, limit))
+		s.recordRedisResult(ctx, err)
+	} else {
+		breakerRejections.WithLabelValues("tenant").Inc()
+		err = errBreakerOpen
+	}
 	if err != nil {
-		redisErrors.WithLabelValues("incr").Inc()
-		return 0, 0, fmt.Errorf("redis error: %v", err)
+		if err := contextDone(ctx); err != nil {
+			return false, err
+		}
+		if config.FailureMode == FailOpen {
+			failOpenDecisions.Inc()
+			return false, err
+		}
+		failClosedDecisions.Inc()
+		return true, err
+	}
+
+	return count > limit, nil
+}
+
+// isWriteMethod reports whether an HTTP method modifies state
+func isWriteMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// unitForWindow maps a window duration to the unit reported to Envoy.
+// Windows that are not exactly one unit long are reported as UNKNOWN.
+func unitForWindow(window time.Duration) envoy.RateLimitResponse_RateLimit_Unit {
+	switch window {
+	case time.Second:
+		return envoy.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return envoy.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return envoy.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return envoy.RateLimitResponse_RateLimit_DAY
+	}
+	return envoy.RateLimitResponse_RateLimit_UNKNOWN
+}
+
+// bucketParams adjusts a key's limit and window for the token bucket and
+// GCRA modes: the limit becomes the burst capacity and the window the time to
+// restore it in full. Other modes use the limit and window unchanged.
+func (c *RateLimitConfig) bucketParams(limit int64, window time.Duration) (int64, time.Duration) {
+	if c.WindowMode != TokenBucket && c.WindowMode != GCRA {
+		return limit, window
 	}
+	if c.BurstCapacity > 0 {
+		limit = c.BurstCapacity
+	}
+	if c.RefillRate > 0 {
+		window = time.Duration(float64(limit) / c.RefillRate * float64(time.Second))
+	}
+	return limit, window
+}
 
-	// Set expiration if this is the first request
-	if count == 1 {
-		s.redis.Expire(ctx, key, s.window)
+// keyTypeFor returns the key type of a descriptor key. Keys without a
+// built-in short name, such as custom keys from the config, are their own type.
+func keyTypeFor(descriptorKey string) string {
+	if keyType, ok := keyTypes[descriptorKey]; ok {
+		return keyType
 	}
+	return descriptorKey
+}
+
+// keyTypes maps descriptor entry keys to the key types that prefix their
+// Redis counters and label their metrics
+var keyTypes = map[string]string{
+	"remote_address": "ip",
+	"path":           "path",
+	"company_id":     "company",
+	"user_id":        "user",
+	"api_key":        "apikey",
+	"tenant_id":      "tenant",
+}
+
+// buildKey returns the Redis counter key for a value of the given key type,
+// e.g. "{ip:10.0.0.1}", after the key prefix if one is set. Every read and
+// write of a counter goes through it, so both paths always agree on the key.
+// The braces make the key a cluster hash tag: composite keys extend it with a
+// suffix, e.g. "{ip:10.0.0.1}:path:/x", so all counters and overrides for one
+// entity share a slot and can be used together in multi-key scripts and
+// transactions without CROSSSLOT errors.
+// The prefix sits outside the hash tag, so it does not change the slot.
+func (s *RateLimitServer) buildKey(keyType, value string) string {
+	return fmt.Sprintf("%s{%s:%s}", s.keyPrefix, keyType, value)
+}
+
+// overrideKey returns the Redis key holding the limit override for a counter
+// key built by buildKey: "limit:" inserted after the key prefix, e.g.
+// "staging:limit:{company:acme}", so the prefix comes first as on every
+// other key
+func (s *RateLimitServer) overrideKey(key string) string {
+	return s.keyPrefix + "limit:" + strings.TrimPrefix(key, s.keyPrefix)
+}
 
-	// Update local cache
-	s.localCache.Set(key, count, 1)
+// keyPrefixFromEnv reads KEY_PREFIX, a namespace for every Redis key so
+// environments or tenants can share one Redis without their counters
+// colliding. The prefix is returned with a trailing colon, e.g. "staging:",
+// or empty when unset. It may not contain braces, which would change the
+// keys' cluster hash tags.
+func keyPrefixFromEnv() (string, error) {
+	prefix := os.Getenv("KEY_PREFIX")
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "{}") {
+		return "", fmt.Errorf("KEY_PREFIX must not contain braces, got %q", prefix)
+	}
+	return strings.TrimSuffix(prefix, ":") + ":", nil
+}
 
-	// Return current count and limit
-	return int(count), int(limit), nil
+// windowedKey scopes a counter key to its window duration. Changing a
+// window (e.g. through a config reload) therefore starts a fresh keyspace
+// instead of reusing counters that still carry the TTL of the old window;
+// the old keys simply expire on their own.
+func windowedKey(key string, window time.Duration) string {
+	return fmt.Sprintf("%s:w%d", key, window.Milliseconds())
+}
+
+// hitsAddend returns the number of hits a descriptor counts for: its own
+// hits_addend if set, otherwise the request's, defaulting to one. Addends are
+// capped at the uint32 range so a huge value cannot overflow the counters.
+func hitsAddend(req *envoy.RateLimitRequest, descriptor *ratelimit.RateLimitDescriptor) int64 {
+	hits := uint64(req.GetHitsAddend())
+	if addend := descriptor.GetHitsAddend(); addend != nil {
+		hits = addend.GetValue()
+	}
+	if hits == 0 {
+		return 1
+	}
+	if hits > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return int64(hits)
+}
+
+// requestValue returns the first value for key found in the request descriptors
+func requestValue(descriptors []*ratelimit.RateLimitDescriptor, key string) string {
+	for _, descriptor := range descriptors {
+		if value := descriptorValue(descriptor, key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// tupleRuleKey returns the entry keys of a descriptor joined in order, as
+// used to name tuple rules, e.g. "company_id+user_id"
+func tupleRuleKey(descriptor *ratelimit.RateLimitDescriptor) string {
+	keys := make([]string, len(descriptor.Entries))
+	for i, entry := range descriptor.Entries {
+		keys[i] = entry.Key
+	}
+	return strings.Join(keys, "+")
+}
+
+// tupleKey returns the Redis key for a descriptor's tuple of entries, e.g.
+// "{company_id:acme|user_id:123}". The braces make the whole tuple a cluster
+// hash tag, so every key derived from it lands on the same slot. Like
+// buildKey it starts with the key prefix, if one is set.
+func (s *RateLimitServer) tupleKey(descriptor *ratelimit.RateLimitDescriptor) string {
+	parts := make([]string, len(descriptor.Entries))
+	for i, entry := range descriptor.Entries {
+		parts[i] = fmt.Sprintf("%s:%s", entry.Key, entry.Value)
+	}
+	return fmt.Sprintf("%s{%s}", s.keyPrefix, strings.Join(parts, "|"))
+}
+
+// descriptorValue returns the value of the given entry key in a descriptor
+func descriptorValue(descriptor *ratelimit.RateLimitDescriptor, key string) string {
+	for _, entry := range descriptor.Entries {
+		if entry.Key == key {
+			return entry.Value
+		}
+	}
+	return ""
 }
 
 // main initializes and runs the rate limit service
@@ -433,10 +1813,27 @@ func main() {
 		)
 	}
 
-	// Create gRPC server with tracing interceptor
-	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(grpcTracingInterceptor),
-	)
+	// Create gRPC server with panic recovery and tracing interceptors and
+	// the configured keepalive policy, serving TLS when a certificate is
+	// configured. Recovery runs first so it also covers the tracing
+	// interceptor.
+	opts, err := serverKeepalive()
+	if err != nil {
+		logger.Fatal("failed to configure gRPC keepalive",
+			zap.Error(err),
+		)
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(grpcRecoveryInterceptor(logger), grpcTracingInterceptor))
+	creds, err := serverCredentials()
+	if err != nil {
+		logger.Fatal("failed to configure TLS",
+			zap.Error(err),
+		)
+	}
+	if creds != nil {
+		opts = append(opts, creds)
+	}
+	grpcServer := grpc.NewServer(opts...)
 
 	// Register rate limit service
 	server, err := NewRateLimitServer()
@@ -447,9 +1844,30 @@ func main() {
 	}
 	envoy.RegisterRateLimitServiceServer(grpcServer, server)
 
+	// Register the standard health service for gRPC probes. Redis answered
+	// a ping during startup, so the service starts out SERVING.
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	setServingStatus(healthServer, true)
+
 	// Enable reflection for debugging
 	reflection.Register(grpcServer)
 
+	// Stop gracefully on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Export traces when an OTLP endpoint is configured
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		logger.Fatal("failed to initialize tracing",
+			zap.Error(err),
+		)
+	}
+
+	// Report NOT_SERVING while Redis is unreachable
+	go server.watchRedisHealth(ctx, healthServer, healthCheckInterval)
+
 	// Start Prometheus metrics endpoint
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
@@ -460,16 +1878,69 @@ func main() {
 		}
 	}()
 
+	// Start the admin API for inspecting and resetting counters
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, server.adminHandler(token)); err != nil {
+				logger.Error("admin server error",
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+
 	// Log service startup
 	logger.Info("rate limit service starting",
 		zap.String("address", ":8081"),
+		zap.Bool("tls", creds != nil),
+		zap.Bool("mtls", os.Getenv("TLS_CA_FILE") != ""),
 	)
 
 	// Start gRPC server
-	if err := grpcServer.Serve(lis); err != nil {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-serveErr:
 		logger.Fatal("failed to serve",
 			zap.Error(err),
 		)
+	case <-ctx.Done():
+	}
+
+	logger.Info("rate limit service shutting down")
+	healthServer.Shutdown()
+	servingStatus.Set(0)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests and wait for in-flight ones, forcing the
+	// remaining connections closed if that outlasts the deadline
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		grpcServer.Stop()
+	}
+
+	// Flush the updates still buffered by the worker pool
+	if err := server.workerPool.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to drain update workers",
+			zap.Error(err),
+		)
+	}
+
+	// Export the spans still buffered
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces",
+			zap.Error(err),
+		)
 	}
 }
 
@@ -492,6 +1963,9 @@ func grpcTracingInterceptor(ctx context.Context, req interface{}, info *grpc.Una
 		if spanIDs := md.Get(string(spanIDKey)); len(spanIDs) > 0 {
 			ctx = context.WithValue(ctx, spanIDKey, spanIDs[0])
 		}
+
+		// Join the caller's trace from its traceparent or b3 headers
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
 	}
 
 	return handler(ctx, req)
@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newTestRedis returns a client of an in-memory Redis server that runs the
+// service's Lua scripts
+func newTestRedis(t testing.TB) (redisClient, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client, mr
+}
+
+// newDeadRedis returns a client of a Redis server that refuses connections
+func newDeadRedis(t testing.TB) redisClient {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// blackHole returns the address of a server that accepts connections but
+// never replies
+func blackHole(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// newTestServer returns a server enforcing config against rdb, without a
+// local cache or worker pool
+func newTestServer(t testing.TB, config *RateLimitConfig, rdb redisClient) *RateLimitServer {
+	t.Helper()
+	logger := zap.NewNop()
+	scripts := newScriptManager(rdb, logger)
+	strategy, err := newWindowStrategy(config.WindowMode, config.CountRejected, scripts)
+	if err != nil {
+		t.Fatalf("newWindowStrategy: %v", err)
+	}
+	s := &RateLimitServer{
+		redis:    rdb,
+		strategy: strategy,
+		scripts:  scripts,
+		metrics:  rateLimitRequests,
+		logger:   logger,
+	}
+	s.config.Store(config)
+	return s
+}
+
+// writeTestConfig writes YAML to a configuration file in a temporary
+// directory and returns its path
+func writeTestConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTestConfig loads a configuration from YAML written to a temporary file
+func loadTestConfig(t *testing.T, data string) *RateLimitConfig {
+	t.Helper()
+	config, err := LoadConfig(writeTestConfig(t, data))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return config
+}
+
+// descriptor builds a descriptor from alternating keys and values
+func descriptor(kv ...string) *ratelimit.RateLimitDescriptor {
+	d := &ratelimit.RateLimitDescriptor{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		d.Entries = append(d.Entries, &ratelimit.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return d
+}
+
+// check sends a request for domain with the given descriptors and returns
+// the overall decision
+func check(t *testing.T, s *RateLimitServer, domain string, descriptors ...*ratelimit.RateLimitDescriptor) envoy.RateLimitResponse_Code {
+	t.Helper()
+	return shouldRateLimit(t, s, domain, descriptors...).OverallCode
+}
+
+// shouldRateLimit sends a request for domain with the given descriptors and
+// returns the response
+func shouldRateLimit(t *testing.T, s *RateLimitServer, domain string, descriptors ...*ratelimit.RateLimitDescriptor) *envoy.RateLimitResponse {
+	t.Helper()
+	response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{Domain: domain, Descriptors: descriptors})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	return response
+}
+
+// allowed sends n requests and returns how many were allowed
+func allowed(t *testing.T, s *RateLimitServer, n int, domain string, descriptors ...*ratelimit.RateLimitDescriptor) int {
+	t.Helper()
+	var ok int
+	for i := 0; i < n; i++ {
+		if check(t, s, domain, descriptors...) == envoy.RateLimitResponse_OK {
+			ok++
+		}
+	}
+	return ok
+}
+
+// admitted sends n requests with a single descriptor and returns how many
+// the descriptor's status allowed
+func admitted(t *testing.T, s *RateLimitServer, n int, domain string, d *ratelimit.RateLimitDescriptor) int {
+	t.Helper()
+	var ok int
+	for i := 0; i < n; i++ {
+		if shouldRateLimit(t, s, domain, d).Statuses[0].Code == envoy.RateLimitResponse_OK {
+			ok++
+		}
+	}
+	return ok
+}
+
+func TestTenantLimit(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.TenantLimit = 3
+	s := newTestServer(t, config, rdb)
+
+	// Each request stays well within its user and IP limits, but together
+	// they exceed the tenant's ceiling
+	requests := [][]*ratelimit.RateLimitDescriptor{
+		{descriptor("user_id", "alice", "tenant_id", "acme")},
+		{descriptor("user_id", "bob", "tenant_id", "acme")},
+		{descriptor("remote_address", "10.0.0.1", "tenant_id", "acme")},
+		{descriptor("remote_address", "10.0.0.2", "tenant_id", "acme")},
+	}
+	for i, descriptors := range requests {
+		want := envoy.RateLimitResponse_OK
+		if i == 3 {
+			want = envoy.RateLimitResponse_OVER_LIMIT
+		}
+		if got := check(t, s, "", descriptors...); got != want {
+			t.Errorf("request %d: got %v, want %v", i+1, got, want)
+		}
+	}
+
+	// Another tenant is unaffected
+	if got := check(t, s, "", descriptor("user_id", "alice", "tenant_id", "globex")); got != envoy.RateLimitResponse_OK {
+		t.Errorf("other tenant got %v, want OK", got)
+	}
+}
+
+func TestTenantLimitCountedOncePerRequest(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.TenantLimit = 2
+	s := newTestServer(t, config, rdb)
+
+	// Three descriptors carrying the tenant count as one request
+	descriptors := []*ratelimit.RateLimitDescriptor{
+		descriptor("user_id", "alice", "tenant_id", "acme"),
+		descriptor("remote_address", "10.0.0.1", "tenant_id", "acme"),
+		descriptor("path", "/orders", "tenant_id", "acme"),
+	}
+	if got := allowed(t, s, 3, "", descriptors...); got != 2 {
+		t.Errorf("allowed %d of 3, want 2", got)
+	}
+}
+
+func TestToEnvoyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       int64
+		want    uint32
+		clamped bool
+	}{
+		{name: "in range", v: 1000, want: 1000},
+		{name: "ceiling", v: maxEnvoyLimit, want: maxEnvoyLimit},
+		{name: "above uint32", v: maxEnvoyLimit + 1, want: maxEnvoyLimit, clamped: true},
+		{name: "far above uint32", v: 1 << 40, want: maxEnvoyLimit, clamped: true},
+		{name: "negative", v: -1, want: 0, clamped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clamped := limitClamped.WithLabelValues("test")
+			before := testutil.ToFloat64(clamped)
+			if got := toEnvoyLimit("test", tt.v); got != tt.want {
+				t.Errorf("toEnvoyLimit(%d) = %d, want %d", tt.v, got, tt.want)
+			}
+			if got := testutil.ToFloat64(clamped) - before; (got == 1) != tt.clamped {
+				t.Errorf("clamp counter moved by %v, clamped = %v", got, tt.clamped)
+			}
+		})
+	}
+}
+
+func TestOversizedLimitReported(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 1 << 40, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+
+	response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	})
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+
+	// The limit is still enforced, but reported as the uint32 ceiling
+	// instead of wrapping around
+	status := response.Statuses[0]
+	if status.Code != envoy.RateLimitResponse_OK {
+		t.Errorf("code = %v, want OK", status.Code)
+	}
+	if got := status.LimitRemaining; got != maxEnvoyLimit {
+		t.Errorf("limit_remaining = %d, want %d", got, uint32(maxEnvoyLimit))
+	}
+}
+
+func TestIPPathLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.IPPathWindow = 30 * time.Second
+	s := newTestServer(t, config, rdb)
+
+	scraped := descriptor("remote_address", "10.0.0.1", "path", "/products")
+	for i := 0; i < 3; i++ {
+		check(t, s, "", scraped)
+	}
+	check(t, s, "", descriptor("remote_address", "10.0.0.1", "path", "/cart"))
+	check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+
+	// The IP's requests on one endpoint are counted apart from its other
+	// endpoints and its standalone counter, over their own window
+	counters := map[string]string{
+		"{ip:10.0.0.1}:path:/products:w30000": "3",
+		"{ip:10.0.0.1}:path:/cart:w30000":     "1",
+		"{ip:10.0.0.1}:w60000":                "1",
+	}
+	for key, want := range counters {
+		if got, _ := mr.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if ttl := mr.TTL("{ip:10.0.0.1}:path:/products:w30000"); ttl != 30*time.Second {
+		t.Errorf("IP-per-path TTL = %v, want 30s", ttl)
+	}
+	if ttl := mr.TTL("{ip:10.0.0.1}:w60000"); ttl != time.Minute {
+		t.Errorf("IP TTL = %v, want 1m", ttl)
+	}
+}
+
+func TestUserWriteLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.UserWriteWindow = 30 * time.Second
+	s := newTestServer(t, config, rdb)
+
+	for _, method := range []string{"POST", "put", "DELETE", "GET", "HEAD"} {
+		check(t, s, "", descriptor("user_id", "alice", "method", method))
+	}
+	check(t, s, "", descriptor("user_id", "alice"))
+
+	// Writes are counted under the user's write cap over its own window,
+	// apart from the user's overall counter; reads are not capped and fall
+	// through to the user's own rule
+	if got, _ := mr.Get("{user:alice}:writes:w30000"); got != "3" {
+		t.Errorf("write counter = %q, want 3", got)
+	}
+	if got, _ := mr.Get("{user:alice}:w60000"); got != "3" {
+		t.Errorf("user counter = %q, want 3 for the two reads and the plain request", got)
+	}
+}
+
+func TestIsWriteMethod(t *testing.T) {
+	for method, want := range map[string]bool{
+		"POST": true, "PUT": true, "PATCH": true, "DELETE": true, "post": true,
+		"GET": false, "HEAD": false, "OPTIONS": false,
+	} {
+		if got := isWriteMethod(method); got != want {
+			t.Errorf("isWriteMethod(%q) = %v, want %v", method, got, want)
+		}
+	}
+}
+
+func TestDurationUntilReset(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+	request := &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	}
+
+	response, err := s.ShouldRateLimit(context.Background(), request)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	reset := response.Statuses[0].DurationUntilReset.AsDuration()
+	if reset <= 0 || reset > time.Minute {
+		t.Errorf("reset after first hit = %v, want (0, 1m]", reset)
+	}
+
+	// Later in the window the reset comes closer
+	mr.FastForward(45 * time.Second)
+	response, err = s.ShouldRateLimit(context.Background(), request)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+	reset = response.Statuses[0].DurationUntilReset.AsDuration()
+	if reset <= 0 || reset > 15*time.Second {
+		t.Errorf("reset 45s into the window = %v, want (0, 15s]", reset)
+	}
+}
+
+func TestFailureMode(t *testing.T) {
+	tests := []struct {
+		mode      FailureMode
+		want      envoy.RateLimitResponse_Code
+		decisions prometheus.Counter
+	}{
+		{mode: FailOpen, want: envoy.RateLimitResponse_OK, decisions: failOpenDecisions},
+		{mode: FailClosed, want: envoy.RateLimitResponse_OVER_LIMIT, decisions: failClosedDecisions},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			config := DefaultRateLimitConfig()
+			config.FailureMode = tt.mode
+			config.TenantLimit = 10
+			s := newTestServer(t, config, newDeadRedis(t))
+
+			// Both per-descriptor checks and the tenant ceiling follow the mode
+			before := testutil.ToFloat64(tt.decisions)
+			check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+			if got := testutil.ToFloat64(tt.decisions) - before; got != 1 {
+				t.Errorf("descriptor check counted %v %s decisions, want 1", got, tt.mode)
+			}
+			if got := check(t, s, "", descriptor("tenant_id", "acme")); got != tt.want {
+				t.Errorf("tenant check got %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(tt.decisions) - before; got != 2 {
+				t.Errorf("counted %v %s decisions, want 2", got, tt.mode)
+			}
+		})
+	}
+}
+
+func TestCompanyRegionQuota(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+
+	for i := 0; i < 3; i++ {
+		check(t, s, "", descriptor("company_id", "acme"), descriptor("company_id", "acme", "region", "us-east"))
+	}
+	check(t, s, "", descriptor("company_id", "acme", "region", "eu-west"))
+
+	// Each region is counted apart from the company's other regions and
+	// from its global counter
+	counters := map[string]string{
+		"{company:acme}:region:us-east:w60000": "3",
+		"{company:acme}:region:eu-west:w60000": "1",
+		"{company:acme}:w60000":                "3",
+	}
+	for key, want := range counters {
+		if got, _ := mr.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestOverrideLimit(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+
+	tests := []struct {
+		name     string
+		override string // Stored override, empty for none
+		want     int64
+	}{
+		{name: "no override", want: 5000},
+		{name: "override", override: "3", want: 3},
+		{name: "zero", override: "0", want: 5000},
+		{name: "negative", override: "-2", want: 5000},
+		{name: "not a number", override: "lots", want: 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const key = "limit:{company:acme}:region:us-east"
+			mr.Del(key)
+			if tt.override != "" {
+				mr.Set(key, tt.override)
+			}
+			if got := s.overrideLimit(context.Background(), key, 5000); got != tt.want {
+				t.Errorf("overrideLimit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompanyLimitOverride(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	mr.Set(s.overrideKey(s.buildKey("company", "acme")), "3")
+
+	// acme's override replaces the configured limit; other companies keep it
+	if got := allowed(t, s, 6, "", descriptor("company_id", "acme")); got != 3 {
+		t.Errorf("acme allowed %d of 6, want its override of 3", got)
+	}
+	if got := allowed(t, s, 6, "", descriptor("company_id", "globex")); got != 5 {
+		t.Errorf("globex allowed %d of 6, want the default of 5", got)
+	}
+
+	// An invalid override is ignored
+	mr.Set(s.overrideKey(s.buildKey("company", "initech")), "0")
+	if got := allowed(t, s, 6, "", descriptor("company_id", "initech")); got != 5 {
+		t.Errorf("initech allowed %d of 6, want the default of 5", got)
+	}
+}
+
+func TestCompanyLimitOverrideCached(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newCachedTestServer(t, config, rdb)
+	overrideKey := s.overrideKey(s.buildKey("company", "acme"))
+	request := func() envoy.RateLimitResponse_Code {
+		code := check(t, s, "", descriptor("company_id", "acme"))
+		s.localCache.Wait()
+		return code
+	}
+
+	// The absence of an override is cached too
+	request()
+	mr.Set(overrideKey, "1")
+	if got := request(); got != envoy.RateLimitResponse_OK {
+		t.Fatalf("second request got %v, want OK under the cached default", got)
+	}
+
+	// Once the cached entry expires, the new override applies
+	s.localCache.Del(overrideKey)
+	if got := request(); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("request after refresh got %v, want OVER_LIMIT under the override of 1", got)
+	}
+	mr.Set(overrideKey, "10")
+	if got := request(); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("request with the override cached got %v, want OVER_LIMIT", got)
+	}
+	s.localCache.Del(overrideKey)
+	if got := request(); got != envoy.RateLimitResponse_OK {
+		t.Errorf("request after raising the override got %v, want OK", got)
+	}
+}
+
+func TestPerKeyUnits(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, `
+rules:
+  - key: user_id
+    limit: 2
+    unit: second
+  - key: company_id
+    limit: 5
+    unit: day
+`), rdb)
+
+	response := shouldRateLimit(t, s, "", descriptor("user_id", "alice"), descriptor("company_id", "acme"))
+	for i, want := range []envoy.RateLimitResponse_RateLimit_Unit{
+		envoy.RateLimitResponse_RateLimit_SECOND,
+		envoy.RateLimitResponse_RateLimit_DAY,
+	} {
+		if got := response.Statuses[i].CurrentLimit.GetUnit(); got != want {
+			t.Errorf("status %d unit = %v, want %v", i, got, want)
+		}
+	}
+
+	// Each counter expires with its own window
+	if ttl := mr.TTL("{user:alice}:w1000"); ttl != time.Second {
+		t.Errorf("user counter TTL = %v, want 1s", ttl)
+	}
+	if ttl := mr.TTL("{company:acme}:w86400000"); ttl != 24*time.Hour {
+		t.Errorf("company counter TTL = %v, want 24h", ttl)
+	}
+}
+
+func TestUnitForWindow(t *testing.T) {
+	for window, want := range map[time.Duration]envoy.RateLimitResponse_RateLimit_Unit{
+		time.Second:      envoy.RateLimitResponse_RateLimit_SECOND,
+		time.Minute:      envoy.RateLimitResponse_RateLimit_MINUTE,
+		time.Hour:        envoy.RateLimitResponse_RateLimit_HOUR,
+		24 * time.Hour:   envoy.RateLimitResponse_RateLimit_DAY,
+		30 * time.Second: envoy.RateLimitResponse_RateLimit_UNKNOWN,
+	} {
+		if got := unitForWindow(window); got != want {
+			t.Errorf("unitForWindow(%v) = %v, want %v", window, got, want)
+		}
+	}
+}
+
+func TestHitsAddend(t *testing.T) {
+	for _, mode := range []WindowMode{FixedWindow, SlidingWindow} {
+		t.Run(string(mode), func(t *testing.T) {
+			rdb, mr := newTestRedis(t)
+			config := DefaultRateLimitConfig()
+			config.setWindowMode(mode)
+			config.Keys["remote_address"] = KeyRule{Limit: 8, Window: time.Minute}
+			s := newTestServer(t, config, rdb)
+			request := &envoy.RateLimitRequest{
+				HitsAddend:  5,
+				Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+			}
+
+			// The first weighted request advances the counter by five
+			response, err := s.ShouldRateLimit(context.Background(), request)
+			if err != nil {
+				t.Fatalf("ShouldRateLimit: %v", err)
+			}
+			if response.OverallCode != envoy.RateLimitResponse_OK {
+				t.Errorf("first request got %v, want OK", response.OverallCode)
+			}
+			if got := response.Statuses[0].LimitRemaining; got != 3 {
+				t.Errorf("limit_remaining = %d, want 3", got)
+			}
+
+			// A second would take it over the limit and is rejected whole
+			response, err = s.ShouldRateLimit(context.Background(), request)
+			if err != nil {
+				t.Fatalf("ShouldRateLimit: %v", err)
+			}
+			if response.OverallCode != envoy.RateLimitResponse_OVER_LIMIT {
+				t.Errorf("request crossing the limit got %v, want OVER_LIMIT", response.OverallCode)
+			}
+
+			// The rejected hits count too, by default, so the counter holds
+			// ten
+			key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Minute)
+			if !mr.Exists(key) {
+				t.Fatalf("redis keys = %v, want %s", mr.Keys(), key)
+			}
+			if got, err := s.counterValue(context.Background(), key); err != nil || got != 10 {
+				t.Errorf("counter = %d (%v), want 10", got, err)
+			}
+		})
+	}
+}
+
+func TestHitsAddendDefaults(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    uint32
+		descriptor *wrapperspb.UInt64Value
+		want       int64
+	}{
+		{name: "unset", want: 1},
+		{name: "request", request: 5, want: 5},
+		{name: "descriptor overrides request", request: 5, descriptor: wrapperspb.UInt64(2), want: 2},
+		{name: "descriptor zero", request: 5, descriptor: wrapperspb.UInt64(0), want: 1},
+		{name: "capped", descriptor: wrapperspb.UInt64(1 << 40), want: math.MaxUint32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := descriptor("remote_address", "10.0.0.1")
+			d.HitsAddend = tt.descriptor
+			if got := hitsAddend(&envoy.RateLimitRequest{HitsAddend: tt.request}, d); got != tt.want {
+				t.Errorf("hitsAddend = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyPathQuota(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["api_key"] = KeyRule{Limit: 20, Window: time.Minute}
+	config.APIKeyPathLimit = 10
+	s := newTestServer(t, config, rdb)
+
+	// The key may only export twice a minute
+	mr.Set("limit:{apikey:key-1}:path:/export", "2")
+
+	request := func(path string) *envoy.RateLimitResponse {
+		return shouldRateLimit(t, s, "", descriptor("api_key", "key-1"), descriptor("api_key", "key-1", "path", path))
+	}
+	for i := 0; i < 2; i++ {
+		if got := request("/export").Statuses[1].Code; got != envoy.RateLimitResponse_OK {
+			t.Fatalf("/export request %d got %v, want OK", i+1, got)
+		}
+	}
+	response := request("/export")
+	if got := response.Statuses[1].Code; got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("/export over its quota got %v, want OVER_LIMIT", got)
+	}
+	if got := response.Statuses[1].CurrentLimit.GetRequestsPerUnit(); got != 2 {
+		t.Errorf("/export reported limit %d, want the override of 2", got)
+	}
+
+	// /search has the default endpoint quota, and the key as a whole is
+	// still under its overall limit
+	response = request("/search")
+	if got := response.Statuses[1].CurrentLimit.GetRequestsPerUnit(); got != 10 {
+		t.Errorf("/search reported limit %d, want the default of 10", got)
+	}
+	for i, status := range response.Statuses {
+		if status.Code != envoy.RateLimitResponse_OK {
+			t.Errorf("/search status %d got %v, want OK", i, status.Code)
+		}
+	}
+	if got, _ := mr.Get("{apikey:key-1}:w60000"); got != "4" {
+		t.Errorf("overall key counter = %q, want 4", got)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.WindowMode = TokenBucket
+	config.BurstCapacity = 5
+	config.RefillRate = 10
+	s := newTestServer(t, config, rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+
+	// The full burst is accepted at once, reporting the tokens left
+	for i := 4; i >= 0; i-- {
+		response := shouldRateLimit(t, s, "", ip)
+		if got := response.Statuses[0].Code; got != envoy.RateLimitResponse_OK {
+			t.Fatalf("burst request got %v, want OK", got)
+		}
+		if got := response.Statuses[0].LimitRemaining; got != uint32(i) {
+			t.Errorf("limit_remaining = %d, want %d", got, i)
+		}
+	}
+	if got := shouldRateLimit(t, s, "", ip).Statuses[0].Code; got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("request to a drained bucket got %v, want OVER_LIMIT", got)
+	}
+
+	// At 10 tokens a second, one is back after 100ms
+	time.Sleep(150 * time.Millisecond)
+	if got := admitted(t, s, 3, "", ip); got != 1 {
+		t.Errorf("allowed %d requests after 150ms, want 1", got)
+	}
+}
+
+func TestBucketParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       WindowMode
+		refill     float64
+		burst      int64
+		wantLimit  int64
+		wantWindow time.Duration
+	}{
+		{name: "fixed window", mode: FixedWindow, refill: 10, burst: 5, wantLimit: 100, wantWindow: time.Minute},
+		{name: "key's limit", mode: TokenBucket, wantLimit: 100, wantWindow: time.Minute},
+		{name: "burst capacity", mode: TokenBucket, burst: 5, wantLimit: 5, wantWindow: time.Minute},
+		{name: "refill rate", mode: TokenBucket, refill: 10, wantLimit: 100, wantWindow: 10 * time.Second},
+		{name: "both", mode: TokenBucket, refill: 10, burst: 5, wantLimit: 5, wantWindow: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultRateLimitConfig()
+			config.WindowMode = tt.mode
+			config.RefillRate = tt.refill
+			config.BurstCapacity = tt.burst
+			limit, window := config.bucketParams(100, time.Minute)
+			if limit != tt.wantLimit || window != tt.wantWindow {
+				t.Errorf("bucketParams = %d per %v, want %d per %v", limit, window, tt.wantLimit, tt.wantWindow)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolShutdownFlushes(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	// Nothing is flushed before shutdown: the interval and batch size are
+	// never reached
+	pool := NewUpdateWorkerPool(WorkerPoolOptions{Size: 4, FlushInterval: time.Hour, BatchSize: 1000}, rdb, newScriptManager(rdb, zap.NewNop()), nil, zap.NewNop())
+
+	for i := 0; i < 500; i++ {
+		pool.queue <- &counterUpdate{key: fmt.Sprintf("counter:%d", i%10), window: time.Minute, hits: 2}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Every buffered and queued increment reached Redis
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("counter:%d", i)
+		if got, _ := mr.Get(key); got != "100" {
+			t.Errorf("%s = %q, want 100", key, got)
+		}
+		if ttl := mr.TTL(key); ttl <= 0 {
+			t.Errorf("%s has no TTL", key)
+		}
+	}
+	if n := len(pool.queue); n != 0 {
+		t.Errorf("%d updates left in the queue", n)
+	}
+}
+
+func TestCancelledContextSkipsRedis(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	commands := mr.CommandCount()
+	_, err := s.ShouldRateLimit(ctx, &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	})
+	if got := status.Code(err); got != codes.Canceled {
+		t.Errorf("error code = %v, want Canceled", got)
+	}
+	if got := mr.CommandCount() - commands; got != 0 {
+		t.Errorf("cancelled request sent %d commands to Redis, want 0", got)
+	}
+}
+
+func TestDeadlineAbortsRedisCall(t *testing.T) {
+	// Redis accepts the connection but never answers, so only the
+	// request's deadline ends the call, well before the read timeout
+	rdb := redis.NewClient(&redis.Options{
+		Addr:                  blackHole(t),
+		ContextTimeoutEnabled: true,
+		MaxRetries:            -1,
+		ReadTimeout:           10 * time.Second,
+	})
+	t.Cleanup(func() { rdb.Close() })
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.ShouldRateLimit(ctx, &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+	})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, want it aborted at its 100ms deadline", elapsed)
+	}
+}
+
+func TestFlushBounded(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:                  blackHole(t),
+		ContextTimeoutEnabled: true,
+		MaxRetries:            -1,
+		ReadTimeout:           time.Minute,
+	})
+	t.Cleanup(func() { rdb.Close() })
+	worker := &UpdateWorker{
+		redis:   rdb,
+		scripts: newScriptManager(rdb, zap.NewNop()),
+		buffer:  []*counterUpdate{{key: "counter", window: time.Minute, hits: 1}},
+		logger:  zap.NewNop(),
+	}
+
+	// A stalled Redis holds the worker for flushTimeout at most
+	start := time.Now()
+	worker.flush()
+	if elapsed := time.Since(start); elapsed > flushTimeout+time.Second {
+		t.Errorf("flush took %v, want it bounded by %v", elapsed, flushTimeout)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.DryRun = true
+	config.Keys["remote_address"] = KeyRule{Limit: 1, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	ip := descriptor("remote_address", "10.0.0.1")
+
+	shadow := shadowRejections.WithLabelValues("remote_address")
+	before := testutil.ToFloat64(shadow)
+	check(t, s, "", ip)
+	response := shouldRateLimit(t, s, "", ip)
+
+	// The over-limit descriptor is allowed, but the rejection it would
+	// have had is counted
+	if response.OverallCode != envoy.RateLimitResponse_OK {
+		t.Errorf("overall code = %v, want OK", response.OverallCode)
+	}
+	if got := response.Statuses[0].Code; got != envoy.RateLimitResponse_OK {
+		t.Errorf("descriptor code = %v, want OK", got)
+	}
+	if got := testutil.ToFloat64(shadow) - before; got != 1 {
+		t.Errorf("shadow rejections increased by %v, want 1", got)
+	}
+}
+
+func TestMixedDescriptorsOverLimit(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["user_id"] = KeyRule{Limit: 1, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	user := descriptor("user_id", "alice")
+	check(t, s, "", user)
+
+	// One descriptor over its limit rejects the whole request, whatever the
+	// position of the others
+	for _, descriptors := range [][]*ratelimit.RateLimitDescriptor{
+		{descriptor("remote_address", "10.0.0.1"), user},
+		{user, descriptor("remote_address", "10.0.0.1")},
+	} {
+		response := shouldRateLimit(t, s, "", descriptors...)
+		if response.OverallCode != envoy.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("overall code = %v, want OVER_LIMIT", response.OverallCode)
+		}
+		for i, d := range descriptors {
+			want := envoy.RateLimitResponse_OK
+			if d == user {
+				want = envoy.RateLimitResponse_OVER_LIMIT
+			}
+			if got := response.Statuses[i].Code; got != want {
+				t.Errorf("descriptor %d code = %v, want %v", i, got, want)
+			}
+		}
+	}
+}
+
+// tenDescriptorServer returns a server limiting remote addresses to 3
+// requests every 61 seconds in mode, whose Redis client counts its round
+// trips, and a request for 10 addresses of which the i-th was already seen
+// i%5 times. A token bucket refilling 3 tokens a minute is left holding
+// round amounts such as 5e-05 tokens, which miniredis's Lua formats but
+// cannot parse back; a prime number of seconds avoids them.
+func tenDescriptorServer(t testing.TB, mode WindowMode) (*RateLimitServer, *callCounter, []*ratelimit.RateLimitDescriptor) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	counter := &callCounter{}
+	rdb.AddHook(counter)
+
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 3, Window: 61 * time.Second}
+	config.WindowMode = mode
+	s := newTestServer(t, config, rdb)
+
+	descriptors := make([]*ratelimit.RateLimitDescriptor, 10)
+	for i := range descriptors {
+		descriptors[i] = descriptor("remote_address", fmt.Sprintf("10.0.0.%d", i))
+		for j := 0; j < i%5; j++ {
+			req := &envoy.RateLimitRequest{Descriptors: descriptors[i : i+1]}
+			if _, err := s.ShouldRateLimit(context.Background(), req); err != nil {
+				t.Fatalf("ShouldRateLimit: %v", err)
+			}
+		}
+	}
+	return s, counter, descriptors
+}
+
+func TestMultiDescriptorPipeline(t *testing.T) {
+	for _, mode := range []WindowMode{FixedWindow, SlidingWindow, TokenBucket, GCRA} {
+		t.Run(string(mode), func(t *testing.T) {
+			s, counter, descriptors := tenDescriptorServer(t, mode)
+
+			calls := counter.calls.Load()
+			response := shouldRateLimit(t, s, "", descriptors...)
+			if got := counter.calls.Load() - calls; got != 1 {
+				t.Errorf("made %d Redis round trips for 10 descriptors, want 1", got)
+			}
+
+			// Each descriptor is decided on its own count: addresses seen 3
+			// or 4 times before are over the limit of 3
+			if response.OverallCode != envoy.RateLimitResponse_OVER_LIMIT {
+				t.Errorf("overall code = %v, want OVER_LIMIT", response.OverallCode)
+			}
+			for i, status := range response.Statuses {
+				seen := i % 5
+				want := envoy.RateLimitResponse_OK
+				if seen >= 3 {
+					want = envoy.RateLimitResponse_OVER_LIMIT
+				}
+				if status.Code != want {
+					t.Errorf("descriptor %d seen %d times: code = %v, want %v", i, seen, status.Code, want)
+				}
+				if want == envoy.RateLimitResponse_OK && status.LimitRemaining != uint32(3-seen-1) {
+					t.Errorf("descriptor %d seen %d times: remaining = %d, want %d", i, seen, status.LimitRemaining, 3-seen-1)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTenDescriptors checks 10 descriptors per request and reports the
+// Redis round trips made per request
+func BenchmarkTenDescriptors(b *testing.B) {
+	s, counter, descriptors := tenDescriptorServer(b, SlidingWindow)
+	req := &envoy.RateLimitRequest{Descriptors: descriptors}
+
+	calls := counter.calls.Load()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ShouldRateLimit(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(counter.calls.Load()-calls)/float64(b.N), "round-trips/op")
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 100, Window: time.Minute}
+	config.Keys["user_id"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+
+	check(t, s, "", descriptor("user_id", "alice"))
+	mr.FastForward(20 * time.Second)
+	response := shouldRateLimit(t, s, "", descriptor("remote_address", "10.0.0.1"), descriptor("user_id", "alice"))
+
+	headers := make(map[string]string)
+	for _, header := range response.ResponseHeadersToAdd {
+		headers[header.Key] = header.Value
+	}
+	// The user has the fewest requests left: 3 of 5, resetting 40s from now
+	want := map[string]string{
+		"X-RateLimit-Limit":     "5",
+		"X-RateLimit-Remaining": "3",
+		"X-RateLimit-Reset":     "40",
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %v, want %v", headers, want)
+	}
+}
+
+func TestRateLimitHeadersWithoutLimits(t *testing.T) {
+	// Descriptors without a reported limit add no headers
+	statuses := []*envoy.RateLimitResponse_DescriptorStatus{nil, {Code: envoy.RateLimitResponse_OK}}
+	if headers := rateLimitHeaders(statuses); headers != nil {
+		t.Errorf("headers = %v, want none", headers)
+	}
+}
+
+// pipelineCounter is a Redis hook counting the pipelines executed
+type pipelineCounter struct {
+	n atomic.Int64
+}
+
+func (c *pipelineCounter) DialHook(next redis.DialHook) redis.DialHook          { return next }
+func (c *pipelineCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+func (c *pipelineCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// countFlushes runs a single worker with opts, sends it updates for distinct
+// keys and returns the pipelines it executed after wait
+func countFlushes(t *testing.T, opts WorkerPoolOptions, updates int, wait time.Duration) int64 {
+	t.Helper()
+	rdb, _ := newTestRedis(t)
+	// Preloaded, the script is never resent in a pipeline of its own
+	scripts := newScriptManager(rdb, zap.NewNop())
+	if err := scripts.load(context.Background()); err != nil {
+		t.Fatalf("load scripts: %v", err)
+	}
+	counter := &pipelineCounter{}
+	rdb.(*redis.Client).AddHook(counter)
+
+	pool := NewUpdateWorkerPool(opts, rdb, scripts, nil, zap.NewNop())
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	for i := 0; i < updates; i++ {
+		pool.queue <- &counterUpdate{key: fmt.Sprintf("counter:%d", i), window: time.Minute, hits: 1}
+	}
+	time.Sleep(wait)
+	return counter.n.Load()
+}
+
+func TestWorkerBatchSize(t *testing.T) {
+	// With an interval that never passes, every 5 updates fill a batch
+	got := countFlushes(t, WorkerPoolOptions{Size: 1, FlushInterval: time.Hour, BatchSize: 5}, 20, 100*time.Millisecond)
+	if got != 4 {
+		t.Errorf("flushed %d times, want 4", got)
+	}
+}
+
+func TestWorkerFlushInterval(t *testing.T) {
+	// A batch that never fills is flushed on every tick it has updates
+	got := countFlushes(t, WorkerPoolOptions{Size: 1, FlushInterval: 10 * time.Millisecond, BatchSize: 1000}, 3, 100*time.Millisecond)
+	if got != 1 {
+		t.Errorf("flushed %d times, want 1", got)
+	}
+	got = countFlushes(t, WorkerPoolOptions{Size: 1, FlushInterval: time.Hour, BatchSize: 1000}, 3, 100*time.Millisecond)
+	if got != 0 {
+		t.Errorf("flushed %d times before the interval, want 0", got)
+	}
+}
+
+func TestWorkerPoolOptionsFromEnv(t *testing.T) {
+	t.Setenv("WORKER_POOL_SIZE", "3")
+	t.Setenv("WORKER_FLUSH_INTERVAL", "20ms")
+	t.Setenv("WORKER_BATCH_SIZE", "7")
+	opts, err := workerPoolOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("workerPoolOptionsFromEnv: %v", err)
+	}
+	if want := (WorkerPoolOptions{Size: 3, FlushInterval: 20 * time.Millisecond, BatchSize: 7}); opts != want {
+		t.Errorf("options = %+v, want %+v", opts, want)
+	}
+
+	for name, value := range map[string]string{
+		"WORKER_POOL_SIZE":      "0",
+		"WORKER_FLUSH_INTERVAL": "0s",
+		"WORKER_BATCH_SIZE":     "-1",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := workerPoolOptionsFromEnv(); err == nil {
+				t.Errorf("accepted %s=%s", name, value)
+			}
+		})
+	}
+}
+
+// clusterSlot returns the Redis Cluster slot of key: the CRC16 (XMODEM) of
+// its hash tag, or of the whole key if it has none, modulo 16384
+func clusterSlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+func TestClusterSlot(t *testing.T) {
+	// Reference slots from CLUSTER KEYSLOT
+	for key, want := range map[string]uint16{"foo": 12182, "123456789": 12739, "{user1000}.following": 3443, "foo{}{bar}": 8363} {
+		if got := clusterSlot(key); got != want {
+			t.Errorf("clusterSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestCompositeKeysShareSlot(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	s := newTestServer(t, config, rdb)
+	check(t, s, "",
+		descriptor("remote_address", "10.0.0.1"),
+		descriptor("remote_address", "10.0.0.1", "path", "/orders"),
+		descriptor("user_id", "alice"),
+		descriptor("user_id", "alice", "method", "POST"),
+		descriptor("company_id", "acme"),
+		descriptor("company_id", "acme", "region", "eu"),
+		descriptor("api_key", "k1"),
+		descriptor("api_key", "k1", "path", "/orders"),
+	)
+
+	// Group the keys written by their entity; every group must map to one
+	// slot, including the Redis limit overrides read alongside the counters
+	groups := map[string][]string{
+		"{company:acme}": {"limit:{company:acme}:region:eu"},
+		"{apikey:k1}":    {"limit:{apikey:k1}:path:/orders"},
+	}
+	for _, key := range mr.Keys() {
+		tag := key[:strings.IndexByte(key, '}')+1]
+		groups[tag] = append(groups[tag], key)
+	}
+	for tag, want := range map[string]int{"{ip:10.0.0.1}": 2, "{user:alice}": 2, "{company:acme}": 3, "{apikey:k1}": 3} {
+		keys := groups[tag]
+		if len(keys) != want {
+			t.Errorf("%s has keys %v, want %d", tag, keys, want)
+			continue
+		}
+		for _, key := range keys[1:] {
+			if clusterSlot(key) != clusterSlot(keys[0]) {
+				t.Errorf("%s (slot %d) and %s (slot %d) are on different slots", key, clusterSlot(key), keys[0], clusterSlot(keys[0]))
+			}
+		}
+	}
+}
+
+func TestKeyPrefixIsolation(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Minute}
+	staging := newTestServer(t, config, rdb)
+	staging.keyPrefix = "staging:"
+	// Counted through the worker pool, so its flushes are covered too
+	prod := newCachedTestServer(t, config, rdb)
+	prod.keyPrefix = "prod:"
+	pool := withWorkerPool(t, prod, time.Hour)
+
+	ip := descriptor("remote_address", "10.0.0.1")
+	if got := allowed(t, staging, 3, "", ip); got != 2 {
+		t.Errorf("staging allowed %d of 3, want 2", got)
+	}
+	if got := allowed(t, prod, 1, "", ip); got != 1 {
+		t.Errorf("prod allowed %d of 1 after staging used its quota, want 1", got)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	key := "{ip:10.0.0.1}:w60000"
+	// Rejected requests are counted too
+	if got, _ := mr.Get("staging:" + key); got != "3" {
+		t.Errorf("staging counter = %q, want 3", got)
+	}
+	if got, _ := mr.Get("prod:" + key); got != "1" {
+		t.Errorf("prod counter = %q, want 1", got)
+	}
+	if keys := mr.Keys(); len(keys) != 2 {
+		t.Errorf("redis keys = %v, want one counter per prefix", keys)
+	}
+
+	// The admin API works on its own server's keys only
+	if rec := adminRequest(t, staging, http.MethodDelete, limitPath(key), ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset status = %d, want 204", rec.Code)
+	}
+	if mr.Exists("staging:"+key) || !mr.Exists("prod:"+key) {
+		t.Errorf("redis keys after resetting staging = %v, want only prod's counter", mr.Keys())
+	}
+}
+
+func TestKeyPrefixOverride(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 5, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	s.keyPrefix = "staging:"
+
+	// The prefix comes first on override keys too
+	if got := s.overrideKey(s.buildKey("company", "acme")); got != "staging:limit:{company:acme}" {
+		t.Errorf("override key = %s, want staging:limit:{company:acme}", got)
+	}
+	mr.Set("staging:limit:{company:acme}", "3")
+	if got := allowed(t, s, 6, "", descriptor("company_id", "acme")); got != 3 {
+		t.Errorf("acme allowed %d of 6, want its override of 3", got)
+	}
+}
+
+func TestKeyPrefixFromEnv(t *testing.T) {
+	for value, want := range map[string]string{"": "", "staging": "staging:", "staging:": "staging:", "eu:prod": "eu:prod:"} {
+		t.Setenv("KEY_PREFIX", value)
+		if got, err := keyPrefixFromEnv(); err != nil || got != want {
+			t.Errorf("KEY_PREFIX=%q gave %q, %v; want %q", value, got, err, want)
+		}
+	}
+	t.Setenv("KEY_PREFIX", "{staging}")
+	if _, err := keyPrefixFromEnv(); err == nil {
+		t.Error("keyPrefixFromEnv accepted a prefix with braces")
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend selects where rate limit counters are stored
+type Backend string
+
+const (
+	// BackendRedis stores counters in Redis, shared by every replica
+	BackendRedis Backend = "redis"
+
+	// BackendMemory stores counters in this process only. It needs no
+	// Redis, but each replica enforces its limits independently, so it only
+	// suits development and single-replica deployments.
+	BackendMemory Backend = "memory"
+)
+
+const (
+	// memoryShards is the number of independently locked shards of the
+	// in-memory store
+	memoryShards = 64
+
+	// memorySweepInterval is how often expired in-memory counters are removed
+	memorySweepInterval = 10 * time.Second
+)
+
+// memoryError is an error reply, which like one from Redis satisfies
+// redis.Error
+type memoryError string
+
+func (e memoryError) Error() string { return string(e) }
+
+// RedisError marks memoryError as a Redis error reply
+func (memoryError) RedisError() {}
+
+const (
+	// errWrongType mirrors the error Redis returns for a command run against
+	// a key holding another kind of value
+	errWrongType = memoryError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	// errNoScript mirrors the error Redis returns for EVALSHA with a script
+	// it does not have
+	errNoScript = memoryError("NOSCRIPT No matching script")
+
+	// errCrossSlot mirrors the error Redis Cluster returns for a script
+	// whose keys do not share a hash slot
+	errCrossSlot = memoryError("CROSSSLOT Keys in request don't hash to the same slot")
+)
+
+// memoryScript is the Go equivalent of one of the service's Lua scripts,
+// run against the locked shard holding its keys
+type memoryScript func(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error)
+
+// memoryScripts maps the SHA of each Lua script the service runs to its Go
+// equivalent
+var memoryScripts = map[string]memoryScript{
+	scriptSHA(incrScript):          memoryIncr,
+	scriptSHA(slidingWindowScript): memorySlidingWindow,
+	scriptSHA(tokenBucketScript):   memoryTokenBucket,
+	scriptSHA(gcraScript):          memoryGCRA,
+	scriptSHA(distinctIPsScript):   memoryDistinctIPs,
+}
+
+// memoryEntry is a single key of the in-memory store. Like a Redis key it
+// holds one kind of value: a counter, hit timestamps, a token bucket or a set.
+type memoryEntry struct {
+	kind      string              // Redis type name: string, zset, hash or set
+	count     int64               // Counter value
+	tat       float64             // GCRA theoretical arrival time in milliseconds
+	hits      []memoryHit         // Sliding window requests, oldest first
+	tokens    float64             // Tokens left in the bucket
+	refilled  int64               // Last bucket refill, in milliseconds
+	members   map[string]struct{} // Set members
+	expiresAt time.Time           // Expiry time; noExpiry for keys set without a TTL
+}
+
+// memoryHit is one request recorded in a sliding window
+type memoryHit struct {
+	at     int64 // Timestamp in milliseconds
+	weight int64 // Hits the request counts for
+}
+
+// noExpiry is the expiry time of keys set without a TTL, such as limit
+// overrides
+var noExpiry = time.Unix(1<<62, 0)
+
+// memoryShard is a locked partition of the in-memory store
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// lookup returns the live entry for key, deleting it if it has expired
+func (s *memoryShard) lookup(key string, now time.Time) *memoryEntry {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// create returns the live entry for key, creating one of the given kind if
+// there is none
+func (s *memoryShard) create(key, kind string, now time.Time) (*memoryEntry, error) {
+	if entry := s.lookup(key, now); entry != nil {
+		if entry.kind != kind {
+			return nil, errWrongType
+		}
+		return entry, nil
+	}
+	entry := &memoryEntry{kind: kind}
+	s.entries[key] = entry
+	return entry, nil
+}
+
+// memoryStore implements redisClient in process memory for BACKEND=memory.
+// Scripts are not interpreted: EVAL and EVALSHA run the Go equivalent of
+// the service's own scripts and reject any other script with NOSCRIPT.
+type memoryStore struct {
+	shards []*memoryShard
+}
+
+// newMemoryStore creates an empty store split into the given number of shards
+func newMemoryStore(shards int) *memoryStore {
+	store := &memoryStore{shards: make([]*memoryShard, shards)}
+	for i := range store.shards {
+		store.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+	return store
+}
+
+// shard returns the shard holding key. Like a Redis Cluster slot, it only
+// depends on the key's hash tag if it has one, so a script can run against
+// several keys sharing a hash tag under one lock.
+func (m *memoryStore) shard(key string) *memoryShard {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// sweep removes expired entries every interval, until ctx is cancelled.
+// Expired entries are never returned, but without a sweep keys that are not
+// requested again would be kept forever.
+func (m *memoryStore) sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, shard := range m.shards {
+				shard.mu.Lock()
+				for key, entry := range shard.entries {
+					if !now.Before(entry.expiresAt) {
+						delete(shard.entries, key)
+					}
+				}
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Ping always succeeds
+func (m *memoryStore) Ping(ctx context.Context) *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
+
+// Get returns the value of a counter
+func (m *memoryStore) Get(ctx context.Context, key string) *redis.StringCmd {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.lookup(key, time.Now())
+	switch {
+	case entry == nil:
+		return redis.NewStringResult("", redis.Nil)
+	case entry.kind != "string":
+		return redis.NewStringResult("", errWrongType)
+	}
+	if entry.tat != 0 {
+		return redis.NewStringResult(strconv.FormatFloat(entry.tat, 'f', -1, 64), nil)
+	}
+	return redis.NewStringResult(strconv.FormatInt(entry.count, 10), nil)
+}
+
+// Set stores an integer value at key, replacing any previous value, with
+// the given TTL or none if it is not positive. Only integers are supported,
+// as only counters and limit overrides are stored as strings.
+func (m *memoryStore) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	count := memoryArg([]interface{}{value}, 0)
+	expiresAt := noExpiry
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration)
+	}
+
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.entries[key] = &memoryEntry{kind: "string", count: count, expiresAt: expiresAt}
+	return redis.NewStatusResult("OK", nil)
+}
+
+// PTTL returns the time until key expires, -1 if it has no TTL, or -2 if
+// it does not exist
+func (m *memoryStore) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	entry := shard.lookup(key, now)
+	if entry == nil {
+		return redis.NewDurationResult(-2, nil)
+	}
+	if entry.expiresAt.Equal(noExpiry) {
+		return redis.NewDurationResult(-1, nil)
+	}
+	return redis.NewDurationResult(entry.expiresAt.Sub(now).Truncate(time.Millisecond), nil)
+}
+
+// Del deletes keys and returns how many existed
+func (m *memoryStore) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	now := time.Now()
+	var deleted int64
+	for _, key := range keys {
+		shard := m.shard(key)
+		shard.mu.Lock()
+		if shard.lookup(key, now) != nil {
+			delete(shard.entries, key)
+			deleted++
+		}
+		shard.mu.Unlock()
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+// Type returns the Redis type name of the value at key, or "none"
+func (m *memoryStore) Type(ctx context.Context, key string) *redis.StatusCmd {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if entry := shard.lookup(key, time.Now()); entry != nil {
+		return redis.NewStatusResult(entry.kind, nil)
+	}
+	return redis.NewStatusResult("none", nil)
+}
+
+// HGet returns a field of a token bucket: "tokens" or "ts"
+func (m *memoryStore) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry := shard.lookup(key, time.Now())
+	switch {
+	case entry == nil:
+		return redis.NewStringResult("", redis.Nil)
+	case entry.kind != "hash":
+		return redis.NewStringResult("", errWrongType)
+	}
+	switch field {
+	case "tokens":
+		return redis.NewStringResult(strconv.FormatFloat(entry.tokens, 'f', -1, 64), nil)
+	case "ts":
+		return redis.NewStringResult(strconv.FormatInt(entry.refilled, 10), nil)
+	default:
+		return redis.NewStringResult("", redis.Nil)
+	}
+}
+
+// Eval runs the Go equivalent of a known script
+func (m *memoryStore) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	return m.EvalSha(ctx, scriptSHA(script), keys, args...)
+}
+
+// EvalSha runs the Go equivalent of the script with the given SHA against
+// its keys, which must share a shard
+func (m *memoryStore) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	script, ok := memoryScripts[sha1]
+	if !ok {
+		return redis.NewCmdResult(nil, errNoScript)
+	}
+	if len(keys) == 0 {
+		return redis.NewCmdResult(nil, fmt.Errorf("script expects a key"))
+	}
+
+	shard := m.shard(keys[0])
+	for _, key := range keys[1:] {
+		if m.shard(key) != shard {
+			return redis.NewCmdResult(nil, errCrossSlot)
+		}
+	}
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	result, err := script(shard, keys, time.Now(), args)
+	if err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+	return redis.NewCmdResult(result, nil)
+}
+
+// ScriptLoad returns the SHA of a script, which EvalSha accepts if it is one
+// of the service's own scripts
+func (m *memoryStore) ScriptLoad(ctx context.Context, script string) *redis.StringCmd {
+	sha := scriptSHA(script)
+	if _, ok := memoryScripts[sha]; !ok {
+		return redis.NewStringResult("", fmt.Errorf("unsupported script %s", sha))
+	}
+	return redis.NewStringResult(sha, nil)
+}
+
+// memoryPipeline implements redisPipeline, the pipelined commands the
+// service uses (GET, PTTL, EVAL and EVALSHA), by running them immediately
+// against the store
+type memoryPipeline struct {
+	store *memoryStore  // Store the commands run against
+	cmds  []redis.Cmder // Commands run since the last Exec
+}
+
+// Get runs GET immediately
+func (p *memoryPipeline) Get(ctx context.Context, key string) *redis.StringCmd {
+	cmd := p.store.Get(ctx, key)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// PTTL runs PTTL immediately
+func (p *memoryPipeline) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	cmd := p.store.PTTL(ctx, key)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Eval runs EVAL immediately
+func (p *memoryPipeline) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := p.store.Eval(ctx, script, keys, args...)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// EvalSha runs EVALSHA immediately
+func (p *memoryPipeline) EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := p.store.EvalSha(ctx, sha1, keys, args...)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Exec returns the commands run since the last Exec and, like a Redis
+// pipeline, the first error among them
+func (p *memoryPipeline) Exec(ctx context.Context) ([]redis.Cmder, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return cmds, err
+		}
+	}
+	return cmds, nil
+}
+
+// memoryIncr is the Go equivalent of incrScript: ARGV[1] is the window in
+// milliseconds, ARGV[2] the hits and the optional ARGV[3] the limit
+func memoryIncr(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error) {
+	if err := memoryArgsErr(args, 2); err != nil {
+		return 0, err
+	}
+	window, hits := memoryArg(args, 0), memoryArg(args, 1)
+	if len(args) > 2 {
+		var count int64
+		if entry := shard.lookup(keys[0], now); entry != nil && entry.kind == "string" {
+			count = entry.count
+		}
+		if count+hits > memoryArg(args, 2) {
+			return count + hits, nil
+		}
+	}
+	entry, err := shard.create(keys[0], "string", now)
+	if err != nil {
+		return 0, err
+	}
+	// Like the script, give a counter left without a TTL one, whatever its
+	// count, so no counter outlives its window indefinitely
+	if entry.expiresAt.IsZero() || entry.expiresAt.Equal(noExpiry) {
+		entry.expiresAt = now.Add(time.Duration(window) * time.Millisecond)
+	}
+	entry.count += hits
+	return entry.count, nil
+}
+
+// memorySlidingWindow is the Go equivalent of slidingWindowScript: KEYS[1]
+// holds the requests and KEYS[2] their running total, ARGV[1] is the current
+// time and ARGV[2] the window, both in milliseconds, ARGV[4] the hits and
+// the optional ARGV[5] the limit. The member prefix in ARGV[3] is not needed.
+func memorySlidingWindow(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error) {
+	if err := memoryArgsErr(args, 4); err != nil {
+		return 0, err
+	}
+	if len(keys) < 2 {
+		return 0, fmt.Errorf("script expects 2 keys, got %d", len(keys))
+	}
+	at, window, hits := memoryArg(args, 0), memoryArg(args, 1), memoryArg(args, 3)
+	entry, err := shard.create(keys[0], "zset", now)
+	if err != nil {
+		return 0, err
+	}
+	sum, err := shard.create(keys[1], "string", now)
+	if err != nil {
+		return 0, err
+	}
+	if len(entry.hits) == 0 {
+		sum.count = 0
+	}
+
+	// Requests are recorded oldest first, so those leaving the window are
+	// at the front
+	expired := 0
+	for expired < len(entry.hits) && entry.hits[expired].at <= at-window {
+		sum.count -= entry.hits[expired].weight
+		expired++
+	}
+	entry.hits = entry.hits[expired:]
+	count := sum.count + hits
+	if len(args) <= 4 || count <= memoryArg(args, 4) {
+		entry.hits = append(entry.hits, memoryHit{at: at, weight: hits})
+		sum.count = count
+	}
+	entry.expiresAt = now.Add(time.Duration(window) * time.Millisecond)
+	sum.expiresAt = entry.expiresAt
+	return count, nil
+}
+
+// memoryTokenBucket is the Go equivalent of tokenBucketScript: ARGV[1] is
+// the capacity, ARGV[2] the refill period and ARGV[3] the current time,
+// both in milliseconds, and ARGV[4] the hits
+func memoryTokenBucket(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error) {
+	if err := memoryArgsErr(args, 4); err != nil {
+		return 0, err
+	}
+	capacity := float64(memoryArg(args, 0))
+	refill := memoryArg(args, 1)
+	at := memoryArg(args, 2)
+	hits := float64(memoryArg(args, 3))
+
+	entry, err := shard.create(keys[0], "hash", now)
+	if err != nil {
+		return 0, err
+	}
+	if entry.expiresAt.IsZero() { // New bucket, starting full
+		entry.tokens, entry.refilled = capacity, at
+	}
+	if at > entry.refilled {
+		entry.tokens = math.Min(capacity, entry.tokens+float64(at-entry.refilled)*capacity/float64(refill))
+		entry.refilled = at
+	}
+
+	var used float64
+	if entry.tokens >= hits {
+		entry.tokens -= hits
+		used = capacity - entry.tokens
+	} else {
+		used = capacity - entry.tokens + hits
+	}
+	entry.expiresAt = now.Add(time.Duration(refill) * time.Millisecond)
+	return int64(math.Ceil(used)), nil
+}
+
+// memoryGCRA is the Go equivalent of gcraScript: ARGV[1] is the capacity,
+// ARGV[2] the time to restore it and ARGV[3] the current time, both in
+// milliseconds, and ARGV[4] the hits
+func memoryGCRA(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error) {
+	if err := memoryArgsErr(args, 4); err != nil {
+		return nil, err
+	}
+	capacity := float64(memoryArg(args, 0))
+	period := float64(memoryArg(args, 1))
+	at := float64(memoryArg(args, 2))
+	hits := float64(memoryArg(args, 3))
+
+	tat := at
+	if entry := shard.lookup(keys[0], now); entry != nil {
+		if entry.kind != "string" {
+			return nil, errWrongType
+		}
+		tat = math.Max(entry.tat, at)
+	}
+	emission := period / capacity
+	newTAT := tat + hits*emission
+	used := int64(math.Ceil((newTAT-at)/emission - 1e-6))
+	if allowAt := newTAT - period; allowAt > at {
+		return []interface{}{used, int64(math.Ceil(allowAt - at))}, nil
+	}
+
+	ttl := int64(math.Ceil(newTAT - at))
+	shard.entries[keys[0]] = &memoryEntry{
+		kind:      "string",
+		tat:       newTAT,
+		expiresAt: now.Add(time.Duration(ttl) * time.Millisecond),
+	}
+	return []interface{}{used, ttl}, nil
+}
+
+// memoryDistinctIPs is the Go equivalent of distinctIPsScript: ARGV[1] is
+// the window in milliseconds and ARGV[2] the IP
+func memoryDistinctIPs(shard *memoryShard, keys []string, now time.Time, args []interface{}) (interface{}, error) {
+	if err := memoryArgsErr(args, 2); err != nil {
+		return 0, err
+	}
+	entry, err := shard.create(keys[0], "set", now)
+	if err != nil {
+		return 0, err
+	}
+	if entry.members == nil {
+		entry.members = make(map[string]struct{})
+		entry.expiresAt = now.Add(time.Duration(memoryArg(args, 0)) * time.Millisecond)
+	}
+	entry.members[fmt.Sprint(args[1])] = struct{}{}
+	return int64(len(entry.members)), nil
+}
+
+// memoryArgsErr returns an error unless there are at least n script arguments
+func memoryArgsErr(args []interface{}, n int) error {
+	if len(args) < n {
+		return fmt.Errorf("script expects %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+// memoryArg returns script argument i as an integer, as Lua's tonumber
+// would, or 0 if it is not numeric
+func memoryArg(args []interface{}, i int) int64 {
+	switch v := args[i].(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	default:
+		return 0
+	}
+}
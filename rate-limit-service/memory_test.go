@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendEnforcesLimits(t *testing.T) {
+	for _, mode := range []WindowMode{FixedWindow, SlidingWindow, TokenBucket, GCRA} {
+		t.Run(string(mode), func(t *testing.T) {
+			config := DefaultRateLimitConfig()
+			config.Keys["remote_address"] = KeyRule{Limit: 3, Window: time.Minute}
+			config.setWindowMode(mode)
+			s := newTestServer(t, config, newMemoryStore(memoryShards))
+
+			if got := allowed(t, s, 5, "", descriptor("remote_address", "10.0.0.1")); got != 3 {
+				t.Errorf("allowed %d of 5, want 3", got)
+			}
+			// Counters are kept per key
+			if got := allowed(t, s, 1, "", descriptor("remote_address", "10.0.0.2")); got != 1 {
+				t.Errorf("other IP allowed %d of 1, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendResetsAfterWindow(t *testing.T) {
+	for _, mode := range []WindowMode{FixedWindow, SlidingWindow} {
+		t.Run(string(mode), func(t *testing.T) {
+			t.Parallel()
+			config := DefaultRateLimitConfig()
+			config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Second}
+			config.setWindowMode(mode)
+			s := newTestServer(t, config, newMemoryStore(memoryShards))
+
+			if got := allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1")); got != 2 {
+				t.Fatalf("allowed %d of 3, want 2", got)
+			}
+			// A sliding window still weighs the previous window right after
+			// it ends, so wait until it has passed completely
+			time.Sleep(2100 * time.Millisecond)
+			if got := allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1")); got != 2 {
+				t.Errorf("allowed %d of 3 after the window, want 2", got)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendQueuedIncrements(t *testing.T) {
+	store := newMemoryStore(memoryShards)
+	s := newCachedTestServer(t, loadTestConfig(t, ipRuleConfig), store)
+	pool := withWorkerPool(t, s, time.Hour)
+	for i := 0; i < 2; i++ {
+		checkCached(t, s)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// The worker pool writes its batches to the store like to Redis
+	key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Second)
+	if got, err := store.Get(context.Background(), key).Int64(); err != nil || got != 2 {
+		t.Errorf("%s = %d (%v), want 2", key, got, err)
+	}
+}
+
+func TestMemoryBackendSlidingWindowTotal(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 10, Window: time.Minute}
+	config.setWindowMode(SlidingWindow)
+	s := newTestServer(t, config, newMemoryStore(memoryShards))
+
+	allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1"))
+	// The admin API reads the running total the store keeps beside the window
+	key := windowedKey(s.buildKey("ip", "10.0.0.1"), time.Minute)
+	if got, err := s.counterValue(context.Background(), key); err != nil || got != 3 {
+		t.Errorf("counter = %d (%v), want 3", got, err)
+	}
+}
+
+func TestMemoryPipeline(t *testing.T) {
+	store := newMemoryStore(memoryShards)
+	ctx := context.Background()
+	store.Set(ctx, "counter", 4, time.Minute)
+
+	// The store pipelines the commands the service sends, and like Redis
+	// reports the first error among them from Exec
+	pipe := newPipeline(store)
+	get := pipe.Get(ctx, "counter")
+	pttl := pipe.PTTL(ctx, "counter")
+	unknown := pipe.EvalSha(ctx, "unknown", []string{"counter"})
+	cmds, err := pipe.Exec(ctx)
+	if len(cmds) != 3 || err != errNoScript {
+		t.Errorf("Exec = %d commands, %v; want 3, NOSCRIPT", len(cmds), err)
+	}
+	if got, _ := get.Int64(); got != 4 {
+		t.Errorf("GET = %d, want 4", got)
+	}
+	if got := pttl.Val(); got <= 0 || got > time.Minute {
+		t.Errorf("PTTL = %v, want (0, 1m]", got)
+	}
+	if unknown.Err() != errNoScript {
+		t.Errorf("EVALSHA of an unknown script = %v, want NOSCRIPT", unknown.Err())
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	store := newMemoryStore(4)
+	ctx := context.Background()
+	store.Set(ctx, "short", 1, 10*time.Millisecond)
+	store.Set(ctx, "long", 1, time.Hour)
+
+	sweepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go store.sweep(sweepCtx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		shard := store.shard("short")
+		shard.mu.Lock()
+		_, present := shard.entries["short"]
+		shard.mu.Unlock()
+		if !present {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired entry not swept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := store.PTTL(ctx, "long").Val(); got <= 0 {
+		t.Errorf("unexpired entry swept, PTTL = %v", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherSeries scrapes the default registry and returns the label sets of
+// the series of the named metric
+func gatherSeries(t *testing.T, name string) []map[string]string {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	var series []map[string]string
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			series = append(series, labelMap(metric))
+		}
+	}
+	return series
+}
+
+// labelMap returns the labels of a scraped metric by name
+func labelMap(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(metric.GetLabel()))
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
+
+// hasSeries reports whether a series carries all the given labels
+func hasSeries(series []map[string]string, want map[string]string) bool {
+	for _, labels := range series {
+		matched := true
+		for name, value := range want {
+			if labels[name] != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redisObservations scrapes the default registry and returns the number of
+// observations of redis_operation_duration_seconds by operation
+func redisObservations(t *testing.T) map[string]uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	observations := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "redis_operation_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			observations[labelMap(metric)["operation"]] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return observations
+}
+
+func TestRedisOperationDuration(t *testing.T) {
+	before := redisObservations(t)
+	rdb, _ := newTestRedis(t)
+
+	// A single script run
+	if _, _, err := newTestStrategy(t, FixedWindow, rdb).increment(context.Background(), "counter", 10, time.Minute, 1); err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+	// A synchronous check, pipelining its scripts after looking up the
+	// company's override
+	check(t, newTestServer(t, DefaultRateLimitConfig(), rdb), "", descriptor("company_id", "acme"))
+	// An async check reading the count, then flushed by the worker pool
+	s := newCachedTestServer(t, loadTestConfig(t, ipRuleConfig), rdb)
+	pool := withWorkerPool(t, s, time.Hour)
+	checkCached(t, s)
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	after := redisObservations(t)
+	for _, operation := range []string{"eval", "eval_pipeline", "get", "read", "pipeline_exec"} {
+		if after[operation] <= before[operation] {
+			t.Errorf("no %s observations recorded", operation)
+		}
+	}
+}
+
+func TestDecisionMetricLabels(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 1, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	allowed(t, s, 2, "", descriptor("company_id", "acme-metrics"))
+
+	decisions := gatherSeries(t, "rate_limit_decisions_total")
+	for _, decision := range []string{"ok", "over_limit"} {
+		if !hasSeries(decisions, map[string]string{"key_type": "company", "decision": decision}) {
+			t.Errorf("no rate_limit_decisions_total series for company %s in %v", decision, decisions)
+		}
+	}
+	if !hasSeries(gatherSeries(t, "rate_limit_latency_seconds"), map[string]string{"type": "descriptor", "key_type": "company"}) {
+		t.Error("no rate_limit_latency_seconds series for company descriptors")
+	}
+
+	// Key types label the series, never the raw values
+	for _, labels := range decisions {
+		for _, value := range labels {
+			if value == "acme-metrics" {
+				t.Errorf("series %v is labeled with a descriptor value", labels)
+			}
+		}
+	}
+}
+
+func TestCompanyDecisionAllowlist(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := loadTestConfig(t, `
+observed_companies: [acme-observed]
+rules:
+  - key: company_id
+    limit: 1
+    unit: minute
+`)
+	s := newTestServer(t, config, rdb)
+	decisions := func(company, decision string) float64 {
+		return testutil.ToFloat64(companyDecisions.WithLabelValues(company, decision))
+	}
+	acmeOK, acmeOver := decisions("acme-observed", "ok"), decisions("acme-observed", "over_limit")
+	otherOK, otherOver := decisions(otherCompanies, "ok"), decisions(otherCompanies, "over_limit")
+
+	// The listed company gets its own series, the rest fold into other
+	allowed(t, s, 2, "", descriptor("company_id", "acme-observed"))
+	allowed(t, s, 3, "", descriptor("company_id", "globex-unlisted"))
+	allowed(t, s, 1, "", descriptor("remote_address", "10.0.0.1"))
+
+	for _, tt := range []struct {
+		company, decision string
+		got, want         float64
+	}{
+		{"acme-observed", "ok", decisions("acme-observed", "ok") - acmeOK, 1},
+		{"acme-observed", "over_limit", decisions("acme-observed", "over_limit") - acmeOver, 1},
+		{otherCompanies, "ok", decisions(otherCompanies, "ok") - otherOK, 1},
+		{otherCompanies, "over_limit", decisions(otherCompanies, "over_limit") - otherOver, 2},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s %s decisions increased by %v, want %v", tt.company, tt.decision, tt.got, tt.want)
+		}
+	}
+	if hasSeries(gatherSeries(t, "rate_limit_company_decisions_total"), map[string]string{"company": "globex-unlisted"}) {
+		t.Error("unlisted company has a series of its own")
+	}
+}
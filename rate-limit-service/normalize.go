@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+)
+
+// normalizeFile configures how descriptor values are normalized before they
+// become counter keys, so unbounded values such as resource IDs or client
+// addresses share a bounded set of keys
+type normalizeFile struct {
+	Paths      bool `yaml:"paths" json:"paths"`             // Collapse numeric and UUID path segments to ":id"
+	IPv4Prefix int  `yaml:"ipv4_prefix" json:"ipv4_prefix"` // Count IPv4 addresses per network of this prefix length (0 keeps them whole)
+	IPv6Prefix int  `yaml:"ipv6_prefix" json:"ipv6_prefix"` // Count IPv6 addresses per network of this prefix length (0 keeps them whole)
+}
+
+// idSegment matches path segments that identify a resource: numbers and
+// UUIDs
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// loadNormalization validates the normalization settings of a file
+func (c *RateLimitConfig) loadNormalization(file *normalizeFile) error {
+	if file == nil {
+		return nil
+	}
+	if file.IPv4Prefix < 0 || file.IPv4Prefix > 32 {
+		return fmt.Errorf("normalize: ipv4_prefix must be within [0, 32], got %d", file.IPv4Prefix)
+	}
+	if file.IPv6Prefix < 0 || file.IPv6Prefix > 128 {
+		return fmt.Errorf("normalize: ipv6_prefix must be within [0, 128], got %d", file.IPv6Prefix)
+	}
+	c.NormalizePaths = file.Paths
+	c.IPv4Prefix = file.IPv4Prefix
+	c.IPv6Prefix = file.IPv6Prefix
+	return nil
+}
+
+// normalizeValue returns the value a descriptor entry of the given key type
+// is counted under: a path with its ID segments collapsed, an IP address
+// reduced to its network, or the value unchanged when its key type is not
+// normalized or the value cannot be parsed
+func (c *RateLimitConfig) normalizeValue(keyType, value string) string {
+	switch keyType {
+	case "path":
+		if c.NormalizePaths {
+			return collapsePath(value)
+		}
+	case "ip":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return value
+		}
+		addr = addr.Unmap()
+		bits := c.IPv6Prefix
+		if addr.Is4() {
+			bits = c.IPv4Prefix
+		}
+		if bits == 0 {
+			return value
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return value
+		}
+		return prefix.String()
+	}
+	return value
+}
+
+// normalizeDescriptor returns the descriptor with its entry values
+// normalized, or the descriptor itself when no value changes
+func (c *RateLimitConfig) normalizeDescriptor(descriptor *ratelimit.RateLimitDescriptor) *ratelimit.RateLimitDescriptor {
+	if !c.NormalizePaths && c.IPv4Prefix == 0 && c.IPv6Prefix == 0 {
+		return descriptor
+	}
+
+	var normalized *ratelimit.RateLimitDescriptor
+	for i, entry := range descriptor.Entries {
+		value := c.normalizeValue(keyTypeFor(entry.Key), entry.Value)
+		if value == entry.Value {
+			continue
+		}
+		if normalized == nil {
+			normalized = &ratelimit.RateLimitDescriptor{
+				Entries:    make([]*ratelimit.RateLimitDescriptor_Entry, len(descriptor.Entries)),
+				Limit:      descriptor.Limit,
+				HitsAddend: descriptor.HitsAddend,
+			}
+			copy(normalized.Entries, descriptor.Entries)
+		}
+		normalized.Entries[i] = &ratelimit.RateLimitDescriptor_Entry{Key: entry.Key, Value: value}
+	}
+	if normalized == nil {
+		return descriptor
+	}
+	return normalized
+}
+
+// collapsePath drops the query string of a path and replaces its numeric and
+// UUID segments with ":id", so "/users/123?x=1" becomes "/users/:id"
+func collapsePath(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
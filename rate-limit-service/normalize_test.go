@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+)
+
+// pathConfig limits each path to 2 requests a minute, with path
+// normalization switched on or off
+const pathConfig = `
+normalize:
+  paths: %v
+rules:
+  - key: path
+    limit: 2
+    unit: minute
+`
+
+func TestPathsCollapseToOneKey(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(pathConfig, true)), rdb)
+
+	check(t, s, "", descriptor("path", "/users/123"))
+	check(t, s, "", descriptor("path", "/users/456?fields=name"))
+	if got := check(t, s, "", descriptor("path", "/users/789")); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("third user path got %v, want OVER_LIMIT as all share /users/:id", got)
+	}
+	key := windowedKey(s.buildKey("path", "/users/:id"), time.Minute)
+	if keys := mr.Keys(); len(keys) != 1 || keys[0] != key {
+		t.Errorf("redis keys = %v, want only %s", keys, key)
+	}
+}
+
+func TestPathsKeptWhole(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(pathConfig, false)), rdb)
+
+	for _, path := range []string{"/users/123", "/users/456", "/users/789"} {
+		if got := allowed(t, s, 2, "", descriptor("path", path)); got != 2 {
+			t.Errorf("%s allowed %d of 2, want 2", path, got)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 3 {
+		t.Errorf("redis keys = %v, want one per path", keys)
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.NormalizePaths = true
+	config.IPv4Prefix = 24
+	config.IPv6Prefix = 64
+	tests := []struct {
+		keyType, value, want string
+	}{
+		{keyType: "path", value: "/users/123", want: "/users/:id"},
+		{keyType: "path", value: "/orgs/42/users/7/", want: "/orgs/:id/users/:id/"},
+		{keyType: "path", value: "/files/6ba7b810-9dad-11d1-80b4-00c04fd430c8", want: "/files/:id"},
+		{keyType: "path", value: "/users/me?x=1", want: "/users/me"},
+		{keyType: "path", value: "/v2/users", want: "/v2/users"},
+		{keyType: "ip", value: "10.1.2.3", want: "10.1.2.0/24"},
+		{keyType: "ip", value: "::ffff:10.1.2.3", want: "10.1.2.0/24"},
+		{keyType: "ip", value: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+		{keyType: "ip", value: "not-an-ip", want: "not-an-ip"},
+		{keyType: "user", value: "123", want: "123"},
+	}
+	for _, tt := range tests {
+		if got := config.normalizeValue(tt.keyType, tt.value); got != tt.want {
+			t.Errorf("normalizeValue(%s, %s) = %s, want %s", tt.keyType, tt.value, got, tt.want)
+		}
+	}
+
+	// Without normalization, values are kept as they are
+	config = DefaultRateLimitConfig()
+	for _, tt := range tests {
+		if got := config.normalizeValue(tt.keyType, tt.value); got != tt.value {
+			t.Errorf("normalizeValue(%s, %s) = %s with normalization off", tt.keyType, tt.value, got)
+		}
+	}
+}
+
+func TestNormalizeDescriptorCopies(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.NormalizePaths = true
+	original := descriptor("remote_address", "10.0.0.1", "path", "/users/123")
+
+	normalized := config.normalizeDescriptor(original)
+	if normalized.Entries[1].Value != "/users/:id" || normalized.Entries[0] != original.Entries[0] {
+		t.Errorf("normalized entries = %v", normalized.Entries)
+	}
+	if original.Entries[1].Value != "/users/123" {
+		t.Errorf("request descriptor modified to %v", original.Entries)
+	}
+	unchanged := descriptor("path", "/health")
+	if config.normalizeDescriptor(unchanged) != unchanged {
+		t.Error("descriptor without values to normalize was copied")
+	}
+}
+
+func TestLoadNormalizationInvalid(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	for _, file := range []normalizeFile{{IPv4Prefix: 33}, {IPv4Prefix: -1}, {IPv6Prefix: 129}} {
+		if err := config.loadNormalization(&file); err == nil {
+			t.Errorf("loadNormalization accepted %+v", file)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherCompanies is the company label shared by every company that is not
+// observed
+const otherCompanies = "other"
+
+// companyDecisions tracks the decisions for descriptors carrying a company
+// ID. Only observed companies get a series of their own; the rest share the
+// "other" label, bounding the metric's cardinality.
+var companyDecisions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_company_decisions_total",
+		Help: "Total number of rate limit decisions per observed company, with the rest labeled other",
+	},
+	[]string{"company", "decision"},
+)
+
+// recordCompanyDecision counts a decision for a descriptor of company,
+// under its own label if the company is observed. Descriptors without a
+// company are not counted.
+func (c *RateLimitConfig) recordCompanyDecision(company string, overLimit bool) {
+	if company == "" {
+		return
+	}
+	if !c.ObservedCompanies[company] {
+		company = otherCompanies
+	}
+	decision := "ok"
+	if overLimit {
+		decision = "over_limit"
+	}
+	companyDecisions.WithLabelValues(company, decision).Inc()
+}
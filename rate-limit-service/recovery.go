@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// grpcPanics counts gRPC handlers that panicked, labeled by method
+	grpcPanics = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_grpc_panics_total",
+			Help: "Total number of gRPC calls whose handler panicked",
+		},
+		[]string{"method"},
+	)
+
+	// grpcErrors counts gRPC calls that returned an error, labeled by method
+	// and status code
+	grpcErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_grpc_errors_total",
+			Help: "Total number of gRPC calls that returned an error",
+		},
+		[]string{"method", "code"},
+	)
+)
+
+// grpcRecoveryInterceptor returns an interceptor that turns a panicking
+// handler into an Internal error, logging the panic with its stack, instead
+// of letting it crash the server, and counts the errors calls return
+func grpcRecoveryInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				grpcPanics.WithLabelValues(info.FullMethod).Inc()
+				logger.Error("recovered from panic in gRPC handler",
+					zap.String("method", info.FullMethod),
+					zap.Any("panic", r),
+					zap.ByteString("stack", debug.Stack()),
+				)
+				resp, err = nil, status.Error(codes.Internal, "internal error")
+			}
+			if err != nil {
+				grpcErrors.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+			}
+		}()
+
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecoveryInterceptorPanic(t *testing.T) {
+	const method = "/test.Service/Panics"
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	// A handler failing a type assertion on a cached value
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		var cached interface{} = "5"
+		return cached.(int64), nil
+	}
+
+	panics := testutil.ToFloat64(grpcPanics.WithLabelValues(method))
+	errs := testutil.ToFloat64(grpcErrors.WithLabelValues(method, codes.Internal.String()))
+	resp, err := grpcRecoveryInterceptor(zap.NewNop())(context.Background(), nil, info, handler)
+	if resp != nil || status.Code(err) != codes.Internal {
+		t.Fatalf("interceptor returned %v, %v; want an Internal error", resp, err)
+	}
+	if got := testutil.ToFloat64(grpcPanics.WithLabelValues(method)) - panics; got != 1 {
+		t.Errorf("panics increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(grpcErrors.WithLabelValues(method, codes.Internal.String())) - errs; got != 1 {
+		t.Errorf("Internal errors increased by %v, want 1", got)
+	}
+}
+
+func TestRecoveryInterceptorErrors(t *testing.T) {
+	const method = "/test.Service/Errors"
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	interceptor := grpcRecoveryInterceptor(zap.NewNop())
+
+	// Errors pass through unchanged, counted by their code
+	unavailable := status.Error(codes.Unavailable, "redis down")
+	errs := testutil.ToFloat64(grpcErrors.WithLabelValues(method, codes.Unavailable.String()))
+	_, err := interceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, unavailable
+	})
+	if !errors.Is(err, unavailable) {
+		t.Errorf("interceptor returned %v, want the handler's error", err)
+	}
+	if got := testutil.ToFloat64(grpcErrors.WithLabelValues(method, codes.Unavailable.String())) - errs; got != 1 {
+		t.Errorf("Unavailable errors increased by %v, want 1", got)
+	}
+
+	// Successful calls are not counted
+	resp, err := interceptor(context.Background(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	if resp != "req" || err != nil {
+		t.Errorf("interceptor returned %v, %v; want the handler's response", resp, err)
+	}
+	if got := testutil.ToFloat64(grpcErrors.WithLabelValues(method, codes.OK.String())); got != 0 {
+		t.Errorf("successful calls counted as %v errors", got)
+	}
+}
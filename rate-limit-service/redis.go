@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// RedisMode selects the Redis deployment the service connects to
+type RedisMode string
+
+const (
+	// RedisCluster connects to a Redis Cluster
+	RedisCluster RedisMode = "cluster"
+
+	// RedisStandalone connects to a single Redis server
+	RedisStandalone RedisMode = "standalone"
+
+	// RedisSentinel connects to the master of a Sentinel-managed deployment
+	RedisSentinel RedisMode = "sentinel"
+)
+
+// redisClient is the subset of the Redis client API used by the service,
+// implemented by the cluster, standalone and sentinel clients alike
+type redisClient interface {
+	Ping(ctx context.Context) *redis.StatusCmd
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	Type(ctx context.Context, key string) *redis.StatusCmd
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+}
+
+// redisPipeline is the subset of redis.Pipeliner used by the service. A
+// go-redis pipeline has every method of it; the in-memory store implements
+// just these.
+type redisPipeline interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(ctx context.Context, sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	Exec(ctx context.Context) ([]redis.Cmder, error)
+}
+
+// newPipeline starts a pipeline on rdb, either a go-redis client or the
+// in-memory store
+func newPipeline(rdb redisClient) redisPipeline {
+	switch client := rdb.(type) {
+	case *memoryStore:
+		return &memoryPipeline{store: client}
+	case interface{ Pipeline() redis.Pipeliner }:
+		return client.Pipeline()
+	default:
+		panic(fmt.Sprintf("%T cannot pipeline commands", rdb))
+	}
+}
+
+// buildRedisOptions reads the Redis connection settings from the
+// environment, defaulting to the redis-cluster nodes with one-second
+// timeouts:
+//   - REDIS_ADDRS: comma-separated cluster node addresses
+//   - REDIS_READ_TIMEOUT, REDIS_WRITE_TIMEOUT: durations such as "500ms"
+//   - REDIS_MAX_REDIRECTS: cluster redirects followed per command
+//   - REDIS_POOL_SIZE: connections per node (0 uses the client default)
+//   - REDIS_PASSWORD: password for AUTH
+//
+// The timeouts, pool size and password apply to every REDIS_MODE.
+func buildRedisOptions() (*redis.ClusterOptions, error) {
+	opts := &redis.ClusterOptions{
+		Addrs: []string{
+			"redis-cluster-0.redis:6379",
+			"redis-cluster-1.redis:6379",
+			"redis-cluster-2.redis:6379",
+		},
+		ReadTimeout:  time.Second, // Timeout for read operations
+		WriteTimeout: time.Second, // Timeout for write operations
+		MaxRedirects: 3,           // Maximum number of redirects
+		Password:     os.Getenv("REDIS_PASSWORD"),
+	}
+
+	if addrs := os.Getenv("REDIS_ADDRS"); addrs != "" {
+		opts.Addrs = nil
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				opts.Addrs = append(opts.Addrs, addr)
+			}
+		}
+		if len(opts.Addrs) == 0 {
+			return nil, fmt.Errorf("REDIS_ADDRS contains no addresses")
+		}
+	}
+
+	var err error
+	if opts.ReadTimeout, err = durationEnv("REDIS_READ_TIMEOUT", opts.ReadTimeout); err != nil {
+		return nil, err
+	}
+	if opts.WriteTimeout, err = durationEnv("REDIS_WRITE_TIMEOUT", opts.WriteTimeout); err != nil {
+		return nil, err
+	}
+	if opts.MaxRedirects, err = intEnv("REDIS_MAX_REDIRECTS", opts.MaxRedirects); err != nil {
+		return nil, err
+	}
+	if opts.PoolSize, err = intEnv("REDIS_POOL_SIZE", opts.PoolSize); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// durationEnv parses a positive duration from the environment variable
+// name, returning fallback when it is unset
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %s", name, value)
+	}
+	return d, nil
+}
+
+// intEnv parses a non-negative integer from the environment variable name,
+// returning fallback when it is unset
+func intEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %d", name, n)
+	}
+	return n, nil
+}
+
+// boolEnv parses a boolean such as "true" or "0" from the environment
+// variable name, returning fallback when it is unset
+func boolEnv(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return b, nil
+}
+
+// newRedisClient builds the client for the deployment selected by
+// REDIS_MODE, defaulting to a cluster:
+//   - cluster: the nodes in REDIS_ADDRS
+//   - standalone: REDIS_ADDR (default localhost:6379)
+//   - sentinel: the master named REDIS_MASTER_NAME, discovered through the
+//     comma-separated REDIS_SENTINEL_ADDRS
+func newRedisClient(logger *zap.Logger) (redisClient, error) {
+	opts, err := buildRedisOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		logger.Info("connected to Redis node",
+			zap.String("addr", fmt.Sprintf("%v", cn)),
+		)
+		return nil
+	}
+
+	var client redis.UniversalClient
+	mode := RedisMode(os.Getenv("REDIS_MODE"))
+	switch mode {
+	case "", RedisCluster:
+		client = redis.NewClusterClient(opts)
+	case RedisStandalone:
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		client = redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     opts.Password,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+			PoolSize:     opts.PoolSize,
+			OnConnect:    opts.OnConnect,
+		})
+	case RedisSentinel:
+		masterName := os.Getenv("REDIS_MASTER_NAME")
+		sentinels := os.Getenv("REDIS_SENTINEL_ADDRS")
+		if masterName == "" || sentinels == "" {
+			return nil, fmt.Errorf("sentinel mode requires REDIS_MASTER_NAME and REDIS_SENTINEL_ADDRS")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    masterName,
+			SentinelAddrs: strings.Split(sentinels, ","),
+			Password:      opts.Password,
+			ReadTimeout:   opts.ReadTimeout,
+			WriteTimeout:  opts.WriteTimeout,
+			PoolSize:      opts.PoolSize,
+			OnConnect:     opts.OnConnect,
+		})
+	default:
+		return nil, fmt.Errorf("invalid REDIS_MODE %q", mode)
+	}
+
+	// Trace every Redis command as a child of the calling span
+	if err := redisotel.InstrumentTracing(client); err != nil {
+		return nil, fmt.Errorf("failed to instrument Redis client: %v", err)
+	}
+	return client, nil
+}
+
+// warmRedisConnections opens a connection to every cluster master, or to
+// the single server for standalone and sentinel clients
+func warmRedisConnections(ctx context.Context, rdb redisClient) error {
+	if cluster, ok := rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.Ping(ctx).Err()
+		})
+	}
+	return rdb.Ping(ctx).Err()
+}
+
+// classifyError maps an error to one of a small, fixed set of categories,
+// used as a metric label instead of the error text, whose addresses and
+// durations would give every failure a label value of its own:
+//   - redis_timeout: a command or dial that timed out
+//   - redis_conn: Redis unreachable, a dropped connection or an open breaker
+//   - script_error: an error reply from Redis, such as a failing script
+//   - no_key: a descriptor no rule applies to
+//   - other: anything else
+func classifyError(err error) string {
+	var netErr net.Error
+	var redisErr redis.Error
+	isNetErr := errors.As(err, &netErr)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), isNetErr && netErr.Timeout():
+		return "redis_timeout"
+	case isNetErr,
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, redis.ErrClosed),
+		errors.Is(err, errBreakerOpen):
+		return "redis_conn"
+	case errors.As(err, &redisErr):
+		return "script_error"
+	case errors.Is(err, errNoRateLimitKey):
+		return "no_key"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestStandaloneEndToEnd(t *testing.T) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_MODE", "standalone")
+	t.Setenv("REDIS_ADDR", mr.Addr())
+
+	rdb, err := newRedisClient(zap.NewNop())
+	if err != nil {
+		t.Fatalf("newRedisClient: %v", err)
+	}
+	t.Cleanup(func() { rdb.(redis.UniversalClient).Close() })
+	if _, ok := rdb.(*redis.Client); !ok {
+		t.Fatalf("standalone mode built a %T, want *redis.Client", rdb)
+	}
+	if err := warmRedisConnections(context.Background(), rdb); err != nil {
+		t.Fatalf("warmRedisConnections: %v", err)
+	}
+
+	// Requests are decided against the single server, and queued updates
+	// written to it
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	if got := allowed(t, s, 3, "", descriptor("remote_address", "10.0.0.1")); got != 2 {
+		t.Errorf("allowed %d of 3, want 2", got)
+	}
+
+	pool := NewUpdateWorkerPool(WorkerPoolOptions{Size: 1, FlushInterval: time.Hour, BatchSize: 100}, rdb, newScriptManager(rdb, zap.NewNop()), nil, zap.NewNop())
+	pool.queue <- &counterUpdate{key: "queued", window: time.Minute, hits: 3}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if got, _ := mr.Get("queued"); got != "3" {
+		t.Errorf("queued counter = %q, want 3", got)
+	}
+}
+
+func TestRedisModeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "unknown mode", env: map[string]string{"REDIS_MODE": "replicated"}},
+		{name: "sentinel without master", env: map[string]string{"REDIS_MODE": "sentinel", "REDIS_SENTINEL_ADDRS": "sentinel:26379"}},
+		{name: "sentinel without sentinels", env: map[string]string{"REDIS_MODE": "sentinel", "REDIS_MASTER_NAME": "mymaster"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"REDIS_MODE", "REDIS_MASTER_NAME", "REDIS_SENTINEL_ADDRS"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if _, err := newRedisClient(zap.NewNop()); err == nil {
+				t.Error("newRedisClient succeeded, want an error")
+			}
+		})
+	}
+}
+
+// redisEnv lists the variables read by buildRedisOptions
+var redisEnv = []string{"REDIS_ADDRS", "REDIS_READ_TIMEOUT", "REDIS_WRITE_TIMEOUT", "REDIS_MAX_REDIRECTS", "REDIS_POOL_SIZE", "REDIS_PASSWORD"}
+
+// setRedisEnv sets the Redis variables for the test, clearing unlisted ones
+func setRedisEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range redisEnv {
+		t.Setenv(name, env[name])
+	}
+}
+
+func TestBuildRedisOptions(t *testing.T) {
+	setRedisEnv(t, map[string]string{
+		"REDIS_ADDRS":         "redis-a:6379, redis-b:6379,",
+		"REDIS_READ_TIMEOUT":  "250ms",
+		"REDIS_WRITE_TIMEOUT": "2s",
+		"REDIS_MAX_REDIRECTS": "5",
+		"REDIS_POOL_SIZE":     "40",
+		"REDIS_PASSWORD":      "secret",
+	})
+	opts, err := buildRedisOptions()
+	if err != nil {
+		t.Fatalf("buildRedisOptions: %v", err)
+	}
+	if want := []string{"redis-a:6379", "redis-b:6379"}; !reflect.DeepEqual(opts.Addrs, want) {
+		t.Errorf("Addrs = %v, want %v", opts.Addrs, want)
+	}
+	if opts.ReadTimeout != 250*time.Millisecond {
+		t.Errorf("ReadTimeout = %v, want 250ms", opts.ReadTimeout)
+	}
+	if opts.WriteTimeout != 2*time.Second {
+		t.Errorf("WriteTimeout = %v, want 2s", opts.WriteTimeout)
+	}
+	if opts.MaxRedirects != 5 {
+		t.Errorf("MaxRedirects = %d, want 5", opts.MaxRedirects)
+	}
+	if opts.PoolSize != 40 {
+		t.Errorf("PoolSize = %d, want 40", opts.PoolSize)
+	}
+	if opts.Password != "secret" {
+		t.Errorf("Password = %q, want secret", opts.Password)
+	}
+}
+
+func TestBuildRedisOptionsDefaults(t *testing.T) {
+	setRedisEnv(t, nil)
+	opts, err := buildRedisOptions()
+	if err != nil {
+		t.Fatalf("buildRedisOptions: %v", err)
+	}
+	if len(opts.Addrs) != 3 || opts.ReadTimeout != time.Second || opts.WriteTimeout != time.Second || opts.MaxRedirects != 3 || opts.PoolSize != 0 {
+		t.Errorf("defaults = %+v, want the three cluster nodes, 1s timeouts and 3 redirects", opts)
+	}
+}
+
+func TestBuildRedisOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{name: "REDIS_ADDRS", value: " , "},
+		{name: "REDIS_READ_TIMEOUT", value: "fast"},
+		{name: "REDIS_READ_TIMEOUT", value: "-1s"},
+		{name: "REDIS_WRITE_TIMEOUT", value: "0s"},
+		{name: "REDIS_MAX_REDIRECTS", value: "-1"},
+		{name: "REDIS_POOL_SIZE", value: "many"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			setRedisEnv(t, map[string]string{tt.name: tt.value})
+			if _, err := buildRedisOptions(); err == nil {
+				t.Errorf("buildRedisOptions accepted %s=%q", tt.name, tt.value)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	ctx := context.Background()
+	scriptErrors := []error{
+		rdb.Eval(ctx, `return redis.error_reply("ERR counter is not a number")`, nil).Err(),
+		rdb.EvalSha(ctx, "0000000000000000000000000000000000000000", nil).Err(),
+	}
+	refused := func(addr string) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 6379}, Err: syscall.ECONNREFUSED}
+	}
+
+	// Errors of one kind share a category, whatever their text
+	categories := map[string][]error{
+		"redis_timeout": {
+			context.DeadlineExceeded,
+			fmt.Errorf("evalsha: %w", context.DeadlineExceeded),
+			&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},
+		},
+		"redis_conn": {
+			refused("10.0.0.1"),
+			refused("10.0.0.2"),
+			io.EOF,
+			redis.ErrClosed,
+			fmt.Errorf("check: %w", errBreakerOpen),
+		},
+		"script_error": scriptErrors,
+		"no_key":       {errNoRateLimitKey, fmt.Errorf("descriptor 2: %w", errNoRateLimitKey)},
+		"other":        {errors.New("unexpected reply"), errors.New("something else")},
+	}
+	for want, errs := range categories {
+		for _, err := range errs {
+			if got := classifyError(err); got != want {
+				t.Errorf("classifyError(%v) = %s, want %s", err, got, want)
+			}
+		}
+	}
+}
+
+func TestErrorLabelBounded(t *testing.T) {
+	config := DefaultRateLimitConfig()
+	config.Keys["remote_address"] = KeyRule{Limit: 2, Window: time.Minute}
+	before := testutil.ToFloat64(rateLimitRequests.WithLabelValues("error", "request", "redis_conn"))
+
+	// Failures against two different unreachable servers count under one
+	// label value, rather than one per address
+	for i := 0; i < 2; i++ {
+		s := newTestServer(t, config, newDeadRedis(t))
+		check(t, s, "", descriptor("remote_address", "10.0.0.1"))
+	}
+	if got := testutil.ToFloat64(rateLimitRequests.WithLabelValues("error", "request", "redis_conn")) - before; got != 2 {
+		t.Errorf("redis_conn errors increased by %v, want 2", got)
+	}
+	for _, labels := range gatherSeries(t, "rate_limit_requests_total") {
+		switch labels["error"] {
+		case "", "redis_timeout", "redis_conn", "script_error", "no_key", "other":
+		default:
+			t.Errorf("series with error label %q", labels["error"])
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// scriptMisses tracks EVALSHA calls answered with NOSCRIPT, which are
+// retried with EVAL and trigger a reload of every script
+var scriptMisses = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rate_limit_script_misses_total",
+		Help: "Total number of EVALSHA calls that found the script missing from Redis",
+	},
+)
+
+// scriptReloadTimeout bounds a background reload of the scripts
+const scriptReloadTimeout = 5 * time.Second
+
+// serviceScripts lists every Lua script the service runs
+var serviceScripts = []string{
+	incrScript,
+	slidingWindowScript,
+	tokenBucketScript,
+	gcraScript,
+	distinctIPsScript,
+}
+
+// scriptSHA returns the SHA1 a script is cached under by Redis
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptManager runs the service's Lua scripts by SHA. It loads them with
+// SCRIPT LOAD, which a cluster client sends to every node, and recovers when
+// Redis loses its script cache, e.g. after a restart or failover: a NOSCRIPT
+// reply is retried with EVAL, and every script is loaded again in the
+// background so the other calls find them.
+type scriptManager struct {
+	redis     redisClient       // Redis client
+	mu        sync.RWMutex      // Guards shas
+	shas      map[string]string // SHA by script source, as returned by SCRIPT LOAD
+	reloading atomic.Bool       // Set while a background reload runs
+	logger    *zap.Logger       // Structured logger
+}
+
+// newScriptManager returns a manager for the service's scripts. They are not
+// loaded until load is called.
+func newScriptManager(rdb redisClient, logger *zap.Logger) *scriptManager {
+	shas := make(map[string]string, len(serviceScripts))
+	for _, src := range serviceScripts {
+		shas[src] = scriptSHA(src)
+	}
+	return &scriptManager{redis: rdb, shas: shas, logger: logger}
+}
+
+// load loads every script into Redis and records the SHAs Redis returns
+func (m *scriptManager) load(ctx context.Context) error {
+	for _, src := range serviceScripts {
+		sha, err := m.redis.ScriptLoad(ctx, src).Result()
+		if err != nil {
+			return fmt.Errorf("failed to load script %s: %v", scriptSHA(src), err)
+		}
+		m.mu.Lock()
+		m.shas[src] = sha
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// sha returns the SHA a script is run by
+func (m *scriptManager) sha(src string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.shas[src]
+}
+
+// missing reports whether err is a NOSCRIPT reply, scheduling a reload of
+// every script if so
+func (m *scriptManager) missing(err error) bool {
+	if !redis.HasErrorPrefix(err, "NOSCRIPT") {
+		return false
+	}
+	scriptMisses.Inc()
+	m.reloadAsync()
+	return true
+}
+
+// reloadAsync loads the scripts again in the background, unless a reload is
+// already running
+func (m *scriptManager) reloadAsync() {
+	if !m.reloading.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer m.reloading.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), scriptReloadTimeout)
+		defer cancel()
+		if err := m.load(ctx); err != nil {
+			m.logger.Warn("failed to reload scripts after NOSCRIPT", zap.Error(err))
+			return
+		}
+		m.logger.Info("reloaded scripts after NOSCRIPT")
+	}()
+}
+
+// run runs a script by SHA, falling back to EVAL if Redis no longer has it
+// cached
+func (m *scriptManager) run(ctx context.Context, src string, keys []string, args ...interface{}) *redis.Cmd {
+	defer observeRedis("eval", time.Now())
+	cmd := m.redis.EvalSha(ctx, m.sha(src), keys, args...)
+	if m.missing(cmd.Err()) {
+		cmd = m.redis.Eval(ctx, src, keys, args...)
+	}
+	return cmd
+}
+
+// eval runs a script returning an integer
+func (m *scriptManager) eval(ctx context.Context, src string, keys []string, args ...interface{}) (int64, error) {
+	result, err := m.run(ctx, src, keys, args...).Int64()
+	if err != nil {
+		redisErrors.WithLabelValues("eval").Inc()
+		return 0, fmt.Errorf("redis error: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// allScriptsCached reports whether Redis has every service script cached
+func allScriptsCached(t *testing.T, rdb redisClient) bool {
+	t.Helper()
+	shas := make([]string, len(serviceScripts))
+	for i, src := range serviceScripts {
+		shas[i] = scriptSHA(src)
+	}
+	exists, err := rdb.(*redis.Client).ScriptExists(context.Background(), shas...).Result()
+	if err != nil {
+		t.Fatalf("SCRIPT EXISTS: %v", err)
+	}
+	for _, ok := range exists {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// loadedScripts returns a script manager with every script loaded into rdb
+func loadedScripts(t *testing.T, rdb redisClient) *scriptManager {
+	t.Helper()
+	scripts := newScriptManager(rdb, zap.NewNop())
+	if err := scripts.load(context.Background()); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !allScriptsCached(t, rdb) {
+		t.Fatal("scripts not cached after load")
+	}
+	return scripts
+}
+
+// waitForReload waits until the background reload has cached every script
+// again
+func waitForReload(t *testing.T, rdb redisClient) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !allScriptsCached(t, rdb) {
+		if time.Now().After(deadline) {
+			t.Fatal("scripts not reloaded after NOSCRIPT")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestScriptLoad(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	scripts := loadedScripts(t, rdb)
+	for _, src := range serviceScripts {
+		if got := scripts.sha(src); got != scriptSHA(src) {
+			t.Errorf("sha = %s, want %s", got, scriptSHA(src))
+		}
+	}
+}
+
+func TestNoScriptFallback(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	scripts := loadedScripts(t, rdb)
+	ctx := context.Background()
+
+	// Redis loses its script cache, e.g. on a restart: the call is retried
+	// by source and the scripts loaded again
+	rdb.(*redis.Client).ScriptFlush(ctx)
+	misses := testutil.ToFloat64(scriptMisses)
+	if count, err := scripts.eval(ctx, incrScript, []string{"counter"}, 60000, 1); err != nil || count != 1 {
+		t.Fatalf("eval after flush = %d, %v; want 1", count, err)
+	}
+	if got := testutil.ToFloat64(scriptMisses) - misses; got != 1 {
+		t.Errorf("script misses increased by %v, want 1", got)
+	}
+	waitForReload(t, rdb)
+
+	// Once reloaded, calls by SHA succeed again
+	if count, err := scripts.eval(ctx, incrScript, []string{"counter"}, 60000, 1); err != nil || count != 2 {
+		t.Fatalf("eval after reload = %d, %v; want 2", count, err)
+	}
+	if got := testutil.ToFloat64(scriptMisses) - misses; got != 1 {
+		t.Errorf("script misses increased by %v after the reload, want 1", got)
+	}
+}
+
+func TestNoScriptFallbackPipeline(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	strategy, err := newWindowStrategy(FixedWindow, true, loadedScripts(t, rdb))
+	if err != nil {
+		t.Fatalf("newWindowStrategy: %v", err)
+	}
+	rdb.(*redis.Client).ScriptFlush(context.Background())
+
+	// Every script of the pipeline is retried by source
+	reqs := []counterRequest{
+		{key: "a", limit: 10, window: time.Minute, hits: 1},
+		{key: "b", limit: 10, window: time.Minute, hits: 2},
+		{key: "c", limit: 10, window: time.Minute, hits: 3},
+	}
+	for i, result := range strategy.incrementAll(context.Background(), reqs) {
+		if result.err != nil || result.count != reqs[i].hits || result.reset <= 0 {
+			t.Errorf("%s: result = %+v, want a count of %d with a reset", reqs[i].key, result, reqs[i].hits)
+		}
+	}
+	waitForReload(t, rdb)
+}
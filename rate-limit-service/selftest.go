@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// selfTestTimeout bounds a whole self-test
+	selfTestTimeout = 5 * time.Second
+
+	// selfTestWindow is the window of the self-test counter, which is
+	// deleted at the end of the test or otherwise expires with it
+	selfTestWindow = 10 * time.Second
+
+	// selfTestLimit is the limit the self-test counter is checked against,
+	// high enough never to be reached
+	selfTestLimit = 1000
+)
+
+// selfTestStep is the JSON view of one step of a self-test
+type selfTestStep struct {
+	Name      string  `json:"name"`            // Step performed
+	OK        bool    `json:"ok"`              // Whether the step succeeded
+	LatencyMs float64 `json:"latency_ms"`      // Time the step took
+	Error     string  `json:"error,omitempty"` // Why the step failed
+}
+
+// selfTestReport is the JSON view of a self-test
+type selfTestReport struct {
+	OK    bool           `json:"ok"`    // Whether every step succeeded
+	Key   string         `json:"key"`   // Reserved counter key the test used
+	Steps []selfTestStep `json:"steps"` // Steps in the order they ran
+}
+
+// selfTest counts a hit against a reserved counter with the configured
+// window mode, as a rate limit check would, then checks that the counter has
+// an expiry, reads it back and deletes it. Each step runs only if the
+// previous ones succeeded, except the cleanup, which always runs. The
+// circuit breaker is bypassed so the test reaches Redis even while it is open.
+func (s *RateLimitServer) selfTest(ctx context.Context) selfTestReport {
+	key := "{selftest}:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	redisKey := s.keyPrefix + key
+	report := selfTestReport{OK: true, Key: redisKey}
+
+	run := func(name string, step func() error) {
+		if !report.OK && name != "cleanup" {
+			return
+		}
+		start := time.Now()
+		err := step()
+		result := selfTestStep{Name: name, OK: err == nil, LatencyMs: milliseconds(time.Since(start))}
+		if err != nil {
+			result.Error = err.Error()
+			report.OK = false
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	run("increment", func() error {
+		result := s.strategy.incrementAll(ctx, []counterRequest{{key: redisKey, limit: selfTestLimit, window: selfTestWindow, hits: 1}})[0]
+		if result.err != nil {
+			return result.err
+		}
+		if result.count < 1 {
+			return fmt.Errorf("counter reports %d hits after one was counted", result.count)
+		}
+		return nil
+	})
+	run("expire", func() error {
+		ttl, err := s.redis.PTTL(ctx, redisKey).Result()
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 || ttl > selfTestWindow {
+			return fmt.Errorf("counter TTL is %v, want within (0, %v]", ttl, selfTestWindow)
+		}
+		return nil
+	})
+	run("read", func() error {
+		_, err := s.counterValue(ctx, key)
+		return err
+	})
+	run("cleanup", func() error {
+		s.cacheDel(redisKey)
+		// The running total of a sliding window shares the key's hash tag
+		return s.redis.Del(ctx, redisKey, slidingWindowSumKey(redisKey)).Err()
+	})
+	return report
+}
+
+// handleSelfTest runs a self-test against Redis and reports each step,
+// responding 503 if any step failed
+func (s *RateLimitServer) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), selfTestTimeout)
+	defer cancel()
+
+	report := s.selfTest(ctx)
+	if report.OK {
+		s.logger.Info("self-test passed", zap.String("key", report.Key))
+	} else {
+		s.logger.Warn("self-test failed", zap.Any("steps", report.Steps))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// milliseconds converts d to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
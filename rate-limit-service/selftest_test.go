@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// runSelfTest runs the self-test through the admin API and returns the
+// response status and report
+func runSelfTest(t *testing.T, s *RateLimitServer) (int, selfTestReport) {
+	t.Helper()
+	rec := adminRequest(t, s, http.MethodGet, "/admin/selftest", "")
+	var report selfTestReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestSelfTestPasses(t *testing.T) {
+	for _, mode := range []WindowMode{FixedWindow, SlidingWindow, TokenBucket, GCRA} {
+		t.Run(string(mode), func(t *testing.T) {
+			rdb, mr := newTestRedis(t)
+			config := DefaultRateLimitConfig()
+			config.setWindowMode(mode)
+			s := newTestServer(t, config, rdb)
+			s.keyPrefix = "staging:"
+
+			code, report := runSelfTest(t, s)
+			if code != http.StatusOK || !report.OK {
+				t.Fatalf("status %d, report %+v; want success", code, report)
+			}
+			var names []string
+			for _, step := range report.Steps {
+				names = append(names, step.Name)
+				if !step.OK || step.Error != "" || step.LatencyMs < 0 {
+					t.Errorf("step %+v failed", step)
+				}
+			}
+			if len(names) != 4 || names[0] != "increment" || names[3] != "cleanup" {
+				t.Errorf("steps = %v, want increment, expire, read and cleanup", names)
+			}
+			if !strings.HasPrefix(report.Key, "staging:{selftest}:") {
+				t.Errorf("key = %s, want a prefixed self-test key", report.Key)
+			}
+			// The reserved counter is cleaned up
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("redis keys after the self-test = %v", keys)
+			}
+		})
+	}
+}
+
+func TestSelfTestDeadRedis(t *testing.T) {
+	s := newTestServer(t, DefaultRateLimitConfig(), newDeadRedis(t))
+
+	code, report := runSelfTest(t, s)
+	if code != http.StatusServiceUnavailable || report.OK {
+		t.Fatalf("status %d, ok %v; want a 503 failure", code, report.OK)
+	}
+	// The steps after the failed increment are skipped, except the cleanup
+	if len(report.Steps) != 2 || report.Steps[0].Name != "increment" || report.Steps[1].Name != "cleanup" {
+		t.Fatalf("steps = %+v, want increment and cleanup", report.Steps)
+	}
+	for _, step := range report.Steps {
+		if step.OK || step.Error == "" {
+			t.Errorf("step %+v succeeded against a dead Redis", step)
+		}
+	}
+}
+
+func TestSelfTestRequiresToken(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, DefaultRateLimitConfig(), rdb)
+	rec := httptest.NewRecorder()
+	s.adminHandler(adminToken).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/selftest", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SharingAction selects what happens when a user exceeds the distinct IP limit
+type SharingAction string
+
+const (
+	// SharingFlag logs and counts shared accounts but allows their requests
+	SharingFlag SharingAction = "flag"
+
+	// SharingReject rejects requests from shared accounts
+	SharingReject SharingAction = "reject"
+)
+
+// sharedAccounts counts requests from users seen on more distinct IPs than
+// allowed, labeled by the action taken
+var sharedAccounts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_shared_account_total",
+		Help: "Total number of requests from users exceeding the distinct IP limit",
+	},
+	[]string{"action"},
+)
+
+// distinctIPsScript adds ARGV[2] to the set at KEYS[1], starts its window of
+// ARGV[1] milliseconds if it has none yet, and returns the set's size
+const distinctIPsScript = `
+redis.call("SADD", KEYS[1], ARGV[2])
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return redis.call("SCARD", KEYS[1])
+`
+
+// checkSharedAccount records the IP a user was seen from and reports whether
+// the user has been seen from more distinct IPs than allowed in the window.
+// This is tracked separately from the user's request count, and skipped
+// while the circuit breaker is open.
+func (s *RateLimitServer) checkSharedAccount(ctx context.Context, config *RateLimitConfig, userID, ip string) (bool, error) {
+	key := windowedKey(config.scopeKey(s.buildKey(keyTypeFor("user_id"), userID)+":ips"), config.SharedIPWindow)
+
+	if !s.breaker.allow() {
+		breakerRejections.WithLabelValues("shared_account").Inc()
+		return false, errBreakerOpen
+	}
+	count, err := s.scripts.eval(ctx, distinctIPsScript, []string{key}, config.SharedIPWindow.Milliseconds(), ip)
+	s.recordRedisResult(ctx, err)
+	if err != nil {
+		return false, err
+	}
+
+	return count > config.SharedIPLimit, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fromIP checks a request from user on ip
+func fromIP(t *testing.T, s *RateLimitServer, user string, ip int) envoy.RateLimitResponse_Code {
+	t.Helper()
+	return check(t, s, "", descriptor("user_id", user), descriptor("remote_address", fmt.Sprintf("10.0.0.%d", ip)))
+}
+
+func TestSharedAccountReject(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.SharedIPLimit = 3
+	config.SharedIPAction = SharingReject
+	s := newTestServer(t, config, rdb)
+
+	// A user on a few IPs, coming back to them, is allowed
+	for i := 0; i < 9; i++ {
+		if got := fromIP(t, s, "alice", i%3); got != envoy.RateLimitResponse_OK {
+			t.Fatalf("request %d from 3 IPs got %v, want OK", i+1, got)
+		}
+	}
+
+	// Suddenly on many IPs, the distinct IP limit trips
+	if got := fromIP(t, s, "alice", 3); got != envoy.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("request from a 4th IP got %v, want OVER_LIMIT", got)
+	}
+	// Other users are tracked separately
+	if got := fromIP(t, s, "bob", 3); got != envoy.RateLimitResponse_OK {
+		t.Errorf("other user got %v, want OK", got)
+	}
+}
+
+func TestSharedAccountFlag(t *testing.T) {
+	rdb, mr := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.SharedIPLimit = 3
+	s := newTestServer(t, config, rdb)
+
+	flagged := testutil.ToFloat64(sharedAccounts.WithLabelValues("flag"))
+	for ip := 0; ip < 5; ip++ {
+		if got := fromIP(t, s, "alice", ip); got != envoy.RateLimitResponse_OK {
+			t.Errorf("flagged request from IP %d got %v, want OK", ip, got)
+		}
+	}
+	if got := testutil.ToFloat64(sharedAccounts.WithLabelValues("flag")) - flagged; got != 2 {
+		t.Errorf("flagged %v requests, want 2", got)
+	}
+
+	// The set of IPs expires with its window
+	mr.FastForward(config.SharedIPWindow + time.Second)
+	flagged = testutil.ToFloat64(sharedAccounts.WithLabelValues("flag"))
+	fromIP(t, s, "alice", 9)
+	if got := testutil.ToFloat64(sharedAccounts.WithLabelValues("flag")) - flagged; got != 0 {
+		t.Errorf("flagged %v requests after the window, want 0", got)
+	}
+}
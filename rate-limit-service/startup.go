@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// startupTimeout bounds the total time spent on startup tasks
+const startupTimeout = 10 * time.Second
+
+// startupTask is an independent unit of work run while the server starts
+type startupTask struct {
+	name     string                          // Task name used in logs
+	critical bool                            // Whether failure aborts startup
+	run      func(ctx context.Context) error // Work to perform
+}
+
+// runStartup runs the startup tasks concurrently within timeout. It waits
+// for the critical tasks and returns the first critical failure, while
+// best-effort tasks keep running in the background and only log failures.
+func runStartup(ctx context.Context, logger *zap.Logger, timeout time.Duration, tasks []startupTask) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, task := range tasks {
+		if !task.critical {
+			// Best-effort tasks get their own deadline so they may outlive startup
+			go func() {
+				taskCtx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				runStartupTask(taskCtx, logger, task)
+			}()
+			continue
+		}
+
+		group.Go(func() error {
+			if err := runStartupTask(groupCtx, logger, task); err != nil {
+				return fmt.Errorf("startup task %s failed: %w", task.name, err)
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// runStartupTask runs a single startup task and logs its outcome
+func runStartupTask(ctx context.Context, logger *zap.Logger, task startupTask) error {
+	start := time.Now()
+	logger.Info("startup task started",
+		zap.String("task", task.name),
+		zap.Bool("critical", task.critical),
+	)
+
+	if err := task.run(ctx); err != nil {
+		logger.Error("startup task failed",
+			zap.String("task", task.name),
+			zap.Bool("critical", task.critical),
+			zap.Duration("duration", time.Since(start)),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	logger.Info("startup task completed",
+		zap.String("task", task.name),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
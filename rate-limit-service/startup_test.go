@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sleepTask returns a task that waits for d or for its context to end
+func sleepTask(name string, critical bool, d time.Duration) startupTask {
+	return startupTask{
+		name:     name,
+		critical: critical,
+		run: func(ctx context.Context) error {
+			select {
+			case <-time.After(d):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
+
+func TestRunStartupConcurrent(t *testing.T) {
+	start := time.Now()
+	err := runStartup(context.Background(), zap.NewNop(), time.Second, []startupTask{
+		sleepTask("a", true, 100*time.Millisecond),
+		sleepTask("b", true, 100*time.Millisecond),
+		sleepTask("c", true, 100*time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("runStartup: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 250*time.Millisecond {
+		t.Errorf("three 100ms tasks took %v, want them to run concurrently", elapsed)
+	}
+}
+
+func TestRunStartupCriticalFailure(t *testing.T) {
+	errPing := errors.New("connection refused")
+	err := runStartup(context.Background(), zap.NewNop(), time.Second, []startupTask{
+		{name: "redis_ping", critical: true, run: func(context.Context) error { return errPing }},
+		sleepTask("script_load", true, 10*time.Millisecond),
+	})
+	if !errors.Is(err, errPing) {
+		t.Errorf("runStartup error = %v, want %v", err, errPing)
+	}
+}
+
+func TestRunStartupBestEffort(t *testing.T) {
+	// A failing or slow best-effort task neither fails nor delays startup
+	start := time.Now()
+	err := runStartup(context.Background(), zap.NewNop(), time.Second, []startupTask{
+		sleepTask("redis_ping", true, 10*time.Millisecond),
+		{name: "warmup_error", run: func(context.Context) error { return errors.New("warmup failed") }},
+		sleepTask("warmup_slow", false, 500*time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("runStartup: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 250*time.Millisecond {
+		t.Errorf("startup took %v, want it not to wait for best-effort tasks", elapsed)
+	}
+}
+
+func TestRunStartupDeadline(t *testing.T) {
+	start := time.Now()
+	err := runStartup(context.Background(), zap.NewNop(), 50*time.Millisecond, []startupTask{
+		sleepTask("redis_ping", true, time.Minute),
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runStartup error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("startup took %v, want it bounded by the 50ms deadline", elapsed)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCert is a certificate and key issued for tests
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issueCert creates a certificate for name signed by parent, or self-signed
+// when parent is nil
+func issueCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and its key to PEM files in dir and
+// returns their paths
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsCertificate returns the certificate for use in a tls.Config
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveHealth starts a gRPC server with the given options serving health
+// checks and returns its address
+func serveHealth(t *testing.T, opts ...grpc.ServerOption) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+	return ln.Addr().String()
+}
+
+// healthCheck dials addr with creds and reports the error of a health check
+func healthCheck(t *testing.T, addr string, creds credentials.TransportCredentials) error {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestServerCredentialsMTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "test-ca", true, nil)
+	server := issueCert(t, "rate-limit-service", false, ca)
+	client := issueCert(t, "envoy", false, ca)
+	stranger := issueCert(t, "stranger", false, issueCert(t, "other-ca", true, nil))
+
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := server.writePEM(t, dir, "server")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CA_FILE", caFile)
+
+	opt, err := serverCredentials()
+	if err != nil {
+		t.Fatalf("serverCredentials: %v", err)
+	}
+	addr := serveHealth(t, opt)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientTLS := func(certs ...tls.Certificate) credentials.TransportCredentials {
+		return credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: certs})
+	}
+
+	if err := healthCheck(t, addr, clientTLS(client.tlsCertificate())); err != nil {
+		t.Errorf("client with a valid certificate: %v", err)
+	}
+	if err := healthCheck(t, addr, clientTLS()); err == nil {
+		t.Error("client without a certificate completed the handshake")
+	}
+	if err := healthCheck(t, addr, clientTLS(stranger.tlsCertificate())); err == nil {
+		t.Error("client with a certificate from another CA completed the handshake")
+	}
+	if err := healthCheck(t, addr, insecure.NewCredentials()); err == nil {
+		t.Error("plaintext client was served")
+	}
+}
+
+func TestServerCredentialsPlaintext(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CA_FILE", "")
+
+	opt, err := serverCredentials()
+	if err != nil {
+		t.Fatalf("serverCredentials: %v", err)
+	}
+	if opt != nil {
+		t.Fatal("serverCredentials returned credentials without a certificate")
+	}
+	if err := healthCheck(t, serveHealth(t), insecure.NewCredentials()); err != nil {
+		t.Errorf("plaintext client: %v", err)
+	}
+}
+
+func TestServerCredentialsIncomplete(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "server.crt")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CA_FILE", "")
+	if _, err := serverCredentials(); err == nil {
+		t.Error("serverCredentials accepted a certificate without a key")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// recordSpans makes the service's tracer record into an in-memory exporter
+// for the duration of the test
+func recordSpans(t *testing.T) (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous, propagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = previous
+		otel.SetTextMapPropagator(propagator)
+		provider.Shutdown(context.Background())
+	})
+	return exporter, provider
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	exporter, provider := recordSpans(t)
+	rdb, _ := newTestRedis(t)
+	config := DefaultRateLimitConfig()
+	config.Keys["company_id"] = KeyRule{Limit: 10, Window: time.Minute}
+	s := newTestServer(t, config, rdb)
+	if err := redisotel.InstrumentTracing(rdb.(*redis.Client), redisotel.WithTracerProvider(provider)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request arrives through the interceptor carrying the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01",
+	))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.ShouldRateLimit(ctx, req.(*envoy.RateLimitRequest))
+	}
+	req := &envoy.RateLimitRequest{Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("company_id", "acme")}}
+	if _, err := grpcTracingInterceptor(ctx, req, &grpc.UnaryServerInfo{}, handler); err != nil {
+		t.Fatalf("ShouldRateLimit: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	var redisSpans []tracetest.SpanStub
+	for _, span := range spans {
+		// Connections are dialed for the pool, outside any request
+		if span.Name == "redis.dial" {
+			continue
+		}
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %s in trace %s, want the caller's %s", span.Name, span.SpanContext.TraceID(), traceID)
+		}
+		if strings.HasPrefix(span.Name, "ShouldRateLimit") || strings.HasPrefix(span.Name, "checkRateLimit") {
+			byName[span.Name] = span
+		} else {
+			redisSpans = append(redisSpans, span)
+		}
+	}
+	root, ok := byName["ShouldRateLimit"]
+	if !ok {
+		t.Fatalf("no ShouldRateLimit span in %d spans", len(spans))
+	}
+	if got := root.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("ShouldRateLimit parent = %s, want the caller's span", got)
+	}
+	check, ok := byName["checkRateLimit"]
+	if !ok {
+		t.Fatal("no checkRateLimit span")
+	}
+	if check.Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Error("checkRateLimit is not a child of ShouldRateLimit")
+	}
+	attrs := make(map[string]string)
+	for _, attr := range check.Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["ratelimit.key_type"] != "company" || attrs["ratelimit.decision"] != "ok" || attrs["ratelimit.count"] != "1" {
+		t.Errorf("checkRateLimit attributes = %v", attrs)
+	}
+
+	if len(redisSpans) == 0 {
+		t.Fatal("no Redis spans")
+	}
+	// Increments of all the request's descriptors share one pipeline, so
+	// Redis spans hang off the request or off a single check
+	for _, span := range redisSpans {
+		if parent := span.Parent.SpanID(); parent != root.SpanContext.SpanID() && parent != check.SpanContext.SpanID() {
+			t.Errorf("Redis span %s is outside the request's span tree", span.Name)
+		}
+	}
+}
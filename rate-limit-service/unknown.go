@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DescriptorPolicy selects how descriptors that match no rate limit rule are
+// handled
+type DescriptorPolicy string
+
+const (
+	// DescriptorAllow skips descriptors that match no rule, leaving the
+	// decision to the request's other descriptors
+	DescriptorAllow DescriptorPolicy = "allow"
+
+	// DescriptorDeny rejects requests carrying a descriptor that matches no
+	// rule
+	DescriptorDeny DescriptorPolicy = "deny"
+
+	// DescriptorError fails requests carrying a descriptor that matches no
+	// rule with InvalidArgument, leaving the decision to Envoy's
+	// failure_mode_deny
+	DescriptorError DescriptorPolicy = "error"
+)
+
+// unknownDescriptorRequests tracks descriptors that match no rule, labeled
+// by the policy applied to them
+var unknownDescriptorRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_unknown_descriptor_total",
+		Help: "Total number of descriptors matching no rate limit rule",
+	},
+	[]string{"policy"},
+)
+
+// validDescriptorPolicy reports whether p is a known policy
+func validDescriptorPolicy(p DescriptorPolicy) bool {
+	return p == DescriptorAllow || p == DescriptorDeny || p == DescriptorError
+}
+
+// isUnknownDescriptor reports whether a descriptor whose check returned err
+// matched no rule. Descriptors carrying a tenant ID are counted against the
+// tenant ceiling even when no other rule applies, so they are not unknown.
+func isUnknownDescriptor(descriptor *ratelimit.RateLimitDescriptor, err error) bool {
+	return errors.Is(err, errNoRateLimitKey) && descriptorValue(descriptor, "tenant_id") == ""
+}
+
+// checkUnknownDescriptors applies the unknown descriptor policy to the
+// checked descriptors of a request. It returns an InvalidArgument error under
+// DescriptorError, and otherwise the indexes of the descriptors to reject. In
+// dry-run mode DescriptorError rejects the descriptors like DescriptorDeny,
+// so the rejections are recorded as shadow ones rather than enforced.
+func (c *RateLimitConfig) checkUnknownDescriptors(descriptors []*ratelimit.RateLimitDescriptor, errs []error) (map[int]bool, error) {
+	var denied map[int]bool
+	for i, descriptor := range descriptors {
+		if !isUnknownDescriptor(descriptor, errs[i]) {
+			continue
+		}
+		unknownDescriptorRequests.WithLabelValues(string(c.UnknownDescriptors)).Inc()
+		switch c.UnknownDescriptors {
+		case DescriptorError:
+			if !c.DryRun {
+				return nil, status.Errorf(codes.InvalidArgument, "descriptor %d matches no rate limit rule", i)
+			}
+			fallthrough
+		case DescriptorDeny:
+			if denied == nil {
+				denied = make(map[int]bool)
+			}
+			denied[i] = true
+		}
+	}
+	return denied, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	envoy "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unknownDescriptorConfig limits companies under the given policy for
+// descriptors matching no rule
+const unknownDescriptorConfig = `
+unknown_descriptors: %s
+rules:
+  - key: company_id
+    limit: 5
+    unit: minute
+`
+
+func TestUnknownDescriptorPolicies(t *testing.T) {
+	unknown := descriptor("header.x-region", "eu")
+	known := descriptor("company_id", "acme")
+	tests := []struct {
+		policy  DescriptorPolicy
+		code    codes.Code                     // gRPC status of the call
+		overall envoy.RateLimitResponse_Code   // Decision for the unknown descriptor alone
+		mixed   []envoy.RateLimitResponse_Code // Statuses for the known and unknown descriptors
+	}{
+		{
+			policy:  DescriptorAllow,
+			code:    codes.OK,
+			overall: envoy.RateLimitResponse_OK,
+			mixed:   []envoy.RateLimitResponse_Code{envoy.RateLimitResponse_OK, envoy.RateLimitResponse_OK},
+		},
+		{
+			policy:  DescriptorDeny,
+			code:    codes.OK,
+			overall: envoy.RateLimitResponse_OVER_LIMIT,
+			mixed:   []envoy.RateLimitResponse_Code{envoy.RateLimitResponse_OK, envoy.RateLimitResponse_OVER_LIMIT},
+		},
+		{
+			policy: DescriptorError,
+			code:   codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rdb, mr := newTestRedis(t)
+			s := newTestServer(t, loadTestConfig(t, fmt.Sprintf(unknownDescriptorConfig, tt.policy)), rdb)
+			counted := testutil.ToFloat64(unknownDescriptorRequests.WithLabelValues(string(tt.policy)))
+
+			response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{Descriptors: []*ratelimit.RateLimitDescriptor{unknown}})
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("status = %v, want %v", got, tt.code)
+			}
+			if got := testutil.ToFloat64(unknownDescriptorRequests.WithLabelValues(string(tt.policy))) - counted; got != 1 {
+				t.Errorf("unknown descriptors counted %v times, want 1", got)
+			}
+			if err != nil {
+				return
+			}
+			if response.OverallCode != tt.overall {
+				t.Errorf("unknown descriptor alone got %v, want %v", response.OverallCode, tt.overall)
+			}
+
+			// Next to a known descriptor, only the unknown one is affected
+			response = shouldRateLimit(t, s, "", known, unknown)
+			for i, want := range tt.mixed {
+				if got := response.Statuses[i].Code; got != want {
+					t.Errorf("descriptor %d got %v, want %v", i, got, want)
+				}
+			}
+			// Unknown descriptors are never counted
+			if keys := mr.Keys(); len(keys) != 1 {
+				t.Errorf("redis keys = %v, want only the company counter", keys)
+			}
+		})
+	}
+}
+
+func TestUnknownDescriptorErrorDryRun(t *testing.T) {
+	rdb, _ := newTestRedis(t)
+	s := newTestServer(t, loadTestConfig(t, "dry_run: true\n"+fmt.Sprintf(unknownDescriptorConfig, DescriptorError)), rdb)
+
+	// The descriptor is allowed, but the rejection it would have had is
+	// counted
+	shadow := shadowRejections.WithLabelValues(tupleRuleKey(descriptor("header.x-region", "eu")))
+	before := testutil.ToFloat64(shadow)
+	response, err := s.ShouldRateLimit(context.Background(), &envoy.RateLimitRequest{
+		Descriptors: []*ratelimit.RateLimitDescriptor{descriptor("header.x-region", "eu")},
+	})
+	if err != nil {
+		t.Fatalf("unknown descriptor failed in dry run: %v", err)
+	}
+	if response.OverallCode != envoy.RateLimitResponse_OK {
+		t.Errorf("unknown descriptor got %v in dry run, want OK", response.OverallCode)
+	}
+	if got := testutil.ToFloat64(shadow) - before; got != 1 {
+		t.Errorf("shadow rejections increased by %v, want 1", got)
+	}
+}
+
+func TestUnknownDescriptorPolicyInvalid(t *testing.T) {
+	if _, err := LoadConfig(writeTestConfig(t, fmt.Sprintf(unknownDescriptorConfig, "ignore"))); err == nil {
+		t.Error("LoadConfig accepted unknown_descriptors: ignore")
+	}
+	config, err := LoadConfig(writeTestConfig(t, "rules: []\n"))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.UnknownDescriptors != DescriptorAllow {
+		t.Errorf("default policy = %s, want allow", config.UnknownDescriptors)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// actorKey holds the user ID of the caller authenticated by RequireRole
+const actorKey contextKey = "actor"
+
+// Actions recorded in the audit log
+const (
+	auditCreate = "user.create"
+	auditUpdate = "user.update"
+	auditDelete = "user.delete"
+	auditLogin  = "user.login"
+)
+
+// Outcomes of a login recorded in the audit log
+const (
+	loginSucceeded = "success"
+	loginFailed    = "invalid_credentials"
+	loginLocked    = "locked"
+	loginSuspended = "suspended"
+)
+
+// redacted replaces the value of a sensitive field in an audit record
+const redacted = "[REDACTED]"
+
+// sensitiveFields lists the user fields whose values never reach the audit
+// log; that they changed is still recorded
+var sensitiveFields = map[string]bool{"password": true}
+
+// actorID returns the user ID of the caller authenticated by RequireRole, or
+// an empty string for unauthenticated requests
+func actorID(r *http.Request) string {
+	id, _ := r.Context().Value(actorKey).(string)
+	return id
+}
+
+// auditCreated records the creation of user in the audit log
+func (s *UserService) auditCreated(r *http.Request, user User) {
+	s.audit(r, auditCreate, actorID(r), user.ID, map[string]interface{}{
+		"email":    user.Email,
+		"password": user.Password,
+		"role":     user.Role,
+		"status":   user.Status,
+	})
+}
+
+// audit records an action by actor on the user with ID target in the audit
+// log, with the new values of the fields it changed. Values of sensitive
+// fields are redacted.
+func (s *UserService) audit(r *http.Request, action, actor, target string, changes map[string]interface{}, fields ...zap.Field) {
+	values := make(map[string]interface{}, len(changes))
+	for field, value := range changes {
+		if sensitiveFields[field] {
+			value = redacted
+		}
+		values[field] = value
+	}
+	requestLogger(s.auditLog, r).Info("audit",
+		append([]zap.Field{
+			zap.String("action", action),
+			zap.String("actor", actor),
+			zap.String("target_user_id", target),
+			zap.Any("changes", values),
+		}, fields...)...,
+	)
+}
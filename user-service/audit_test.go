@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observeAudit replaces the audit logger of s with one recording its
+// entries
+func observeAudit(s *UserService) *observer.ObservedLogs {
+	core, logs := observer.New(zap.InfoLevel)
+	s.auditLog = zap.New(core)
+	return logs
+}
+
+// auditRecord returns the fields of the only audit record of action
+func auditRecord(t *testing.T, logs *observer.ObservedLogs, action string) map[string]interface{} {
+	t.Helper()
+	entries := logs.FilterField(zap.String("action", action)).All()
+	if len(entries) != 1 {
+		t.Fatalf("%d %s audit records, want 1", len(entries), action)
+	}
+	return entries[0].ContextMap()
+}
+
+func TestAuditCreate(t *testing.T) {
+	s, _ := newTestService(t)
+	logs := observeAudit(s)
+	handler := s.RequireRole("admin")(http.HandlerFunc(s.CreateUser))
+
+	rec := serve(t, handler, http.MethodPost, "/users", `{"email":"user@example.com","password":"hunter2","role":"user"}`, signTestToken(t, s, "admin-1", "admin"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var user User
+	decode(t, rec, &user)
+
+	record := auditRecord(t, logs, auditCreate)
+	if record["actor"] != "admin-1" || record["target_user_id"] != user.ID {
+		t.Errorf("record = %v, want actor admin-1 and target %s", record, user.ID)
+	}
+	changes, _ := record["changes"].(map[string]interface{})
+	if changes["email"] != "user@example.com" || changes["role"] != "user" || changes["password"] != redacted {
+		t.Errorf("changes = %v, want the email and role with the password redacted", changes)
+	}
+
+	// Neither the password nor its hash is logged
+	stored, _ := s.redis.HGet(context.Background(), "user:user@example.com", "password").Result()
+	if logged := fmt.Sprint(record); strings.Contains(logged, "hunter2") || stored == "" || strings.Contains(logged, stored) {
+		t.Errorf("record %s includes the password", logged)
+	}
+}
+
+func TestAuditPasswordChangeRedacted(t *testing.T) {
+	s, _ := newTestService(t)
+	logs := observeAudit(s)
+
+	// That the password changed is recorded, never its value
+	r := httptest.NewRequest(http.MethodPatch, "/users/42", nil)
+	s.audit(r, auditUpdate, "admin-1", "42", map[string]interface{}{"password": "new-secret", "role": "admin"})
+	changes, _ := auditRecord(t, logs, auditUpdate)["changes"].(map[string]interface{})
+	if changes["password"] != redacted || changes["role"] != "admin" {
+		t.Errorf("changes = %v, want the role with the password redacted", changes)
+	}
+}
+
+func TestAuditUpdateDeleteLogin(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	logs := observeAudit(s)
+	routes := userRoutes(s)
+
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"role":"admin","version":1}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	record := auditRecord(t, logs, auditUpdate)
+	if changes, _ := record["changes"].(map[string]interface{}); record["target_user_id"] != user.ID || len(changes) != 1 || changes["role"] != "admin" {
+		t.Errorf("update record = %v, want the role change of %s", record, user.ID)
+	}
+
+	login(t, s, "user@example.com", "secret")
+	attemptLogin(t, s, "user@example.com", "wrong")
+	outcomes := map[string]bool{}
+	for _, entry := range logs.FilterField(zap.String("action", auditLogin)).All() {
+		fields := entry.ContextMap()
+		outcomes[fmt.Sprint(fields["outcome"])] = true
+		if fields["target_user_id"] != user.ID || fields["email"] != "user@example.com" {
+			t.Errorf("login record = %v, want %s", fields, user.ID)
+		}
+	}
+	if !outcomes[loginSucceeded] || !outcomes[loginFailed] || len(outcomes) != 2 {
+		t.Errorf("login outcomes = %v, want a success and a failure", outcomes)
+	}
+
+	if rec := serve(t, routes, http.MethodDelete, "/users/"+user.ID, "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d, want 204", rec.Code)
+	}
+	if record := auditRecord(t, logs, auditDelete); record["target_user_id"] != user.ID {
+		t.Errorf("delete record = %v, want %s", record, user.ID)
+	}
+}
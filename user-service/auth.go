@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RequireRole returns middleware that admits only requests whose bearer
+// token is valid and carries one of the given roles in its role claim. It
+// responds 401 to a missing or invalid token and 403 to any other role.
+// The caller's user ID is passed on to the handler as the audit actor.
+func (s *UserService) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || tokenString == "" {
+				http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			token, err := s.ValidateToken(r.Context(), tokenString)
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			claims, _ := token.Claims.(jwt.MapClaims)
+			role, _ := claims["role"].(string)
+			if !slices.Contains(roles, role) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			userID, _ := claims["user_id"].(string)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey, userID)))
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signTestToken signs an access token for a user with the given role, as
+// Login would
+func signTestToken(t *testing.T, s *UserService, userID, role string) string {
+	t.Helper()
+	token, err := s.signToken(jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"jti":     randomID(),
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequireRole(t *testing.T) {
+	s, _ := newTestService(t)
+	var actor string
+	handler := s.RequireRole("admin", "operator")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = actorID(r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	expired, err := s.signToken(jwt.MapClaims{"user_id": "1", "role": "admin", "exp": time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "missing token", token: "", want: http.StatusUnauthorized},
+		{name: "malformed token", token: "not-a-jwt", want: http.StatusUnauthorized},
+		{name: "expired token", token: expired, want: http.StatusUnauthorized},
+		{name: "wrong role", token: signTestToken(t, s, "1", "user"), want: http.StatusForbidden},
+		{name: "no role", token: signTestToken(t, s, "1", ""), want: http.StatusForbidden},
+		{name: "admin", token: signTestToken(t, s, "1", "admin"), want: http.StatusNoContent},
+		{name: "operator", token: signTestToken(t, s, "2", "operator"), want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(t, handler, http.MethodGet, "/users", "", tt.token); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+	// The caller is passed on to the handler
+	if actor != "2" {
+		t.Errorf("handler saw actor %q, want 2", actor)
+	}
+}
+
+func TestRequireRoleRevokedToken(t *testing.T) {
+	s, _ := newTestService(t)
+	createTestUser(t, s, "admin@example.com", "secret", "admin")
+	tokens := login(t, s, "admin@example.com", "secret")
+	handler := s.RequireRole("admin")(http.HandlerFunc(s.ListUsers))
+
+	if rec := serve(t, handler, http.MethodGet, "/users", "", tokens["token"]); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	logout(t, s, tokens["token"], "")
+	if rec := serve(t, handler, http.MethodGet, "/users", "", tokens["token"]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status after logout = %d, want 401", rec.Code)
+	}
+}
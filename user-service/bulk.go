@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// maxBulkCreate bounds the users BulkCreateUsers accepts in one request, as
+// each password is hashed in turn
+const maxBulkCreate = 500
+
+// bulkCreateResult is the outcome of one user of a BulkCreateUsers request
+type bulkCreateResult struct {
+	User  *User  `json:"user,omitempty"`  // The user as created
+	Error string `json:"error,omitempty"` // Why the user was not created
+}
+
+// BulkCreateUsers creates the users in the body, each as CreateUser would,
+// and reports the outcome of each in the order given, so callers know which
+// ones failed and why. A user failing does not stop the others, so the
+// response is 200 as long as the request itself is valid.
+func (s *UserService) BulkCreateUsers(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Users []createRequest `json:"users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Users) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Users) > maxBulkCreate {
+		http.Error(w, "Too many users", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	users, errs := s.createUsers(r.Context(), body.Users)
+	response := struct {
+		Created int                `json:"created"`
+		Failed  int                `json:"failed"`
+		Results []bulkCreateResult `json:"results"`
+	}{Results: make([]bulkCreateResult, len(users))}
+	for i, err := range errs {
+		switch {
+		case errors.Is(err, errEmailRequired), errors.Is(err, errPasswordRequired), errors.Is(err, errEmailTaken):
+			response.Results[i].Error = err.Error()
+		case err != nil:
+			requestLogger(s.logger, r).Error("failed to create user", zap.Int("index", i), zap.Error(err))
+			response.Results[i].Error = "failed to create user"
+		default:
+			s.auditCreated(r, users[i])
+			response.Results[i].User = &users[i]
+			response.Created++
+			continue
+		}
+		response.Failed++
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
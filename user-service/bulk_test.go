@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// bulkResponse is the body of a BulkCreateUsers response
+type bulkResponse struct {
+	Created int                `json:"created"`
+	Failed  int                `json:"failed"`
+	Results []bulkCreateResult `json:"results"`
+}
+
+func TestBulkCreateUsers(t *testing.T) {
+	s, _ := newTestService(t)
+	taken := createTestUser(t, s, "taken@example.com", "secret", "admin")
+
+	body := `{"users":[
+		{"email":"a@example.com","password":"secret-a","role":"user"},
+		{"email":"taken@example.com","password":"other","role":"user"},
+		{"email":"b@example.com","password":"secret-b","role":"user"},
+		{"email":"a@example.com","password":"again","role":"user"},
+		{"email":"c@example.com","role":"user"}
+	]}`
+	rec := serve(t, http.HandlerFunc(s.BulkCreateUsers), http.MethodPost, "/users/bulk", body, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var response bulkResponse
+	decode(t, rec, &response)
+	if response.Created != 2 || response.Failed != 3 || len(response.Results) != 5 {
+		t.Fatalf("response = %+v, want 2 created and 3 failed of 5", response)
+	}
+
+	// Each failure is reported at its index, the rest are created
+	wantErrors := []error{nil, errEmailTaken, nil, errEmailTaken, errPasswordRequired}
+	for i, result := range response.Results {
+		if want := wantErrors[i]; want != nil {
+			if result.Error != want.Error() || result.User != nil {
+				t.Errorf("result %d = %+v, want error %q", i, result, want)
+			}
+			continue
+		}
+		if result.Error != "" || result.User == nil || result.User.ID == "" {
+			t.Errorf("result %d = %+v, want a created user", i, result)
+			continue
+		}
+		got, err := s.getUserByEmail(context.Background(), result.User.Email)
+		if err != nil || got.ID != result.User.ID {
+			t.Errorf("%s resolves to %+v (%v), want %s", result.User.Email, got, err, result.User.ID)
+		}
+	}
+	login(t, s, "a@example.com", "secret-a")
+	login(t, s, "b@example.com", "secret-b")
+
+	// The colliding email still belongs to its user
+	if got, err := s.getUserByEmail(context.Background(), "taken@example.com"); err != nil || got.ID != taken.ID || got.Role != "admin" {
+		t.Errorf("taken@example.com resolves to %+v (%v), want %s unchanged", got, err, taken.ID)
+	}
+	if _, err := s.getUserByEmail(context.Background(), "c@example.com"); err == nil {
+		t.Error("user without a password created")
+	}
+}
+
+func TestBulkCreateUsersInvalid(t *testing.T) {
+	s, _ := newTestService(t)
+	tooMany := strings.Repeat(`{"email":"x@example.com","password":"x"},`, maxBulkCreate+1)
+	for body, want := range map[string]int{
+		`not json`:     http.StatusBadRequest,
+		`{"users":[]}`: http.StatusBadRequest,
+		fmt.Sprintf(`{"users":[%s]}`, strings.TrimSuffix(tooMany, ",")): http.StatusRequestEntityTooLarge,
+	} {
+		if rec := serve(t, http.HandlerFunc(s.BulkCreateUsers), http.MethodPost, "/users/bulk", body, ""); rec.Code != want {
+			t.Errorf("status = %d for %.40s, want %d", rec.Code, body, want)
+		}
+	}
+}
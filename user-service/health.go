@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readinessTimeout bounds the Redis ping behind /readyz, so a probe fails
+// well before Kubernetes gives up on it
+const readinessTimeout = time.Second
+
+// Healthz reports that the process is up. It does not check Redis, so a
+// Redis outage does not get the pod restarted.
+func (s *UserService) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the service can serve requests, responding 503
+// while Redis cannot be reached so the pod is taken out of rotation
+func (s *UserService) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := s.redis.Ping(ctx).Err(); err != nil {
+		requestLogger(s.logger, r).Warn("readiness check failed", zap.Error(err))
+		http.Error(w, "redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
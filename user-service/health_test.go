@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	s, mr := newTestService(t)
+	if rec := serve(t, http.HandlerFunc(s.Readyz), http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("ready with Redis up status = %d, want 200", rec.Code)
+	}
+
+	// Not ready while Redis is down, and ready again once it is back
+	mr.Close()
+	if rec := serve(t, http.HandlerFunc(s.Readyz), http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready with Redis down status = %d, want 503", rec.Code)
+	}
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(t, http.HandlerFunc(s.Readyz), http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("ready after Redis restarted status = %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyzUnresponsiveRedis(t *testing.T) {
+	s := newBlackHoleService(t, time.Minute)
+
+	// The probe gives up after readinessTimeout, well before Kubernetes would
+	start := time.Now()
+	if rec := serve(t, http.HandlerFunc(s.Readyz), http.MethodGet, "/readyz", "", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > readinessTimeout+500*time.Millisecond {
+		t.Errorf("probe took %v, want about %v", elapsed, readinessTimeout)
+	}
+}
+
+func TestHealthzIgnoresRedis(t *testing.T) {
+	s, mr := newTestService(t)
+	mr.Close()
+
+	// Liveness does not depend on Redis, so an outage does not restart pods
+	if rec := serve(t, http.HandlerFunc(s.Healthz), http.MethodGet, "/healthz", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// errAccountLocked is returned while an account is locked out after too many
+// failed logins
+var errAccountLocked = errors.New("account temporarily locked")
+
+// loginThrottle configures the lockout of accounts after repeated failed
+// logins
+type loginThrottle struct {
+	maxFailures int64         // Failures that lock the account
+	decay       time.Duration // Time for one recorded failure to be forgotten
+	lockout     time.Duration // How long a locked account stays locked
+}
+
+// loginThrottleFromEnv reads LOGIN_MAX_FAILURES, LOGIN_FAILURE_DECAY and
+// LOGIN_LOCKOUT, defaulting to locking an account for 15 minutes once it
+// has 5 failures, each forgotten over 15 minutes
+func loginThrottleFromEnv() (loginThrottle, error) {
+	t := loginThrottle{
+		maxFailures: 5,
+		decay:       15 * time.Minute,
+		lockout:     15 * time.Minute,
+	}
+
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return t, fmt.Errorf("invalid LOGIN_MAX_FAILURES %q", v)
+		}
+		t.maxFailures = n
+	}
+	for name, d := range map[string]*time.Duration{
+		"LOGIN_FAILURE_DECAY": &t.decay,
+		"LOGIN_LOCKOUT":       &t.lockout,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return t, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*d = parsed
+	}
+	return t, nil
+}
+
+// loginFailureScript records a failed login in the hash at KEYS[1], which
+// holds the failures not yet forgotten and when they were last updated.
+// Failures decay continuously, one per ARGV[1] milliseconds; ARGV[2] is the
+// current time in milliseconds. Unlike a counter that resets when its window
+// expires, failures paced faster than the decay keep accumulating, so slow
+// brute-forcing trips the lock too. It returns the failures recorded,
+// rounded down, and lets the hash expire once they have all decayed. The
+// rounding forgives up to a hundredth of a failure, so a burst of failures
+// a few seconds apart still counts as one each.
+const loginFailureScript = `
+local decay = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local state = redis.call("HMGET", KEYS[1], "failures", "ts")
+local failures = tonumber(state[1]) or 0
+local ts = tonumber(state[2]) or now
+failures = math.max(0, failures - math.max(0, now - ts) / decay) + 1
+redis.call("HSET", KEYS[1], "failures", failures, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(failures * decay))
+return math.floor(failures + 0.01)
+`
+
+// loginFailKey holds the decaying count of failed logins for an email
+func loginFailKey(email string) string {
+	return "login_fail:" + email
+}
+
+// loginLockKey marks an email as locked out until it expires
+func loginLockKey(email string) string {
+	return "login_lock:" + email
+}
+
+// checkLockout returns errAccountLocked, with the time left until the lock
+// expires, if the email is locked out
+func (s *UserService) checkLockout(ctx context.Context, email string) (time.Duration, error) {
+	ttl, err := s.redis.PTTL(ctx, loginLockKey(email)).Result()
+	if err != nil {
+		return 0, s.dbError("failed to check lockout", err)
+	}
+	if ttl > 0 {
+		return ttl, errAccountLocked
+	}
+	return 0, nil
+}
+
+// recordLoginFailure counts a failed login at now for the email and locks it
+// out once the failures not yet decayed reach the threshold
+func (s *UserService) recordLoginFailure(ctx context.Context, email string, now time.Time) error {
+	key := loginFailKey(email)
+	failures, err := s.redis.Eval(ctx, loginFailureScript, []string{key}, s.throttle.decay.Milliseconds(), now.UnixMilli()).Int64()
+	if err != nil {
+		return s.dbError("failed to count login failure", err)
+	}
+	if failures < s.throttle.maxFailures {
+		return nil
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, loginLockKey(email), 1, s.throttle.lockout)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return s.dbError("failed to lock account", err)
+	}
+	return nil
+}
+
+// resetLoginFailures clears the failed login count after a successful login
+func (s *UserService) resetLoginFailures(ctx context.Context, email string) error {
+	if err := s.redis.Del(ctx, loginFailKey(email)).Err(); err != nil {
+		return s.dbError("failed to reset login failures", err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failUntilLocked records failed logins for email every interval from start,
+// up to max attempts, and returns the attempts made when the account locked,
+// or 0 if it never did
+func failUntilLocked(t *testing.T, s *UserService, email string, start time.Time, interval time.Duration, max int) int {
+	t.Helper()
+	ctx := context.Background()
+	for attempt := 1; attempt <= max; attempt++ {
+		at := start.Add(time.Duration(attempt-1) * interval)
+		if err := s.recordLoginFailure(ctx, email, at); err != nil {
+			t.Fatalf("recordLoginFailure: %v", err)
+		}
+		if _, err := s.checkLockout(ctx, email); errors.Is(err, errAccountLocked) {
+			return attempt
+		} else if err != nil {
+			t.Fatalf("checkLockout: %v", err)
+		}
+	}
+	return 0
+}
+
+func TestLoginFailureDecay(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		interval time.Duration
+		attempts int // Attempts that lock the account, 0 for never
+	}{
+		// A burst locks the account at the threshold
+		{name: "bursty", interval: 0, attempts: 5},
+		// Paced at two attempts every 15 minutes, an attack would never
+		// lock a counter reset every 15 minutes; with each failure decaying
+		// over 15 minutes, half of each one remains
+		{name: "paced", interval: 7*time.Minute + 30*time.Second, attempts: 9},
+		// Failures slower than the decay are all forgotten
+		{name: "slower than decay", interval: 16 * time.Minute, attempts: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestService(t)
+			if got := failUntilLocked(t, s, "attacker@example.com", start, tt.interval, 50); got != tt.attempts {
+				t.Errorf("locked after %d attempts, want %d", got, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestLoginFailureDecayRate(t *testing.T) {
+	s, _ := newTestService(t)
+	s.throttle.decay = time.Hour
+
+	// With failures forgotten over an hour, one attempt every 15 minutes
+	// keeps three quarters of each: 1, 1.75, 2.5, 3.25, 4, 4.75, 5.5
+	if got := failUntilLocked(t, s, "attacker@example.com", time.Now(), 15*time.Minute, 50); got != 7 {
+		t.Errorf("locked after %d attempts, want 7", got)
+	}
+}
+
+func TestLoginFailureKeyExpires(t *testing.T) {
+	s, mr := newTestService(t)
+	ctx := context.Background()
+	email := "user@example.com"
+
+	for i := 0; i < 2; i++ {
+		if err := s.recordLoginFailure(ctx, email, time.Now()); err != nil {
+			t.Fatalf("recordLoginFailure: %v", err)
+		}
+	}
+	// The record expires once both failures have decayed
+	if ttl := mr.TTL(loginFailKey(email)); ttl <= 15*time.Minute || ttl > 30*time.Minute {
+		t.Errorf("failure record TTL = %v, want (15m, 30m]", ttl)
+	}
+	mr.FastForward(30 * time.Minute)
+	if mr.Exists(loginFailKey(email)) {
+		t.Error("failure record still exists after decaying")
+	}
+}
+
+// attemptLogin logs in to the handler and returns the response
+func attemptLogin(t *testing.T, s *UserService, email, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, http.HandlerFunc(s.Login), http.MethodPost, "/login", fmt.Sprintf(`{"email":%q,"password":%q}`, email, password), "")
+}
+
+// failLogins makes n logins with a wrong password, each refused as invalid
+func failLogins(t *testing.T, s *UserService, email string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if rec := attemptLogin(t, s, email, "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d status = %d, want 401", i+1, rec.Code)
+		}
+	}
+}
+
+func TestLockoutAfterFailures(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+
+	// The failure that reaches the threshold locks the account, refusing
+	// even the right password until the lock expires
+	failLogins(t, s, "user@example.com", 5)
+	rec := attemptLogin(t, s, "user@example.com", "secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login while locked status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "900" {
+		t.Errorf("Retry-After = %q, want 900", got)
+	}
+
+	mr.FastForward(s.throttle.lockout)
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("login after the lockout status = %d, want 200", rec.Code)
+	}
+}
+
+func TestLockoutUnknownEmail(t *testing.T) {
+	s, _ := newTestService(t)
+
+	// Probing emails that are not registered locks them too, so lockouts do
+	// not reveal which accounts exist
+	failLogins(t, s, "nobody@example.com", 5)
+	if rec := attemptLogin(t, s, "nobody@example.com", "wrong"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login while locked status = %d, want 429", rec.Code)
+	}
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+
+	failLogins(t, s, "user@example.com", 4)
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want 200", rec.Code)
+	}
+	if mr.Exists(loginFailKey("user@example.com")) {
+		t.Error("failures still recorded after a successful login")
+	}
+	// A full budget of failures is needed to lock the account again
+	failLogins(t, s, "user@example.com", 4)
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("login status = %d, want 200", rec.Code)
+	}
+}
+
+func TestLoginFailuresExpire(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+
+	// Once the failures have decayed their record expires, and the budget
+	// starts over
+	failLogins(t, s, "user@example.com", 4)
+	mr.FastForward(4 * s.throttle.decay)
+	if mr.Exists(loginFailKey("user@example.com")) {
+		t.Fatal("failure record still exists after decaying")
+	}
+	failLogins(t, s, "user@example.com", 4)
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("login status = %d, want 200", rec.Code)
+	}
+}
+
+func TestLoginThrottleFromEnv(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	t.Setenv("LOGIN_FAILURE_DECAY", "1h")
+	t.Setenv("LOGIN_LOCKOUT", "30m")
+	throttle, err := loginThrottleFromEnv()
+	if err != nil {
+		t.Fatalf("loginThrottleFromEnv: %v", err)
+	}
+	if want := (loginThrottle{maxFailures: 3, decay: time.Hour, lockout: 30 * time.Minute}); throttle != want {
+		t.Errorf("throttle = %+v, want %+v", throttle, want)
+	}
+
+	for name, value := range map[string]string{"LOGIN_MAX_FAILURES": "0", "LOGIN_FAILURE_DECAY": "soon", "LOGIN_LOCKOUT": "-1m"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loginThrottleFromEnv(); err == nil {
+				t.Errorf("loginThrottleFromEnv accepted %s=%s", name, value)
+			}
+		})
+	}
+}
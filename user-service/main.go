@@ -4,10 +4,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,6 +25,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
 )
 
 var (
@@ -37,63 +48,207 @@ var (
 	)
 )
 
+// ErrDatabaseError is wrapped, alongside the Redis error itself, by every
+// error returned when reading or writing users in Redis fails, so callers can
+// tell a storage failure from a missing or conflicting user with errors.Is
+// while the cause stays retrievable
+var ErrDatabaseError = errors.New("database error")
+
+// errUserNotFound is returned when no user matches a lookup
+var errUserNotFound = errors.New("user not found")
+
+// errConcurrentModification is returned when a user changed since the
+// version an update was based on
+var errConcurrentModification = errors.New("user was modified concurrently")
+
+// errEmailTaken is returned when a user would be created with, or changed
+// to, an email already registered
+var errEmailTaken = errors.New("email already registered")
+
+// errEmailRequired and errPasswordRequired are returned for a user to create
+// without an email or a password
+var (
+	errEmailRequired    = errors.New("email is required")
+	errPasswordRequired = errors.New("password is required")
+)
+
+// contextKey is the type of the request-scoped values stored in a context
+type contextKey string
+
+// requestIDKey holds the request ID assigned by loggingMiddleware
+const requestIDKey contextKey = "request_id"
+
+// requestIDHeader carries the request ID, set by the mesh or generated here
+const requestIDHeader = "X-Request-Id"
+
+const (
+	// defaultAccessTokenTTL is the lifetime of an access token when
+	// JWT_ACCESS_TOKEN_TTL is unset
+	defaultAccessTokenTTL = 15 * time.Minute
+
+	// refreshTokenTTL is the lifetime of a refresh token, which is single use
+	refreshTokenTTL = 7 * 24 * time.Hour
+
+	// defaultPageSize and maxPageSize bound the users returned by ListUsers
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
 // User represents a user account
 type User struct {
 	ID       string `json:"id"`
 	Email    string `json:"email"`
 	Password string `json:"-"` // Password is never sent in JSON responses
 	Role     string `json:"role"`
+	Status   string `json:"status"`  // One of statusActive, statusSuspended or statusDeleted
+	Version  int64  `json:"version"` // Incremented by every change, for optimistic concurrency
+}
+
+// User statuses. Deleted users are kept for audit but can no longer log in,
+// and their email can be registered again; suspended users keep their email
+// but cannot log in.
+const (
+	statusActive    = "active"
+	statusSuspended = "suspended"
+	statusDeleted   = "deleted"
+)
+
+// userFromRecord builds a user from its Redis hash. Records written before
+// users had a status are active, and those written before they had a
+// version are at version 0.
+func userFromRecord(data map[string]string) User {
+	user := User{ID: data["id"], Email: data["email"], Role: data["role"], Status: data["status"]}
+	if user.Status == "" {
+		user.Status = statusActive
+	}
+	user.Version, _ = strconv.ParseInt(data["version"], 10, 64)
+	return user
 }
 
 // UserService manages user accounts and authentication
 type UserService struct {
-	redis  *redis.Client
-	jwtKey []byte
+	redis      *redis.Client
+	jwtKey     []byte          // HS256 secret, used when no RSA key is configured
+	signingKey *rsa.PrivateKey // RS256 signing key from JWT_PRIVATE_KEY_FILE
+	keyID      string          // Key ID of signingKey, published in the JWKS
+	throttle   loginThrottle   // Lockout after repeated failed logins
+	tokens     tokenSettings   // Lifetime, issuer and audience of access tokens
+	logger     *zap.Logger
+	auditLog   *zap.Logger // Audit trail of account changes and logins, named "audit"
 }
 
 // NewUserService creates a new user service instance
-func NewUserService() (*UserService, error) {
+func NewUserService(logger *zap.Logger) (*UserService, error) {
 	// Initialize Redis client
 	redisClient := redis.NewClient(&redis.Options{
 		Addr:     "redis:6379",
 		Password: "", // Set if required
 		DB:       0,  // Use default DB
+
+		// Honor the per-operation deadlines set by redisTimeoutHook
+		ContextTimeoutEnabled: true,
 	})
 
 	// Test Redis connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := redisClient.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	// Bound every Redis operation, so requests fail fast when Redis is slow
+	redisTimeout, err := redisTimeoutFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	redisClient.AddHook(redisTimeoutHook{timeout: redisTimeout})
+
+	// Hash new passwords at the configured bcrypt cost
+	if err := setPasswordCostFromEnv(); err != nil {
+		return nil, err
+	}
+
+	// Lock accounts out after repeated failed logins
+	throttle, err := loginThrottleFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
 	// Generate JWT key
 	jwtKey := []byte("your-secret-key") // In production, use a secure key
 
+	// Set the lifetime, issuer and audience of access tokens
+	tokens, err := tokenSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sign with RS256 instead when an RSA key is configured
+	signingKey, keyID, err := loadSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	if signingKey == nil {
+		logger.Warn("JWT_PRIVATE_KEY_FILE not set, signing tokens with the built-in HS256 secret")
+	}
+
 	return &UserService{
-		redis:  redisClient,
-		jwtKey: jwtKey,
+		redis:      redisClient,
+		jwtKey:     jwtKey,
+		signingKey: signingKey,
+		keyID:      keyID,
+		throttle:   throttle,
+		tokens:     tokens,
+		logger:     logger,
+		auditLog:   logger.Named("audit"),
 	}, nil
 }
 
-// loggingMiddleware logs all incoming requests
-func loggingMiddleware(next http.Handler) http.Handler {
+// requestLogger returns the logger annotated with the request's ID
+func requestLogger(logger *zap.Logger, r *http.Request) *zap.Logger {
+	if requestID, ok := r.Context().Value(requestIDKey).(string); ok {
+		return logger.With(zap.String("request_id", requestID))
+	}
+	return logger
+}
+
+// randomID generates a random hex ID, used for requests and refresh tokens
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggingMiddleware assigns each request an ID, reusing the X-Request-Id
+// header when the mesh already set one, returns it in the response and logs
+// the completed request
+func loggingMiddleware(logger *zap.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
+		// Propagate the request ID to handlers and back to the client
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = randomID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, requestID))
+
 		// Create a custom response writer to capture the status code
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
-		// Log the incoming request
-		log.Printf("Incoming request: %s %s", r.Method, r.URL.Path)
-
 		// Call the next handler
 		next.ServeHTTP(rw, r)
 
 		// Log the response
 		duration := time.Since(start).Seconds()
-		log.Printf("Request completed: %s %s - Status: %d - Duration: %.3fs",
-			r.Method, r.URL.Path, rw.statusCode, duration)
+		logger.Info("request completed",
+			zap.String("request_id", requestID),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", rw.statusCode),
+			zap.Float64("duration_seconds", duration),
+		)
 
 		// Record metrics
 		requestDuration.WithLabelValues(r.URL.Path, r.Method, fmt.Sprintf("%d", rw.statusCode)).Observe(duration)
@@ -112,34 +267,484 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// CreateUser creates the user in the body, responding 409 if the email is
+// already registered
 func (s *UserService) CreateUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var body createRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Store user in Redis
-	userKey := fmt.Sprintf("user:%s", user.Email)
-	if err := s.redis.HSet(r.Context(), userKey, map[string]interface{}{
-		"id":       user.ID,
-		"email":    user.Email,
-		"password": user.Password,
-		"role":     user.Role,
-	}).Err(); err != nil {
+	users, errs := s.createUsers(r.Context(), []createRequest{body})
+	switch err := errs[0]; {
+	case errors.Is(err, errEmailRequired):
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	case errors.Is(err, errPasswordRequired):
+		http.Error(w, "Password is required", http.StatusBadRequest)
+		return
+	case errors.Is(err, errEmailTaken):
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	case err != nil:
+		requestLogger(s.logger, r).Error("failed to create user", zap.Error(err))
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
+	s.auditCreated(r, users[0])
 
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(users[0])
+}
+
+// createRequest is a user to create. The password is only accepted on
+// input, never encoded back.
+type createRequest struct {
+	User
+	Password string `json:"password"`
+}
+
+// createUsers creates users and returns each one as stored, with the hash of
+// its password, or why it was not created: errEmailRequired,
+// errPasswordRequired, errEmailTaken or a failure to hash the password or
+// reach Redis. IDs are assigned here; any id in a request is ignored.
+//
+// Every email is reserved atomically with HSETNX, in one pipeline, so
+// concurrent creates for the same email, within the batch or not, cannot
+// both succeed or overwrite an existing user. The reserved users are then
+// stored and indexed by ID in one transaction, releasing their emails if
+// that fails.
+func (s *UserService) createUsers(ctx context.Context, reqs []createRequest) ([]User, []error) {
+	users := make([]User, len(reqs))
+	errs := make([]error, len(reqs))
+	for i, req := range reqs {
+		switch {
+		case req.Email == "":
+			errs[i] = errEmailRequired
+		case req.Password == "":
+			errs[i] = errPasswordRequired
+		default:
+			hash, err := hashPassword(req.Password)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to hash password: %w", err)
+				continue
+			}
+			users[i] = req.User
+			users[i].ID = randomID()
+			users[i].Password = hash
+			users[i].Status = statusActive
+			users[i].Version = 1
+		}
+	}
+
+	// Reserve the emails
+	reserve := s.redis.Pipeline()
+	reservations := make([]*redis.BoolCmd, len(reqs))
+	for i, user := range users {
+		if errs[i] == nil {
+			reservations[i] = reserve.HSetNX(ctx, fmt.Sprintf("user:%s", user.Email), "email", user.Email)
+		}
+	}
+	if reserve.Len() > 0 {
+		reserve.Exec(ctx) // Errors are read per command below
+	}
+	var reserved []int
+	for i, cmd := range reservations {
+		if cmd == nil {
+			continue
+		}
+		ok, err := cmd.Result()
+		switch {
+		case err != nil:
+			errs[i] = s.dbError("failed to reserve email", err)
+		case !ok:
+			errs[i] = errEmailTaken
+		default:
+			reserved = append(reserved, i)
+		}
+	}
+	if len(reserved) == 0 {
+		return users, errs
+	}
+
+	// Store the rest of the users and index them by ID, releasing the
+	// emails if that fails
+	pipe := s.redis.TxPipeline()
+	for _, i := range reserved {
+		pipe.HSet(ctx, fmt.Sprintf("user:%s", users[i].Email), map[string]interface{}{
+			"id":       users[i].ID,
+			"password": users[i].Password,
+			"role":     users[i].Role,
+			"status":   users[i].Status,
+			"version":  users[i].Version,
+		})
+		pipe.Set(ctx, userIDKey(users[i].ID), users[i].Email, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		err = s.dbError("failed to store user", err)
+		keys := make([]string, 0, 2*len(reserved))
+		for _, i := range reserved {
+			keys = append(keys, fmt.Sprintf("user:%s", users[i].Email), userIDKey(users[i].ID))
+			errs[i] = err
+		}
+		if err := s.redis.Del(context.WithoutCancel(ctx), keys...).Err(); err != nil {
+			s.logger.Error("failed to release reserved emails", zap.Error(err))
+		}
+	}
+	return users, errs
+}
+
+// userIDKey maps a user ID to the email the user is stored under
+func userIDKey(id string) string {
+	return "user_id:" + id
+}
+
+// deletedUserKey holds a deleted user's record, moved out of user:<email> so
+// the email can be registered again
+func deletedUserKey(id string) string {
+	return "deleted_user:" + id
+}
+
+// dbError logs a failed Redis operation, described by op, with its cause and
+// returns the error wrapped in ErrDatabaseError
+func (s *UserService) dbError(op string, err error) error {
+	s.logger.Error("redis operation failed", zap.String("operation", op), zap.Error(err))
+	return fmt.Errorf("%s: %w: %w", op, ErrDatabaseError, err)
+}
+
+// getUserByEmail returns the user stored under email, or errUserNotFound
+func (s *UserService) getUserByEmail(ctx context.Context, email string) (User, error) {
+	data, err := s.redis.HGetAll(ctx, fmt.Sprintf("user:%s", email)).Result()
+	if err != nil {
+		return User{}, s.dbError("failed to read user", err)
+	}
+	if data["id"] == "" {
+		return User{}, errUserNotFound
+	}
+	return userFromRecord(data), nil
+}
+
+// getUserByID returns the user with the given ID, including a deleted user,
+// or errUserNotFound
+func (s *UserService) getUserByID(ctx context.Context, id string) (User, error) {
+	email, err := s.redis.Get(ctx, userIDKey(id)).Result()
+	if err == redis.Nil {
+		return s.getDeletedUser(ctx, id)
+	}
+	if err != nil {
+		return User{}, s.dbError("failed to read user index", err)
+	}
+	user, err := s.getUserByEmail(ctx, email)
+	if err != nil {
+		return User{}, err
+	}
+	// Guard against an index entry left behind by a since-replaced user
+	if user.ID != id {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+// getDeletedUser returns the deleted user with the given ID, or
+// errUserNotFound
+func (s *UserService) getDeletedUser(ctx context.Context, id string) (User, error) {
+	data, err := s.redis.HGetAll(ctx, deletedUserKey(id)).Result()
+	if err != nil {
+		return User{}, s.dbError("failed to read deleted user", err)
+	}
+	if data["id"] == "" {
+		return User{}, errUserNotFound
+	}
+	return userFromRecord(data), nil
+}
+
+// DeleteUser soft-deletes the user whose ID is in the path: the record is
+// marked deleted and kept, under deleted_user:<id>, where GetUser still
+// finds it, and the email is freed for a new registration
+func (s *UserService) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	user, err := s.getUserByID(r.Context(), id)
+	if err == nil && user.Status == statusDeleted {
+		err = errUserNotFound
+	}
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to get user", zap.Error(err))
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	userKey := fmt.Sprintf("user:%s", user.Email)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(r.Context(), userKey, "status", statusDeleted)
+	pipe.HIncrBy(r.Context(), userKey, "version", 1)
+	pipe.Rename(r.Context(), userKey, deletedUserKey(id))
+	pipe.Del(r.Context(), userIDKey(id))
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		requestLogger(s.logger, r).Error("failed to delete user", zap.Error(err))
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, auditDelete, actorID(r), id, map[string]interface{}{"status": statusDeleted})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateUser changes the email, role or status of the user whose ID is in
+// the path. The body must carry the version the change is based on; if the
+// user has changed since, the update is refused with 409 and must be retried
+// from a fresh read. Changing to an email another user has is refused with
+// 409 as well.
+func (s *UserService) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email   *string `json:"email"`
+		Role    *string `json:"role"`
+		Status  *string `json:"status"`
+		Version *int64  `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Version == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	fields := map[string]interface{}{}
+	if body.Email != nil {
+		if *body.Email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		fields["email"] = *body.Email
+	}
+	if body.Role != nil {
+		fields["role"] = *body.Role
+	}
+	if body.Status != nil {
+		// Deleting goes through DeleteUser, which also frees the email
+		if *body.Status != statusActive && *body.Status != statusSuspended {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		fields["status"] = *body.Status
+	}
+
+	user, err := s.updateUser(r.Context(), r.PathValue("id"), *body.Version, fields)
+	if errors.Is(err, errConcurrentModification) {
+		http.Error(w, "User was modified, retry with the current version", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errEmailTaken) {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		s.audit(r, auditUpdate, actorID(r), user.ID, fields)
+	}
+	s.writeUser(w, r, user, err)
+}
+
+// updateUser sets fields on the user with the given ID if its version is
+// still version, incrementing the version, and returns the updated user.
+// The version check and write are one WATCH/MULTI/EXEC transaction, so of
+// two updates from the same version only the first succeeds.
+//
+// A new email is reserved before the transaction, as CreateUser does, so of
+// two users moving to one email only the first succeeds and the other gets
+// errEmailTaken. The transaction then moves the user to the new email,
+// freeing the old one, or the reservation is released if it fails.
+func (s *UserService) updateUser(ctx context.Context, id string, version int64, fields map[string]interface{}) (User, error) {
+	user, err := s.getUserByID(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Status == statusDeleted {
+		return User{}, errUserNotFound
+	}
+
+	userKey := fmt.Sprintf("user:%s", user.Email)
+	var newEmail, newKey string
+	if email, ok := fields["email"].(string); ok && email != user.Email {
+		newEmail, newKey = email, fmt.Sprintf("user:%s", email)
+		reserved, err := s.redis.HSetNX(ctx, newKey, "email", newEmail).Result()
+		if err != nil {
+			return User{}, s.dbError("failed to reserve email", err)
+		}
+		if !reserved {
+			return User{}, errEmailTaken
+		}
+	}
+
+	err = s.redis.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.HGetAll(ctx, userKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read user: %w", err)
+		}
+		if data["id"] != id {
+			return errUserNotFound
+		}
+		user = userFromRecord(data)
+		if user.Version != version {
+			return errConcurrentModification
+		}
+
+		user.Version++
+		values := map[string]interface{}{"version": user.Version}
+		for field, value := range fields {
+			values[field] = value
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, userKey, values)
+			if newKey != "" {
+				pipe.Rename(ctx, userKey, newKey)
+				pipe.Set(ctx, userIDKey(id), newEmail, 0)
+			}
+			return nil
+		})
+		return err
+	}, userKey)
+	if err != nil && newKey != "" {
+		if err := s.redis.Del(context.WithoutCancel(ctx), newKey).Err(); err != nil {
+			s.logger.Error("failed to release reserved email", zap.Error(err))
+		}
+	}
+	switch {
+	case err == redis.TxFailedErr:
+		return User{}, errConcurrentModification
+	case errors.Is(err, errUserNotFound), errors.Is(err, errConcurrentModification):
+		return User{}, err
+	case err != nil:
+		return User{}, s.dbError("failed to update user", err)
+	}
+
+	if newEmail != "" {
+		user.Email = newEmail
+	}
+	if role, ok := fields["role"].(string); ok {
+		user.Role = role
+	}
+	if status, ok := fields["status"].(string); ok {
+		user.Status = status
+	}
+	return user, nil
+}
+
+// GetUser returns the user whose ID is in the path
+func (s *UserService) GetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.getUserByID(r.Context(), r.PathValue("id"))
+	s.writeUser(w, r, user, err)
+}
+
+// writeUser encodes a looked up user, or the error the lookup failed with
+func (s *UserService) writeUser(w http.ResponseWriter, r *http.Request, user User, err error) {
+	if errors.Is(err, errUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to get user", zap.Error(err))
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
 
+// ListUsers returns the user with the given email when the email query
+// parameter is set, and a page of users otherwise. The optional cursor query
+// parameter continues from a previous page's next_cursor, and limit (default
+// defaultPageSize, at most maxPageSize) is the number of users to aim for;
+// like the underlying SCAN, a page may hold slightly more or fewer. An empty
+// next_cursor means there are no more users.
+func (s *UserService) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("email") {
+		email := r.URL.Query().Get("email")
+		if !strings.Contains(email, "@") {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+		user, err := s.getUserByEmail(r.Context(), email)
+		s.writeUser(w, r, user, err)
+		return
+	}
+
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	var cursor uint64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cursor = n
+	}
+
+	users, next, err := s.listUsers(r.Context(), cursor, limit)
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to list users", zap.Error(err))
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	page := struct {
+		Users      []User `json:"users"`
+		NextCursor string `json:"next_cursor"`
+	}{Users: users}
+	if next != 0 {
+		page.NextCursor = strconv.FormatUint(next, 10)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// listUsers scans user:* keys from cursor until at least limit users are
+// found or the scan completes, returning the users and the cursor to
+// continue from, 0 once the scan is complete
+func (s *UserService) listUsers(ctx context.Context, cursor uint64, limit int) ([]User, uint64, error) {
+	users := []User{}
+	for {
+		keys, next, err := s.redis.Scan(ctx, cursor, "user:*", int64(limit)).Result()
+		if err != nil {
+			return nil, 0, s.dbError("failed to scan users", err)
+		}
+		cursor = next
+
+		// Fetch the batch in one round trip; only hashes are user records
+		pipe := s.redis.Pipeline()
+		records := make([]*redis.MapStringStringCmd, len(keys))
+		for i, key := range keys {
+			records[i] = pipe.HGetAll(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !redis.HasErrorPrefix(err, "WRONGTYPE") {
+			return nil, 0, s.dbError("failed to read users", err)
+		}
+		for _, record := range records {
+			data := record.Val()
+			if record.Err() != nil || data["id"] == "" {
+				continue
+			}
+			users = append(users, userFromRecord(data))
+		}
+
+		if cursor == 0 || len(users) >= limit {
+			return users, cursor, nil
+		}
+	}
+}
+
 func (s *UserService) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -156,45 +761,248 @@ func (s *UserService) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse locked accounts without checking the password
+	retryAfter, err := s.checkLockout(r.Context(), creds.Email)
+	if errors.Is(err, errAccountLocked) {
+		s.audit(r, auditLogin, "", "", nil, zap.String("outcome", loginLocked), zap.String("email", creds.Email))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, "Account temporarily locked", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to check account lockout", zap.Error(err))
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
 	// Get user from Redis
 	userKey := fmt.Sprintf("user:%s", creds.Email)
 	userData, err := s.redis.HGetAll(r.Context(), userKey).Result()
-	if err != nil || len(userData) == 0 {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to read user", zap.Error(err))
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
 		return
 	}
 
-	// Check password
-	if userData["password"] != creds.Password {
+	// Check password, counting failures towards a lockout whether or not
+	// the user exists
+	ok, rehash := checkPassword(userData["password"], creds.Password)
+	if len(userData) == 0 || !ok {
+		if err := s.recordLoginFailure(r.Context(), creds.Email, time.Now()); err != nil {
+			requestLogger(s.logger, r).Error("failed to record login failure", zap.Error(err))
+		}
+		s.audit(r, auditLogin, "", userData["id"], nil, zap.String("outcome", loginFailed), zap.String("email", creds.Email))
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	if err := s.resetLoginFailures(r.Context(), creds.Email); err != nil {
+		requestLogger(s.logger, r).Error("failed to reset login failures", zap.Error(err))
+	}
+	if userFromRecord(userData).Status != statusActive {
+		s.audit(r, auditLogin, userData["id"], userData["id"], nil, zap.String("outcome", loginSuspended), zap.String("email", creds.Email))
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": userData["id"],
-		"role":    userData["role"],
-		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	})
+	// Upgrade weaker hashes now that the plaintext is known; failing to do
+	// so does not fail the login
+	if rehash {
+		if hash, err := hashPassword(creds.Password); err != nil {
+			requestLogger(s.logger, r).Error("failed to rehash password", zap.Error(err))
+		} else if err := s.redis.HSet(r.Context(), userKey, "password", hash).Err(); err != nil {
+			requestLogger(s.logger, r).Error("failed to store rehashed password", zap.Error(err))
+		}
+	}
 
-	tokenString, err := token.SignedString(s.jwtKey)
+	// Generate access and refresh tokens
+	tokens, err := s.issueTokens(r.Context(), userData["id"], userData["role"])
 	if err != nil {
+		requestLogger(s.logger, r).Error("failed to issue tokens", zap.Error(err))
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, auditLogin, userData["id"], userData["id"], nil, zap.String("outcome", loginSucceeded), zap.String("email", creds.Email))
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// Refresh exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token can be used once: it is deleted as it
+// is redeemed, so a replayed token is rejected.
+func (s *UserService) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Redeem the refresh token atomically, so concurrent reuse succeeds once
+	key := refreshKey(body.RefreshToken)
+	pipe := s.redis.TxPipeline()
+	get := pipe.HGetAll(r.Context(), key)
+	pipe.Del(r.Context(), key)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		requestLogger(s.logger, r).Error("failed to redeem refresh token", zap.Error(err))
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	// Expired, unknown and already used tokens are all absent
+	session := get.Val()
+	if session["user_id"] == "" {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Sessions end once their user is deleted or suspended, and the new
+	// token carries the user's current role, so a demotion takes effect at
+	// the next refresh
+	user, err := s.getUserByID(r.Context(), session["user_id"])
+	if err != nil && !errors.Is(err, errUserNotFound) {
+		requestLogger(s.logger, r).Error("failed to get user", zap.Error(err))
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || user.Status != statusActive {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.issueTokens(r.Context(), user.ID, user.Role)
+	if err != nil {
+		requestLogger(s.logger, r).Error("failed to issue tokens", zap.Error(err))
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
 }
 
-func (s *UserService) ValidateToken(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// issueTokens signs an access token for the user and stores a new refresh
+// token under refresh:<jti>, where the random jti is the refresh token itself.
+// The refresh token only records the user ID: the role is read again from
+// the user when it is redeemed.
+func (s *UserService) issueTokens(ctx context.Context, userID, role string) (map[string]string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"role":    role,
+		"jti":     randomID(), // Identifies the token for revocation
+		"exp":     time.Now().Add(s.tokens.ttl).Unix(),
+	}
+	if s.tokens.issuer != "" {
+		claims["iss"] = s.tokens.issuer
+	}
+	if s.tokens.audience != "" {
+		claims["aud"] = s.tokens.audience
+	}
+	tokenString, err := s.signToken(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	jti := randomID()
+	key := refreshKey(jti)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, key, "user_id", userID)
+	pipe.Expire(ctx, key, refreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, s.dbError("failed to store refresh token", err)
+	}
+
+	return map[string]string{
+		"token":         tokenString,
+		"refresh_token": jti,
+	}, nil
+}
+
+// refreshKey is the Redis key of the refresh token with the given jti
+func refreshKey(jti string) string {
+	return "refresh:" + jti
+}
+
+// revokedKey is the Redis key marking the access token with the given jti
+// as revoked
+func revokedKey(jti string) string {
+	return "revoked:" + jti
+}
+
+// Logout revokes the bearer access token until it would have expired, and
+// the refresh token in the body, if any
+func (s *UserService) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	token, err := s.ValidateToken(r.Context(), tokenString)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
+		http.Error(w, "Token cannot be revoked", http.StatusBadRequest)
+		return
+	}
+
+	// The denylist entry only needs to outlive the token itself
+	if ttl := time.Until(exp.Time); ttl > 0 {
+		if err := s.redis.Set(r.Context(), revokedKey(jti), 1, ttl).Err(); err != nil {
+			requestLogger(s.logger, r).Error("failed to revoke token", zap.Error(err))
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
 		}
-		return s.jwtKey, nil
-	})
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if json.NewDecoder(r.Body).Decode(&body) == nil && body.RefreshToken != "" {
+		if err := s.redis.Del(r.Context(), refreshKey(body.RefreshToken)).Err(); err != nil {
+			requestLogger(s.logger, r).Error("failed to revoke refresh token", zap.Error(err))
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ValidateToken parses and verifies an access token, rejecting tokens that
+// have been revoked by Logout or lack the configured issuer or audience
+func (s *UserService) ValidateToken(ctx context.Context, tokenString string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenString, s.verificationKey, s.tokens.parserOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued before jti claims were added cannot be revoked
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if jti, _ := claims["jti"].(string); jti != "" {
+		revoked, err := s.redis.Exists(ctx, revokedKey(jti)).Result()
+		if err != nil {
+			return nil, s.dbError("failed to check token revocation", err)
+		}
+		if revoked > 0 {
+			return nil, fmt.Errorf("token has been revoked")
+		}
+	}
+	return token, nil
 }
 
 // DummyService provides endpoints with different response times
@@ -244,10 +1052,65 @@ func (s *DummyService) VerySlowEndpoint(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Very slow response"})
 }
 
+// defaultShutdownTimeout bounds how long shutdown waits for in-flight
+// requests when SHUTDOWN_TIMEOUT is unset
+const defaultShutdownTimeout = 15 * time.Second
+
+// shutdownTimeoutFromEnv reads SHUTDOWN_TIMEOUT, how long shutdown waits
+// for in-flight requests before closing their connections
+func shutdownTimeoutFromEnv() (time.Duration, error) {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return defaultShutdownTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", value)
+	}
+	return timeout, nil
+}
+
+// runServer serves HTTP on ln until ctx is done, then stops accepting
+// connections and waits up to shutdownTimeout for in-flight requests,
+// closing the remaining connections if that outlasts the timeout. It
+// returns an error only if the server fails before ctx is done.
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener, shutdownTimeout time.Duration, logger *zap.Logger) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("user service shutting down", zap.Duration("timeout", shutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to drain requests", zap.Error(err))
+		srv.Close()
+	}
+	return nil
+}
+
 func main() {
-	userService, err := NewUserService()
+	logger, err := zap.NewProduction()
+	if err != nil {
+		panic(fmt.Sprintf("failed to create logger: %v", err))
+	}
+	defer logger.Sync()
+
+	shutdownTimeout, err := shutdownTimeoutFromEnv()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+
+	userService, err := NewUserService(logger)
 	if err != nil {
-		log.Fatalf("Failed to create user service: %v", err)
+		logger.Fatal("failed to create user service", zap.Error(err))
 	}
 
 	service := NewDummyService()
@@ -256,8 +1119,20 @@ func main() {
 	mux := http.NewServeMux()
 
 	// Register routes
-	mux.HandleFunc("/users", userService.CreateUser)
+	// Only admins can manage users
+	requireAdmin := userService.RequireRole("admin")
+	mux.Handle("POST /users", requireAdmin(http.HandlerFunc(userService.CreateUser)))
+	mux.Handle("POST /users/bulk", requireAdmin(http.HandlerFunc(userService.BulkCreateUsers)))
+	mux.Handle("GET /users", requireAdmin(http.HandlerFunc(userService.ListUsers)))
+	mux.Handle("GET /users/{id}", requireAdmin(http.HandlerFunc(userService.GetUser)))
+	mux.Handle("PATCH /users/{id}", requireAdmin(http.HandlerFunc(userService.UpdateUser)))
+	mux.Handle("DELETE /users/{id}", requireAdmin(http.HandlerFunc(userService.DeleteUser)))
 	mux.HandleFunc("/login", userService.Login)
+	mux.HandleFunc("/refresh", userService.Refresh)
+	mux.HandleFunc("/logout", userService.Logout)
+	mux.HandleFunc("/.well-known/jwks.json", userService.JWKS)
+	mux.HandleFunc("GET /healthz", userService.Healthz)
+	mux.HandleFunc("GET /readyz", userService.Readyz)
 
 	// Register routes with different response times
 	mux.HandleFunc("/fast", service.FastEndpoint)          // 10ms
@@ -269,17 +1144,34 @@ func main() {
 	mux.Handle("/metrics", promhttp.Handler())
 
 	// Wrap the mux with our logging middleware
-	handler := loggingMiddleware(mux)
-
-	log.Printf("User service starting on :8083")
-	log.Printf("Available endpoints:")
-	log.Printf("  GET /fast      - 10ms response time")
-	log.Printf("  GET /medium    - 100ms response time")
-	log.Printf("  GET /slow      - 500ms response time")
-	log.Printf("  GET /very-slow - 1s response time")
-	log.Printf("  GET /metrics   - Prometheus metrics")
-
-	if err := http.ListenAndServe(":8083", handler); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	handler := loggingMiddleware(logger, mux)
+
+	logger.Info("user service starting",
+		zap.String("addr", ":8083"),
+		zap.Strings("endpoints", []string{
+			"GET /fast (10ms)",
+			"GET /medium (100ms)",
+			"GET /slow (500ms)",
+			"GET /very-slow (1s)",
+			"GET /metrics",
+		}),
+	)
+
+	// Stop gracefully on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	ln, err := net.Listen("tcp", ":8083")
+	if err != nil {
+		logger.Fatal("failed to start server", zap.Error(err))
+	}
+	srv := &http.Server{Handler: handler}
+	if err := runServer(ctx, srv, ln, shutdownTimeout, logger); err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+
+	// Redis is closed only once no handler can still be using it
+	if err := userService.redis.Close(); err != nil {
+		logger.Error("failed to close Redis client", zap.Error(err))
 	}
 }
@@ -0,0 +1,891 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestService returns a user service backed by an in-memory Redis, with
+// the default login throttle and token settings
+func newTestService(t *testing.T) (*UserService, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	// Hash passwords at the lowest cost to keep tests fast
+	cost := passwordCost
+	passwordCost = bcrypt.MinCost
+	t.Cleanup(func() { passwordCost = cost })
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return &UserService{
+		redis:  client,
+		jwtKey: []byte("test-secret"),
+		throttle: loginThrottle{
+			maxFailures: 5,
+			decay:       15 * time.Minute,
+			lockout:     15 * time.Minute,
+		},
+		tokens:   tokenSettings{ttl: defaultAccessTokenTTL},
+		logger:   zap.NewNop(),
+		auditLog: zap.NewNop(),
+	}, mr
+}
+
+// createTestUser creates an active user with the given password and role
+func createTestUser(t *testing.T, s *UserService, email, password, role string) User {
+	t.Helper()
+	users, errs := s.createUsers(context.Background(), []createRequest{{User: User{Email: email, Role: role}, Password: password}})
+	if errs[0] != nil {
+		t.Fatalf("createUsers: %v", errs[0])
+	}
+	return users[0]
+}
+
+// serve sends a request with body to handler, with token as the bearer
+// token unless it is empty, and returns the response
+func serve(t *testing.T, handler http.Handler, method, target, body, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode decodes the JSON body of a response into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body, err)
+	}
+}
+
+// login logs in with email and password and returns the issued tokens
+func login(t *testing.T, s *UserService, email, password string) map[string]string {
+	t.Helper()
+	rec := serve(t, http.HandlerFunc(s.Login), http.MethodPost, "/login", fmt.Sprintf(`{"email":%q,"password":%q}`, email, password), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login status = %d: %s", rec.Code, rec.Body)
+	}
+	var tokens map[string]string
+	decode(t, rec, &tokens)
+	return tokens
+}
+
+// refresh redeems a refresh token and returns the response
+func refresh(t *testing.T, s *UserService, refreshToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, http.HandlerFunc(s.Refresh), http.MethodPost, "/refresh", fmt.Sprintf(`{"refresh_token":%q}`, refreshToken), "")
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	var handlerID string
+	handler := loggingMiddleware(zap.New(core), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerID, _ = r.Context().Value(requestIDKey).(string)
+		http.Error(w, "Not found", http.StatusNotFound)
+	}))
+
+	// An ID set by the mesh is kept and handed to the handler
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.Header.Set(requestIDHeader, "mesh-id")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "mesh-id" {
+		t.Errorf("%s = %q, want mesh-id", requestIDHeader, got)
+	}
+	if handlerID != "mesh-id" {
+		t.Errorf("handler saw request ID %q, want mesh-id", handlerID)
+	}
+	entries := logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["request_id"] != "mesh-id" || fields["status"] != int64(http.StatusNotFound) || fields["method"] != http.MethodGet || fields["path"] != "/users/1" {
+		t.Errorf("log fields = %v", fields)
+	}
+	if _, ok := fields["duration_seconds"]; !ok {
+		t.Error("log entry has no duration")
+	}
+
+	// Otherwise a new ID is generated for every request
+	var ids []string
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+		ids = append(ids, rec.Header().Get(requestIDHeader))
+	}
+	if len(ids[0]) != 32 || ids[0] == ids[1] {
+		t.Errorf("generated request IDs %q, want distinct 32 character IDs", ids)
+	}
+	for i, entry := range logs.TakeAll() {
+		if got := entry.ContextMap()["request_id"]; got != ids[i] {
+			t.Errorf("request %d logged ID %v, want %s", i+1, got, ids[i])
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s, mr := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	tokens := login(t, s, "user@example.com", "secret")
+	if ttl := mr.TTL(refreshKey(tokens["refresh_token"])); ttl != refreshTokenTTL {
+		t.Errorf("refresh token TTL = %v, want %v", ttl, refreshTokenTTL)
+	}
+
+	rec := refresh(t, s, tokens["refresh_token"])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var refreshed map[string]string
+	decode(t, rec, &refreshed)
+	token, err := s.ValidateToken(context.Background(), refreshed["token"])
+	if err != nil {
+		t.Fatalf("refreshed access token invalid: %v", err)
+	}
+	if claims := token.Claims.(jwt.MapClaims); claims["user_id"] != user.ID || claims["role"] != "user" {
+		t.Errorf("refreshed token claims = %v", claims)
+	}
+
+	// The refresh token is rotated: the old one is spent, the new one works
+	if refreshed["refresh_token"] == "" || refreshed["refresh_token"] == tokens["refresh_token"] {
+		t.Fatalf("refresh token not rotated: %q", refreshed["refresh_token"])
+	}
+	if rec := refresh(t, s, tokens["refresh_token"]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token status = %d, want 401", rec.Code)
+	}
+	if rec := refresh(t, s, refreshed["refresh_token"]); rec.Code != http.StatusOK {
+		t.Errorf("rotated refresh token status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	tokens := login(t, s, "user@example.com", "secret")
+
+	mr.FastForward(refreshTokenTTL + time.Second)
+	if rec := refresh(t, s, tokens["refresh_token"]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired refresh token status = %d, want 401", rec.Code)
+	}
+}
+
+func TestRefreshSuspendedUser(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	tokens := login(t, s, "user@example.com", "secret")
+
+	if _, err := s.updateUser(context.Background(), user.ID, user.Version, map[string]interface{}{"status": statusSuspended}); err != nil {
+		t.Fatalf("updateUser: %v", err)
+	}
+	if rec := refresh(t, s, tokens["refresh_token"]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("suspended user's refresh status = %d, want 401", rec.Code)
+	}
+}
+
+func TestRefreshAfterDemotion(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "admin@example.com", "secret", "admin")
+	tokens := login(t, s, "admin@example.com", "secret")
+
+	if rec := serve(t, userRoutes(s), http.MethodPatch, "/users/"+user.ID, `{"role":"user","version":1}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	// The refreshed token carries the role the user has now, not the one
+	// they logged in with
+	rec := refresh(t, s, tokens["refresh_token"])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var refreshed map[string]string
+	decode(t, rec, &refreshed)
+	token, err := s.ValidateToken(context.Background(), refreshed["token"])
+	if err != nil {
+		t.Fatalf("refreshed access token invalid: %v", err)
+	}
+	if claims := token.Claims.(jwt.MapClaims); claims["user_id"] != user.ID || claims["role"] != "user" {
+		t.Errorf("refreshed token claims = %v, want the demoted role", claims)
+	}
+}
+
+// logout logs out the bearer token, revoking refreshToken too unless it is
+// empty, and returns the response
+func logout(t *testing.T, s *UserService, token, refreshToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, http.HandlerFunc(s.Logout), http.MethodPost, "/logout", fmt.Sprintf(`{"refresh_token":%q}`, refreshToken), token)
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	tokens := login(t, s, "user@example.com", "secret")
+	token, err := s.ValidateToken(context.Background(), tokens["token"])
+	if err != nil {
+		t.Fatalf("ValidateToken before logout: %v", err)
+	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	if jti == "" {
+		t.Fatal("access token has no jti")
+	}
+
+	if rec := logout(t, s, tokens["token"], tokens["refresh_token"]); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	// Neither token is accepted any more
+	if _, err := s.ValidateToken(context.Background(), tokens["token"]); err == nil {
+		t.Error("access token still valid after logout")
+	}
+	if rec := refresh(t, s, tokens["refresh_token"]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout status = %d, want 401", rec.Code)
+	}
+	if rec := logout(t, s, tokens["token"], ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second logout status = %d, want 401", rec.Code)
+	}
+
+	// The denylist entry lasts as long as the token would have
+	if ttl := mr.TTL(revokedKey(jti)); ttl <= defaultAccessTokenTTL-time.Minute || ttl > defaultAccessTokenTTL {
+		t.Errorf("denylist TTL = %v, want about %v", ttl, defaultAccessTokenTTL)
+	}
+	mr.FastForward(defaultAccessTokenTTL)
+	if mr.Exists(revokedKey(jti)) {
+		t.Error("denylist entry outlived the token")
+	}
+}
+
+func TestLogoutLeavesOtherSessions(t *testing.T) {
+	s, _ := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	first := login(t, s, "user@example.com", "secret")
+	second := login(t, s, "user@example.com", "secret")
+
+	if rec := logout(t, s, first["token"], first["refresh_token"]); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want 204", rec.Code)
+	}
+	if _, err := s.ValidateToken(context.Background(), second["token"]); err != nil {
+		t.Errorf("other session's token rejected: %v", err)
+	}
+	if rec := refresh(t, s, second["refresh_token"]); rec.Code != http.StatusOK {
+		t.Errorf("other session's refresh status = %d, want 200", rec.Code)
+	}
+}
+
+// userPage is a page of ListUsers results
+type userPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// listPage requests the page of users at query
+func listPage(t *testing.T, s *UserService, query string) userPage {
+	t.Helper()
+	rec := serve(t, http.HandlerFunc(s.ListUsers), http.MethodGet, "/users?"+query, "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ListUsers?%s status = %d: %s", query, rec.Code, rec.Body)
+	}
+	var page userPage
+	decode(t, rec, &page)
+	return page
+}
+
+// scanPager answers SCAN from the keys of a miniredis server a page of
+// COUNT keys at a time, as a real server pages a large keyspace; miniredis
+// itself returns every key in one reply
+type scanPager struct {
+	mr    *miniredis.Miniredis
+	scans int // SCAN commands answered
+}
+
+func (p *scanPager) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (p *scanPager) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (p *scanPager) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		scan, ok := cmd.(*redis.ScanCmd)
+		if !ok {
+			return next(ctx, cmd)
+		}
+		// SCAN cursor MATCH pattern COUNT count
+		args := cmd.Args()
+		cursor, _ := strconv.Atoi(fmt.Sprint(args[1]))
+		pattern := strings.TrimSuffix(fmt.Sprint(args[3]), "*")
+		count, _ := strconv.Atoi(fmt.Sprint(args[5]))
+
+		var keys []string
+		for _, key := range p.mr.Keys() {
+			if strings.HasPrefix(key, pattern) {
+				keys = append(keys, key)
+			}
+		}
+		end := min(cursor+count, len(keys))
+		next := uint64(end)
+		if end == len(keys) {
+			next = 0
+		}
+		p.scans++
+		scan.SetVal(keys[cursor:end], next)
+		return nil
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	s, mr := newTestService(t)
+	pager := &scanPager{mr: mr}
+	s.redis.AddHook(pager)
+	want := make(map[string]bool)
+	for i := 0; i < 23; i++ {
+		user := createTestUser(t, s, fmt.Sprintf("user%d@example.com", i), "secret", "user")
+		want[user.ID] = true
+	}
+	// Keys of other kinds matching the pattern are skipped
+	mr.Set("user:stray", "not a user")
+	login(t, s, "user0@example.com", "secret")
+
+	seen := make(map[string]bool)
+	query := "limit=5"
+	pages := 0
+	for {
+		page := listPage(t, s, query)
+		pages++
+		// Every page but the last holds at least the users asked for
+		if page.NextCursor != "" && len(page.Users) < 5 {
+			t.Errorf("page %d holds %d users, want at least 5", pages, len(page.Users))
+		}
+		for _, user := range page.Users {
+			if seen[user.ID] {
+				t.Errorf("user %s listed twice", user.ID)
+			}
+			seen[user.ID] = true
+			if !want[user.ID] {
+				t.Errorf("unexpected user %+v", user)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		if pages > 23 {
+			t.Fatal("paging did not terminate")
+		}
+		query = "limit=5&cursor=" + page.NextCursor
+	}
+	if len(seen) != len(want) {
+		t.Errorf("listed %d users, want %d", len(seen), len(want))
+	}
+	if pages < 2 {
+		t.Errorf("listed every user in %d page, want several", pages)
+	}
+	// The stray key makes a SCAN reply short of users, so a page spans
+	// several SCANs
+	if pager.scans <= pages {
+		t.Errorf("answered in %d SCANs for %d pages, want pages to span several", pager.scans, pages)
+	}
+}
+
+func TestListUsersEmpty(t *testing.T) {
+	s, _ := newTestService(t)
+	page := listPage(t, s, "")
+	if page.Users == nil || len(page.Users) != 0 || page.NextCursor != "" {
+		t.Errorf("page = %+v, want an empty list and no cursor", page)
+	}
+}
+
+func TestListUsersByEmail(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+
+	rec := serve(t, http.HandlerFunc(s.ListUsers), http.MethodGet, "/users?email=user@example.com", "", "")
+	var got User
+	decode(t, rec, &got)
+	if got.ID != user.ID {
+		t.Errorf("user = %+v, want %s", got, user.ID)
+	}
+	for query, want := range map[string]int{
+		"email=missing@example.com": http.StatusNotFound,
+		"email=not-an-email":        http.StatusBadRequest,
+		"limit=0":                   http.StatusBadRequest,
+		"cursor=next":               http.StatusBadRequest,
+	} {
+		if rec := serve(t, http.HandlerFunc(s.ListUsers), http.MethodGet, "/users?"+query, "", ""); rec.Code != want {
+			t.Errorf("ListUsers?%s status = %d, want %d", query, rec.Code, want)
+		}
+	}
+}
+
+func TestConcurrentCreateSameEmail(t *testing.T) {
+	s, mr := newTestService(t)
+	body := `{"email":"user@example.com","password":"secret","role":"user"}`
+
+	const creates = 10
+	codes := make(chan int, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(t, http.HandlerFunc(s.CreateUser), http.MethodPost, "/users", body, "").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != creates-1 {
+		t.Errorf("status counts = %v, want one 201 and %d 409", counts, creates-1)
+	}
+	// Only the winner is stored and indexed
+	var indexed int
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "user_id:") {
+			indexed++
+		}
+	}
+	if indexed != 1 {
+		t.Errorf("%d users indexed by ID, want 1", indexed)
+	}
+}
+
+func TestCreateUserRedisError(t *testing.T) {
+	s, mr := newTestService(t)
+	mr.SetError("READONLY You can't write against a read only replica")
+
+	// A failure to reserve the email is not reported as the email being taken
+	rec := serve(t, http.HandlerFunc(s.CreateUser), http.MethodPost, "/users", `{"email":"user@example.com","password":"secret"}`, "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	mr.SetError("")
+	if _, err := s.getUserByEmail(context.Background(), "user@example.com"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("getUserByEmail after a failed create = %v, want errUserNotFound", err)
+	}
+}
+
+func TestCreateUserHashesPassword(t *testing.T) {
+	s, mr := newTestService(t)
+	rec := serve(t, http.HandlerFunc(s.CreateUser), http.MethodPost, "/users",
+		`{"id":"chosen-by-client","email":"user@example.com","password":"secret","role":"user"}`, "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "secret") || strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("response %s includes the password", rec.Body)
+	}
+	var user User
+	decode(t, rec, &user)
+
+	// The ID is assigned by the server
+	if user.ID == "" || user.ID == "chosen-by-client" {
+		t.Errorf("ID = %q, want a server-generated ID", user.ID)
+	}
+	if got, _ := mr.Get(userIDKey(user.ID)); got != "user@example.com" {
+		t.Errorf("ID index = %q, want user@example.com", got)
+	}
+
+	// Only a bcrypt hash of the password is stored
+	stored := mr.HGet("user:user@example.com", "password")
+	if stored == "secret" {
+		t.Fatal("password stored in plaintext")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte("secret")); err != nil {
+		t.Errorf("stored password is not a bcrypt hash of the password: %v", err)
+	}
+}
+
+func TestCreateUserInvalid(t *testing.T) {
+	s, _ := newTestService(t)
+	createTestUser(t, s, "taken@example.com", "secret", "user")
+	for body, want := range map[string]int{
+		`{"password":"secret"}`:        http.StatusBadRequest,
+		`{"email":"user@example.com"}`: http.StatusBadRequest,
+		`{"email":`:                    http.StatusBadRequest,
+		`{"email":"taken@example.com","password":"other"}`: http.StatusConflict,
+	} {
+		if rec := serve(t, http.HandlerFunc(s.CreateUser), http.MethodPost, "/users", body, ""); rec.Code != want {
+			t.Errorf("CreateUser(%s) status = %d, want %d", body, rec.Code, want)
+		}
+	}
+}
+
+// userRoutes routes the user lookup handlers of s as main does, without
+// authorization
+func userRoutes(s *UserService) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", s.ListUsers)
+	mux.HandleFunc("GET /users/{id}", s.GetUser)
+	mux.HandleFunc("PATCH /users/{id}", s.UpdateUser)
+	mux.HandleFunc("DELETE /users/{id}", s.DeleteUser)
+	return mux
+}
+
+func TestGetUser(t *testing.T) {
+	s, mr := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	routes := userRoutes(s)
+
+	for _, target := range []string{"/users/" + user.ID, "/users?email=user@example.com"} {
+		rec := serve(t, routes, http.MethodGet, target, "", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want 200", target, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "password") {
+			t.Errorf("GET %s response %s includes the password", target, rec.Body)
+		}
+		var got User
+		decode(t, rec, &got)
+		if want := (User{ID: user.ID, Email: user.Email, Role: "user", Status: statusActive, Version: 1}); got != want {
+			t.Errorf("GET %s = %+v, want %+v", target, got, want)
+		}
+	}
+
+	for target, want := range map[string]int{
+		"/users/unknown":                  http.StatusNotFound,
+		"/users?email=nobody@example.com": http.StatusNotFound,
+		"/users?email=":                   http.StatusBadRequest,
+		"/users?email=user.example.com":   http.StatusBadRequest,
+	} {
+		if rec := serve(t, routes, http.MethodGet, target, "", ""); rec.Code != want {
+			t.Errorf("GET %s status = %d, want %d", target, rec.Code, want)
+		}
+	}
+
+	// Failing to reach Redis is not reported as a missing user
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	if rec := serve(t, routes, http.MethodGet, "/users/"+user.ID, "", ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("GET with Redis failing status = %d, want 500", rec.Code)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	routes := userRoutes(s)
+
+	if rec := serve(t, routes, http.MethodDelete, "/users/"+user.ID, "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d, want 204", rec.Code)
+	}
+
+	// The user can no longer log in
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("login after delete status = %d, want 401", rec.Code)
+	}
+
+	// The record is kept for audit, retrievable by ID
+	rec := serve(t, routes, http.MethodGet, "/users/"+user.ID, "", "")
+	var got User
+	decode(t, rec, &got)
+	if got.ID != user.ID || got.Email != user.Email || got.Status != statusDeleted || got.Version != 2 {
+		t.Errorf("deleted user = %+v, want %s marked deleted at version 2", got, user.ID)
+	}
+	if rec := serve(t, routes, http.MethodDelete, "/users/"+user.ID, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %d, want 404", rec.Code)
+	}
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"role":"admin","version":2}`, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("PATCH of a deleted user status = %d, want 404", rec.Code)
+	}
+
+	// The email is free for a new account, and the old record survives it
+	replacement := createTestUser(t, s, "user@example.com", "other", "user")
+	login(t, s, "user@example.com", "other")
+	if got, err := s.getUserByID(context.Background(), user.ID); err != nil || got.Status != statusDeleted {
+		t.Errorf("deleted user after re-registration = %+v, %v", got, err)
+	}
+	if got, err := s.getUserByID(context.Background(), replacement.ID); err != nil || got.Status != statusActive {
+		t.Errorf("new user = %+v, %v", got, err)
+	}
+}
+
+func TestSuspendedUserCannotLogIn(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	routes := userRoutes(s)
+
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"status":"suspended","version":1}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if rec := attemptLogin(t, s, "user@example.com", "secret"); rec.Code != http.StatusForbidden {
+		t.Errorf("login while suspended status = %d, want 403", rec.Code)
+	}
+	// Deletion goes through DELETE only
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"status":"deleted","version":2}`, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("PATCH to deleted status = %d, want 400", rec.Code)
+	}
+
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"status":"active","version":2}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("PATCH status = %d, want 200", rec.Code)
+	}
+	login(t, s, "user@example.com", "secret")
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	routes := userRoutes(s)
+
+	// Two updates based on the same version: the second is refused
+	rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"role":"admin","version":1}`, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first PATCH status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var updated User
+	decode(t, rec, &updated)
+	if updated.Role != "admin" || updated.Version != 2 {
+		t.Errorf("updated user = %+v, want admin at version 2", updated)
+	}
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"role":"viewer","version":1}`, ""); rec.Code != http.StatusConflict {
+		t.Errorf("second PATCH status = %d, want 409", rec.Code)
+	}
+	if got, _ := s.getUserByID(context.Background(), user.ID); got.Role != "admin" {
+		t.Errorf("role = %q after the refused update, want admin", got.Role)
+	}
+
+	// A request without a version is refused outright
+	if rec := serve(t, routes, http.MethodPatch, "/users/"+user.ID, `{"role":"viewer"}`, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("PATCH without a version status = %d, want 400", rec.Code)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	s, _ := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+
+	// Of concurrent updates from one version exactly one is applied
+	const updates = 10
+	errs := make(chan error, updates)
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.updateUser(context.Background(), user.ID, 1, map[string]interface{}{"role": fmt.Sprintf("role-%d", i)})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var applied int
+	for err := range errs {
+		switch {
+		case err == nil:
+			applied++
+		case !errors.Is(err, errConcurrentModification):
+			t.Errorf("updateUser: %v", err)
+		}
+	}
+	if applied != 1 {
+		t.Errorf("%d updates applied, want 1", applied)
+	}
+	if got, _ := s.getUserByID(context.Background(), user.ID); got.Version != 2 {
+		t.Errorf("version = %d, want 2", got.Version)
+	}
+}
+
+func TestConcurrentEmailMove(t *testing.T) {
+	s, _ := newTestService(t)
+	const movers = 10
+	users := make([]User, movers)
+	for i := range users {
+		users[i] = createTestUser(t, s, fmt.Sprintf("user-%d@example.com", i), "secret", "user")
+	}
+
+	// Of users moving to one email concurrently exactly one gets it
+	errs := make([]error, movers)
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = s.updateUser(context.Background(), user.ID, 1, map[string]interface{}{"email": "shared@example.com"})
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner < 0:
+			winner = i
+		case err == nil:
+			t.Errorf("users %d and %d both moved to the shared email", winner, i)
+		case !errors.Is(err, errEmailTaken):
+			t.Errorf("updateUser: %v", err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no user moved to the shared email")
+	}
+	if got, err := s.getUserByEmail(context.Background(), "shared@example.com"); err != nil || got.ID != users[winner].ID {
+		t.Errorf("shared email belongs to %+v (%v), want user %s", got, err, users[winner].ID)
+	}
+
+	// The others keep their email; the winner's old one is freed
+	for i, user := range users {
+		got, err := s.getUserByEmail(context.Background(), user.Email)
+		if i == winner {
+			if !errors.Is(err, errUserNotFound) {
+				t.Errorf("old email of the moved user still resolves to %+v (%v)", got, err)
+			}
+			continue
+		}
+		if err != nil || got.ID != user.ID || got.Version != 1 {
+			t.Errorf("%s resolves to %+v (%v), want user %s unchanged", user.Email, got, err, user.ID)
+		}
+	}
+	createTestUser(t, s, users[winner].Email, "secret", "user")
+
+	// Moving onto a taken email is refused as a conflict
+	rec := serve(t, userRoutes(s), http.MethodPatch, "/users/"+users[(winner+1)%movers].ID, `{"email":"shared@example.com","version":1}`, "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("PATCH to a taken email status = %d, want 409", rec.Code)
+	}
+}
+
+// startServer runs handler with runServer on a local port until the returned
+// function is called, which waits for runServer to return
+func startServer(t *testing.T, handler http.Handler, shutdownTimeout time.Duration) (string, func() error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer(ctx, &http.Server{Handler: handler}, ln, shutdownTimeout, zap.NewNop())
+	}()
+	return "http://" + ln.Addr().String(), func() error {
+		cancel()
+		return <-done
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	addr, shutdown := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}), 5*time.Second)
+
+	// A slow request is in flight when shutdown begins
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+	<-started
+	stopped := make(chan error, 1)
+	go func() { stopped <- shutdown() }()
+
+	// New connections are refused while the request drains
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "http://"))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections during shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	default:
+	}
+
+	// The in-flight request completes, then shutdown does
+	close(release)
+	if got := <-inFlight; got.err != nil || got.body != "done" {
+		t.Errorf("in-flight request = %q, %v; want it completed", got.body, got.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("runServer: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	addr, shutdown := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}), 100*time.Millisecond)
+
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(addr + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+
+	// A request outlasting the drain timeout has its connection closed
+	start := time.Now()
+	if err := shutdown(); err != nil {
+		t.Errorf("runServer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v, want about the 100ms timeout", elapsed)
+	}
+	if err := <-failed; err == nil {
+		t.Error("stuck request completed, want its connection closed")
+	}
+}
+
+func TestShutdownTimeoutFromEnv(t *testing.T) {
+	t.Setenv("SHUTDOWN_TIMEOUT", "")
+	if timeout, err := shutdownTimeoutFromEnv(); err != nil || timeout != defaultShutdownTimeout {
+		t.Errorf("default timeout = %v, %v; want %v", timeout, err, defaultShutdownTimeout)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	if timeout, err := shutdownTimeoutFromEnv(); err != nil || timeout != 30*time.Second {
+		t.Errorf("timeout = %v, %v; want 30s", timeout, err)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "0s")
+	if _, err := shutdownTimeoutFromEnv(); err == nil {
+		t.Error("shutdownTimeoutFromEnv accepted 0s")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordCost is the bcrypt cost new password hashes are created with.
+// Hashes of a lower cost are upgraded when their user next logs in.
+var passwordCost = bcrypt.DefaultCost
+
+// setPasswordCostFromEnv sets passwordCost from BCRYPT_COST, if set
+func setPasswordCostFromEnv() error {
+	value := os.Getenv("BCRYPT_COST")
+	if value == "" {
+		return nil
+	}
+	cost, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid BCRYPT_COST %q: %v", value, err)
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return fmt.Errorf("BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+	passwordCost = cost
+	return nil
+}
+
+// hashPassword hashes a password at passwordCost
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches the stored value and
+// whether the stored value should be replaced by a new hash: a bcrypt hash
+// below passwordCost, or a plaintext password stored before passwords were
+// hashed
+func checkPassword(stored, password string) (ok, rehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		ok = stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	return true, cost < passwordCost
+}
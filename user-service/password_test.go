@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// storedCost returns the bcrypt cost of the password stored for email
+func storedCost(t *testing.T, s *UserService, email string) int {
+	t.Helper()
+	hash, err := s.redis.HGet(context.Background(), "user:"+email, "password").Result()
+	if err != nil {
+		t.Fatalf("reading password: %v", err)
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		t.Fatalf("stored password %q is not a bcrypt hash: %v", hash, err)
+	}
+	return cost
+}
+
+func TestLoginRehashesLowCost(t *testing.T) {
+	s, _ := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	if cost := storedCost(t, s, "user@example.com"); cost != bcrypt.MinCost {
+		t.Fatalf("created with cost %d, want %d", cost, bcrypt.MinCost)
+	}
+
+	// Raising the cost upgrades the hash on the next login, and the new hash
+	// still validates
+	passwordCost = bcrypt.MinCost + 1
+	login(t, s, "user@example.com", "secret")
+	if cost := storedCost(t, s, "user@example.com"); cost != bcrypt.MinCost+1 {
+		t.Errorf("cost after login = %d, want %d", cost, bcrypt.MinCost+1)
+	}
+	login(t, s, "user@example.com", "secret")
+}
+
+func TestLoginRehashesPlaintext(t *testing.T) {
+	s, mr := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	// A password stored before passwords were hashed
+	mr.HSet("user:user@example.com", "password", "legacy")
+
+	login(t, s, "user@example.com", "legacy")
+	if cost := storedCost(t, s, "user@example.com"); cost != passwordCost {
+		t.Errorf("cost after login = %d, want %d", cost, passwordCost)
+	}
+	login(t, s, "user@example.com", "legacy")
+}
+
+func TestCheckPassword(t *testing.T) {
+	cost := passwordCost
+	passwordCost = bcrypt.MinCost + 1
+	t.Cleanup(func() { passwordCost = cost })
+	current, err := bcrypt.GenerateFromPassword([]byte("secret"), passwordCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, stored, password string
+		ok, rehash             bool
+	}{
+		{name: "current hash", stored: string(current), password: "secret", ok: true},
+		{name: "low cost hash", stored: string(hash), password: "secret", ok: true, rehash: true},
+		{name: "wrong password", stored: string(hash), password: "wrong"},
+		{name: "plaintext", stored: "secret", password: "secret", ok: true, rehash: true},
+		{name: "wrong plaintext", stored: "secret", password: "wrong"},
+		{name: "no password", stored: "", password: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok, rehash := checkPassword(tt.stored, tt.password); ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("checkPassword = %v, %v; want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestSetPasswordCostFromEnv(t *testing.T) {
+	cost := passwordCost
+	t.Cleanup(func() { passwordCost = cost })
+
+	t.Setenv("BCRYPT_COST", "12")
+	if err := setPasswordCostFromEnv(); err != nil || passwordCost != 12 {
+		t.Errorf("BCRYPT_COST=12 set cost %d, %v", passwordCost, err)
+	}
+	for _, value := range []string{"high", "3", "32"} {
+		t.Setenv("BCRYPT_COST", value)
+		if err := setPasswordCostFromEnv(); err == nil {
+			t.Errorf("setPasswordCostFromEnv accepted BCRYPT_COST=%s", value)
+		}
+	}
+}
+
+func TestHashPasswordKeepsCause(t *testing.T) {
+	_, err := hashPassword(strings.Repeat("x", 73))
+	if !errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		t.Errorf("error = %v, want it to wrap bcrypt.ErrPasswordTooLong", err)
+	}
+}
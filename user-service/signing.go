@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenSettings configures the access tokens the service issues and accepts
+type tokenSettings struct {
+	ttl      time.Duration // Lifetime of an access token
+	issuer   string        // iss claim set on tokens and required of them, if not empty
+	audience string        // aud claim set on tokens and required of them, if not empty
+}
+
+// tokenSettingsFromEnv reads JWT_ACCESS_TOKEN_TTL (default 15m), and the
+// optional JWT_ISSUER and JWT_AUDIENCE. The issuer and audience should match
+// those the rate limit service is configured to require.
+func tokenSettingsFromEnv() (tokenSettings, error) {
+	settings := tokenSettings{
+		ttl:      defaultAccessTokenTTL,
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+	}
+	if value := os.Getenv("JWT_ACCESS_TOKEN_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return tokenSettings{}, fmt.Errorf("invalid JWT_ACCESS_TOKEN_TTL %q", value)
+		}
+		settings.ttl = ttl
+	}
+	return settings, nil
+}
+
+// parserOptions returns the options requiring the configured issuer and
+// audience of a token
+func (t tokenSettings) parserOptions() []jwt.ParserOption {
+	var opts []jwt.ParserOption
+	if t.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(t.issuer))
+	}
+	if t.audience != "" {
+		opts = append(opts, jwt.WithAudience(t.audience))
+	}
+	return opts
+}
+
+// loadSigningKey reads the RSA private key at JWT_PRIVATE_KEY_FILE, in PKCS#1
+// or PKCS#8 PEM form, and derives its key ID. It returns a nil key when the
+// variable is unset, leaving tokens signed with HS256.
+func loadSigningKey() (*rsa.PrivateKey, string, error) {
+	path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+	if path == "" {
+		return nil, "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read JWT private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("no PEM block in JWT private key %s", path)
+	}
+
+	var key *rsa.PrivateKey
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse JWT private key: %w", err)
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, "", fmt.Errorf("JWT private key is not an RSA key")
+		}
+	}
+
+	// The key ID is a digest of the public key, so it changes with the key
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	return key, base64.RawURLEncoding.EncodeToString(sum[:8]), nil
+}
+
+// signToken signs claims with the RSA key when one is configured, or with
+// the HS256 secret otherwise
+func (s *UserService) signToken(claims jwt.MapClaims) (string, error) {
+	if s.signingKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwtKey)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	return token.SignedString(s.signingKey)
+}
+
+// verificationKey returns the key verifying a token, accepting only the
+// algorithm this service signs with
+func (s *UserService) verificationKey(token *jwt.Token) (interface{}, error) {
+	if s.signingKey == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.jwtKey, nil
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return &s.signingKey.PublicKey, nil
+}
+
+// JWKS publishes the RSA public key as a JSON Web Key Set, so other services
+// can verify tokens without a shared secret. The set is empty when tokens
+// are signed with HS256.
+func (s *UserService) JWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys := []map[string]string{}
+	if s.signingKey != nil {
+		pub := s.signingKey.PublicKey
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": s.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
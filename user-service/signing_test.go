@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeRSAKey generates an RSA key and writes it as a PEM file of the given
+// block type, PKCS#1 for "RSA PRIVATE KEY" and PKCS#8 otherwise
+func writeRSAKey(t *testing.T, blockType string) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der := x509.MarshalPKCS1PrivateKey(key)
+	if blockType != "RSA PRIVATE KEY" {
+		if der, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+// newRSATestService returns a test service signing tokens with the RSA key
+// at JWT_PRIVATE_KEY_FILE
+func newRSATestService(t *testing.T, path string) *UserService {
+	t.Helper()
+	t.Setenv("JWT_PRIVATE_KEY_FILE", path)
+	key, keyID, err := loadSigningKey()
+	if err != nil {
+		t.Fatalf("loadSigningKey: %v", err)
+	}
+	s, _ := newTestService(t)
+	s.signingKey, s.keyID = key, keyID
+	return s
+}
+
+// publishedKeys fetches the JWKS of s and returns its RSA keys by key ID
+func publishedKeys(t *testing.T, s *UserService) map[string]*rsa.PublicKey {
+	t.Helper()
+	rec := serve(t, http.HandlerFunc(s.JWKS), http.MethodGet, "/.well-known/jwks.json", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("JWKS status = %d", rec.Code)
+	}
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	decode(t, rec, &set)
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k["kty"] != "RSA" || k["alg"] != "RS256" || k["use"] != "sig" {
+			t.Errorf("unexpected key %v", k)
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k["n"])
+		if err != nil {
+			t.Fatalf("modulus: %v", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k["e"])
+		if err != nil {
+			t.Fatalf("exponent: %v", err)
+		}
+		keys[k["kid"]] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys
+}
+
+func TestRS256VerifiedWithJWKS(t *testing.T) {
+	for _, blockType := range []string{"RSA PRIVATE KEY", "PRIVATE KEY"} {
+		t.Run(blockType, func(t *testing.T) {
+			key, path := writeRSAKey(t, blockType)
+			s := newRSATestService(t, path)
+			createTestUser(t, s, "user@example.com", "secret", "user")
+			tokens := login(t, s, "user@example.com", "secret")
+
+			// A verifier holding only the published keys accepts the token
+			keys := publishedKeys(t, s)
+			if len(keys) != 1 || keys[s.keyID] == nil || keys[s.keyID].N.Cmp(key.N) != 0 {
+				t.Fatalf("published keys = %v, want the signing key under %q", keys, s.keyID)
+			}
+			token, err := jwt.Parse(tokens["token"], func(token *jwt.Token) (interface{}, error) {
+				kid, _ := token.Header["kid"].(string)
+				return keys[kid], nil
+			}, jwt.WithValidMethods([]string{"RS256"}))
+			if err != nil {
+				t.Fatalf("token not verified by the JWKS: %v", err)
+			}
+			if claims := token.Claims.(jwt.MapClaims); claims["role"] != "user" {
+				t.Errorf("claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestRS256RejectsHS256Tokens(t *testing.T) {
+	_, path := writeRSAKey(t, "RSA PRIVATE KEY")
+	s := newRSATestService(t, path)
+
+	// A token signed with the HS256 fallback secret is not accepted once
+	// tokens are signed with RSA
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": "1",
+		"role":    "admin",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString(s.jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ValidateToken(context.Background(), forged); err == nil {
+		t.Error("HS256 token accepted by an RS256 service")
+	}
+}
+
+func TestHS256Fallback(t *testing.T) {
+	t.Setenv("JWT_PRIVATE_KEY_FILE", "")
+	key, _, err := loadSigningKey()
+	if err != nil || key != nil {
+		t.Fatalf("loadSigningKey = %v, %v; want no key", key, err)
+	}
+
+	s, _ := newTestService(t)
+	createTestUser(t, s, "user@example.com", "secret", "user")
+	tokens := login(t, s, "user@example.com", "secret")
+	token, err := s.ValidateToken(context.Background(), tokens["token"])
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if token.Method != jwt.SigningMethodHS256 {
+		t.Errorf("signed with %v, want HS256", token.Method.Alg())
+	}
+	if keys := publishedKeys(t, s); len(keys) != 0 {
+		t.Errorf("JWKS publishes %d keys, want none", len(keys))
+	}
+}
+
+func TestLoadSigningKeyInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{path, filepath.Join(t.TempDir(), "missing.pem")} {
+		t.Setenv("JWT_PRIVATE_KEY_FILE", path)
+		if _, _, err := loadSigningKey(); err == nil {
+			t.Errorf("loadSigningKey accepted %s", path)
+		}
+	}
+
+	// The cause of a failed read is kept
+	t.Setenv("JWT_PRIVATE_KEY_FILE", filepath.Join(t.TempDir(), "missing.pem"))
+	if _, _, err := loadSigningKey(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("error = %v, want it to wrap fs.ErrNotExist", err)
+	}
+}
+
+func TestIssuerAudience(t *testing.T) {
+	s, _ := newTestService(t)
+	s.tokens = tokenSettings{ttl: 30 * time.Minute, issuer: "issuer.example.com", audience: "rate-limit-service"}
+	createTestUser(t, s, "user@example.com", "secret", "user")
+
+	// Issued tokens carry the configured claims and lifetime
+	token, err := s.ValidateToken(context.Background(), login(t, s, "user@example.com", "secret")["token"])
+	if err != nil {
+		t.Fatalf("token with the configured iss and aud rejected: %v", err)
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if iss, _ := claims.GetIssuer(); iss != "issuer.example.com" {
+		t.Errorf("iss = %q, want issuer.example.com", iss)
+	}
+	if aud, _ := claims.GetAudience(); len(aud) != 1 || aud[0] != "rate-limit-service" {
+		t.Errorf("aud = %v, want rate-limit-service", aud)
+	}
+	if exp, _ := claims.GetExpirationTime(); exp == nil || time.Until(exp.Time) <= 29*time.Minute || time.Until(exp.Time) > 30*time.Minute {
+		t.Errorf("exp = %v, want 30m from now", exp)
+	}
+
+	// Tokens for another issuer or audience, or without them, are rejected
+	for name, claims := range map[string]jwt.MapClaims{
+		"wrong audience": {"iss": "issuer.example.com", "aud": "other-service"},
+		"wrong issuer":   {"iss": "other.example.com", "aud": "rate-limit-service"},
+		"neither":        {},
+	} {
+		claims["user_id"] = "1"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		signed, err := s.signToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ValidateToken(context.Background(), signed); err == nil {
+			t.Errorf("token with %s accepted", name)
+		}
+	}
+}
+
+func TestTokenSettingsFromEnv(t *testing.T) {
+	t.Setenv("JWT_ACCESS_TOKEN_TTL", "")
+	t.Setenv("JWT_ISSUER", "")
+	t.Setenv("JWT_AUDIENCE", "")
+	if settings, err := tokenSettingsFromEnv(); err != nil || settings != (tokenSettings{ttl: defaultAccessTokenTTL}) {
+		t.Errorf("defaults = %+v, %v", settings, err)
+	}
+
+	t.Setenv("JWT_ACCESS_TOKEN_TTL", "1h")
+	t.Setenv("JWT_ISSUER", "issuer.example.com")
+	t.Setenv("JWT_AUDIENCE", "rate-limit-service")
+	want := tokenSettings{ttl: time.Hour, issuer: "issuer.example.com", audience: "rate-limit-service"}
+	if settings, err := tokenSettingsFromEnv(); err != nil || settings != want {
+		t.Errorf("settings = %+v, %v; want %+v", settings, err, want)
+	}
+
+	for _, value := range []string{"forever", "0", "-5m"} {
+		t.Setenv("JWT_ACCESS_TOKEN_TTL", value)
+		if _, err := tokenSettingsFromEnv(); err == nil {
+			t.Errorf("tokenSettingsFromEnv accepted JWT_ACCESS_TOKEN_TTL=%s", value)
+		}
+	}
+}
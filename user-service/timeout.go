@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisTimeout bounds each Redis command or pipeline when
+// REDIS_OP_TIMEOUT is unset
+const defaultRedisTimeout = 2 * time.Second
+
+// errRedisTimeout is returned by a Redis command that did not complete within
+// the operation timeout, as opposed to one Redis failed. It wraps the error
+// the command was abandoned with.
+var errRedisTimeout = errors.New("redis operation timed out")
+
+// redisTimeoutFromEnv reads REDIS_OP_TIMEOUT, the limit on each Redis
+// command or pipeline
+func redisTimeoutFromEnv() (time.Duration, error) {
+	value := os.Getenv("REDIS_OP_TIMEOUT")
+	if value == "" {
+		return defaultRedisTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid REDIS_OP_TIMEOUT %q", value)
+	}
+	return timeout, nil
+}
+
+// redisTimeoutHook gives every Redis command and pipeline its own deadline,
+// so a slow or unreachable Redis cannot hang a request, and reports a missed
+// deadline as errRedisTimeout
+type redisTimeoutHook struct {
+	timeout time.Duration // Limit on each command or pipeline
+}
+
+func (h redisTimeoutHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h redisTimeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		opCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+
+		err := next(opCtx, cmd)
+		if h.timedOut(ctx, opCtx, err) {
+			err = fmt.Errorf("%w after %v: %s: %w", errRedisTimeout, h.timeout, cmd.Name(), err)
+			cmd.SetErr(err)
+		}
+		return err
+	}
+}
+
+func (h redisTimeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		opCtx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+
+		err := next(opCtx, cmds)
+		if h.timedOut(ctx, opCtx, err) {
+			// Commands that were never answered are left without an error,
+			// so every command is marked
+			err = fmt.Errorf("%w after %v: pipeline: %w", errRedisTimeout, h.timeout, err)
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+		}
+		return err
+	}
+}
+
+// timedOut reports whether err is due to the operation deadline rather
+// than a Redis error or the caller's own context ending. Depending on where
+// the command was blocked, a missed deadline surfaces as the context's
+// error or as a network timeout.
+func (h redisTimeoutHook) timedOut(ctx, opCtx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || opCtx.Err() != context.DeadlineExceeded {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// blackHole returns the address of a server that accepts connections but
+// never replies
+func blackHole(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// newBlackHoleService returns a test service whose Redis never replies,
+// with Redis operations bounded by timeout
+func newBlackHoleService(t *testing.T, timeout time.Duration) *UserService {
+	t.Helper()
+	s, _ := newTestService(t)
+	s.redis = redis.NewClient(&redis.Options{
+		Addr:                  blackHole(t),
+		ContextTimeoutEnabled: true,
+		MaxRetries:            -1,
+	})
+	s.redis.AddHook(redisTimeoutHook{timeout: timeout})
+	t.Cleanup(func() { s.redis.Close() })
+	return s
+}
+
+func TestRedisTimeoutKeepsCause(t *testing.T) {
+	s := newBlackHoleService(t, 50*time.Millisecond)
+
+	_, err := s.getUserByEmail(context.Background(), "user@example.com")
+	if !errors.Is(err, errRedisTimeout) {
+		t.Fatalf("error = %v, want errRedisTimeout", err)
+	}
+	// The reason the command was abandoned is still there
+	var netErr net.Error
+	if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Errorf("error = %v, want it to wrap the deadline it missed", err)
+	}
+}
+
+func TestRedisErrorKeepsCause(t *testing.T) {
+	s, mr := newTestService(t)
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+
+	_, err := s.getUserByEmail(context.Background(), "user@example.com")
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("error = %v, want it to wrap the Redis error", err)
+	}
+	if got := redisErr.Error(); got != "LOADING Redis is loading the dataset in memory" {
+		t.Errorf("wrapped error = %q", got)
+	}
+	if errors.Is(err, errUserNotFound) || !errors.Is(err, ErrDatabaseError) {
+		t.Errorf("error = %v, want a database error rather than a missing user", err)
+	}
+}
+
+func TestDatabaseErrorKeepsCause(t *testing.T) {
+	s, mr := newTestService(t)
+	user := createTestUser(t, s, "user@example.com", "secret", "user")
+	ctx := context.Background()
+
+	operations := map[string]func() error{
+		"read": func() error {
+			_, err := s.getUserByID(ctx, user.ID)
+			return err
+		},
+		"create": func() error {
+			_, errs := s.createUsers(ctx, []createRequest{{User: User{Email: "other@example.com"}, Password: "secret"}})
+			return errs[0]
+		},
+		"update": func() error {
+			_, err := s.updateUser(ctx, user.ID, user.Version, map[string]interface{}{"role": "admin"})
+			return err
+		},
+		"list": func() error {
+			_, _, err := s.listUsers(ctx, 0, 10)
+			return err
+		},
+		"lockout": func() error {
+			return s.recordLoginFailure(ctx, user.Email, time.Now())
+		},
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			core, logs := observer.New(zap.ErrorLevel)
+			s.logger = zap.New(core)
+			mr.SetError("LOADING Redis is loading the dataset in memory")
+			defer mr.SetError("")
+
+			// The sentinel identifies a storage failure, and the Redis error
+			// that caused it is still there
+			err := operation()
+			if !errors.Is(err, ErrDatabaseError) {
+				t.Fatalf("error = %v, want ErrDatabaseError", err)
+			}
+			var redisErr redis.Error
+			if !errors.As(err, &redisErr) || redisErr.Error() != "LOADING Redis is loading the dataset in memory" {
+				t.Errorf("error = %v, want it to wrap the Redis error", err)
+			}
+
+			// The cause is logged where the operation failed
+			entries := logs.All()
+			if len(entries) == 0 {
+				t.Fatal("failure not logged")
+			}
+			if got := entries[0].ContextMap()["error"]; got != redisErr.Error() {
+				t.Errorf("logged error = %v, want the Redis error", got)
+			}
+		})
+	}
+}
+
+func TestRedisTimeoutBoundsOperations(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := newBlackHoleService(t, timeout)
+	ctx := context.Background()
+
+	operations := map[string]func() error{
+		"command": func() error {
+			_, err := s.getUserByID(ctx, "1")
+			return err
+		},
+		"pipeline": func() error {
+			_, errs := s.createUsers(ctx, []createRequest{{User: User{Email: "user@example.com"}, Password: "secret"}})
+			return errs[0]
+		},
+		"transaction": func() error {
+			_, err := s.updateUser(ctx, "1", 1, map[string]interface{}{"role": "admin"})
+			return err
+		},
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			err := operation()
+			if elapsed := time.Since(start); elapsed > timeout+time.Second {
+				t.Errorf("returned after %v, want about %v", elapsed, timeout)
+			}
+			if !errors.Is(err, errRedisTimeout) {
+				t.Errorf("error = %v, want errRedisTimeout", err)
+			}
+		})
+	}
+}
+
+func TestRedisTimeoutHandler(t *testing.T) {
+	s := newBlackHoleService(t, 100*time.Millisecond)
+
+	// The request fails with a server error instead of hanging
+	start := time.Now()
+	rec := serve(t, http.HandlerFunc(s.GetUser), http.MethodGet, "/users/1", "", "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, want it bounded by the Redis timeout", elapsed)
+	}
+}
+
+func TestRedisTimeoutFromEnv(t *testing.T) {
+	t.Setenv("REDIS_OP_TIMEOUT", "")
+	if timeout, err := redisTimeoutFromEnv(); err != nil || timeout != defaultRedisTimeout {
+		t.Errorf("default timeout = %v, %v; want %v", timeout, err, defaultRedisTimeout)
+	}
+	t.Setenv("REDIS_OP_TIMEOUT", "250ms")
+	if timeout, err := redisTimeoutFromEnv(); err != nil || timeout != 250*time.Millisecond {
+		t.Errorf("timeout = %v, %v; want 250ms", timeout, err)
+	}
+	for _, value := range []string{"soon", "0s", "-1s"} {
+		t.Setenv("REDIS_OP_TIMEOUT", value)
+		if _, err := redisTimeoutFromEnv(); err == nil {
+			t.Errorf("redisTimeoutFromEnv accepted %q", value)
+		}
+	}
+}